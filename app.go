@@ -2,16 +2,30 @@ package httpcap
 
 import (
 	"context"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/fatih/color"
 	"github.com/jroimartin/gocui"
+	"github.com/uole/httpcap/grpc"
+	"github.com/uole/httpcap/har"
 	"github.com/uole/httpcap/http"
+	"github.com/uole/httpcap/internal/decoder"
+	"github.com/uole/httpcap/redis"
+	"github.com/uole/httpcap/sql"
+	"github.com/uole/httpcap/store"
+	"github.com/uole/httpcap/tls"
+	"github.com/uole/httpcap/websocket"
 	"github.com/uole/httpcap/widget"
 	"github.com/valyala/bytebufferpool"
+	"math"
+	"os"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,65 +33,657 @@ type (
 	packet struct {
 		request  *http.Request
 		response *http.Response
+		mutex    sync.Mutex
+		messages []*socketMessage
+		//bytes of the response body on the wire, the kept body may be truncated or dropped once the exchange is stored
+		size int
+		//offset of the exchange in the store, 0 when it is not stored
+		offset int64
+		//gRPC call of the exchange, it is decoded when the packet is first drawn
+		call        *grpc.Call
+		callDecoded bool
+	}
+
+	// socketMessage is a websocket message displayed below its handshake.
+	socketMessage struct {
+		*websocket.Message
+		packet *packet
+		//bytes of the payload, only its head is kept once the message is stored
+		size   int
+		offset int64
 	}
 
 	State struct {
-		paused       bool
-		NumOfCapture int
+		//first field, atomic 64 bit operations need it aligned on 32 bit platforms
+		NumOfCapture int64
+		//the fields are set by the key bindings and read by the capture goroutines and the refresh loop
+		mutex     sync.Mutex
+		paused    bool
+		finished  bool
+		message   string
+		filter    string
+		search    string
+		dashboard bool
 	}
 
 	App struct {
-		filter        *Filter
 		ctx           context.Context
 		cancelFun     context.CancelFunc
 		ui            *gocui.Gui
 		capture       *Capture
+		store         *store.Store
+		done          <-chan struct{}
 		state         *State
 		curIndex      int
 		sideWidget    *widget.ListView
 		contentWidget *widget.ContentView
 		footerWidget  *widget.ContentView
+		inputWidget   *widget.InputView
+		promptMode    string
+		sortMode      int
+		sideWidth     int
+		registry      *grpc.Registry
+		mutex         sync.Mutex
+		sockets       map[*http.Response]*packet
+		stats         *stats
+		retention     Retention
+		retained      retained
 	}
 )
 
+const (
+	promptFilter = "filter"
+	promptSearch = "search"
+)
+
+const (
+	sortArrival = iota
+	sortLatency
+	sortSize
+	sortStatus
+)
+
+var (
+	sortNames = []string{"arrival", "latency", "size", "status"}
+)
+
 func (app *App) Handle(req *http.Request, res *http.Response) {
-	if app.state.paused {
+	if app.state.isPaused() {
 		req.Release()
 		res.Release()
 		return
 	}
-	app.state.NumOfCapture++
-	app.sideWidget.Push(&packet{request: req, response: res})
+	p := &packet{request: req, response: res, size: res.ContentLength}
+	app.persistPacket(p)
+	app.addPacket(p)
+}
+
+func (app *App) addPacket(p *packet) {
+	atomic.AddInt64(&app.state.NumOfCapture, 1)
+	app.stats.add(p.request, p.response)
+	if websocket.IsUpgrade(p.response.Header, p.response.StatusCode) {
+		app.mutex.Lock()
+		app.sockets[p.response] = p
+		app.mutex.Unlock()
+	}
+	//it is counted before it is listed, an eviction in between would subtract bodies which were never added
+	app.retain(p, int64(len(p.request.Body)+len(p.response.Body)))
+	app.sideWidget.Push(p)
+	app.evict()
+}
+
+// HandleMessage appends a websocket message to its handshake, which can be expanded in the request list.
+func (app *App) HandleMessage(req *http.Request, res *http.Response, msg *websocket.Message) {
+	app.mutex.Lock()
+	p, ok := app.sockets[res]
+	app.mutex.Unlock()
+	if !ok {
+		return
+	}
+	m := &socketMessage{Message: msg, packet: p, size: len(msg.Data)}
+	app.persistMessage(m)
+	app.addMessage(m)
+}
+
+func (app *App) addMessage(m *socketMessage) {
+	p := m.packet
+	if !app.retain(m, int64(len(m.Raw))) {
+		return
+	}
+	app.sideWidget.Refresh(p)
+	app.evict()
+}
+
+// appendMessage adds a websocket message to its handshake.
+func (p *packet) appendMessage(m *socketMessage) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	//the directions are read concurrently, messages are kept in the order of time
+	pos := sort.Search(len(p.messages), func(i int) bool {
+		return p.messages[i].Time.After(m.Time)
+	})
+	p.messages = append(p.messages, nil)
+	copy(p.messages[pos+1:], p.messages[pos:])
+	p.messages[pos] = m
+}
+
+// HandleHandshake lists a tls connection which is not decrypted with the requests.
+func (app *App) HandleHandshake(hs *tls.Handshake) {
+	if app.state.isPaused() {
+		return
+	}
+	app.persist(hs)
+	app.push(hs)
+}
+
+// HandleExchange lists an exchange of another protocol than http, e.g. a redis command.
+func (app *App) HandleExchange(e decoder.Exchange) {
+	if app.state.isPaused() {
+		return
+	}
+	app.persist(e)
+	app.push(e)
+}
+
+// push lists a tls connection or an exchange of another protocol than http.
+func (app *App) push(v interface{}) {
+	atomic.AddInt64(&app.state.NumOfCapture, 1)
+	app.sideWidget.Push(v)
+	app.retain(v, 0)
+	app.evict()
+}
+
+// grpcCall returns the gRPC call of the exchange, loaded is the packet with the bodies of a stored exchange.
+func (p *packet) grpcCall(loaded *packet, registry *grpc.Registry) *grpc.Call {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.callDecoded {
+		return p.call
+	}
+	call := grpc.NewCall(loaded.request, loaded.response, registry)
+	//the bodies of a stored exchange which failed to load are dropped, it is decoded again with the next draw
+	if p.offset == 0 || loaded != p {
+		p.call, p.callDecoded = call, true
+	}
+	return call
+}
+
+func (p *packet) children() []interface{} {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	values := make([]interface{}, 0, len(p.messages))
+	for _, m := range p.messages {
+		values = append(values, m)
+	}
+	return values
+}
+
+func (app *App) exportHAR() (err error) {
+	var (
+		fp *os.File
+	)
+	entries := make([]*har.Entry, 0)
+	app.sideWidget.Range(func(i int, v interface{}) bool {
+		if p, ok := v.(*packet); ok {
+			loaded := app.loadPacket(p)
+			entry := har.NewEntry(loaded.request, loaded.response)
+			p.mutex.Lock()
+			for _, m := range p.messages {
+				entry.AppendMessage(app.loadMessage(m).Message)
+			}
+			p.mutex.Unlock()
+			entries = append(entries, entry)
+		}
+		return true
+	})
+	filename := "httpcap-" + time.Now().Format("20060102-150405") + ".har"
+	if fp, err = os.Create(filename); err != nil {
+		return
+	}
+	defer func() {
+		_ = fp.Close()
+	}()
+	if err = har.Encode(fp, entries); err == nil {
+		app.setMessage(fmt.Sprintf("%d requests exported to %s", len(entries), filename))
+	}
+	return
+}
+
+func packetMatch(f MatchFunc) widget.MatchFunc {
+	if f == nil {
+		return nil
+	}
+	return func(v interface{}) bool {
+		switch p := v.(type) {
+		case *packet:
+			return f(&exchange{req: p.request, res: p.response})
+		case *tls.Handshake:
+			return f(&handshake{hs: p})
+		case decoder.Exchange:
+			if r := resolver(p); r != nil {
+				return f(r)
+			}
+		}
+		return false
+	}
+}
+
+func (app *App) setFilter(query string) (err error) {
+	var (
+		f MatchFunc
+	)
+	if f, err = CompileQuery(query); err != nil {
+		return
+	}
+	app.sideWidget.SetFilter(packetMatch(f))
+	return
+}
+
+func (app *App) findNext(query string, step int) (err error) {
+	var (
+		f MatchFunc
+	)
+	if f, err = CompileQuery(query); err != nil || f == nil {
+		return
+	}
+	if !app.sideWidget.Find(packetMatch(f), step) {
+		app.setMessage(fmt.Sprintf("no request matches %q", query))
+	}
+	return
+}
+
+func (app *App) openPrompt(mode string) {
+	app.promptMode = mode
+	app.setMessage("")
+	if mode == promptFilter {
+		app.inputWidget.Show("Filter: host, path, method, status or expression (Enter apply, Esc cancel)", app.state.filterQuery())
+	} else {
+		app.inputWidget.Show("Search (Enter confirm, Esc cancel, n/N next/previous)", app.state.searchQuery())
+	}
+}
+
+func (app *App) handlePromptChange(text string) {
+	var (
+		err error
+	)
+	app.setMessage("")
+	if app.promptMode == promptFilter {
+		err = app.setFilter(text)
+	} else {
+		err = app.findNext(text, 0)
+	}
+	if err != nil {
+		app.setMessage(err.Error())
+	}
+	app.updateSummary()
+}
+
+func (app *App) handlePromptSubmit(text string) {
+	var (
+		err error
+	)
+	app.setMessage("")
+	if app.promptMode == promptFilter {
+		if err = app.setFilter(text); err == nil {
+			app.state.setFilterQuery(strings.TrimSpace(text))
+		} else {
+			_ = app.setFilter(app.state.filterQuery())
+		}
+	} else {
+		if err = app.findNext(text, 0); err == nil {
+			app.state.setSearchQuery(strings.TrimSpace(text))
+		}
+	}
+	if err != nil {
+		app.setMessage("invalid " + app.promptMode + ": " + err.Error())
+	}
+	app.updateSummary()
+}
+
+func (app *App) handlePromptCancel() {
+	app.setMessage("")
+	if app.promptMode == promptFilter {
+		_ = app.setFilter(app.state.filterQuery())
+	}
+	app.updateSummary()
 }
 
 func (app *App) ioLoop() {
 	ticker := time.NewTicker(time.Second)
 	defer ticker.Stop()
+	doneChan := app.done
 	for {
 		select {
 		case <-app.ctx.Done():
 			return
+		case <-doneChan:
+			doneChan = nil
+			app.state.finish()
+			app.updateSummary()
 		case <-ticker.C:
+			//exchanges also expire while nothing is captured
+			if app.retention.MaxAge > 0 {
+				app.evict()
+			}
 			app.updateSummary()
+			if app.state.isDashboard() {
+				app.ui.Update(func(gui *gocui.Gui) error {
+					app.drawStats()
+					return nil
+				})
+			}
 		}
 	}
 }
 
+func formatDuration(d time.Duration) string {
+	switch {
+	case d <= 0:
+		return "-"
+	case d < time.Millisecond:
+		return strconv.FormatInt(d.Microseconds(), 10) + "µs"
+	case d < time.Second:
+		return strconv.FormatInt(d.Milliseconds(), 10) + "ms"
+	default:
+		return strconv.FormatFloat(d.Seconds(), 'f', 2, 64) + "s"
+	}
+}
+
+func formatSize(n int) string {
+	switch {
+	case n < 1024:
+		return strconv.Itoa(n) + "B"
+	case n < 1024*1024:
+		return strconv.FormatFloat(float64(n)/1024, 'f', 1, 64) + "KB"
+	default:
+		return strconv.FormatFloat(float64(n)/1024/1024, 'f', 1, 64) + "MB"
+	}
+}
+
+func formatBodySize(raw []byte, decoded []byte, encoding string, err error) string {
+	if encoding == "" {
+		return formatSize(len(raw))
+	}
+	if err != nil {
+		return fmt.Sprintf("%s %s (decode failed: %s)", formatSize(len(raw)), encoding, err.Error())
+	}
+	return fmt.Sprintf("%s %s -> %s", formatSize(len(raw)), encoding, formatSize(len(decoded)))
+}
+
+// formatTruncated marks a body which was cut at the max body size.
+func formatTruncated(truncated bool, size int) string {
+	if !truncated {
+		return ""
+	}
+	return color.RedString(" (truncated, %s on the wire)", formatSize(size))
+}
+
+func truncate(s string, width int) string {
+	if width <= 0 {
+		return ""
+	}
+	runes := []rune(s)
+	if len(runes) <= width {
+		return s
+	}
+	if width == 1 {
+		return "…"
+	}
+	return string(runes[:width-1]) + "…"
+}
+
+func formatStatus(code int) string {
+	s := fmt.Sprintf("%3d", code)
+	switch {
+	case code <= 0:
+		return "---"
+	case code < 200:
+		return color.BlueString(s)
+	case code < 300:
+		return color.GreenString(s)
+	case code < 400:
+		return color.CyanString(s)
+	case code < 500:
+		return color.YellowString(s)
+	default:
+		return color.RedString(s)
+	}
+}
+
+// columnWidths returns the width of the host and client columns and the width left for the path.
+func (app *App) columnWidths() (hostWidth int, clientWidth int, remain int) {
+	//index, status, method, latency and size take 33 columns, the host and client are shown when the panel is wide enough
+	remain = app.sideWidth - 1 - 33
+	if remain >= 72 {
+		clientWidth = 21
+	}
+	if remain >= 30 {
+		hostWidth = remain / 3
+		if hostWidth < 12 {
+			hostWidth = 12
+		} else if hostWidth > 28 {
+			hostWidth = 28
+		}
+	}
+	return
+}
+
 func (app *App) formatRequest(idx int, v interface{}) string {
-	if p, ok := v.(*packet); ok {
-		method := fmt.Sprintf("%-4s", p.request.Method)
-		return fmt.Sprintf("[%3d] %s %s", idx, method, p.request.RequestURI)
+	if m, ok := v.(*socketMessage); ok {
+		return formatMessage(m, app.sideWidth-1)
+	}
+	if hs, ok := v.(*tls.Handshake); ok {
+		return app.formatHandshake(idx, hs)
+	}
+	if cmd, ok := v.(*redis.Command); ok {
+		return app.formatCommand(idx, cmd)
+	}
+	if q, ok := v.(*sql.Query); ok {
+		return app.formatQuery(idx, q)
+	}
+	p, ok := v.(*packet)
+	if !ok {
+		return ""
+	}
+	size := formatSize(p.size)
+	p.mutex.Lock()
+	if len(p.messages) > 0 {
+		size = strconv.Itoa(len(p.messages)) + " msg"
 	}
-	return ""
+	p.mutex.Unlock()
+	hostWidth, clientWidth, remain := app.columnWidths()
+	index := fmt.Sprintf("[%3d]", idx)
+	//bytes of the exchange were missing in the capture
+	if p.request.Gap || p.response.Gap {
+		index = color.RedString(index)
+	}
+	str := fmt.Sprintf("%s %s %-7s %6s %7s ", index,
+		formatStatus(p.response.StatusCode),
+		truncate(p.request.Method, 7),
+		formatDuration(p.response.Latency()),
+		truncate(size, 7),
+	)
+	if hostWidth > 0 {
+		str += fmt.Sprintf("%-*s ", hostWidth, truncate(hostname(p.request.Host), hostWidth))
+		remain -= hostWidth + 1
+	}
+	if clientWidth > 0 {
+		str += fmt.Sprintf("%-*s ", clientWidth, truncate(p.request.Address, clientWidth))
+		remain -= clientWidth + 1
+	}
+	return str + truncate(p.request.RequestURI, remain)
+}
+
+// formatHandshake shows the version and cipher suite of a tls connection where the path of a request is.
+func (app *App) formatHandshake(idx int, hs *tls.Handshake) string {
+	hostWidth, clientWidth, remain := app.columnWidths()
+	protocol := hs.Protocol
+	if protocol == "" && len(hs.ALPN) > 0 {
+		protocol = hs.ALPN[0]
+	}
+	str := fmt.Sprintf("[%3d] %s %-7s %6s %7s ", idx, color.MagentaString("TLS"), truncate(protocol, 7), "-", "-")
+	host := hs.ServerName
+	if host == "" {
+		host = hs.Server
+	}
+	if hostWidth > 0 {
+		str += fmt.Sprintf("%-*s ", hostWidth, truncate(host, hostWidth))
+		remain -= hostWidth + 1
+	}
+	if clientWidth > 0 {
+		str += fmt.Sprintf("%-*s ", clientWidth, truncate(hs.Client, clientWidth))
+		remain -= clientWidth + 1
+	}
+	return str + truncate(strings.TrimSpace(hs.VersionName()+" "+hs.CipherSuiteName()), remain)
+}
+
+// formatCommand shows a redis command with the summary of its reply where the path of a request is.
+func (app *App) formatCommand(idx int, cmd *redis.Command) string {
+	hostWidth, clientWidth, remain := app.columnWidths()
+	status := color.CyanString("RDS")
+	size := "-"
+	if cmd.Reply != nil {
+		size = formatSize(cmd.Reply.Size())
+		if cmd.Reply.IsError() {
+			status = color.RedString("ERR")
+		}
+	}
+	index := fmt.Sprintf("[%3d]", idx)
+	if cmd.Gap {
+		index = color.RedString(index)
+	}
+	str := fmt.Sprintf("%s %s %-7s %6s %7s ", index, status, truncate(cmd.Name(), 7), formatDuration(cmd.Latency()), size)
+	if hostWidth > 0 {
+		str += fmt.Sprintf("%-*s ", hostWidth, truncate(cmd.Server, hostWidth))
+		remain -= hostWidth + 1
+	}
+	if clientWidth > 0 {
+		str += fmt.Sprintf("%-*s ", clientWidth, truncate(cmd.Client, clientWidth))
+		remain -= clientWidth + 1
+	}
+	return str + truncate(cmd.Summary(remain), remain)
+}
+
+// formatQuery shows a sql query with its rows where the path of a request is.
+func (app *App) formatQuery(idx int, q *sql.Query) string {
+	hostWidth, clientWidth, remain := app.columnWidths()
+	status := color.BlueString("SQL")
+	if q.Error != "" {
+		status = color.RedString("ERR")
+	}
+	rows := "-"
+	if q.Completed() && q.Error == "" {
+		rows = strconv.FormatInt(q.Rows, 10)
+	}
+	index := fmt.Sprintf("[%3d]", idx)
+	if q.Gap {
+		index = color.RedString(index)
+	}
+	str := fmt.Sprintf("%s %s %-7s %6s %7s ", index, status, truncate(q.Verb(), 7), formatDuration(q.Latency()), truncate(rows, 7))
+	if hostWidth > 0 {
+		str += fmt.Sprintf("%-*s ", hostWidth, truncate(q.Server, hostWidth))
+		remain -= hostWidth + 1
+	}
+	if clientWidth > 0 {
+		str += fmt.Sprintf("%-*s ", clientWidth, truncate(q.Client, clientWidth))
+		remain -= clientWidth + 1
+	}
+	return str + truncate(q.Summary(remain), remain)
+}
+
+func formatMessage(m *socketMessage, width int) string {
+	direction := color.CyanString("↑")
+	if !m.FromClient {
+		direction = color.GreenString("↓")
+	}
+	str := fmt.Sprintf("      %s %-7s %7s ", direction, truncate(m.Type(), 7), formatSize(m.size))
+	preview := ""
+	switch {
+	case m.Opcode == websocket.OpClose:
+		if code, reason := m.CloseCode(); code > 0 {
+			preview = strconv.Itoa(code) + " " + reason
+		}
+	case !m.IsBinary():
+		preview = strings.Join(strings.Fields(string(m.Data)), " ")
+	default:
+		b := m.Data
+		if len(b) > width {
+			b = b[:width]
+		}
+		preview = hex.EncodeToString(b)
+	}
+	return str + truncate(preview, width-24)
+}
+
+// sortKeys returns the latency, size and status of a row, tls connections have none of them.
+func sortKeys(v interface{}) (latency time.Duration, size int, status int) {
+	switch p := v.(type) {
+	case *packet:
+		return p.response.Latency(), p.size, p.response.StatusCode
+	case *redis.Command:
+		if p.Reply != nil {
+			size = p.Reply.Size()
+		}
+		return p.Latency(), size, 0
+	case *sql.Query:
+		return p.Latency(), int(p.Rows), 0
+	}
+	return
+}
+
+func sortFunc(mode int) widget.LessFunc {
+	var (
+		key func(v interface{}) int64
+	)
+	switch mode {
+	case sortLatency:
+		key = func(v interface{}) int64 { latency, _, _ := sortKeys(v); return int64(latency) }
+	case sortSize:
+		key = func(v interface{}) int64 { _, size, _ := sortKeys(v); return int64(size) }
+	case sortStatus:
+		key = func(v interface{}) int64 { _, _, status := sortKeys(v); return int64(status) }
+	default:
+		return nil
+	}
+	//the largest value comes first, so slow, large or failed requests are on the top of the list
+	return func(a, b interface{}) bool {
+		return key(a) > key(b)
+	}
+}
+
+func (app *App) cycleSort() {
+	app.sortMode = (app.sortMode + 1) % len(sortNames)
+	app.sideWidget.Title("Requests (" + sortNames[app.sortMode] + ")")
+	app.sideWidget.SetSort(sortFunc(app.sortMode))
 }
 
-func (app *App) drawPacket(p *packet, displayLargeBody bool) {
+func (app *App) drawPacket(selected *packet, displayLargeBody bool) {
+	p := app.loadPacket(selected)
 	buf := bytebufferpool.Get()
 	defer bytebufferpool.Put(buf)
-	_, _ = buf.WriteString(color.MagentaString("\nAddress: ") + color.YellowString("%s <--> %s\n\n", p.request.Address, p.response.Address))
+	_, _ = buf.WriteString(color.MagentaString("\nAddress: ") + color.YellowString("%s <--> %s", p.request.Address, p.response.Address))
+	if p.request.StreamID > 0 {
+		_, _ = buf.WriteString(color.MagentaString("  Stream: ") + color.YellowString("%d", p.request.StreamID))
+	}
+	_, _ = buf.WriteString("\n")
+	_, _ = buf.WriteString(color.MagentaString("Started: ") + color.YellowString("%s", p.request.StartedAt.Format("2006-01-02 15:04:05.000")))
+	_, _ = buf.WriteString(color.MagentaString("  TTFB: ") + color.YellowString("%s", formatDuration(p.response.TimeToFirstByte())))
+	_, _ = buf.WriteString(color.MagentaString("  Latency: ") + color.YellowString("%s\n", formatDuration(p.response.Latency())))
+	_, _ = buf.WriteString(color.MagentaString("Request Body: ") + color.YellowString("%s", formatBodySize(p.request.Body, p.request.DecodedBody(), p.request.ContentEncoding(), p.request.DecodeError())))
+	_, _ = buf.WriteString(formatTruncated(p.request.Truncated, p.request.ContentLength))
+	_, _ = buf.WriteString(color.MagentaString("  Response Body: ") + color.YellowString("%s", formatBodySize(p.response.Body, p.response.DecodedBody(), p.response.ContentEncoding(), p.response.DecodeError())))
+	_, _ = buf.WriteString(formatTruncated(p.response.Truncated, p.response.ContentLength) + "\n")
+	if p.request.Gap || p.response.Gap {
+		_, _ = buf.WriteString(color.RedString("Bytes of this exchange were missing in the capture, its bodies may be incomplete\n"))
+	}
+	_, _ = buf.WriteString("\n")
 	_, _ = p.request.WriteTo(buf)
 	_, _ = buf.WriteString("\r\n\r\n")
 	_, _ = p.response.Dumper(buf, displayLargeBody)
+	if call := selected.grpcCall(p, app.registry); call != nil {
+		_, _ = buf.WriteString("\r\n\r\n")
+		_, _ = call.WriteTo(buf)
+	}
 	b := buf.Bytes()
 	for idx := 0; idx < len(b); idx++ {
 		if b[idx] == '\r' {
@@ -87,54 +693,465 @@ func (app *App) drawPacket(p *packet, displayLargeBody bool) {
 	_, _ = app.contentWidget.Write(b)
 }
 
+func (app *App) drawMessage(m *socketMessage, displayLargeBody bool) {
+	buf := bytebufferpool.Get()
+	defer bytebufferpool.Put(buf)
+	direction := "client -> server"
+	if !m.FromClient {
+		direction = "server -> client"
+	}
+	_, _ = buf.WriteString(color.MagentaString("\nAddress: ") + color.YellowString("%s <--> %s\n", m.packet.request.Address, m.packet.response.Address))
+	_, _ = buf.WriteString(color.MagentaString("Time: ") + color.YellowString("%s", m.Time.Format("2006-01-02 15:04:05.000")))
+	_, _ = buf.WriteString(color.MagentaString("  Direction: ") + color.YellowString("%s\n", direction))
+	_, _ = buf.WriteString(color.MagentaString("Type: ") + color.YellowString("%s", m.Type()))
+	_, _ = buf.WriteString(color.MagentaString("  Payload: ") + color.YellowString("%s", formatBodySize(m.Raw, m.Data, m.ContentEncoding(), m.DecodeError())))
+	if code, reason := m.CloseCode(); code > 0 {
+		_, _ = buf.WriteString(color.MagentaString("  Close: ") + color.YellowString("%d %s", code, reason))
+	}
+	_, _ = buf.WriteString("\n" + color.MagentaString("Handshake: ") + color.YellowString("%s %s\n\n", m.packet.request.Method, m.packet.request.RequestURI))
+	if len(m.Data) < 1024 || displayLargeBody {
+		if m.IsBinary() {
+			wc := hex.Dumper(buf)
+			_, _ = wc.Write(m.Data)
+			_ = wc.Close()
+		} else {
+			_, _ = buf.Write(m.Data)
+		}
+	}
+	_, _ = app.contentWidget.Write(buf.Bytes())
+}
+
+func (app *App) drawHandshake(hs *tls.Handshake) {
+	buf := bytebufferpool.Get()
+	defer bytebufferpool.Put(buf)
+	_, _ = buf.WriteString(color.MagentaString("\nAddress: ") + color.YellowString("%s <--> %s\n", hs.Client, hs.Server))
+	_, _ = buf.WriteString(color.MagentaString("Started: ") + color.YellowString("%s\n\n", hs.Time.Format("2006-01-02 15:04:05.000")))
+	for _, field := range [][2]string{
+		{"Server Name", hs.ServerName},
+		{"ALPN", strings.Join(hs.ALPN, ", ")},
+		{"Protocol", hs.Protocol},
+		{"Version", hs.VersionName()},
+		{"Cipher Suite", hs.CipherSuiteName()},
+		{"Subject", hs.Subject},
+		{"Issuer", hs.Issuer},
+		{"JA3", hs.JA3},
+		{"JA4", hs.JA4},
+	} {
+		value := field[1]
+		if value == "" {
+			value = "-"
+		}
+		_, _ = buf.WriteString(color.MagentaString("%-14s", field[0]+":") + color.YellowString("%s\n", value))
+	}
+	_, _ = app.contentWidget.Write(buf.Bytes())
+}
+
+func (app *App) drawCommand(cmd *redis.Command, displayLargeBody bool) {
+	buf := bytebufferpool.Get()
+	defer bytebufferpool.Put(buf)
+	_, _ = buf.WriteString(color.MagentaString("\nAddress: ") + color.YellowString("%s <--> %s\n", cmd.Client, cmd.Server))
+	started := cmd.StartedAt
+	if cmd.Push {
+		started = cmd.FirstByteAt
+	}
+	_, _ = buf.WriteString(color.MagentaString("Started: ") + color.YellowString("%s", started.Format("2006-01-02 15:04:05.000")))
+	_, _ = buf.WriteString(color.MagentaString("  TTFB: ") + color.YellowString("%s", formatDuration(cmd.TimeToFirstByte())))
+	_, _ = buf.WriteString(color.MagentaString("  Latency: ") + color.YellowString("%s\n", formatDuration(cmd.Latency())))
+	if !cmd.Push {
+		_, _ = buf.WriteString(color.MagentaString("Command: ") + color.YellowString("%s", formatSize(cmd.Size())))
+	}
+	if cmd.Reply != nil {
+		_, _ = buf.WriteString(color.MagentaString("  Reply: ") + color.YellowString("%s", formatSize(cmd.Reply.Size())))
+	}
+	_, _ = buf.WriteString("\n")
+	if cmd.Gap {
+		_, _ = buf.WriteString(color.RedString("Bytes of this command were missing in the capture, its reply may be incomplete\n"))
+	}
+	_, _ = buf.WriteString("\n")
+	if !cmd.Push {
+		_, _ = buf.WriteString(cmd.Line(math.MaxInt32) + "\n\n")
+	}
+	switch {
+	case cmd.Reply == nil:
+		_, _ = buf.WriteString("(no reply)\n")
+	case cmd.Reply.Size() < 1024*64 || displayLargeBody:
+		_, _ = cmd.Reply.WriteTo(buf)
+	default:
+		_, _ = buf.WriteString(cmd.Reply.Summary() + ", press Space to show it\n")
+	}
+	_, _ = app.contentWidget.Write(buf.Bytes())
+}
+
+func (app *App) drawQuery(q *sql.Query) {
+	buf := bytebufferpool.Get()
+	defer bytebufferpool.Put(buf)
+	_, _ = buf.WriteString(color.MagentaString("\nAddress: ") + color.YellowString("%s <--> %s\n", q.Client, q.Server))
+	_, _ = buf.WriteString(color.MagentaString("Database: ") + color.YellowString("%s %s", q.DialectName(), q.Database))
+	if q.User != "" {
+		_, _ = buf.WriteString(color.MagentaString("  User: ") + color.YellowString("%s", q.User))
+	}
+	_, _ = buf.WriteString("\n")
+	_, _ = buf.WriteString(color.MagentaString("Started: ") + color.YellowString("%s", q.StartedAt.Format("2006-01-02 15:04:05.000")))
+	_, _ = buf.WriteString(color.MagentaString("  TTFB: ") + color.YellowString("%s", formatDuration(q.TimeToFirstByte())))
+	_, _ = buf.WriteString(color.MagentaString("  Latency: ") + color.YellowString("%s\n", formatDuration(q.Latency())))
+	_, _ = buf.WriteString(color.MagentaString("Result: ") + color.YellowString("%s", q.Result()))
+	if q.Tag != "" {
+		_, _ = buf.WriteString(color.MagentaString("  Tag: ") + color.YellowString("%s", q.Tag))
+	}
+	if q.ErrorCode != "" {
+		_, _ = buf.WriteString(color.MagentaString("  Code: ") + color.YellowString("%s", q.ErrorCode))
+	}
+	_, _ = buf.WriteString("\n")
+	if q.Gap {
+		_, _ = buf.WriteString(color.RedString("Bytes of this query were missing in the capture, its result may be incomplete\n"))
+	}
+	_, _ = buf.WriteString("\n" + strings.TrimSpace(q.Text) + "\n")
+	if len(q.Params) > 0 {
+		_, _ = buf.WriteString(color.MagentaString("\nParams:\n"))
+		for i, param := range q.Params {
+			//postgres numbers its placeholders, mysql uses question marks
+			name := "$" + strconv.Itoa(i+1)
+			if q.Dialect == sql.DialectMySQL {
+				name = "?" + strconv.Itoa(i+1)
+			}
+			_, _ = buf.WriteString(color.CyanString("%4s", name) + " = " + sql.FormatParam(param) + "\n")
+		}
+	}
+	_, _ = app.contentWidget.Write(buf.Bytes())
+}
+
+// toggleDashboard switches the content view between the selected request and the stats of the capture.
+func (app *App) toggleDashboard() {
+	if app.state.toggleDashboard() {
+		app.contentWidget.Title("Stats")
+		app.drawStats()
+		return
+	}
+	app.contentWidget.Title("Raw Content")
+	if v, ok := app.sideWidget.Selected(); ok {
+		app.handleSelectedChange(app.curIndex, v)
+	} else {
+		_, _ = app.contentWidget.Write(nil)
+	}
+}
+
+func formatBar(n, max int64, width int) string {
+	if max <= 0 {
+		return ""
+	}
+	size := int(n * int64(width) / max)
+	if size == 0 && n > 0 {
+		size = 1
+	}
+	return strings.Repeat("█", size)
+}
+
+// drawStats shows the request rate, the latency percentiles, the status codes and the most frequent
+// hosts, paths and clients, a capture file is summarized at the time of its last request.
+func (app *App) drawStats() {
+	buf := bytebufferpool.Get()
+	defer bytebufferpool.Put(buf)
+	now := time.Now()
+	if app.offline() {
+		now = app.stats.lastAt()
+	}
+	summary := app.stats.summary(now, 10)
+	width, _ := app.ui.Size()
+	barWidth := (width - app.sideWidth) / 4
+	_, _ = buf.WriteString(color.MagentaString("\nRequests: ") + color.YellowString("%d", summary.Total))
+	_, _ = buf.WriteString(color.MagentaString("  Rate: ") + color.YellowString("%.1f/s", summary.Rate))
+	_, _ = buf.WriteString(color.MagentaString("  Average: ") + color.YellowString("%.1f/s\n", summary.AverageRate))
+	_, _ = buf.WriteString(color.MagentaString("Latency: ") + color.YellowString("p50 %s  p90 %s  p99 %s\n",
+		formatDuration(summary.P50), formatDuration(summary.P90), formatDuration(summary.P99)))
+	_, _ = buf.WriteString(color.MagentaString("\nStatus\n"))
+	var max int64
+	for _, s := range summary.Statuses {
+		if s.Count > max {
+			max = s.Count
+		}
+	}
+	for _, s := range summary.Statuses {
+		percent := float64(s.Count) * 100 / float64(summary.Total)
+		_, _ = buf.WriteString(fmt.Sprintf("  %s %8d %5.1f%% %s\n", formatStatus(s.Code), s.Count, percent, formatBar(s.Count, max, barWidth)))
+	}
+	for _, section := range []struct {
+		title string
+		ranks []rank
+	}{
+		{"Top hosts", summary.Hosts},
+		{"Top paths", summary.Paths},
+		{"Top clients", summary.Clients},
+	} {
+		_, _ = buf.WriteString(color.MagentaString("\n%s\n", section.title))
+		if len(section.ranks) == 0 {
+			continue
+		}
+		keyWidth := 0
+		for _, r := range section.ranks {
+			if len(r.Key) > keyWidth {
+				keyWidth = len(r.Key)
+			}
+		}
+		if keyWidth > 48 {
+			keyWidth = 48
+		}
+		for _, r := range section.ranks {
+			_, _ = buf.WriteString(fmt.Sprintf("  %8d %-*s %s\n", r.Count, keyWidth, truncate(r.Key, keyWidth), color.CyanString(formatBar(r.Count, section.ranks[0].Count, barWidth))))
+		}
+	}
+	_, _ = app.contentWidget.Write(buf.Bytes())
+}
+
 func (app *App) updateSummary() {
 	msg := make([]string, 0)
-	if app.state.paused {
+	if app.state.isPaused() {
 		msg = append(msg, color.New(color.FgBlack, color.BgRed).Sprintf("%-8s", "Pause"))
+	} else if app.state.isFinished() {
+		msg = append(msg, color.New(color.FgBlack, color.BgBlue).Sprintf("%-8s", "Finished"))
+	} else if app.offline() {
+		msg = append(msg, color.New(color.FgBlack, color.BgYellow).Sprintf("%-8s", "Reading"))
 	} else {
 		msg = append(msg, color.New(color.FgBlack, color.BgGreen).Sprintf("%-8s", "Capture"))
 	}
-	msg = append(msg, color.BlueString("Requests")+" "+strconv.Itoa(app.state.NumOfCapture))
+	if app.capture == nil {
+		msg = append(msg, color.BlueString("File")+" "+app.store.Name())
+	} else if app.capture.Offline() {
+		msg = append(msg, color.BlueString("File")+" "+app.capture.Name())
+	}
+	if filter := app.state.filterQuery(); filter != "" {
+		visible, _ := app.sideWidget.Count()
+		msg = append(msg, color.BlueString("Requests")+" "+strconv.Itoa(visible)+"/"+strconv.FormatInt(atomic.LoadInt64(&app.state.NumOfCapture), 10))
+		msg = append(msg, color.BlueString("Filter")+" "+filter)
+	} else {
+		msg = append(msg, color.BlueString("Requests")+" "+strconv.FormatInt(atomic.LoadInt64(&app.state.NumOfCapture), 10))
+	}
+	if search := app.state.searchQuery(); search != "" {
+		msg = append(msg, color.BlueString("Search")+" "+search)
+	}
+	app.mutex.Lock()
+	evicted := app.retained.evicted
+	app.mutex.Unlock()
+	if evicted > 0 {
+		msg = append(msg, color.BlueString("Evicted")+" "+strconv.Itoa(evicted))
+	}
+	stats := app.captureStats()
+	if stats.TruncatedBodies > 0 || stats.DroppedBytes > 0 {
+		msg = append(msg, color.RedString("Truncated")+" "+strconv.FormatInt(stats.TruncatedBodies, 10))
+		msg = append(msg, color.RedString("Dropped")+" "+formatSize(int(stats.DroppedBytes)))
+	}
+	//packets lost by the kernel or the interface leave gaps in the connections, the requests around them are incomplete
+	if stats.PacketsDropped > 0 || stats.PacketsIfDropped > 0 {
+		msg = append(msg, color.RedString("Lost")+" "+strconv.FormatInt(stats.PacketsDropped, 10)+" kernel "+strconv.FormatInt(stats.PacketsIfDropped, 10)+" if")
+	}
+	if stats.Gaps > 0 {
+		msg = append(msg, color.RedString("Gaps")+" "+strconv.FormatInt(stats.Gaps, 10)+" ("+formatSize(int(stats.SkippedBytes))+", "+strconv.FormatInt(stats.GapExchanges, 10)+" exchanges)")
+	}
+	if stats.ParseErrors > 0 {
+		msg = append(msg, color.RedString("Errors")+" "+strconv.FormatInt(stats.ParseErrors, 10))
+	}
+	if stats.Timeouts > 0 {
+		msg = append(msg, color.RedString("Timeouts")+" "+strconv.FormatInt(stats.Timeouts, 10))
+	}
 	msg = append(msg, color.BlueString("Goroutine")+" "+strconv.Itoa(runtime.NumGoroutine()))
-	msg = append(msg, fmt.Sprintf("%s %s Exit %s Swtich Tab %s Show All %s Clear %s Pause/Capture",
+	msg = append(msg, fmt.Sprintf("%s %s Exit %s Swtich Tab %s Show All %s Messages %s Clear %s Pause/Capture %s Export HAR %s Stats %s Filter %s Search %s Sort",
 		color.BlueString("Shortcut"),
 		color.MagentaString("^C"),
 		color.MagentaString("Tab"),
 		color.MagentaString("Space"),
+		color.MagentaString("Enter"),
 		color.MagentaString("F5"),
 		color.MagentaString("F6"),
+		color.MagentaString("F7"),
+		color.MagentaString("F8"),
+		color.MagentaString("/"),
+		color.MagentaString("s"),
+		color.MagentaString("o"),
 	))
+	if message := app.message(); message != "" {
+		msg = append(msg, color.YellowString(message))
+	}
 	app.footerWidget.SetContent(strings.Join(msg, "    "))
 }
 
+func (app *App) message() string {
+	app.state.mutex.Lock()
+	defer app.state.mutex.Unlock()
+	return app.state.message
+}
+
+// setMessage shows a message in the footer with its next refresh.
+func (app *App) setMessage(msg string) {
+	app.state.mutex.Lock()
+	app.state.message = msg
+	app.state.mutex.Unlock()
+}
+
+func (state *State) isPaused() bool {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	return state.paused
+}
+
+func (state *State) togglePause() {
+	state.mutex.Lock()
+	state.paused = !state.paused
+	state.mutex.Unlock()
+}
+
+func (state *State) isFinished() bool {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	return state.finished
+}
+
+func (state *State) finish() {
+	state.mutex.Lock()
+	state.finished = true
+	state.mutex.Unlock()
+}
+
+func (state *State) filterQuery() string {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	return state.filter
+}
+
+func (state *State) setFilterQuery(query string) {
+	state.mutex.Lock()
+	state.filter = query
+	state.mutex.Unlock()
+}
+
+func (state *State) searchQuery() string {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	return state.search
+}
+
+func (state *State) setSearchQuery(query string) {
+	state.mutex.Lock()
+	state.search = query
+	state.mutex.Unlock()
+}
+
+func (state *State) isDashboard() bool {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	return state.dashboard
+}
+
+// toggleDashboard switches the dashboard on or off and returns whether it is shown.
+func (state *State) toggleDashboard() bool {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	state.dashboard = !state.dashboard
+	return state.dashboard
+}
+
 func (app *App) handleSelectedChange(i int, v interface{}) {
 	app.curIndex = i
-	if p, ok := v.(*packet); ok {
+	if app.state.isDashboard() {
+		return
+	}
+	switch p := v.(type) {
+	case *packet:
 		app.drawPacket(p, false)
+	case *socketMessage:
+		app.drawMessage(app.loadMessage(p), false)
+	case *tls.Handshake:
+		app.drawHandshake(p)
+	case *redis.Command:
+		app.drawCommand(p, false)
+	case *sql.Query:
+		app.drawQuery(p)
 	}
 }
 
+// layout resizes the request list with the terminal, it runs before the widgets are laid out.
+func (app *App) layout(ui *gocui.Gui) error {
+	width, _ := ui.Size()
+	sideWidth := width * 2 / 5
+	if sideWidth < 44 {
+		sideWidth = 44
+	}
+	if sideWidth != app.sideWidth {
+		app.sideWidth = sideWidth
+		app.sideWidget.Size(app.sideWidth, -4)
+		app.contentWidget.Offset(app.sideWidth+1, 0)
+		app.sideWidget.Redraw()
+	}
+	return nil
+}
+
 func (app *App) initLayout() (err error) {
-	app.sideWidget = widget.NewListView("side", 36, -4).Title("Requests").
+	app.sideWidth = 44
+	app.sideWidget = widget.NewListView("side", app.sideWidth, -4).Title("Requests (" + sortNames[app.sortMode] + ")").
 		WithFormat(app.formatRequest).
-		WithChange(app.handleSelectedChange)
-	app.contentWidget = widget.NewContentView("main", 0, -4).Offset(37, 0).Editable().Title("Raw Content")
+		WithChange(app.handleSelectedChange).
+		WithChildren(func(v interface{}) []interface{} {
+			if p, ok := v.(*packet); ok {
+				return p.children()
+			}
+			return nil
+		})
+	app.contentWidget = widget.NewContentView("main", 0, -4).Offset(app.sideWidth+1, 0).Editable().Title("Raw Content")
 	app.footerWidget = widget.NewContentView("footer", 0, 2).Offset(0, -3).Title("Summary")
+	app.inputWidget = widget.NewInputView("prompt", 0).Offset(0, -3).
+		WithChange(app.handlePromptChange).
+		WithSubmit(app.handlePromptSubmit).
+		WithCancel(app.handlePromptCancel)
 	return
 }
 
-func (app *App) initCapture(iface string) (err error) {
-	app.capture = NewCapture(iface, 65535, app.filter)
-	app.capture.WithHandle(app.Handle)
+// offline reports whether a capture file or a store is read, their exchanges are not live.
+func (app *App) offline() bool {
+	return app.capture == nil || app.capture.Offline()
+}
+
+func (app *App) captureStats() CaptureStats {
+	if app.capture == nil {
+		return CaptureStats{}
+	}
+	return app.capture.Stats()
+}
+
+func (app *App) initCapture() (err error) {
+	if app.capture == nil {
+		//a store is reopened, its exchanges are listed instead of a capture
+		done := make(chan struct{})
+		app.done = done
+		go app.replay(done)
+		return
+	}
+	app.done = app.capture.Done()
+	app.capture.WithHandle(app.Handle).WithMessageHandle(app.HandleMessage).WithHandshakeHandle(app.HandleHandshake).WithExchangeHandle(app.HandleExchange)
 	err = app.capture.Start(app.ctx)
 	return
 }
 
 func (app *App) initKeybindings() (err error) {
 	if err = app.ui.SetKeybinding("", gocui.KeySpace, gocui.ModNone, func(gui *gocui.Gui, view *gocui.View) error {
-		if v, ok := app.sideWidget.Item(app.curIndex); ok {
-			p := v.(*packet)
-			app.drawPacket(p, true)
+		if app.inputWidget.Active() {
+			app.inputWidget.Write(' ')
+			return nil
+		}
+		if app.state.isDashboard() {
+			return nil
+		}
+		if v, ok := app.sideWidget.Selected(); ok {
+			switch p := v.(type) {
+			case *packet:
+				app.drawPacket(p, true)
+			case *socketMessage:
+				app.drawMessage(app.loadMessage(p), true)
+			case *tls.Handshake:
+				app.drawHandshake(p)
+			case *redis.Command:
+				app.drawCommand(p, true)
+			case *sql.Query:
+				app.drawQuery(p)
+			}
+			app.updateSummary()
 		}
 		return nil
 	}); err != nil {
@@ -147,25 +1164,89 @@ func (app *App) initKeybindings() (err error) {
 				p.response.Release()
 			}
 		})
-		app.state.NumOfCapture = 0
+		app.mutex.Lock()
+		app.sockets = make(map[*http.Response]*packet)
+		app.retained = retained{}
+		app.mutex.Unlock()
+		app.stats.reset()
+		atomic.StoreInt64(&app.state.NumOfCapture, 0)
 		app.updateSummary()
 		return nil
 	}); err != nil {
 		return
 	}
 	if err = app.ui.SetKeybinding("", gocui.KeyF6, gocui.ModNone, func(gui *gocui.Gui, view *gocui.View) error {
-		app.state.paused = !app.state.paused
+		app.state.togglePause()
 		app.updateSummary()
 		return nil
 	}); err != nil {
 		return
 	}
+	if err = app.ui.SetKeybinding("", gocui.KeyF7, gocui.ModNone, func(gui *gocui.Gui, view *gocui.View) error {
+		if err := app.exportHAR(); err != nil {
+			app.setMessage("export failed: " + err.Error())
+		}
+		app.updateSummary()
+		return nil
+	}); err != nil {
+		return
+	}
+	if err = app.ui.SetKeybinding("", gocui.KeyF8, gocui.ModNone, func(gui *gocui.Gui, view *gocui.View) error {
+		app.toggleDashboard()
+		return nil
+	}); err != nil {
+		return
+	}
 	if err = app.ui.SetKeybinding("", gocui.KeyCtrlC, gocui.ModNone, func(gui *gocui.Gui, view *gocui.View) error {
 		return gocui.ErrQuit
 	}); err != nil {
 		return
 	}
+	if err = app.ui.SetKeybinding("side", '/', gocui.ModNone, func(gui *gocui.Gui, view *gocui.View) error {
+		app.openPrompt(promptFilter)
+		return nil
+	}); err != nil {
+		return
+	}
+	if err = app.ui.SetKeybinding("side", gocui.KeyEnter, gocui.ModNone, func(gui *gocui.Gui, view *gocui.View) error {
+		app.sideWidget.Toggle()
+		return nil
+	}); err != nil {
+		return
+	}
+	if err = app.ui.SetKeybinding("side", 'o', gocui.ModNone, func(gui *gocui.Gui, view *gocui.View) error {
+		app.cycleSort()
+		app.updateSummary()
+		return nil
+	}); err != nil {
+		return
+	}
+	if err = app.ui.SetKeybinding("side", 's', gocui.ModNone, func(gui *gocui.Gui, view *gocui.View) error {
+		app.openPrompt(promptSearch)
+		return nil
+	}); err != nil {
+		return
+	}
+	if err = app.ui.SetKeybinding("side", 'n', gocui.ModNone, func(gui *gocui.Gui, view *gocui.View) error {
+		app.setMessage("")
+		_ = app.findNext(app.state.searchQuery(), 1)
+		app.updateSummary()
+		return nil
+	}); err != nil {
+		return
+	}
+	if err = app.ui.SetKeybinding("side", 'N', gocui.ModNone, func(gui *gocui.Gui, view *gocui.View) error {
+		app.setMessage("")
+		_ = app.findNext(app.state.searchQuery(), -1)
+		app.updateSummary()
+		return nil
+	}); err != nil {
+		return
+	}
 	if err = app.ui.SetKeybinding("", gocui.KeyTab, gocui.ModNone, func(gui *gocui.Gui, view *gocui.View) error {
+		if app.inputWidget.Active() {
+			return nil
+		}
 		if view != nil {
 			if view.Name() == "side" {
 				_, _ = gui.SetCurrentView("main")
@@ -184,14 +1265,15 @@ func (app *App) render() (err error) {
 	if err = app.initLayout(); err != nil {
 		return
 	}
-	app.ui.SetManager(app.sideWidget, app.contentWidget, app.footerWidget)
+	app.ui.SetManager(gocui.ManagerFunc(app.layout), app.sideWidget, app.contentWidget, app.footerWidget, app.inputWidget)
+	app.ui.InputEsc = true
 	app.ui.Highlight = true
 	app.ui.SelFgColor = gocui.ColorGreen
 	err = app.initKeybindings()
 	return
 }
 
-func (app *App) Run(ctx context.Context, iface string) (err error) {
+func (app *App) Run(ctx context.Context) (err error) {
 	app.ctx, app.cancelFun = context.WithCancel(ctx)
 	defer func() {
 		app.cancelFun()
@@ -205,9 +1287,14 @@ func (app *App) Run(ctx context.Context, iface string) (err error) {
 	if err = app.render(); err != nil {
 		return
 	}
-	if err = app.initCapture(iface); err != nil {
+	if err = app.initCapture(); err != nil {
 		return
 	}
+	defer func() {
+		if app.capture != nil {
+			_ = app.capture.Stop()
+		}
+	}()
 	app.updateSummary()
 	go app.ioLoop()
 	if err = app.ui.MainLoop(); err != nil {
@@ -218,9 +1305,22 @@ func (app *App) Run(ctx context.Context, iface string) (err error) {
 	return
 }
 
-func NewApp(filter *Filter) *App {
+func (app *App) WithProto(registry *grpc.Registry) *App {
+	app.registry = registry
+	return app
+}
+
+// WithRetention evicts the oldest exchanges of the list once one of the limits is hit.
+func (app *App) WithRetention(retention Retention) *App {
+	app.retention = retention
+	return app
+}
+
+func NewApp(capture *Capture) *App {
 	return &App{
-		state:  &State{},
-		filter: filter,
+		state:   &State{},
+		capture: capture,
+		sockets: make(map[*http.Response]*packet),
+		stats:   &stats{},
 	}
 }
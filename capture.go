@@ -1,46 +1,208 @@
 package httpcap
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"fmt"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/pcapgo"
 	"github.com/google/gopacket/reassembly"
 	"github.com/uole/httpcap/http"
+	"github.com/uole/httpcap/internal/decoder"
+	httpDecoder "github.com/uole/httpcap/internal/decoder/http"
+	mysqlDecoder "github.com/uole/httpcap/internal/decoder/mysql"
+	postgresDecoder "github.com/uole/httpcap/internal/decoder/postgres"
+	redisDecoder "github.com/uole/httpcap/internal/decoder/redis"
 	"github.com/uole/httpcap/internal/factory"
 	tcpFactory "github.com/uole/httpcap/internal/factory/tcp"
+	iopkg "github.com/uole/httpcap/internal/io"
+	"github.com/uole/httpcap/redis"
+	"github.com/uole/httpcap/sql"
+	"github.com/uole/httpcap/tls"
+	"github.com/uole/httpcap/websocket"
+	"io"
+	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
-type Capture struct {
-	ctx        context.Context
-	iface      string
-	snaplen    int
-	filter     *Filter
-	packChan   chan gopacket.Packet
-	handle     *pcap.Handle
-	handleFunc factory.HandleFunc
+const (
+	//time the assembler waits for the retransmission of missing bytes before they are skipped
+	gapTimeout = 10 * time.Second
+)
+
+var (
+	pcapngMagic = []byte{0x0A, 0x0D, 0x0D, 0x0A}
+)
+
+type (
+	Capture struct {
+		ctx           context.Context
+		iface         string
+		file          string
+		snaplen       int
+		filter        *Filter
+		packChan      chan gopacket.Packet
+		handle        *pcap.Handle
+		fp            *os.File
+		streamFactory *tcpFactory.Factory
+		doneChan      chan struct{}
+		handleFunc    factory.HandleFunc
+		messageFunc   factory.MessageFunc
+		handshakeFunc factory.HandshakeFunc
+		exchangeFunc  factory.ExchangeFunc
+		keylog        *tls.KeyLog
+		registry      *decoder.Registry
+		metrics       *Metrics
+		limits        factory.Limits
+		workers       int
+		packets       int64
+		truncated     int64
+		gapExchanges  int64
+		//capture time of the latest packet in unix nanoseconds
+		lastSeen int64
+		running  int32
+	}
+
+	// CaptureStats describes the health of the capture, the received and dropped
+	// packets are reported by libpcap and only known for live captures.
+	CaptureStats struct {
+		Packets          int64
+		PacketsReceived  int64
+		PacketsDropped   int64
+		PacketsIfDropped int64
+		ActiveStreams    int64
+		ParseErrors      int64
+		BufferedBytes    int64
+		//bodies which were cut at the max body size
+		TruncatedBodies int64
+		//bytes of the connections which were dropped, either after a parse error or once a buffer limit was hit
+		DroppedBytes int64
+		//responses which did not arrive in time
+		Timeouts int64
+		//holes in the connections which were skipped by the assembler and their bytes
+		Gaps         int64
+		SkippedBytes int64
+		//exchanges whose data had gaps, e.g. http requests or sql queries
+		GapExchanges int64
+	}
+
+	bpfSource struct {
+		source gopacket.PacketDataSource
+		bpf    *pcap.BPF
+	}
+)
+
+func (s *bpfSource) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	for {
+		if data, ci, err = s.source.ReadPacketData(); err != nil {
+			return
+		}
+		if s.bpf.Matches(ci, data) {
+			return
+		}
+	}
 }
 
-func (cap *Capture) process(req *http.Request, res *http.Response) {
-	if !cap.filter.Match(req.Host) {
+func (cap *Capture) process(req *http.Request, res *http.Response) (accepted bool) {
+	if !cap.filter.Match(req, res) {
 		req.Release()
 		res.Release()
-		return
+		return false
+	}
+	//the handlers may release the request
+	if cap.metrics != nil {
+		cap.metrics.observe(req, res)
 	}
 	if cap.handleFunc != nil {
 		cap.handleFunc(req, res)
 	}
+	return true
+}
+
+func (cap *Capture) processMessage(req *http.Request, res *http.Response, msg *websocket.Message, accepted bool) {
+	//messages belong to the handshake, they are dropped together with the handshake
+	if !accepted {
+		return
+	}
+	if cap.messageFunc != nil {
+		cap.messageFunc(req, res, msg)
+	}
+}
+
+// emit hands the exchanges of the decoders to the handlers.
+func (cap *Capture) emit(e decoder.Exchange) {
+	switch v := e.(type) {
+	case *httpDecoder.Exchange:
+		if v.Request.Truncated {
+			atomic.AddInt64(&cap.truncated, 1)
+		}
+		if v.Response.Truncated {
+			atomic.AddInt64(&cap.truncated, 1)
+		}
+		if v.Request.Gap || v.Response.Gap {
+			atomic.AddInt64(&cap.gapExchanges, 1)
+		}
+		v.Accepted = cap.process(v.Request, v.Response)
+	case *httpDecoder.Message:
+		cap.processMessage(v.Request, v.Response, v.Message, v.Handshake != nil && v.Handshake.Accepted)
+	default:
+		switch v := e.(type) {
+		case *redis.Command:
+			if v.Gap {
+				atomic.AddInt64(&cap.gapExchanges, 1)
+			}
+		case *sql.Query:
+			if v.Gap {
+				atomic.AddInt64(&cap.gapExchanges, 1)
+			}
+		}
+		if !cap.filter.MatchExchange(e) {
+			return
+		}
+		if cap.metrics != nil {
+			cap.metrics.observeExchange(e)
+		}
+		if cap.exchangeFunc != nil {
+			cap.exchangeFunc(e)
+		}
+	}
+}
+
+func (cap *Capture) processHandshake(hs *tls.Handshake) {
+	if !cap.filter.MatchHandshake(hs) {
+		return
+	}
+	if cap.metrics != nil {
+		cap.metrics.observeHandshake(hs)
+	}
+	if cap.handshakeFunc != nil {
+		cap.handshakeFunc(hs)
+	}
+}
+
+// clock returns the capture time of the latest packet, the decoders of a capture file time out on it.
+func (cap *Capture) clock() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&cap.lastSeen))
 }
 
 func (cap *Capture) ioLoop(assembler *reassembly.Assembler) {
-	ticker := time.NewTicker(time.Minute)
+	var (
+		lastSeen time.Time
+	)
+	ticker := time.NewTicker(gapTimeout)
 	defer func() {
 		ticker.Stop()
 		assembler.FlushAll()
+		if cap.Offline() {
+			cap.streamFactory.Wait()
+			close(cap.doneChan)
+		}
 	}()
 	for {
 		select {
@@ -48,11 +210,23 @@ func (cap *Capture) ioLoop(assembler *reassembly.Assembler) {
 			if pkg == nil {
 				return
 			}
+			atomic.AddInt64(&cap.packets, 1)
 			if tcp, ok := pkg.TransportLayer().(*layers.TCP); ok {
-				assembler.AssembleWithContext(pkg.NetworkLayer().NetworkFlow(), tcp, &AssemblerContext{captureInfo: pkg.Metadata().CaptureInfo})
+				ci := pkg.Metadata().CaptureInfo
+				if ci.Timestamp.After(lastSeen) {
+					lastSeen = ci.Timestamp
+					atomic.StoreInt64(&cap.lastSeen, lastSeen.UnixNano())
+				}
+				assembler.AssembleWithContext(pkg.NetworkLayer().NetworkFlow(), tcp, &AssemblerContext{captureInfo: ci})
 			}
 		case <-ticker.C:
-			assembler.FlushCloseOlderThan(time.Now().Add(time.Minute * -3))
+			//packet timestamps of a capture file have nothing to do with the wall clock
+			now := time.Now()
+			if cap.Offline() {
+				now = lastSeen
+			}
+			//missing bytes are skipped once they have not been retransmitted for a while, idle connections are closed
+			assembler.FlushWithOptions(reassembly.FlushOptions{T: now.Add(-gapTimeout), TC: now.Add(time.Minute * -3)})
 		case <-cap.ctx.Done():
 			return
 		}
@@ -71,18 +245,17 @@ func (cap *Capture) grantRules() []string {
 	return rules
 }
 
-func (cap *Capture) WithHandle(f factory.HandleFunc) *Capture {
-	cap.handleFunc = f
-	return cap
+func (cap *Capture) bpfFilter() string {
+	if cap.filter.BPF != "" {
+		return cap.filter.BPF
+	}
+	return strings.Join(cap.grantRules(), " and ")
 }
 
-func (cap *Capture) Start(ctx context.Context) (err error) {
+func (cap *Capture) openLive() (source gopacket.PacketDataSource, linkType layers.LinkType, err error) {
 	var (
-		ifs       []pcap.Interface
-		rules     []string
-		assembler *reassembly.Assembler
+		ifs []pcap.Interface
 	)
-	cap.ctx = ctx
 	if cap.iface == "" {
 		if ifs, err = pcap.FindAllDevs(); err != nil {
 			return
@@ -94,38 +267,205 @@ func (cap *Capture) Start(ctx context.Context) (err error) {
 	if cap.handle, err = pcap.OpenLive(cap.iface, int32(cap.snaplen), true, pcap.BlockForever); err != nil {
 		return
 	}
-	if cap.filter.BPF != "" {
-		if err = cap.handle.SetBPFFilter(cap.filter.BPF); err != nil {
+	if err = cap.handle.SetBPFFilter(cap.bpfFilter()); err != nil {
+		return
+	}
+	return cap.handle, cap.handle.LinkType(), nil
+}
+
+func (cap *Capture) openFile() (source gopacket.PacketDataSource, linkType layers.LinkType, err error) {
+	var (
+		magic []byte
+	)
+	if cap.fp, err = os.Open(cap.file); err != nil {
+		return
+	}
+	br := bufio.NewReader(cap.fp)
+	if magic, err = br.Peek(len(pcapngMagic)); err != nil {
+		if err == io.EOF {
+			err = fmt.Errorf("%s: not a pcap file", cap.file)
+		}
+		return
+	}
+	if bytes.Equal(magic, pcapngMagic) {
+		var r *pcapgo.NgReader
+		if r, err = pcapgo.NewNgReader(br, pcapgo.DefaultNgReaderOptions); err != nil {
 			return
 		}
+		source, linkType = r, r.LinkType()
 	} else {
-		rules = cap.grantRules()
-		if len(rules) > 0 {
-			bpf := strings.Join(rules, " and ")
-			if err = cap.handle.SetBPFFilter(bpf); err != nil {
-				return
-			}
+		var r *pcapgo.Reader
+		if r, err = pcapgo.NewReader(br); err != nil {
+			return
+		}
+		source, linkType = r, r.LinkType()
+	}
+	//only tcp packets are assembled, so the default rule is not worth compiling
+	if cap.filter.BPF != "" || len(cap.grantRules()) > 1 {
+		var bpf *pcap.BPF
+		if bpf, err = pcap.NewBPF(linkType, cap.snaplen, cap.bpfFilter()); err != nil {
+			return
 		}
+		source = &bpfSource{source: source, bpf: bpf}
+	}
+	return
+}
+
+func (cap *Capture) WithHandle(f factory.HandleFunc) *Capture {
+	cap.handleFunc = f
+	return cap
+}
+
+func (cap *Capture) WithMessageHandle(f factory.MessageFunc) *Capture {
+	cap.messageFunc = f
+	return cap
+}
+
+// WithDecoder adds the decoder of a protocol, connections are sniffed by the decoders
+// in the order they were added, HTTP comes first.
+func (cap *Capture) WithDecoder(d decoder.Decoder) *Capture {
+	cap.registry.Register(d)
+	return cap
+}
+
+// WithExchangeHandle receives the exchanges of the decoders of other protocols than http, e.g. redis.
+func (cap *Capture) WithExchangeHandle(f factory.ExchangeFunc) *Capture {
+	cap.exchangeFunc = f
+	return cap
+}
+
+// WithHandshakeHandle receives the handshakes of tls connections which are not decrypted.
+func (cap *Capture) WithHandshakeHandle(f factory.HandshakeFunc) *Capture {
+	cap.handshakeFunc = f
+	return cap
+}
+
+// WithLimits bounds the memory of the capture, larger bodies are truncated and the data of
+// connections whose decoder does not keep up is dropped.
+func (cap *Capture) WithLimits(limits factory.Limits) *Capture {
+	cap.limits = limits
+	return cap
+}
+
+// WithWorkers bounds the decoders which parse at the same time, 0 is 4 per cpu.
+func (cap *Capture) WithWorkers(n int) *Capture {
+	cap.workers = n
+	return cap
+}
+
+// WithKeyLog decrypts https connections with the secrets of the key log.
+func (cap *Capture) WithKeyLog(keylog *tls.KeyLog) *Capture {
+	cap.keylog = keylog
+	return cap
+}
+
+// Metrics returns the metrics of the captured requests, it has to be called before the capture starts.
+func (cap *Capture) Metrics() *Metrics {
+	if cap.metrics == nil {
+		cap.metrics = NewMetrics(cap)
 	}
-	streamFactory := tcpFactory.New(cap.ctx, cap.process)
-	streamPool := reassembly.NewStreamPool(streamFactory)
+	return cap.metrics
+}
+
+// Stats returns the health of the capture.
+func (cap *Capture) Stats() (stats CaptureStats) {
+	stats.Packets = atomic.LoadInt64(&cap.packets)
+	stats.BufferedBytes = iopkg.Buffered()
+	stats.TruncatedBodies = atomic.LoadInt64(&cap.truncated)
+	stats.GapExchanges = atomic.LoadInt64(&cap.gapExchanges)
+	//the handle and the factory are created by start
+	if atomic.LoadInt32(&cap.running) == 0 {
+		return
+	}
+	if cap.handle != nil {
+		if ps, err := cap.handle.Stats(); err == nil {
+			stats.PacketsReceived = int64(ps.PacketsReceived)
+			stats.PacketsDropped = int64(ps.PacketsDropped)
+			stats.PacketsIfDropped = int64(ps.PacketsIfDropped)
+		}
+	}
+	fs := cap.streamFactory.Stats()
+	stats.ActiveStreams, stats.ParseErrors, stats.DroppedBytes = fs.ActiveStreams, fs.ParseErrors, fs.DroppedBytes
+	stats.Timeouts, stats.Gaps, stats.SkippedBytes = fs.Timeouts, fs.Gaps, fs.SkippedBytes
+	return
+}
+
+func (cap *Capture) Offline() bool {
+	return cap.file != ""
+}
+
+func (cap *Capture) Name() string {
+	if cap.Offline() {
+		return cap.file
+	}
+	return cap.iface
+}
+
+// Done is closed once a capture file has been read to the end and every stream
+// of it has been parsed, live captures never finish on their own.
+func (cap *Capture) Done() <-chan struct{} {
+	return cap.doneChan
+}
+
+func (cap *Capture) Start(ctx context.Context) (err error) {
+	var (
+		source    gopacket.PacketDataSource
+		linkType  layers.LinkType
+		assembler *reassembly.Assembler
+	)
+	cap.ctx = ctx
+	if err = cap.filter.Compile(); err != nil {
+		return
+	}
+	if cap.Offline() {
+		source, linkType, err = cap.openFile()
+	} else {
+		source, linkType, err = cap.openLive()
+	}
+	if err != nil {
+		return
+	}
+	cap.streamFactory = tcpFactory.New(cap.ctx, cap.registry, cap.emit).WithHandshakeHandle(cap.processHandshake).WithKeyLog(cap.keylog).WithLimits(cap.limits).WithWorkers(cap.workers)
+	if cap.Offline() {
+		cap.streamFactory.WithClock(cap.clock)
+	}
+	streamPool := reassembly.NewStreamPool(cap.streamFactory)
 	assembler = reassembly.NewAssembler(streamPool)
-	source := gopacket.NewPacketSource(cap.handle, cap.handle.LinkType())
-	source.NoCopy = true
-	cap.packChan = source.Packets()
+	packetSource := gopacket.NewPacketSource(source, linkType)
+	packetSource.NoCopy = true
+	cap.packChan = packetSource.Packets()
+	atomic.StoreInt32(&cap.running, 1)
 	go cap.ioLoop(assembler)
 	return
 }
 
 func (cap *Capture) Stop() (err error) {
-	cap.handle.Close()
+	atomic.StoreInt32(&cap.running, 0)
+	if cap.handle != nil {
+		cap.handle.Close()
+	}
+	if cap.fp != nil {
+		err = cap.fp.Close()
+	}
 	return
 }
 
 func NewCapture(iface string, snaplen int, filter *Filter) *Capture {
 	return &Capture{
-		iface:   iface,
-		snaplen: snaplen,
-		filter:  filter,
+		iface:    iface,
+		snaplen:  snaplen,
+		filter:   filter,
+		doneChan: make(chan struct{}),
+		registry: decoder.NewRegistry(httpDecoder.New(), redisDecoder.New(), postgresDecoder.New(), mysqlDecoder.New()),
+	}
+}
+
+func NewOfflineCapture(file string, filter *Filter) *Capture {
+	return &Capture{
+		file:     file,
+		snaplen:  65535,
+		filter:   filter,
+		doneChan: make(chan struct{}),
+		registry: decoder.NewRegistry(httpDecoder.New(), redisDecoder.New(), postgresDecoder.New(), mysqlDecoder.New()),
 	}
 }
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/uole/httpcap"
+	"github.com/uole/httpcap/http"
+	"net"
+	"os"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	connsFlag    = flag.Int("conns", 5000, "keep-alive connections of the synthetic capture")
+	requestsFlag = flag.Int("requests", 20, "requests of every connection")
+	bodyFlag     = flag.Int("body", 1024, "bytes of every response body")
+	pcapFlag     = flag.String("r", "", "benchmark a pcap file instead of the synthetic capture")
+	keepFlag     = flag.Bool("keep", false, "keep the synthetic capture file")
+)
+
+type (
+	// conn is a tcp connection of the synthetic capture.
+	conn struct {
+		client, server       *net.TCPAddr
+		clientSeq, serverSeq uint32
+	}
+
+	// writer writes the packets of the synthetic capture with ascending timestamps.
+	writer struct {
+		w  *pcapgo.Writer
+		at time.Time
+	}
+)
+
+func (w *writer) write(src, dst *net.TCPAddr, seq, ack uint32, flags string, payload []byte) error {
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		DstMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 6},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: src.IP, DstIP: dst.IP}
+	tcp := &layers.TCP{
+		SrcPort: layers.TCPPort(src.Port),
+		DstPort: layers.TCPPort(dst.Port),
+		Seq:     seq,
+		Ack:     ack,
+		SYN:     strings.Contains(flags, "S"),
+		FIN:     strings.Contains(flags, "F"),
+		ACK:     strings.Contains(flags, "A"),
+		PSH:     len(payload) > 0,
+		Window:  65535,
+	}
+	_ = tcp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, eth, ip, tcp, gopacket.Payload(payload)); err != nil {
+		return err
+	}
+	w.at = w.at.Add(10 * time.Microsecond)
+	b := buf.Bytes()
+	return w.w.WritePacket(gopacket.CaptureInfo{Timestamp: w.at, CaptureLength: len(b), Length: len(b)}, b)
+}
+
+// generate writes a capture of keep-alive connections which are open at the same time,
+// every connection sends a request in turn, so most of them are idle between two requests.
+func generate(name string, conns, requests, bodySize int) (err error) {
+	var (
+		fp *os.File
+	)
+	if fp, err = os.Create(name); err != nil {
+		return
+	}
+	defer func() {
+		_ = fp.Close()
+	}()
+	w := &writer{w: pcapgo.NewWriter(fp), at: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	if err = w.w.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+		return
+	}
+	body := strings.Repeat("x", bodySize)
+	response := []byte("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: " + strconv.Itoa(bodySize) + "\r\n\r\n" + body)
+	list := make([]*conn, conns)
+	for i := range list {
+		c := &conn{
+			client:    &net.TCPAddr{IP: net.IPv4(10, 1, byte(i>>8), byte(i)).To4(), Port: 40000 + i%20000},
+			server:    &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 80},
+			clientSeq: 1000,
+			serverSeq: 5000,
+		}
+		list[i] = c
+		if err = w.write(c.client, c.server, c.clientSeq, 0, "S", nil); err != nil {
+			return
+		}
+		if err = w.write(c.server, c.client, c.serverSeq, c.clientSeq+1, "SA", nil); err != nil {
+			return
+		}
+		c.clientSeq++
+		c.serverSeq++
+		if err = w.write(c.client, c.server, c.clientSeq, c.serverSeq, "A", nil); err != nil {
+			return
+		}
+	}
+	for r := 0; r < requests; r++ {
+		for i, c := range list {
+			request := []byte("GET /api/items/" + strconv.Itoa(r) + "?conn=" + strconv.Itoa(i) + " HTTP/1.1\r\nHost: bench.example.com\r\nUser-Agent: bench\r\n\r\n")
+			if err = w.write(c.client, c.server, c.clientSeq, c.serverSeq, "A", request); err != nil {
+				return
+			}
+			c.clientSeq += uint32(len(request))
+			if err = w.write(c.server, c.client, c.serverSeq, c.clientSeq, "A", response); err != nil {
+				return
+			}
+			c.serverSeq += uint32(len(response))
+		}
+	}
+	for _, c := range list {
+		if err = w.write(c.client, c.server, c.clientSeq, c.serverSeq, "FA", nil); err != nil {
+			return
+		}
+		if err = w.write(c.server, c.client, c.serverSeq, c.clientSeq+1, "FA", nil); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// sample records the peak of the goroutines and of the memory of the heap and the stacks until stop is closed.
+func sample(stop chan struct{}, goroutines *int64, memory *uint64) {
+	var (
+		stats runtime.MemStats
+	)
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if n := int64(runtime.NumGoroutine()); n > atomic.LoadInt64(goroutines) {
+				atomic.StoreInt64(goroutines, n)
+			}
+			runtime.ReadMemStats(&stats)
+			if n := stats.HeapInuse + stats.StackInuse; n > atomic.LoadUint64(memory) {
+				atomic.StoreUint64(memory, n)
+			}
+		}
+	}
+}
+
+func main() {
+	var (
+		err        error
+		count      int64
+		goroutines int64
+		memory     uint64
+		before     runtime.MemStats
+		after      runtime.MemStats
+		info       os.FileInfo
+	)
+	flag.Parse()
+	name := *pcapFlag
+	if name == "" {
+		name = path.Join(os.TempDir(), "httpcap-bench.pcap")
+		if err = generate(name, *connsFlag, *requestsFlag, *bodyFlag); err != nil {
+			fmt.Println("generate capture: " + err.Error())
+			os.Exit(1)
+		}
+		if !*keepFlag {
+			defer func() {
+				_ = os.Remove(name)
+			}()
+		}
+	}
+	if info, err = os.Stat(name); err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+	capture := httpcap.NewOfflineCapture(name, &httpcap.Filter{}).WithHandle(func(req *http.Request, res *http.Response) {
+		atomic.AddInt64(&count, 1)
+		req.Release()
+		res.Release()
+	})
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	stop := make(chan struct{})
+	go sample(stop, &goroutines, &memory)
+	startedAt := time.Now()
+	if err = capture.Start(context.Background()); err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+	<-capture.Done()
+	elapsed := time.Since(startedAt)
+	close(stop)
+	runtime.ReadMemStats(&after)
+	_ = capture.Stop()
+	fmt.Printf("capture      %s (%.1f MB)\n", name, float64(info.Size())/1024/1024)
+	fmt.Printf("requests     %d\n", count)
+	fmt.Printf("elapsed      %s\n", elapsed.Round(time.Millisecond))
+	fmt.Printf("throughput   %.0f requests/s, %.1f MB/s\n", float64(count)/elapsed.Seconds(), float64(info.Size())/1024/1024/elapsed.Seconds())
+	//only http/1.x connections are parked, other protocols keep a goroutine per connection
+	fmt.Printf("goroutines   %d peak of http/1.x connections\n", atomic.LoadInt64(&goroutines))
+	fmt.Printf("memory       %.1f MB peak of heap and stacks in use, %.1f MB allocated\n", float64(atomic.LoadUint64(&memory))/1024/1024, float64(after.TotalAlloc-before.TotalAlloc)/1024/1024)
+}
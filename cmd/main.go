@@ -6,13 +6,20 @@ import (
 	"fmt"
 	"github.com/google/gopacket/pcap"
 	"github.com/uole/httpcap"
+	"github.com/uole/httpcap/grpc"
+	"github.com/uole/httpcap/internal/factory"
+	"github.com/uole/httpcap/store"
+	"github.com/uole/httpcap/tls"
 	"github.com/uole/httpcap/version"
+	"io"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
 	"regexp"
 	"strconv"
+	"syscall"
 	"time"
 )
 
@@ -21,14 +28,33 @@ var (
 )
 
 var (
-	ifaceFlag   = flag.String("i", "", "name or index of interface")
-	filterFlag  = flag.String("f", "", "BPF filter in libpcap filter syntax")
-	portFlag    = flag.Int("p", 0, "filter source or target port")
-	ipFlag      = flag.String("ip", "", "filter source or target ip")
-	hostFlag    = flag.String("host", "", "filter http request host, using wildcard match(*)")
-	versionFlag = flag.Bool("v", false, "display version info and exit")
-	deviceFlag  = flag.Bool("l", false, "list of interfaces and exit")
-	pprofFlag   = flag.Bool("pprof", false, "Enable http debug pprof")
+	ifaceFlag       = flag.String("i", "", "name or index of interface")
+	readFlag        = flag.String("r", "", "read packets from pcap or pcapng file")
+	filterFlag      = flag.String("f", "", "BPF filter in libpcap filter syntax")
+	portFlag        = flag.Int("p", 0, "filter source or target port")
+	ipFlag          = flag.String("ip", "", "filter source or target ip")
+	hostFlag        = flag.String("host", "", "filter http request host, using wildcard match(*)")
+	exprFlag        = flag.String("filter", "", "display filter expression, e.g. method == \"POST\" && status >= 500")
+	versionFlag     = flag.Bool("v", false, "display version info and exit")
+	deviceFlag      = flag.Bool("l", false, "list of interfaces and exit")
+	pprofFlag       = flag.Bool("pprof", false, "Enable http debug pprof")
+	metricsFlag     = flag.Bool("metrics", false, "serve prometheus metrics of the captured requests at /metrics")
+	listenFlag      = flag.String("listen", ":8080", "listen address of the pprof and metrics server")
+	headlessFlag    = flag.Bool("headless", false, "write captured requests as JSON lines instead of starting the terminal ui")
+	outputFlag      = flag.String("o", "", "output file of headless mode, default is stdout")
+	formatFlag      = flag.String("format", httpcap.FormatJSONLines, "output format of headless mode, jsonl or har")
+	protoFlag       = flag.String("proto", "", "directory of .proto files or a serialized FileDescriptorSet used to decode gRPC messages")
+	keylogFlag      = flag.String("tls-keylog", "", "key log file in NSS format (SSLKEYLOGFILE) used to decrypt https connections")
+	maxBodyFlag     = flag.Int("max-body", 4096, "max body size written in headless mode, larger bodies are replaced by sha256 digest")
+	bodyLimitFlag   = flag.Int("body-limit", 16<<20, "max bytes of a request or response body kept in memory, larger bodies are truncated, 0 is unlimited")
+	streamLimitFlag = flag.Int("stream-limit", 64<<20, "max bytes buffered per direction of a tcp stream before its data is dropped, 0 is unlimited")
+	memoryLimitFlag = flag.Int64("memory-limit", 1<<30, "max bytes buffered by all tcp streams before their data is dropped, 0 is unlimited")
+	workersFlag     = flag.Int("workers", 0, "max http connections parsed at the same time, 0 is 4 per cpu")
+	retainFlag      = flag.Int("retain", 100000, "max requests kept by the terminal ui, the oldest ones are evicted, 0 is unlimited")
+	retainSizeFlag  = flag.Int64("retain-size", 1<<30, "max bytes of the bodies kept by the terminal ui, the oldest requests are evicted, 0 is unlimited")
+	retainAgeFlag   = flag.Duration("retain-age", 0, "max age of the requests kept by the terminal ui, e.g. 1h, 0 is unlimited")
+	storeFlag       = flag.String("store", "", "persist the requests of the terminal ui into a session file, only their headers are kept in memory")
+	openFlag        = flag.String("open", "", "reopen a session file written with -store instead of capturing")
 )
 
 func printInterface(ins []pcap.Interface) {
@@ -54,56 +80,163 @@ func printInterface(ins []pcap.Interface) {
 	}
 }
 
+// serve starts the debug server, pprof and the metrics share the listen address.
+func serve(capture *httpcap.Capture) {
+	mux := http.NewServeMux()
+	if *pprofFlag {
+		mux.Handle("/debug/pprof/", http.DefaultServeMux)
+	}
+	if *metricsFlag {
+		mux.Handle("/metrics", capture.Metrics())
+	}
+	go func() {
+		if err := http.ListenAndServe(*listenFlag, mux); err != nil {
+			fmt.Fprintln(os.Stderr, "listen "+*listenFlag+": "+err.Error())
+		}
+	}()
+}
+
+func runHeadless(capture *httpcap.Capture, registry *grpc.Registry) (err error) {
+	var (
+		w io.Writer
+	)
+	ctx, cancelFunc := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancelFunc()
+	if *outputFlag != "" {
+		var fp *os.File
+		if fp, err = os.Create(*outputFlag); err != nil {
+			return
+		}
+		defer func() {
+			_ = fp.Close()
+		}()
+		w = fp
+	} else {
+		w = os.Stdout
+	}
+	return httpcap.NewHeadless(capture, w).WithMaxBodySize(*maxBodyFlag).WithFormat(*formatFlag).WithProto(registry).Run(ctx)
+}
+
+// runApp starts the terminal ui, capture is nil when a session file is reopened.
+func runApp(capture *httpcap.Capture, registry *grpc.Registry) (err error) {
+	var (
+		s *store.Store
+	)
+	switch {
+	case *openFlag != "":
+		s, err = store.Open(*openFlag)
+	case *storeFlag != "":
+		s, err = store.Create(*storeFlag)
+	}
+	if err != nil {
+		return
+	}
+	app := httpcap.NewApp(capture).WithProto(registry).WithRetention(httpcap.Retention{
+		MaxEntries:  *retainFlag,
+		MaxBodySize: *retainSizeFlag,
+		MaxAge:      *retainAgeFlag,
+	})
+	if s != nil {
+		defer func() {
+			_ = s.Close()
+		}()
+		app.WithStore(s)
+	}
+	return app.Run(context.Background())
+}
+
 func main() {
 	var (
-		err   error
-		iface string
-		ins   []pcap.Interface
+		err      error
+		iface    string
+		ins      []pcap.Interface
+		capture  *httpcap.Capture
+		registry *grpc.Registry
+		keylog   *tls.KeyLog
 	)
 	flag.Parse()
 	if *versionFlag {
 		fmt.Println(version.Info())
 		os.Exit(0)
 	}
-	if ins, err = pcap.FindAllDevs(); err != nil {
+	filter := &httpcap.Filter{
+		IP:         *ipFlag,
+		Port:       *portFlag,
+		Host:       *hostFlag,
+		BPF:        *filterFlag,
+		Expression: *exprFlag,
+	}
+	if err = filter.Compile(); err != nil {
 		fmt.Println(err.Error())
 		os.Exit(1)
 	}
-	if *deviceFlag {
-		printInterface(ins)
-		os.Exit(0)
+	if *protoFlag != "" {
+		if registry, err = grpc.LoadDescriptors(*protoFlag); err != nil {
+			fmt.Println("load proto descriptors: " + err.Error())
+			os.Exit(1)
+		}
 	}
-	if *pprofFlag {
-		go func() {
-			_ = http.ListenAndServe(":8080", nil)
-		}()
+	if *keylogFlag != "" {
+		if keylog, err = tls.OpenKeyLog(*keylogFlag); err != nil {
+			fmt.Println("load tls key log: " + err.Error())
+			os.Exit(1)
+		}
 	}
-	if numReg.MatchString(*ifaceFlag) {
-		i, _ := strconv.Atoi(*ifaceFlag)
-		if i < len(ins) {
-			iface = ins[i].Name
+	if *openFlag != "" {
+		if err = runApp(nil, registry); err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
 		}
+		return
+	}
+	if *readFlag != "" {
+		capture = httpcap.NewOfflineCapture(*readFlag, filter)
 	} else {
-		for _, i := range ins {
-			if i.Name == *ifaceFlag {
-				iface = i.Name
-				break
+		if ins, err = pcap.FindAllDevs(); err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		if *deviceFlag {
+			printInterface(ins)
+			os.Exit(0)
+		}
+		if numReg.MatchString(*ifaceFlag) {
+			i, _ := strconv.Atoi(*ifaceFlag)
+			if i < len(ins) {
+				iface = ins[i].Name
 			}
+		} else {
+			for _, i := range ins {
+				if i.Name == *ifaceFlag {
+					iface = i.Name
+					break
+				}
+			}
+		}
+		if iface == "" {
+			printInterface(ins)
+			os.Exit(0)
 		}
+		if !*headlessFlag {
+			fmt.Println(iface)
+			time.Sleep(time.Second)
+		}
+		capture = httpcap.NewCapture(iface, 65535, filter)
 	}
-	if iface == "" {
-		printInterface(ins)
-		os.Exit(0)
+	capture.WithKeyLog(keylog).WithLimits(factory.Limits{
+		MaxBodySize:     *bodyLimitFlag,
+		MaxStreamBuffer: *streamLimitFlag,
+		MaxMemory:       *memoryLimitFlag,
+	}).WithWorkers(*workersFlag)
+	if *pprofFlag || *metricsFlag {
+		serve(capture)
 	}
-	fmt.Println(iface)
-	time.Sleep(time.Second)
-	app := httpcap.NewApp(&httpcap.Filter{
-		IP:   *ipFlag,
-		Port: *portFlag,
-		Host: *hostFlag,
-		BPF:  *filterFlag,
-	})
-	if err = app.Run(context.Background(), iface); err != nil {
+	if *headlessFlag {
+		err = runHeadless(capture, registry)
+	} else {
+		err = runApp(capture, registry)
+	}
+	if err != nil {
 		fmt.Println(err.Error())
 		os.Exit(1)
 	}
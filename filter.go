@@ -1,26 +1,353 @@
 package httpcap
 
-import "strings"
+import (
+	"fmt"
+	"github.com/uole/httpcap/http"
+	"github.com/uole/httpcap/internal/decoder"
+	"github.com/uole/httpcap/internal/expr"
+	"github.com/uole/httpcap/redis"
+	"github.com/uole/httpcap/sql"
+	"github.com/uole/httpcap/tls"
+	"math"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
 
-type Filter struct {
-	IP   string `json:"ip"`
-	Port int    `json:"port"`
-	Host string `json:"host"`
-	BPF  string `json:"bpf"`
-}
+var (
+	filterFields = map[string]expr.Field{
+		"method":          {Kind: expr.KindString},
+		"host":            {Kind: expr.KindString},
+		"path":            {Kind: expr.KindString},
+		"uri":             {Kind: expr.KindString},
+		"query":           {Kind: expr.KindString},
+		"proto":           {Kind: expr.KindString},
+		"client":          {Kind: expr.KindString},
+		"server":          {Kind: expr.KindString},
+		"content_type":    {Kind: expr.KindString},
+		"body":            {Kind: expr.KindString},
+		"request_body":    {Kind: expr.KindString},
+		"header":          {Kind: expr.KindString, Indexed: true},
+		"response_header": {Kind: expr.KindString, Indexed: true},
+		"status":          {Kind: expr.KindNumber},
+		"size":            {Kind: expr.KindNumber},
+		"request_size":    {Kind: expr.KindNumber},
+		"duration":        {Kind: expr.KindDuration},
+		"ttfb":            {Kind: expr.KindDuration},
+		"sni":             {Kind: expr.KindString},
+		"ja3":             {Kind: expr.KindString},
+		"ja4":             {Kind: expr.KindString},
+		"db":              {Kind: expr.KindString},
+		"rows":            {Kind: expr.KindNumber},
+		"error":           {Kind: expr.KindString},
+	}
 
-func (filter *Filter) Match(host string) bool {
-	if len(host) == 0 {
-		return false
+	statusClassReg = regexp.MustCompile(`^[1-5]xx$`)
+
+	queryMethods = map[string]bool{
+		"GET":     true,
+		"POST":    true,
+		"PUT":     true,
+		"DELETE":  true,
+		"HEAD":    true,
+		"TRACE":   true,
+		"OPTIONS": true,
+		"PATCH":   true,
+		"CONNECT": true,
 	}
-	if len(filter.Host) == 0 || filter.Host == "*" {
-		return true
+)
+
+type (
+	Filter struct {
+		IP          string `json:"ip"`
+		Port        int    `json:"port"`
+		Host        string `json:"host"`
+		BPF         string `json:"bpf"`
+		Expression  string `json:"expression"`
+		expressions []*expr.Expression
+	}
+
+	exchange struct {
+		req *http.Request
+		res *http.Response
+	}
+
+	// handshake is a tls connection which is not decrypted, it has no request.
+	handshake struct {
+		hs *tls.Handshake
+	}
+
+	command struct {
+		cmd *redis.Command
+	}
+
+	statement struct {
+		q *sql.Query
 	}
-	if pos := strings.IndexByte(host, ':'); pos > -1 {
+
+	MatchFunc func(r expr.Resolver) bool
+)
+
+func hostname(host string) string {
+	if pos := strings.LastIndexByte(host, ':'); pos > -1 && !strings.HasSuffix(host, "]") {
 		host = host[:pos]
 	}
-	if host[0] == '*' {
-		return strings.HasSuffix(host, filter.Host[1:])
+	return host
+}
+
+func requestPath(uri string) (path, query string) {
+	if u, err := url.ParseRequestURI(uri); err == nil {
+		return u.Path, u.RawQuery
+	}
+	if pos := strings.IndexByte(uri, '?'); pos > -1 {
+		return uri[:pos], uri[pos+1:]
+	}
+	return uri, ""
+}
+
+func (e *exchange) Resolve(name, key string) interface{} {
+	switch name {
+	case "method":
+		return e.req.Method
+	case "host":
+		return hostname(e.req.Host)
+	case "path":
+		path, _ := requestPath(e.req.RequestURI)
+		return path
+	case "uri":
+		return e.req.RequestURI
+	case "query":
+		_, query := requestPath(e.req.RequestURI)
+		return query
+	case "proto":
+		return e.req.Proto
+	case "client":
+		return e.req.Address
+	case "server":
+		return e.res.Address
+	case "content_type":
+		return e.res.Header.Get("Content-Type")
+	case "body":
+		return string(e.res.DecodedBody())
+	case "request_body":
+		return string(e.req.DecodedBody())
+	case "header":
+		return e.req.Header.Get(key)
+	case "response_header":
+		return e.res.Header.Get(key)
+	case "status":
+		return e.res.StatusCode
+	case "size":
+		return len(e.res.DecodedBody())
+	case "request_size":
+		return len(e.req.DecodedBody())
+	case "duration":
+		return e.res.Latency()
+	case "ttfb":
+		return e.res.TimeToFirstByte()
+	}
+	return nil
+}
+
+func (h *handshake) Resolve(name, key string) interface{} {
+	switch name {
+	case "host", "sni":
+		return h.hs.ServerName
+	case "proto":
+		return h.hs.VersionName()
+	case "client":
+		return h.hs.Client
+	case "server":
+		return h.hs.Server
+	case "ja3":
+		return h.hs.JA3
+	case "ja4":
+		return h.hs.JA4
+	}
+	return nil
+}
+
+func (c *command) Resolve(name, key string) interface{} {
+	switch name {
+	case "method":
+		return c.cmd.Name()
+	case "host":
+		return hostname(c.cmd.Server)
+	case "uri":
+		return c.cmd.Line(math.MaxInt32)
+	case "proto":
+		return "RESP"
+	case "client":
+		return c.cmd.Client
+	case "server":
+		return c.cmd.Server
+	case "body":
+		if c.cmd.Reply != nil {
+			return c.cmd.Reply.Text()
+		}
+	case "size":
+		if c.cmd.Reply != nil {
+			return c.cmd.Reply.Size()
+		}
+	case "request_size":
+		return c.cmd.Size()
+	case "duration":
+		return c.cmd.Latency()
+	case "ttfb":
+		return c.cmd.TimeToFirstByte()
+	}
+	return nil
+}
+
+func (s *statement) Resolve(name, key string) interface{} {
+	switch name {
+	case "method":
+		return s.q.Verb()
+	case "host":
+		return hostname(s.q.Server)
+	case "uri":
+		return s.q.Text
+	case "proto":
+		return s.q.DialectName()
+	case "client":
+		return s.q.Client
+	case "server":
+		return s.q.Server
+	case "db":
+		return s.q.Database
+	case "rows":
+		return s.q.Rows
+	case "error":
+		return s.q.Error
+	case "request_size":
+		return s.q.Size
+	case "duration":
+		return s.q.Latency()
+	case "ttfb":
+		return s.q.TimeToFirstByte()
+	}
+	return nil
+}
+
+// resolver returns the fields of an exchange of a decoder, nil if the protocol has no fields.
+func resolver(e decoder.Exchange) expr.Resolver {
+	switch v := e.(type) {
+	case *redis.Command:
+		return &command{cmd: v}
+	case *sql.Query:
+		return &statement{q: v}
+	}
+	return nil
+}
+
+// quote returns s as a string literal of the filter language, which only escapes quotes and backslashes.
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// hostExpression translates the -host wildcard syntax into the filter language.
+func hostExpression(host string) string {
+	if strings.Contains(host, "*") {
+		pattern := strings.ReplaceAll(regexp.QuoteMeta(host), `\*`, ".*")
+		return "host ~ " + quote("^"+pattern+"$")
+	}
+	return "host == " + quote(host)
+}
+
+func (filter *Filter) Compile() (err error) {
+	var (
+		e *expr.Expression
+	)
+	filter.expressions = filter.expressions[:0]
+	if filter.Host != "" && filter.Host != "*" {
+		if e, err = expr.Compile(hostExpression(filter.Host), filterFields); err != nil {
+			return fmt.Errorf("invalid host filter %q: %w", filter.Host, err)
+		}
+		filter.expressions = append(filter.expressions, e)
+	}
+	if filter.Expression != "" {
+		if e, err = expr.Compile(filter.Expression, filterFields); err != nil {
+			return fmt.Errorf("invalid filter %q: %w", filter.Expression, err)
+		}
+		filter.expressions = append(filter.expressions, e)
+	}
+	return
+}
+
+func (filter *Filter) match(r expr.Resolver) bool {
+	for _, e := range filter.expressions {
+		if !e.Match(r) {
+			return false
+		}
 	}
-	return host == filter.Host
+	return true
+}
+
+func (filter *Filter) Match(req *http.Request, res *http.Response) bool {
+	return filter.match(&exchange{req: req, res: res})
+}
+
+func (filter *Filter) MatchHandshake(hs *tls.Handshake) bool {
+	return filter.match(&handshake{hs: hs})
+}
+
+func (filter *Filter) MatchExchange(e decoder.Exchange) bool {
+	if r := resolver(e); r != nil {
+		return filter.match(r)
+	}
+	return len(filter.expressions) == 0
+}
+
+func matchTerm(term string, r expr.Resolver) bool {
+	switch v := r.(type) {
+	case *handshake:
+		//a tls connection only has the server name
+		return strings.Contains(strings.ToLower(v.hs.ServerName), strings.ToLower(term))
+	case *command:
+		//a redis command matches its name or a part of its arguments
+		return strings.EqualFold(v.cmd.Name(), term) || strings.Contains(strings.ToLower(v.cmd.Line(math.MaxInt32)), strings.ToLower(term))
+	case *statement:
+		//a query matches its verb or a part of its text
+		return strings.EqualFold(v.q.Verb(), term) || strings.Contains(strings.ToLower(v.q.Text), strings.ToLower(term))
+	}
+	ex := r.(*exchange)
+	req, res := ex.req, ex.res
+	switch {
+	case queryMethods[term]:
+		return req.Method == term
+	case statusClassReg.MatchString(term):
+		return res.StatusCode/100 == int(term[0]-'0')
+	}
+	if status, err := strconv.Atoi(term); err == nil && status >= 100 && status <= 599 {
+		return res.StatusCode == status
+	}
+	term = strings.ToLower(term)
+	return strings.Contains(strings.ToLower(req.Host), term) || strings.Contains(strings.ToLower(req.RequestURI), term)
+}
+
+// CompileQuery compiles the query typed in the terminal ui, the query is either a filter expression
+// or space separated terms which match a method, a status (404, 5xx) or a substring of the host and path.
+func CompileQuery(query string) (f MatchFunc, err error) {
+	var (
+		e *expr.Expression
+	)
+	if query = strings.TrimSpace(query); query == "" {
+		return nil, nil
+	}
+	if strings.ContainsAny(query, "=<>~!&|()\"") {
+		if e, err = expr.Compile(query, filterFields); err != nil {
+			return
+		}
+		return e.Match, nil
+	}
+	terms := strings.Fields(query)
+	return func(r expr.Resolver) bool {
+		for _, term := range terms {
+			if !matchTerm(term, r) {
+				return false
+			}
+		}
+		return true
+	}, nil
 }
@@ -0,0 +1,44 @@
+package httpcap
+
+import (
+	"github.com/uole/httpcap/http"
+	"testing"
+)
+
+func TestHostFilter(t *testing.T) {
+	tests := []struct {
+		host    string
+		matched []string
+		missed  []string
+	}{
+		{host: "example.com", matched: []string{"example.com", "example.com:8080"}, missed: []string{"api.example.com", "example.org"}},
+		{host: "*.example.com", matched: []string{"api.example.com", "a.b.example.com:443"}, missed: []string{"example.com", "api.example.com.evil"}},
+		{host: "api.*.com", matched: []string{"api.example.com"}, missed: []string{"apixexample.com", "www.example.com"}},
+		//dots of the pattern are no wildcards
+		{host: "a.c", matched: []string{"a.c"}, missed: []string{"abc"}},
+		//quotes and backslashes have to survive the string literal of the expression
+		{host: `ex"ample`, matched: []string{`ex"ample`}, missed: []string{"example"}},
+		{host: `ex\ample`, matched: []string{`ex\ample`}, missed: []string{"example", `ex\\ample`}},
+		{host: `*\"`, matched: []string{`a\"`}, missed: []string{`a"`, `a\`}},
+		{host: `ex\`, matched: []string{`ex\`}, missed: []string{"ex"}},
+		{host: `"`, matched: []string{`"`}, missed: []string{""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			filter := &Filter{Host: tt.host}
+			if err := filter.Compile(); err != nil {
+				t.Fatalf("%s: %v", hostExpression(tt.host), err)
+			}
+			for _, host := range tt.matched {
+				if !filter.Match(&http.Request{Host: host}, &http.Response{}) {
+					t.Errorf("%q is not matched by %s", host, hostExpression(tt.host))
+				}
+			}
+			for _, host := range tt.missed {
+				if filter.Match(&http.Request{Host: host}, &http.Response{}) {
+					t.Errorf("%q is matched by %s", host, hostExpression(tt.host))
+				}
+			}
+		})
+	}
+}
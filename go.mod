@@ -3,19 +3,25 @@ module github.com/uole/httpcap
 go 1.17
 
 require (
+	github.com/andybalholm/brotli v1.0.4
 	github.com/fatih/color v1.13.0
 	github.com/google/gopacket v1.1.19
+	github.com/jhump/protoreflect v1.12.0
 	github.com/jroimartin/gocui v0.5.0
+	github.com/klauspost/compress v1.15.9
 	github.com/valyala/bytebufferpool v1.0.0
+	golang.org/x/crypto v0.6.0
+	golang.org/x/net v0.7.0
+	google.golang.org/protobuf v1.28.1
 )
 
 require (
-	github.com/asmcos/requests v0.0.0-20210319030608-c839e8ae4946 // indirect
-	github.com/corpix/uarand v0.0.0-20170723150923-031be390f409 // indirect
-	github.com/icrowley/fake v0.0.0-20220625154756-3c7517006344 // indirect
+	github.com/golang/protobuf v1.5.0 // indirect
 	github.com/mattn/go-colorable v0.1.9 // indirect
 	github.com/mattn/go-isatty v0.0.14 // indirect
 	github.com/mattn/go-runewidth v0.0.9 // indirect
 	github.com/nsf/termbox-go v1.1.1 // indirect
-	golang.org/x/sys v0.0.0-20210630005230-0f9fa26af87c // indirect
+	golang.org/x/sys v0.5.0 // indirect
+	golang.org/x/text v0.7.0 // indirect
+	google.golang.org/genproto v0.0.0-20200526211855-cb27e3aa2013 // indirect
 )
@@ -0,0 +1,214 @@
+package grpc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/uole/httpcap/http"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var (
+	statusNames = []string{
+		"OK",
+		"CANCELLED",
+		"UNKNOWN",
+		"INVALID_ARGUMENT",
+		"DEADLINE_EXCEEDED",
+		"NOT_FOUND",
+		"ALREADY_EXISTS",
+		"PERMISSION_DENIED",
+		"RESOURCE_EXHAUSTED",
+		"FAILED_PRECONDITION",
+		"ABORTED",
+		"OUT_OF_RANGE",
+		"UNIMPLEMENTED",
+		"INTERNAL",
+		"UNAVAILABLE",
+		"DATA_LOSS",
+		"UNAUTHENTICATED",
+	}
+)
+
+type (
+	Message struct {
+		Compressed bool
+		Data       []byte
+	}
+
+	Payload struct {
+		Size       int             `json:"size"`
+		Compressed bool            `json:"compressed,omitempty"`
+		JSON       json.RawMessage `json:"json,omitempty"`
+		Raw        string          `json:"raw,omitempty"`
+		Error      string          `json:"error,omitempty"`
+	}
+
+	Call struct {
+		Service    string     `json:"service"`
+		Method     string     `json:"method"`
+		Status     *int       `json:"status,omitempty"`
+		StatusName string     `json:"status_name,omitempty"`
+		Message    string     `json:"message,omitempty"`
+		Requests   []*Payload `json:"requests"`
+		Responses  []*Payload `json:"responses"`
+		Error      string     `json:"error,omitempty"`
+	}
+)
+
+func IsGRPC(contentType string) bool {
+	return contentType == "application/grpc" || strings.HasPrefix(contentType, "application/grpc+") || strings.HasPrefix(contentType, "application/grpc;")
+}
+
+// SplitPath returns the service and method of a request path like /helloworld.Greeter/SayHello.
+func SplitPath(path string) (service, method string) {
+	path = strings.TrimPrefix(path, "/")
+	if pos := strings.LastIndexByte(path, '/'); pos > -1 {
+		return path[:pos], path[pos+1:]
+	}
+	return path, ""
+}
+
+func StatusName(code int) string {
+	if code >= 0 && code < len(statusNames) {
+		return statusNames[code]
+	}
+	return "CODE(" + strconv.Itoa(code) + ")"
+}
+
+// ReadMessages splits a body into its length prefixed messages, compressed messages
+// are inflated according to the grpc-encoding of the sender.
+func ReadMessages(body []byte, encoding string) (messages []Message, err error) {
+	for len(body) > 0 {
+		if len(body) < 5 {
+			return messages, fmt.Errorf("truncated message prefix of %d bytes", len(body))
+		}
+		m := Message{Compressed: body[0] == 1}
+		size := binary.BigEndian.Uint32(body[1:5])
+		if uint64(len(body)-5) < uint64(size) {
+			return messages, fmt.Errorf("truncated message, %d of %d bytes", len(body)-5, size)
+		}
+		m.Data = body[5 : 5+size]
+		body = body[5+size:]
+		if m.Compressed {
+			if m.Data, err = decompress(encoding, m.Data); err != nil {
+				return
+			}
+		}
+		messages = append(messages, m)
+	}
+	return
+}
+
+func decompress(encoding string, b []byte) ([]byte, error) {
+	switch encoding {
+	case "gzip":
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			_ = r.Close()
+		}()
+		return io.ReadAll(r)
+	default:
+		return nil, fmt.Errorf("unsupported grpc-encoding %q", encoding)
+	}
+}
+
+func newPayloads(body []byte, encoding string, decode func(b []byte) ([]byte, error)) (payloads []*Payload, err error) {
+	var (
+		messages []Message
+	)
+	payloads = make([]*Payload, 0)
+	messages, err = ReadMessages(body, encoding)
+	for _, m := range messages {
+		p := &Payload{Size: len(m.Data), Compressed: m.Compressed}
+		if b, e := decode(m.Data); e == nil {
+			p.JSON = b
+		} else {
+			p.Error = e.Error()
+			p.Raw = Dump(m.Data)
+		}
+		payloads = append(payloads, p)
+	}
+	return
+}
+
+// NewCall decodes the gRPC call of an exchange, it returns nil if the exchange is not gRPC.
+// Messages are rendered as JSON when the registry knows the method, otherwise as a raw wire dump.
+func NewCall(req *http.Request, res *http.Response, registry *Registry) *Call {
+	var (
+		err error
+	)
+	if !IsGRPC(req.Header.Get("Content-Type")) {
+		return nil
+	}
+	call := &Call{}
+	path := req.RequestURI
+	call.Service, call.Method = SplitPath(path)
+	if call.Requests, err = newPayloads(req.Body, req.Header.Get("Grpc-Encoding"), func(b []byte) ([]byte, error) {
+		return registry.Decode(path, b, true)
+	}); err != nil {
+		call.Error = "request: " + err.Error()
+	}
+	if call.Responses, err = newPayloads(res.Body, res.Header.Get("Grpc-Encoding"), func(b []byte) ([]byte, error) {
+		return registry.Decode(path, b, false)
+	}); err != nil {
+		call.Error = "response: " + err.Error()
+	}
+	//trailers-only responses carry the status in the headers
+	for _, header := range []map[string][]string{res.Trailer, res.Header} {
+		if values, ok := header["Grpc-Status"]; ok && len(values) > 0 {
+			if code, err := strconv.Atoi(values[0]); err == nil {
+				call.Status = &code
+				call.StatusName = StatusName(code)
+			}
+			if values = header["Grpc-Message"]; len(values) > 0 {
+				call.Message, _ = url.PathUnescape(values[0])
+			}
+			break
+		}
+	}
+	return call
+}
+
+func writePayloads(w io.Writer, title string, payloads []*Payload) {
+	_, _ = fmt.Fprintf(w, "%s (%d)\n", title, len(payloads))
+	for i, p := range payloads {
+		_, _ = fmt.Fprintf(w, "#%d %d bytes", i+1, p.Size)
+		if p.Compressed {
+			_, _ = io.WriteString(w, " compressed")
+		}
+		_, _ = io.WriteString(w, "\n")
+		if p.JSON != nil {
+			_, _ = w.Write(p.JSON)
+			_, _ = io.WriteString(w, "\n")
+		} else {
+			_, _ = io.WriteString(w, p.Raw)
+		}
+	}
+}
+
+func (call *Call) WriteTo(w io.Writer) (n int64, err error) {
+	buf := &bytes.Buffer{}
+	_, _ = fmt.Fprintf(buf, "gRPC %s/%s", call.Service, call.Method)
+	if call.Status != nil {
+		_, _ = fmt.Fprintf(buf, "  status %d %s", *call.Status, call.StatusName)
+	}
+	if call.Message != "" {
+		_, _ = fmt.Fprintf(buf, "  message %q", call.Message)
+	}
+	_, _ = buf.WriteString("\n")
+	if call.Error != "" {
+		_, _ = fmt.Fprintf(buf, "malformed %s\n", call.Error)
+	}
+	writePayloads(buf, "Request messages", call.Requests)
+	writePayloads(buf, "Response messages", call.Responses)
+	return buf.WriteTo(w)
+}
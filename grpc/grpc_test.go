@@ -0,0 +1,290 @@
+package grpc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/uole/httpcap/http"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	nethttp "net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	testProto = `syntax = "proto3";
+package test;
+
+message Point {
+  int32 x = 1;
+  int32 y = 2;
+}
+
+message Route {
+  string name = 1;
+  repeated Point points = 2;
+  repeated int32 ids = 3;
+}
+
+service Router {
+  rpc Get(Point) returns (Route);
+}
+`
+)
+
+// frame prefixes a message with its compressed flag and length.
+func frame(compressed bool, b []byte) []byte {
+	prefix := make([]byte, 5)
+	if compressed {
+		prefix[0] = 1
+	}
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(b)))
+	return append(prefix, b...)
+}
+
+func gzipped(b []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, _ = w.Write(b)
+	_ = w.Close()
+	return buf.Bytes()
+}
+
+func point(x, y int32) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(x))
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(y))
+}
+
+// route is a message with a string, a repeated embedded message and a packed repeated field.
+func route(name string, ids ...uint64) []byte {
+	var b, packed []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, name)
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	b = protowire.AppendBytes(b, point(1, 2))
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	b = protowire.AppendBytes(b, point(3, 4))
+	for _, id := range ids {
+		packed = protowire.AppendVarint(packed, id)
+	}
+	b = protowire.AppendTag(b, 3, protowire.BytesType)
+	return protowire.AppendBytes(b, packed)
+}
+
+func newRegistry(t *testing.T) *Registry {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "route.proto"), []byte(testProto), 0644); err != nil {
+		t.Fatal(err)
+	}
+	registry, err := LoadDescriptors(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return registry
+}
+
+// compact removes the whitespace of JSON, protojson varies it on purpose.
+func compact(t *testing.T, b []byte) string {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, b); err != nil {
+		t.Fatalf("%s: %v", b, err)
+	}
+	return buf.String()
+}
+
+func TestReadMessages(t *testing.T) {
+	join := func(b ...[]byte) []byte {
+		return bytes.Join(b, nil)
+	}
+	tests := []struct {
+		name     string
+		body     []byte
+		encoding string
+		want     []string
+		err      string
+	}{
+		{name: "empty"},
+		{name: "messages", body: join(frame(false, []byte("a")), frame(false, nil), frame(false, []byte("bc"))), want: []string{"a", "", "bc"}},
+		{name: "gzip", body: join(frame(true, gzipped([]byte("hello"))), frame(false, []byte("plain"))), encoding: "gzip", want: []string{"hello", "plain"}},
+		{name: "unknown encoding", body: join(frame(false, []byte("a")), frame(true, []byte("packed"))), encoding: "snappy", want: []string{"a"}, err: `unsupported grpc-encoding "snappy"`},
+		{name: "corrupt gzip", body: frame(true, []byte("this is not gzip")), encoding: "gzip", err: "gzip: invalid header"},
+		{name: "truncated prefix", body: join(frame(false, []byte("a")), []byte{0, 0, 0}), want: []string{"a"}, err: "truncated message prefix of 3 bytes"},
+		{name: "truncated message", body: frame(false, []byte("abcdef"))[:8], err: "truncated message, 3 of 6 bytes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messages, err := ReadMessages(tt.body, tt.encoding)
+			if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("error is %v, want %q", err, tt.err)
+			}
+			if len(messages) != len(tt.want) {
+				t.Fatalf("%d messages are read, want %d", len(messages), len(tt.want))
+			}
+			for i, m := range messages {
+				if string(m.Data) != tt.want[i] {
+					t.Errorf("message %d is %q, want %q", i, m.Data, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRegistryDecode(t *testing.T) {
+	registry := newRegistry(t)
+	tests := []struct {
+		name    string
+		path    string
+		b       []byte
+		request bool
+		want    string
+		err     error
+	}{
+		{name: "request", path: "/test.Router/Get", b: point(5, 0), request: true, want: `{"x":5,"y":0}`},
+		{name: "response", path: "/test.Router/Get", b: route("a", 7, 300), want: `{"name":"a","points":[{"x":1,"y":2},{"x":3,"y":4}],"ids":[7,300]}`},
+		{name: "unknown service", path: "/test.Other/Get", err: ErrNoDescriptor},
+		{name: "unknown method", path: "/test.Router/Put", err: ErrNoDescriptor},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := registry.Decode(tt.path, tt.b, tt.request)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Errorf("error is %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := compact(t, b); got != tt.want {
+				t.Errorf("json is %s, want %s", got, tt.want)
+			}
+		})
+	}
+	//a message which does not match the descriptor
+	if _, err := registry.Decode("/test.Router/Get", []byte{0x0a, 0x05, 'a'}, false); err == nil {
+		t.Error("truncated message is decoded")
+	}
+	var empty *Registry
+	if _, err := empty.Decode("/test.Router/Get", nil, true); !errors.Is(err, ErrNoDescriptor) {
+		t.Errorf("error without descriptors is %v, want %v", err, ErrNoDescriptor)
+	}
+}
+
+func TestLoadDescriptorSet(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "route.proto"), []byte(testProto), 0644); err != nil {
+		t.Fatal(err)
+	}
+	set, err := parseProto(dir, "route.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := proto.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, "route.pb")
+	if err = os.WriteFile(name, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	registry, err := LoadDescriptors(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err = registry.Decode("/test.Router/Get", point(1, 2), true); err != nil || compact(t, b) != `{"x":1,"y":2}` {
+		t.Errorf("json is %s (%v)", b, err)
+	}
+	if _, err = LoadDescriptors(filepath.Join(dir, "route.proto")); err != nil {
+		t.Errorf("single file: %v", err)
+	}
+	if err = os.WriteFile(name, []byte("not a descriptor set"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = LoadDescriptors(name); err == nil {
+		t.Error("garbage is loaded as a descriptor set")
+	}
+}
+
+func TestDump(t *testing.T) {
+	var fixed []byte
+	fixed = protowire.AppendTag(fixed, 4, protowire.Fixed32Type)
+	fixed = protowire.AppendFixed32(fixed, 0xdeadbeef)
+	fixed = protowire.AppendTag(fixed, 5, protowire.Fixed64Type)
+	fixed = protowire.AppendFixed64(fixed, 1)
+	tests := []struct {
+		name string
+		b    []byte
+		want string
+	}{
+		{
+			//embedded messages are indented, packed fields are not messages and dumped as bytes
+			name: "nested and packed",
+			b:    route("a", 1, 2, 300),
+			want: "1: \"a\"\n2 {\n  1: 1\n  2: 2\n}\n2 {\n  1: 3\n  2: 4\n}\n3: 0x0102ac02\n",
+		},
+		{
+			name: "deeply nested",
+			b:    []byte{0x0a, 0x04, 0x0a, 0x02, 0x08, 0x01},
+			want: "1 {\n  1 {\n    1: 1\n  }\n}\n",
+		},
+		{name: "fixed", b: fixed, want: "4: 0xdeadbeef\n5: 0x0000000000000001\n"},
+		{name: "malformed tag", b: []byte{0x08, 0x01, 0xff}, want: "1: 1\n<malformed 1 bytes>\n"},
+		{name: "malformed bytes", b: []byte{0x0a, 0x05, 'a'}, want: "1: <malformed bytes>\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Dump(tt.b); got != tt.want {
+				t.Errorf("dump is\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewCall(t *testing.T) {
+	registry := newRegistry(t)
+	req := &http.Request{
+		RequestURI: "/test.Router/Get",
+		Header:     nethttp.Header{"Content-Type": {"application/grpc"}, "Grpc-Encoding": {"gzip"}},
+		Body:       frame(true, gzipped(point(1, 2))),
+	}
+	res := &http.Response{
+		Header:  nethttp.Header{"Content-Type": {"application/grpc"}},
+		Body:    frame(false, route("a")),
+		Trailer: nethttp.Header{"Grpc-Status": {"5"}, "Grpc-Message": {"no%20route"}},
+	}
+	call := NewCall(req, res, registry)
+	if call.Service != "test.Router" || call.Method != "Get" || call.Error != "" {
+		t.Fatalf("call is %s/%s (%s)", call.Service, call.Method, call.Error)
+	}
+	if call.Status == nil || *call.Status != 5 || call.StatusName != "NOT_FOUND" || call.Message != "no route" {
+		t.Errorf("status is %v %s %q", call.Status, call.StatusName, call.Message)
+	}
+	if len(call.Requests) != 1 || !call.Requests[0].Compressed || compact(t, call.Requests[0].JSON) != `{"x":1,"y":2}` {
+		t.Errorf("requests are %+v", call.Requests)
+	}
+	if len(call.Responses) != 1 || call.Responses[0].JSON == nil {
+		t.Errorf("responses are %+v", call.Responses)
+	}
+	//without descriptors the messages are dumped
+	if call = NewCall(req, res, nil); call.Requests[0].JSON != nil || call.Requests[0].Raw != "1: 1\n2: 2\n" {
+		t.Errorf("raw request is %q", call.Requests[0].Raw)
+	}
+	//trailers-only responses carry the status in the headers
+	res = &http.Response{Header: nethttp.Header{"Content-Type": {"application/grpc"}, "Grpc-Status": {"12"}}}
+	if call = NewCall(req, res, nil); call.Status == nil || call.StatusName != "UNIMPLEMENTED" || len(call.Responses) != 0 {
+		t.Errorf("status of a trailers-only response is %v %s", call.Status, call.StatusName)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if NewCall(req, res, nil) != nil {
+		t.Error("call of a request which is not gRPC")
+	}
+}
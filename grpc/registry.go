@@ -0,0 +1,125 @@
+package grpc
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/desc/protoparse"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	ErrNoDescriptor = errors.New("no descriptor")
+)
+
+type Registry struct {
+	files *protoregistry.Files
+}
+
+func parseProto(dir string, names ...string) (set *descriptorpb.FileDescriptorSet, err error) {
+	var (
+		fds []*desc.FileDescriptor
+	)
+	parser := protoparse.Parser{ImportPaths: []string{dir}}
+	if fds, err = parser.ParseFiles(names...); err != nil {
+		return
+	}
+	return desc.ToFileDescriptorSet(fds...), nil
+}
+
+// LoadDescriptors loads a directory of .proto files, a single .proto file or a
+// serialized FileDescriptorSet, e.g. the output of protoc --descriptor_set_out.
+func LoadDescriptors(path string) (registry *Registry, err error) {
+	var (
+		info  os.FileInfo
+		buf   []byte
+		set   *descriptorpb.FileDescriptorSet
+		names []string
+	)
+	if info, err = os.Stat(path); err != nil {
+		return
+	}
+	switch {
+	case info.IsDir():
+		if err = filepath.WalkDir(path, func(name string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() && strings.HasSuffix(name, ".proto") {
+				rel, _ := filepath.Rel(path, name)
+				names = append(names, filepath.ToSlash(rel))
+			}
+			return err
+		}); err != nil {
+			return
+		}
+		if len(names) == 0 {
+			return nil, fmt.Errorf("no .proto file found in %s", path)
+		}
+		set, err = parseProto(path, names...)
+	case strings.HasSuffix(path, ".proto"):
+		set, err = parseProto(filepath.Dir(path), filepath.Base(path))
+	default:
+		if buf, err = os.ReadFile(path); err != nil {
+			return
+		}
+		set = &descriptorpb.FileDescriptorSet{}
+		if err = proto.Unmarshal(buf, set); err != nil {
+			return nil, fmt.Errorf("%s is not a FileDescriptorSet: %w", path, err)
+		}
+	}
+	if err != nil {
+		return
+	}
+	registry = &Registry{}
+	if registry.files, err = protodesc.NewFiles(set); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (registry *Registry) method(path string) (md protoreflect.MethodDescriptor, err error) {
+	var (
+		d protoreflect.Descriptor
+	)
+	if registry == nil || registry.files == nil {
+		return nil, ErrNoDescriptor
+	}
+	service, method := SplitPath(path)
+	if d, err = registry.files.FindDescriptorByName(protoreflect.FullName(service)); err != nil {
+		return nil, fmt.Errorf("%w of service %s", ErrNoDescriptor, service)
+	}
+	sd, ok := d.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a service", service)
+	}
+	if md = sd.Methods().ByName(protoreflect.Name(method)); md == nil {
+		return nil, fmt.Errorf("%w of method %s/%s", ErrNoDescriptor, service, method)
+	}
+	return
+}
+
+// Decode renders a message of the method as JSON, request selects the input or the output type.
+func (registry *Registry) Decode(path string, b []byte, request bool) (buf []byte, err error) {
+	var (
+		md protoreflect.MethodDescriptor
+	)
+	if md, err = registry.method(path); err != nil {
+		return
+	}
+	msg := dynamicpb.NewMessage(md.Output())
+	if request {
+		msg = dynamicpb.NewMessage(md.Input())
+	}
+	if err = proto.Unmarshal(b, msg); err != nil {
+		return
+	}
+	return protojson.MarshalOptions{Multiline: true, Indent: "  ", EmitUnpopulated: true}.Marshal(msg)
+}
@@ -0,0 +1,116 @@
+package grpc
+
+import (
+	"bytes"
+	"fmt"
+	"google.golang.org/protobuf/encoding/protowire"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	maxDumpDepth = 16
+)
+
+func isText(b []byte) bool {
+	if !utf8.Valid(b) {
+		return false
+	}
+	for _, r := range string(b) {
+		if r < 0x20 && r != '\n' && r != '\r' && r != '\t' {
+			return false
+		}
+	}
+	return true
+}
+
+// isMessage reports whether b can be consumed entirely as protobuf fields.
+func isMessage(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 || num <= 0 {
+			return false
+		}
+		b = b[n:]
+		if n = protowire.ConsumeFieldValue(num, typ, b); n < 0 {
+			return false
+		}
+		b = b[n:]
+	}
+	return true
+}
+
+func dump(buf *bytes.Buffer, b []byte, depth int) {
+	indent := strings.Repeat("  ", depth)
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			fmt.Fprintf(buf, "%s<malformed %d bytes>\n", indent, len(b))
+			return
+		}
+		b = b[n:]
+		switch typ {
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				fmt.Fprintf(buf, "%s%d: <malformed varint>\n", indent, num)
+				return
+			}
+			fmt.Fprintf(buf, "%s%d: %d\n", indent, num, v)
+			b = b[n:]
+		case protowire.Fixed32Type:
+			v, n := protowire.ConsumeFixed32(b)
+			if n < 0 {
+				fmt.Fprintf(buf, "%s%d: <malformed fixed32>\n", indent, num)
+				return
+			}
+			fmt.Fprintf(buf, "%s%d: 0x%08x\n", indent, num, v)
+			b = b[n:]
+		case protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(b)
+			if n < 0 {
+				fmt.Fprintf(buf, "%s%d: <malformed fixed64>\n", indent, num)
+				return
+			}
+			fmt.Fprintf(buf, "%s%d: 0x%016x\n", indent, num, v)
+			b = b[n:]
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				fmt.Fprintf(buf, "%s%d: <malformed bytes>\n", indent, num)
+				return
+			}
+			//length delimited fields are either strings, bytes or embedded messages
+			switch {
+			case depth < maxDumpDepth && !isText(v) && isMessage(v):
+				fmt.Fprintf(buf, "%s%d {\n", indent, num)
+				dump(buf, v, depth+1)
+				fmt.Fprintf(buf, "%s}\n", indent)
+			case isText(v):
+				fmt.Fprintf(buf, "%s%d: %s\n", indent, num, strconv.Quote(string(v)))
+			default:
+				fmt.Fprintf(buf, "%s%d: 0x%x\n", indent, num, v)
+			}
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				fmt.Fprintf(buf, "%s%d: <malformed group>\n", indent, num)
+				return
+			}
+			fmt.Fprintf(buf, "%s%d: <group %d bytes>\n", indent, num, n)
+			b = b[n:]
+		}
+	}
+}
+
+// Dump renders a message without its descriptor in the format of protoc --decode_raw.
+func Dump(b []byte) string {
+	buf := &bytes.Buffer{}
+	dump(buf, b, 0)
+	return buf.String()
+}
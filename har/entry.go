@@ -0,0 +1,223 @@
+package har
+
+import (
+	"encoding/base64"
+	httpkg "github.com/uole/httpcap/http"
+	"github.com/uole/httpcap/websocket"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func headerList(header http.Header) []NameValue {
+	values := make([]NameValue, 0, len(header))
+	for name, vs := range header {
+		for _, v := range vs {
+			values = append(values, NameValue{Name: name, Value: v})
+		}
+	}
+	sort.SliceStable(values, func(i, j int) bool {
+		return values[i].Name < values[j].Name
+	})
+	return values
+}
+
+func convertCookies(cookies []*http.Cookie) []Cookie {
+	values := make([]Cookie, 0, len(cookies))
+	for _, c := range cookies {
+		cookie := Cookie{
+			Name:     c.Name,
+			Value:    c.Value,
+			Path:     c.Path,
+			Domain:   c.Domain,
+			HTTPOnly: c.HttpOnly,
+			Secure:   c.Secure,
+		}
+		if !c.Expires.IsZero() {
+			cookie.Expires = c.Expires.Format(time.RFC3339)
+		}
+		values = append(values, cookie)
+	}
+	return values
+}
+
+func requestURL(req *httpkg.Request) string {
+	if strings.HasPrefix(req.RequestURI, "http://") || strings.HasPrefix(req.RequestURI, "https://") {
+		return req.RequestURI
+	}
+	host := req.Host
+	if host == "" {
+		host = req.Address
+	}
+	return "http://" + host + req.RequestURI
+}
+
+func queryString(uri string) []NameValue {
+	values := make([]NameValue, 0)
+	u, err := url.ParseRequestURI(uri)
+	if err != nil {
+		return values
+	}
+	for _, kv := range strings.Split(u.RawQuery, "&") {
+		if kv == "" {
+			continue
+		}
+		name, value := kv, ""
+		if pos := strings.IndexByte(kv, '='); pos > -1 {
+			name, value = kv[:pos], kv[pos+1:]
+		}
+		if s, err := url.QueryUnescape(name); err == nil {
+			name = s
+		}
+		if s, err := url.QueryUnescape(value); err == nil {
+			value = s
+		}
+		values = append(values, NameValue{Name: name, Value: value})
+	}
+	return values
+}
+
+func postData(req *httpkg.Request) *PostData {
+	if len(req.Body) == 0 {
+		return nil
+	}
+	data := &PostData{
+		MimeType: req.Header.Get("Content-Type"),
+		Params:   make([]NameValue, 0),
+	}
+	if req.IsBinary() {
+		data.Encoding = "base64"
+		data.Text = base64.StdEncoding.EncodeToString(req.DecodedBody())
+		return data
+	}
+	data.Text = string(req.DecodedBody())
+	if mediaType, _, err := mime.ParseMediaType(data.MimeType); err == nil && mediaType == "application/x-www-form-urlencoded" {
+		if values, err := url.ParseQuery(data.Text); err == nil {
+			for name, vs := range values {
+				for _, v := range vs {
+					data.Params = append(data.Params, NameValue{Name: name, Value: v})
+				}
+			}
+		}
+	}
+	return data
+}
+
+func content(res *httpkg.Response) Content {
+	body := res.DecodedBody()
+	c := Content{
+		Size:     len(body),
+		MimeType: res.Header.Get("Content-Type"),
+	}
+	if len(body) > len(res.Body) {
+		c.Compression = len(body) - len(res.Body)
+	}
+	if len(body) > 0 {
+		if res.IsBinary() {
+			c.Encoding = "base64"
+			c.Text = base64.StdEncoding.EncodeToString(body)
+		} else {
+			c.Text = string(body)
+		}
+	}
+	return c
+}
+
+const (
+	gapComment = "bytes of the exchange were missing in the capture, the bodies may be incomplete"
+)
+
+// truncatedComment describes a body which was cut at the max body size of the capture.
+func truncatedComment(body []byte, size int) string {
+	return "body truncated, " + strconv.Itoa(len(body)) + " of " + strconv.Itoa(size) + " bytes captured"
+}
+
+func milliseconds(from, to time.Time) float64 {
+	if from.IsZero() || to.IsZero() || to.Before(from) {
+		return 0
+	}
+	return float64(to.Sub(from)) / float64(time.Millisecond)
+}
+
+func NewEntry(req *httpkg.Request, res *httpkg.Response) *Entry {
+	entry := &Entry{
+		StartedDateTime: req.StartedAt.Format(time.RFC3339Nano),
+		Time:            milliseconds(req.StartedAt, res.CompletedAt),
+		Request: Request{
+			Method:      req.Method,
+			URL:         requestURL(req),
+			HTTPVersion: req.Proto,
+			Cookies:     convertCookies((&http.Request{Header: req.Header}).Cookies()),
+			Headers:     headerList(req.Header),
+			QueryString: queryString(req.RequestURI),
+			PostData:    postData(req),
+			HeadersSize: -1,
+			BodySize:    len(req.Body),
+		},
+		Response: Response{
+			Status:      res.StatusCode,
+			StatusText:  res.Status,
+			HTTPVersion: res.Proto,
+			Cookies:     convertCookies((&http.Response{Header: res.Header}).Cookies()),
+			Headers:     headerList(res.Header),
+			Content:     content(res),
+			RedirectURL: res.Header.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    len(res.Body),
+		},
+		Timings: Timings{
+			Send:    milliseconds(req.StartedAt, req.CompletedAt),
+			Wait:    milliseconds(req.CompletedAt, res.FirstByteAt),
+			Receive: milliseconds(res.FirstByteAt, res.CompletedAt),
+		},
+	}
+	if req.Truncated {
+		entry.Request.BodySize = req.ContentLength
+		if entry.Request.PostData != nil {
+			entry.Request.PostData.Comment = truncatedComment(req.Body, req.ContentLength)
+		}
+	}
+	if res.Truncated {
+		entry.Response.BodySize = res.ContentLength
+		entry.Response.Content.Comment = truncatedComment(res.Body, res.ContentLength)
+	}
+	if req.Gap || res.Gap {
+		entry.Comment = gapComment
+	}
+	if host, _, err := net.SplitHostPort(res.Address); err == nil {
+		entry.ServerIPAddress = host
+	}
+	if _, port, err := net.SplitHostPort(req.Address); err == nil {
+		entry.Connection = port
+	}
+	return entry
+}
+
+// AppendMessage records a websocket message of the connection, binary payloads are base64 encoded.
+func (entry *Entry) AppendMessage(msg *websocket.Message) {
+	m := WebSocketMessage{
+		Type:   "receive",
+		Time:   float64(msg.Time.UnixNano()) / float64(time.Second),
+		Opcode: msg.Opcode,
+	}
+	if msg.FromClient {
+		m.Type = "send"
+	}
+	if msg.IsBinary() {
+		m.Data = base64.StdEncoding.EncodeToString(msg.Data)
+	} else {
+		m.Data = string(msg.Data)
+	}
+	//the directions are read concurrently, messages are kept in the order of time
+	pos := sort.Search(len(entry.WebSocketMessages), func(i int) bool {
+		return entry.WebSocketMessages[i].Time > m.Time
+	})
+	entry.WebSocketMessages = append(entry.WebSocketMessages, WebSocketMessage{})
+	copy(entry.WebSocketMessages[pos+1:], entry.WebSocketMessages[pos:])
+	entry.WebSocketMessages[pos] = m
+}
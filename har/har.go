@@ -0,0 +1,126 @@
+package har
+
+import (
+	"encoding/json"
+	"github.com/uole/httpcap/version"
+	"io"
+)
+
+type (
+	NameValue struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+
+	Cookie struct {
+		Name     string `json:"name"`
+		Value    string `json:"value"`
+		Path     string `json:"path,omitempty"`
+		Domain   string `json:"domain,omitempty"`
+		Expires  string `json:"expires,omitempty"`
+		HTTPOnly bool   `json:"httpOnly,omitempty"`
+		Secure   bool   `json:"secure,omitempty"`
+	}
+
+	PostData struct {
+		MimeType string      `json:"mimeType"`
+		Params   []NameValue `json:"params"`
+		Text     string      `json:"text"`
+		Encoding string      `json:"encoding,omitempty"`
+		Comment  string      `json:"comment,omitempty"`
+	}
+
+	Content struct {
+		Size        int    `json:"size"`
+		Compression int    `json:"compression,omitempty"`
+		MimeType    string `json:"mimeType"`
+		Text        string `json:"text,omitempty"`
+		Encoding    string `json:"encoding,omitempty"`
+		Comment     string `json:"comment,omitempty"`
+	}
+
+	Request struct {
+		Method      string      `json:"method"`
+		URL         string      `json:"url"`
+		HTTPVersion string      `json:"httpVersion"`
+		Cookies     []Cookie    `json:"cookies"`
+		Headers     []NameValue `json:"headers"`
+		QueryString []NameValue `json:"queryString"`
+		PostData    *PostData   `json:"postData,omitempty"`
+		HeadersSize int         `json:"headersSize"`
+		BodySize    int         `json:"bodySize"`
+	}
+
+	Response struct {
+		Status      int         `json:"status"`
+		StatusText  string      `json:"statusText"`
+		HTTPVersion string      `json:"httpVersion"`
+		Cookies     []Cookie    `json:"cookies"`
+		Headers     []NameValue `json:"headers"`
+		Content     Content     `json:"content"`
+		RedirectURL string      `json:"redirectURL"`
+		HeadersSize int         `json:"headersSize"`
+		BodySize    int         `json:"bodySize"`
+	}
+
+	Cache struct {
+	}
+
+	Timings struct {
+		Send    float64 `json:"send"`
+		Wait    float64 `json:"wait"`
+		Receive float64 `json:"receive"`
+	}
+
+	Entry struct {
+		StartedDateTime string   `json:"startedDateTime"`
+		Time            float64  `json:"time"`
+		Request         Request  `json:"request"`
+		Response        Response `json:"response"`
+		Cache           Cache    `json:"cache"`
+		Timings         Timings  `json:"timings"`
+		ServerIPAddress string   `json:"serverIPAddress,omitempty"`
+		Connection      string   `json:"connection,omitempty"`
+		Comment         string   `json:"comment,omitempty"`
+		//websocket messages in the format of the chrome devtools
+		WebSocketMessages []WebSocketMessage `json:"_webSocketMessages,omitempty"`
+	}
+
+	WebSocketMessage struct {
+		Type   string  `json:"type"`
+		Time   float64 `json:"time"`
+		Opcode int     `json:"opcode"`
+		Data   string  `json:"data"`
+	}
+
+	Creator struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+
+	Log struct {
+		Version string   `json:"version"`
+		Creator Creator  `json:"creator"`
+		Entries []*Entry `json:"entries"`
+	}
+)
+
+func NewLog(entries []*Entry) *Log {
+	if entries == nil {
+		entries = make([]*Entry, 0)
+	}
+	return &Log{
+		Version: "1.2",
+		Creator: Creator{Name: "httpcap", Version: version.Version},
+		Entries: entries,
+	}
+}
+
+func Encode(w io.Writer, entries []*Entry) (err error) {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(struct {
+		Log *Log `json:"log"`
+	}{Log: NewLog(entries)})
+}
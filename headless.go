@@ -0,0 +1,141 @@
+package httpcap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/uole/httpcap/grpc"
+	"github.com/uole/httpcap/har"
+	"github.com/uole/httpcap/http"
+	"github.com/uole/httpcap/internal/decoder"
+	"github.com/uole/httpcap/redis"
+	"github.com/uole/httpcap/sql"
+	"github.com/uole/httpcap/tls"
+	"github.com/uole/httpcap/websocket"
+	"io"
+	"sync"
+)
+
+const (
+	FormatJSONLines = "jsonl"
+	FormatHAR       = "har"
+)
+
+type Headless struct {
+	capture     *Capture
+	mutex       sync.Mutex
+	writer      io.Writer
+	encoder     *json.Encoder
+	format      string
+	entries     []*har.Entry
+	maxBodySize int
+	registry    *grpc.Registry
+	sockets     map[*http.Response]*har.Entry
+}
+
+func (h *Headless) Handle(req *http.Request, res *http.Response) {
+	h.mutex.Lock()
+	if h.format == FormatHAR {
+		entry := har.NewEntry(req, res)
+		if websocket.IsUpgrade(res.Header, res.StatusCode) {
+			h.sockets[res] = entry
+		}
+		h.entries = append(h.entries, entry)
+	} else {
+		record := NewRecord(req, res, h.maxBodySize)
+		record.GRPC = grpc.NewCall(req, res, h.registry)
+		_ = h.encoder.Encode(record)
+	}
+	h.mutex.Unlock()
+	req.Release()
+	res.Release()
+}
+
+// HandleMessage writes a websocket message as its own line, or appends it to the entry of its handshake in a HAR.
+func (h *Headless) HandleMessage(req *http.Request, res *http.Response, msg *websocket.Message) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.format == FormatHAR {
+		if entry, ok := h.sockets[res]; ok {
+			entry.AppendMessage(msg)
+		}
+		return
+	}
+	_ = h.encoder.Encode(NewMessageRecord(req, res, msg, h.maxBodySize))
+}
+
+// HandleHandshake writes a tls connection which is not decrypted, a HAR has no place for it.
+func (h *Headless) HandleHandshake(hs *tls.Handshake) {
+	if h.format == FormatHAR {
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	_ = h.encoder.Encode(NewHandshakeRecord(hs))
+}
+
+// HandleExchange writes the exchanges of other protocols than http, a HAR has no place for them.
+func (h *Headless) HandleExchange(e decoder.Exchange) {
+	if h.format == FormatHAR {
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	switch v := e.(type) {
+	case *redis.Command:
+		_ = h.encoder.Encode(NewCommandRecord(v, h.maxBodySize))
+	case *sql.Query:
+		_ = h.encoder.Encode(NewQueryRecord(v, h.maxBodySize))
+	}
+}
+
+func (h *Headless) WithMaxBodySize(n int) *Headless {
+	h.maxBodySize = n
+	return h
+}
+
+func (h *Headless) WithProto(registry *grpc.Registry) *Headless {
+	h.registry = registry
+	return h
+}
+
+func (h *Headless) WithFormat(format string) *Headless {
+	h.format = format
+	return h
+}
+
+func (h *Headless) Run(ctx context.Context) (err error) {
+	if h.format != FormatJSONLines && h.format != FormatHAR {
+		return fmt.Errorf("unsupported output format %s", h.format)
+	}
+	h.capture.WithHandle(h.Handle).WithMessageHandle(h.HandleMessage).WithHandshakeHandle(h.HandleHandshake).WithExchangeHandle(h.HandleExchange)
+	if err = h.capture.Start(ctx); err != nil {
+		return
+	}
+	defer func() {
+		_ = h.capture.Stop()
+	}()
+	select {
+	case <-ctx.Done():
+	case <-h.capture.Done():
+	}
+	if h.format == FormatHAR {
+		h.mutex.Lock()
+		err = har.Encode(h.writer, h.entries)
+		h.mutex.Unlock()
+	}
+	return
+}
+
+func NewHeadless(capture *Capture, w io.Writer) *Headless {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	return &Headless{
+		capture:     capture,
+		writer:      w,
+		encoder:     encoder,
+		format:      FormatJSONLines,
+		maxBodySize: 4096,
+		sockets:     make(map[*http.Response]*har.Entry),
+	}
+}
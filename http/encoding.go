@@ -0,0 +1,110 @@
+package http
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	maxDecodedSize = 32 * 1024 * 1024
+)
+
+type content struct {
+	done    bool
+	body    []byte
+	err     error
+	binary  int
+	codings []string
+}
+
+func contentCodings(header http.Header) []string {
+	codings := make([]string, 0)
+	for _, v := range header.Values("Content-Encoding") {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.ToLower(strings.TrimSpace(s)); s != "" && s != "identity" {
+				codings = append(codings, s)
+			}
+		}
+	}
+	return codings
+}
+
+func newDecoder(coding string, b []byte) (rc io.ReadCloser, err error) {
+	r := bytes.NewReader(b)
+	switch coding {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(r)
+	case "deflate":
+		//deflate is zlib wrapped according to the RFC, but plenty of servers send a raw deflate stream
+		if rc, err = zlib.NewReader(r); err == nil {
+			return
+		}
+		return flate.NewReader(bytes.NewReader(b)), nil
+	case "br":
+		return io.NopCloser(brotli.NewReader(r)), nil
+	case "zstd":
+		var d *zstd.Decoder
+		if d, err = zstd.NewReader(r, zstd.WithDecoderConcurrency(1)); err != nil {
+			return
+		}
+		return d.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %s", coding)
+	}
+}
+
+func decodeContent(codings []string, b []byte) (body []byte, err error) {
+	var (
+		rc io.ReadCloser
+	)
+	body = b
+	//codings are listed in the order in which they were applied
+	for i := len(codings) - 1; i >= 0; i-- {
+		if rc, err = newDecoder(codings[i], body); err != nil {
+			return b, err
+		}
+		//one byte more than the limit is read to tell a body of the max size from a larger one
+		body, err = io.ReadAll(io.LimitReader(rc, maxDecodedSize+1))
+		_ = rc.Close()
+		if err != nil {
+			return b, err
+		}
+		if len(body) > maxDecodedSize {
+			return b, fmt.Errorf("decoded body is larger than %d MB", maxDecodedSize/1024/1024)
+		}
+	}
+	return
+}
+
+func (c *content) decode(header http.Header, b []byte) {
+	if c.done {
+		return
+	}
+	c.done = true
+	c.body = b
+	if len(b) == 0 {
+		return
+	}
+	if c.codings = contentCodings(header); len(c.codings) > 0 {
+		c.body, c.err = decodeContent(c.codings, b)
+	}
+}
+
+func (c *content) isBinary() bool {
+	if c.binary == 0 {
+		if isBinary(c.body) {
+			c.binary = 1
+		} else {
+			c.binary = -1
+		}
+	}
+	return c.binary == 1
+}
@@ -0,0 +1,134 @@
+package http
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func encode(t *testing.T, coding string, b []byte) []byte {
+	var (
+		buf bytes.Buffer
+		w   io.WriteCloser
+		err error
+	)
+	switch coding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "raw deflate":
+		if w, err = flate.NewWriter(&buf, flate.DefaultCompression); err != nil {
+			t.Fatal(err)
+		}
+	case "br":
+		w = brotli.NewWriter(&buf)
+	case "zstd":
+		if w, err = zstd.NewWriter(&buf); err != nil {
+			t.Fatal(err)
+		}
+	default:
+		t.Fatalf("unknown coding %s", coding)
+	}
+	if _, err = w.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodedBody(t *testing.T) {
+	plain := []byte(strings.Repeat(`{"name":"alice","tags":["a","b"]}`, 100))
+	tests := []struct {
+		name     string
+		header   string
+		codings  []string
+		encoding string
+	}{
+		{name: "gzip", header: "gzip", codings: []string{"gzip"}, encoding: "gzip"},
+		{name: "x-gzip", header: "x-gzip", codings: []string{"gzip"}, encoding: "x-gzip"},
+		{name: "deflate", header: "deflate", codings: []string{"deflate"}, encoding: "deflate"},
+		{name: "raw deflate", header: "deflate", codings: []string{"raw deflate"}, encoding: "deflate"},
+		{name: "brotli", header: "br", codings: []string{"br"}, encoding: "br"},
+		{name: "zstd", header: "zstd", codings: []string{"zstd"}, encoding: "zstd"},
+		{name: "upper case", header: "GZIP", codings: []string{"gzip"}, encoding: "gzip"},
+		{name: "identity", header: "identity, gzip", codings: []string{"gzip"}, encoding: "gzip"},
+		{name: "stacked", header: "gzip, br", codings: []string{"gzip", "br"}, encoding: "gzip, br"},
+		{name: "none"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := plain
+			//codings are applied in the order in which they are listed
+			for _, coding := range tt.codings {
+				body = encode(t, coding, body)
+			}
+			header := http.Header{}
+			if tt.header != "" {
+				header.Set("Content-Encoding", tt.header)
+			}
+			res := &Response{Header: header, Body: body}
+			if err := res.DecodeError(); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(res.DecodedBody(), plain) {
+				t.Errorf("decoded body is %d bytes, want %d", len(res.DecodedBody()), len(plain))
+			}
+			if res.ContentEncoding() != tt.encoding {
+				t.Errorf("encoding is %q, want %q", res.ContentEncoding(), tt.encoding)
+			}
+			req := &Request{Header: header, Body: body}
+			if !bytes.Equal(req.DecodedBody(), plain) {
+				t.Errorf("decoded request body is %d bytes, want %d", len(req.DecodedBody()), len(plain))
+			}
+		})
+	}
+}
+
+func TestDecodedBodyError(t *testing.T) {
+	gzipped := encode(t, "gzip", []byte("hello"))
+	tests := []struct {
+		name   string
+		header string
+		body   []byte
+	}{
+		{name: "unsupported", header: "compress", body: []byte("hello")},
+		{name: "corrupt", header: "gzip", body: []byte("not gzip at all")},
+		{name: "cut", header: "gzip", body: gzipped[:len(gzipped)-6]},
+		{name: "wrong coding", header: "br", body: gzipped},
+		//a partial body is not shown as if it was complete
+		{name: "too large", header: "gzip", body: encode(t, "gzip", make([]byte, maxDecodedSize+1))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := &Response{Header: http.Header{"Content-Encoding": {tt.header}}, Body: tt.body}
+			if res.DecodeError() == nil {
+				t.Error("no decode error")
+			}
+			//the raw body is shown instead
+			if !bytes.Equal(res.DecodedBody(), tt.body) {
+				t.Errorf("decoded body is %q, want the raw body", res.DecodedBody())
+			}
+		})
+	}
+}
+
+func TestDecodedBodyMaxSize(t *testing.T) {
+	body := make([]byte, maxDecodedSize)
+	res := &Response{Header: http.Header{"Content-Encoding": {"gzip"}}, Body: encode(t, "gzip", body)}
+	if err := res.DecodeError(); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.DecodedBody()) != maxDecodedSize {
+		t.Errorf("decoded body is %d bytes, want %d", len(res.DecodedBody()), maxDecodedSize)
+	}
+}
@@ -2,6 +2,7 @@ package http
 
 import (
 	"bufio"
+	"encoding/hex"
 	"fmt"
 	"github.com/uole/httpcap/internal/bytepool"
 	"github.com/valyala/bytebufferpool"
@@ -9,6 +10,8 @@ import (
 	"net/http"
 	"net/textproto"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type Request struct {
@@ -17,9 +20,18 @@ type Request struct {
 	Method        string
 	Host          string
 	Header        http.Header
+	Trailer       http.Header
 	ContentLength int
 	Body          []byte
-	Address       string
+	//the body was cut at the max body size, ContentLength is the size on the wire
+	Truncated bool
+	//bytes of the message were missing in the capture, its body can not be trusted
+	Gap         bool
+	Address     string
+	StreamID    uint32
+	StartedAt   time.Time
+	CompletedAt time.Time
+	content     content
 }
 
 func (r *Request) Release() {
@@ -28,6 +40,35 @@ func (r *Request) Release() {
 	}
 }
 
+// DropBody releases the body and keeps the headers, e.g. once the body is stored on disk.
+func (r *Request) DropBody() {
+	r.Release()
+	r.Body = nil
+	r.content = content{}
+}
+
+// DecodedBody returns the body with its Content-Encoding removed, the raw
+// wire bytes stay in Body.
+func (r *Request) DecodedBody() []byte {
+	r.content.decode(r.Header, r.Body)
+	return r.content.body
+}
+
+func (r *Request) ContentEncoding() string {
+	r.content.decode(r.Header, r.Body)
+	return strings.Join(r.content.codings, ", ")
+}
+
+func (r *Request) DecodeError() error {
+	r.content.decode(r.Header, r.Body)
+	return r.content.err
+}
+
+func (r *Request) IsBinary() bool {
+	r.content.decode(r.Header, r.Body)
+	return r.content.isBinary()
+}
+
 func (r *Request) WriteTo(w io.Writer) (n int64, err error) {
 	writer := bytebufferpool.Get()
 	defer bytebufferpool.Put(writer)
@@ -36,12 +77,23 @@ func (r *Request) WriteTo(w io.Writer) (n int64, err error) {
 	err = r.Header.Write(writer)
 	_, err = writer.WriteString("\r\n")
 	if r.ContentLength > 0 {
-		_, err = writer.Write(r.Body)
+		if !r.IsBinary() {
+			_, err = writer.Write(r.DecodedBody())
+		} else {
+			wc := hex.Dumper(writer)
+			_, _ = wc.Write(r.DecodedBody())
+			_ = wc.Close()
+		}
+	}
+	if len(r.Trailer) > 0 {
+		_, err = writer.WriteString("\r\n")
+		err = r.Trailer.Write(writer)
 	}
 	return writer.WriteTo(w)
 }
 
-func ReadRequest(b *bufio.Reader) (req *Request, err error) {
+// ReadRequest reads a request, only the first maxBodySize bytes of the body are kept when it is above 0.
+func ReadRequest(b *bufio.Reader, maxBodySize int) (req *Request, err error) {
 	var (
 		ok         bool
 		s          string
@@ -76,10 +128,15 @@ func ReadRequest(b *bufio.Reader) (req *Request, err error) {
 		return
 	}
 	req.Host = req.Header.Get("Host")
+	if isChunked(req.Header) {
+		req.Body, req.ContentLength, req.Trailer, err = readChunkedBody(tp, maxBodySize)
+		req.Truncated = len(req.Body) < req.ContentLength
+		return
+	}
 	req.ContentLength, _ = strconv.Atoi(req.Header.Get("Content-Length"))
 	if req.ContentLength > 0 {
-		req.Body = bytepool.Get(req.ContentLength)
-		_, err = io.ReadFull(b, req.Body)
+		req.Body, err = readBody(b, req.ContentLength, maxBodySize)
+		req.Truncated = len(req.Body) < req.ContentLength
 	}
 	return
 }
@@ -0,0 +1,110 @@
+package http
+
+import (
+	"bufio"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadRequestBody(t *testing.T) {
+	//the request which follows on the connection is only read correctly when the body ends at the right byte
+	const next = "GET /next HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	tests := []struct {
+		name      string
+		input     string
+		maxBody   int
+		body      string
+		length    int
+		truncated bool
+		trailer   http.Header
+	}{
+		{
+			name:  "no body",
+			input: "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		},
+		{
+			name:   "content length",
+			input:  "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\n\r\nhello",
+			body:   "hello",
+			length: 5,
+		},
+		{
+			name:   "chunked",
+			input:  "POST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n",
+			body:   "hello world",
+			length: 11,
+		},
+		{
+			name:   "chunk extensions",
+			input:  "POST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n5;name=value\r\nhello\r\n0;last\r\n\r\n",
+			body:   "hello",
+			length: 5,
+		},
+		{
+			name:    "trailer",
+			input:   "POST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\nTrailer: Checksum, Expires\r\n\r\n2\r\nok\r\n0\r\nChecksum: abc\r\nExpires: never\r\n\r\n",
+			body:    "ok",
+			length:  2,
+			trailer: http.Header{"Checksum": {"abc"}, "Expires": {"never"}},
+		},
+		{
+			name:   "chunked after another coding",
+			input:  "POST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: gzip, chunked\r\n\r\n2\r\nok\r\n0\r\n\r\n",
+			body:   "ok",
+			length: 2,
+		},
+		{
+			name:   "chunked overrides content length",
+			input:  "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 100\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nok\r\n0\r\n\r\n",
+			body:   "ok",
+			length: 2,
+		},
+		{
+			name:      "chunked over the max body size",
+			input:     "POST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n6\r\n world\r\n0\r\nChecksum: abc\r\n\r\n",
+			maxBody:   4,
+			body:      "hell",
+			length:    11,
+			truncated: true,
+			trailer:   http.Header{"Checksum": {"abc"}},
+		},
+		{
+			name:      "content length over the max body size",
+			input:     "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 11\r\n\r\nhello world",
+			maxBody:   4,
+			body:      "hell",
+			length:    11,
+			truncated: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			br := bufio.NewReader(strings.NewReader(tt.input + next))
+			req, err := ReadRequest(br, tt.maxBody)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(req.Body) != tt.body || req.ContentLength != tt.length || req.Truncated != tt.truncated {
+				t.Errorf("body is %q of %d bytes, truncated %v", req.Body, req.ContentLength, req.Truncated)
+			}
+			if !reflect.DeepEqual(req.Trailer, tt.trailer) {
+				t.Errorf("trailer is %v, want %v", req.Trailer, tt.trailer)
+			}
+			if req, err = ReadRequest(br, 0); err != nil {
+				t.Fatalf("read next request: %v", err)
+			}
+			if req.RequestURI != "/next" {
+				t.Errorf("next request is %s", req.RequestURI)
+			}
+		})
+	}
+}
+
+func TestReadRequestMalformedChunk(t *testing.T) {
+	br := bufio.NewReader(strings.NewReader("POST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\nhello\r\n0\r\n\r\n"))
+	if _, err := ReadRequest(br, 0); err == nil {
+		t.Error("no error for a malformed chunk size")
+	}
+}
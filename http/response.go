@@ -9,55 +9,72 @@ import (
 	"github.com/valyala/bytebufferpool"
 	"io"
 	"net/http"
-	"net/http/httputil"
 	"net/textproto"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Response struct {
-	Request       *Request
+	Request       *Request `json:"-"`
 	Status        string
 	StatusCode    int
 	Proto         string
 	Header        http.Header
+	Trailer       http.Header
 	Body          []byte
 	ContentLength int
-	Address       string
-	_isBinary     int
+	//the body was cut at the max body size, ContentLength is the size on the wire
+	Truncated bool
+	//bytes of the message were missing in the capture, its body can not be trusted
+	Gap         bool
+	Address     string
+	FirstByteAt time.Time
+	CompletedAt time.Time
+	content     content
 }
 
-func (r *Response) isBinary() bool {
-	var (
-		numOfText int
-	)
-	if r._isBinary == 1 {
-		return true
-	}
-	if r._isBinary == -1 {
-		return false
+func (r *Response) StartedAt() time.Time {
+	if r.Request != nil {
+		return r.Request.StartedAt
 	}
-	length := r.ContentLength
-	if length > 100 {
-		length = 100
-	}
-	for i := 0; i < length; i++ {
-		if r.Body[i] <= 6 || (r.Body[i] >= 14 && r.Body[i] <= 31) {
-			r._isBinary = 1
-			break
-		}
-		if r.Body[i] >= 0x20 || r.Body[i] == 9 || r.Body[i] == 10 || r.Body[i] == 13 {
-			numOfText++
-		}
+	return r.FirstByteAt
+}
+
+func (r *Response) TimeToFirstByte() time.Duration {
+	if r.StartedAt().IsZero() || r.FirstByteAt.IsZero() {
+		return 0
 	}
-	if r._isBinary == 0 {
-		if numOfText > length/2 {
-			r._isBinary = -1
-		} else {
-			r._isBinary = 1
-		}
+	return r.FirstByteAt.Sub(r.StartedAt())
+}
+
+func (r *Response) Latency() time.Duration {
+	if r.StartedAt().IsZero() || r.CompletedAt.IsZero() {
+		return 0
 	}
-	return r.isBinary()
+	return r.CompletedAt.Sub(r.StartedAt())
+}
+
+// DecodedBody returns the body with its Content-Encoding removed, the raw
+// wire bytes stay in Body.
+func (r *Response) DecodedBody() []byte {
+	r.content.decode(r.Header, r.Body)
+	return r.content.body
+}
+
+func (r *Response) ContentEncoding() string {
+	r.content.decode(r.Header, r.Body)
+	return strings.Join(r.content.codings, ", ")
+}
+
+func (r *Response) DecodeError() error {
+	r.content.decode(r.Header, r.Body)
+	return r.content.err
+}
+
+func (r *Response) IsBinary() bool {
+	r.content.decode(r.Header, r.Body)
+	return r.content.isBinary()
 }
 
 func (r *Response) Release() {
@@ -66,6 +83,13 @@ func (r *Response) Release() {
 	}
 }
 
+// DropBody releases the body and keeps the headers, e.g. once the body is stored on disk.
+func (r *Response) DropBody() {
+	r.Release()
+	r.Body = nil
+	r.content = content{}
+}
+
 func (r *Response) WriteTo(w io.Writer) (n int64, err error) {
 	writer := bytebufferpool.Get()
 	defer bytebufferpool.Put(writer)
@@ -74,14 +98,18 @@ func (r *Response) WriteTo(w io.Writer) (n int64, err error) {
 	err = r.Header.Write(writer)
 	_, err = writer.WriteString("\r\n")
 	if r.ContentLength > 0 {
-		if !r.isBinary() {
-			_, err = writer.Write(r.Body)
+		if !r.IsBinary() {
+			_, err = writer.Write(r.DecodedBody())
 		} else {
 			wc := hex.Dumper(writer)
-			_, _ = wc.Write(r.Body)
+			_, _ = wc.Write(r.DecodedBody())
 			_ = wc.Close()
 		}
 	}
+	if len(r.Trailer) > 0 {
+		_, err = writer.WriteString("\r\n")
+		err = r.Trailer.Write(writer)
+	}
 	return writer.WriteTo(w)
 }
 
@@ -93,34 +121,52 @@ func (r *Response) Dumper(w io.Writer, displayLargeBody bool) (n int64, err erro
 	err = r.Header.Write(writer)
 	_, err = writer.WriteString("\r\n")
 	if r.ContentLength > 0 {
-		if r.ContentLength < 1024 || displayLargeBody {
-			if !r.isBinary() {
-				_, err = writer.Write(r.Body)
+		if len(r.DecodedBody()) < 1024 || displayLargeBody {
+			if !r.IsBinary() {
+				_, err = writer.Write(r.DecodedBody())
 			} else {
 				wc := hex.Dumper(writer)
-				_, _ = wc.Write(r.Body)
+				_, _ = wc.Write(r.DecodedBody())
 				_ = wc.Close()
 			}
 		}
 	}
+	if len(r.Trailer) > 0 {
+		_, err = writer.WriteString("\r\n")
+		err = r.Trailer.Write(writer)
+	}
 	return writer.WriteTo(w)
 }
 
-func ReadResponse(r *bufio.Reader, req *Request) (res *Response, err error) {
+// IsTunnel reports whether the connection stops carrying HTTP messages after
+// the response, which is the case for protocol upgrades and CONNECT requests.
+func (r *Response) IsTunnel() bool {
+	if r.StatusCode == http.StatusSwitchingProtocols {
+		return true
+	}
+	return r.Request != nil && r.Request.Method == http.MethodConnect && r.StatusCode >= 200 && r.StatusCode < 300
+}
+
+// bodyAllowed implements the message body length rules of RFC 9112 section 6.3,
+// any Content-Length or Transfer-Encoding header is ignored for these responses.
+func (r *Response) bodyAllowed() bool {
+	if r.Request != nil && r.Request.Method == http.MethodHead {
+		return false
+	}
+	if r.StatusCode >= 100 && r.StatusCode < 200 {
+		return false
+	}
+	if r.StatusCode == http.StatusNoContent || r.StatusCode == http.StatusNotModified {
+		return false
+	}
+	return !r.IsTunnel()
+}
+
+func readResponseHeader(tp *textproto.Reader, res *Response) (err error) {
 	var (
 		line       string
 		mimeHeader textproto.MIMEHeader
 	)
-	tp := newTextprotoReader(r)
-	res = &Response{
-		Request: req,
-	}
-	defer func() {
-		putTextprotoReader(tp)
-		if err == io.EOF {
-			err = io.ErrUnexpectedEOF
-		}
-	}()
 	// Parse the first line of the response.
 	for {
 		if line, err = tp.ReadLine(); err != nil {
@@ -131,7 +177,7 @@ func ReadResponse(r *bufio.Reader, req *Request) (res *Response, err error) {
 		}
 	}
 	if i := strings.IndexByte(line, ' '); i == -1 {
-		return nil, fmt.Errorf("malformed HTTP response %s", line)
+		return fmt.Errorf("malformed HTTP response %s", line)
 	} else {
 		res.Proto = line[:i]
 		res.Status = strings.TrimLeft(line[i+1:], " ")
@@ -142,34 +188,58 @@ func ReadResponse(r *bufio.Reader, req *Request) (res *Response, err error) {
 		res.Status = res.Status[i+1:]
 	}
 	if len(statusCode) != 3 {
-		return nil, fmt.Errorf("malformed HTTP status code %s", statusCode)
+		return fmt.Errorf("malformed HTTP status code %s", statusCode)
 	}
 	if res.StatusCode, err = strconv.Atoi(statusCode); err != nil || res.StatusCode < 0 {
-		return nil, fmt.Errorf("malformed HTTP status code %s", statusCode)
+		return fmt.Errorf("malformed HTTP status code %s", statusCode)
 	}
 	// Parse the response headers.
 	if mimeHeader, err = tp.ReadMIMEHeader(); err != nil {
 		return
 	}
 	res.Header = http.Header(mimeHeader)
-	if strings.EqualFold(res.Header.Get("Transfer-Encoding"), "chunked") {
-		reader := httputil.NewChunkedReader(tp.R)
-		if res.Body, err = io.ReadAll(reader); err == nil {
-			res.ContentLength = len(res.Body)
+	return
+}
+
+// ReadResponse reads the response of req, only the first maxBodySize bytes of the body are kept when it is above 0.
+func ReadResponse(r *bufio.Reader, req *Request, maxBodySize int) (res *Response, err error) {
+	tp := newTextprotoReader(r)
+	res = &Response{
+		Request: req,
+	}
+	defer func() {
+		putTextprotoReader(tp)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}()
+	for {
+		if err = readResponseHeader(tp, res); err != nil {
+			return nil, err
 		}
+		// Interim responses such as 100 Continue are followed by the final response.
+		if res.StatusCode >= 100 && res.StatusCode < 200 && res.StatusCode != http.StatusSwitchingProtocols {
+			continue
+		}
+		break
+	}
+	if !res.bodyAllowed() {
+		return
+	}
+	if isChunked(res.Header) {
+		res.Body, res.ContentLength, res.Trailer, err = readChunkedBody(tp, maxBodySize)
 	} else if res.Header.Get("Content-Length") != "" {
 		res.ContentLength, _ = strconv.Atoi(res.Header.Get("Content-Length"))
 		if res.ContentLength > 0 {
-			res.Body = bytepool.Get(res.ContentLength)
-			_, err = io.ReadFull(r, res.Body)
+			res.Body, err = readBody(r, res.ContentLength, maxBodySize)
 		}
 	} else {
-		if res.Body, err = io.ReadAll(r); err != nil {
+		if res.Body, res.ContentLength, err = readAll(r, maxBodySize); err != nil {
 			if errors.Is(err, io.ErrClosedPipe) || errors.Is(err, io.EOF) {
 				err = nil
 			}
 		}
-		res.ContentLength = len(res.Body)
 	}
+	res.Truncated = len(res.Body) < res.ContentLength
 	return
 }
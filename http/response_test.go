@@ -0,0 +1,152 @@
+package http
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func TestReadResponseFraming(t *testing.T) {
+	//the response which follows on the connection is only read correctly when the body ends at the right byte
+	const next = "HTTP/1.1 200 OK\r\nContent-Length: 4\r\n\r\nnext"
+	tests := []struct {
+		name   string
+		method string
+		input  string
+		status int
+		body   string
+		length int
+		tunnel bool
+	}{
+		{
+			name:   "content length",
+			method: "GET",
+			input:  "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello",
+			status: 200, body: "hello", length: 5,
+		},
+		{
+			name:   "head with content length",
+			method: "HEAD",
+			input:  "HTTP/1.1 200 OK\r\nContent-Length: 1024\r\n\r\n",
+			status: 200,
+		},
+		{
+			name:   "head with chunked encoding",
+			method: "HEAD",
+			input:  "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n",
+			status: 200,
+		},
+		{
+			name:   "continue before the final response",
+			method: "POST",
+			input:  "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 201 Created\r\nContent-Length: 2\r\n\r\nok",
+			status: 201, body: "ok", length: 2,
+		},
+		{
+			name:   "several interim responses",
+			method: "GET",
+			input:  "HTTP/1.1 103 Early Hints\r\nLink: </a.css>; rel=preload\r\n\r\nHTTP/1.1 102 Processing\r\n\r\nHTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok",
+			status: 200, body: "ok", length: 2,
+		},
+		{
+			name:   "no content with content length",
+			method: "DELETE",
+			input:  "HTTP/1.1 204 No Content\r\nContent-Length: 10\r\n\r\n",
+			status: 204,
+		},
+		{
+			name:   "not modified with chunked encoding",
+			method: "GET",
+			input:  "HTTP/1.1 304 Not Modified\r\nTransfer-Encoding: chunked\r\nContent-Length: 10\r\n\r\n",
+			status: 304,
+		},
+		{
+			name:   "chunked with trailer",
+			method: "GET",
+			input:  "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: Digest\r\n\r\n3\r\nabc\r\n2;ext=1\r\nde\r\n0\r\nDigest: x\r\n\r\n",
+			status: 200, body: "abcde", length: 5,
+		},
+		{
+			name:   "connect",
+			method: "CONNECT",
+			input:  "HTTP/1.1 200 Connection Established\r\n\r\n",
+			status: 200, tunnel: true,
+		},
+		{
+			name:   "switching protocols",
+			method: "GET",
+			input:  "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n",
+			status: 101, tunnel: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			br := bufio.NewReader(strings.NewReader(tt.input + next))
+			req := &Request{Method: tt.method}
+			res, err := ReadResponse(br, req, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.StatusCode != tt.status {
+				t.Errorf("status is %d, want %d", res.StatusCode, tt.status)
+			}
+			if string(res.Body) != tt.body || res.ContentLength != tt.length {
+				t.Errorf("body is %q of %d bytes, want %q of %d bytes", res.Body, res.ContentLength, tt.body, tt.length)
+			}
+			if res.IsTunnel() != tt.tunnel {
+				t.Errorf("tunnel is %v, want %v", res.IsTunnel(), tt.tunnel)
+			}
+			if res, err = ReadResponse(br, &Request{Method: "GET"}, 0); err != nil {
+				t.Fatalf("read next response: %v", err)
+			}
+			if string(res.Body) != "next" {
+				t.Errorf("next body is %q", res.Body)
+			}
+		})
+	}
+}
+
+func TestReadResponseUntilClose(t *testing.T) {
+	br := bufio.NewReader(strings.NewReader("HTTP/1.0 200 OK\r\n\r\nuntil the connection is closed"))
+	res, err := ReadResponse(br, &Request{Method: "GET"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(res.Body) != "until the connection is closed" {
+		t.Errorf("body is %q", res.Body)
+	}
+}
+
+func TestReadResponseTruncated(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{name: "content length", input: "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\n0123456789"},
+		{name: "chunked", input: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n6\r\n012345\r\n4\r\n6789\r\n0\r\n\r\n"},
+		{name: "until close", input: "HTTP/1.1 200 OK\r\n\r\n0123456789"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := ReadResponse(bufio.NewReader(strings.NewReader(tt.input)), &Request{Method: "GET"}, 4)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(res.Body) != "0123" || res.ContentLength != 10 || !res.Truncated {
+				t.Errorf("body is %q of %d bytes, truncated %v", res.Body, res.ContentLength, res.Truncated)
+			}
+		})
+	}
+}
+
+func TestReadResponseCut(t *testing.T) {
+	//the connection ends in the middle of the body, the bytes which were read are kept
+	br := bufio.NewReader(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\n0123"))
+	res, err := ReadResponse(br, &Request{Method: "GET"}, 0)
+	if err == nil {
+		t.Fatal("no error for a cut body")
+	}
+	if res == nil || string(res.Body) != "0123" {
+		t.Errorf("response is %+v", res)
+	}
+}
@@ -2,7 +2,10 @@ package http
 
 import (
 	"bufio"
+	"github.com/uole/httpcap/internal/bytepool"
+	"io"
 	"net/http"
+	"net/http/httputil"
 	"net/textproto"
 	"strings"
 	"sync"
@@ -34,6 +37,66 @@ func parseRequestLine(line string) (method, requestURI, proto string, ok bool) {
 	return line[:s1], line[s1+1 : s2], line[s2+1:], true
 }
 
+func isChunked(header http.Header) bool {
+	te := header.Values("Transfer-Encoding")
+	if len(te) == 0 {
+		return false
+	}
+	codings := strings.Split(te[len(te)-1], ",")
+	return strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked")
+}
+
+// readAll reads r to the end, only the first max bytes are kept when max is above 0,
+// size counts every byte which has been read.
+func readAll(r io.Reader, max int) (body []byte, size int, err error) {
+	if max <= 0 {
+		body, err = io.ReadAll(r)
+		return body, len(body), err
+	}
+	body, err = io.ReadAll(io.LimitReader(r, int64(max)))
+	if size = len(body); err == nil && size == max {
+		var n int64
+		n, err = io.Copy(io.Discard, r)
+		size += int(n)
+	}
+	return
+}
+
+// readBody reads a body of n bytes, only the first max bytes are kept when max is above 0.
+// The body holds the bytes which were read when it ends early.
+func readBody(r *bufio.Reader, n, max int) (body []byte, err error) {
+	var (
+		read int
+	)
+	if max > 0 && n > max {
+		body = bytepool.Get(max)
+		if read, err = io.ReadFull(r, body); err == nil {
+			_, err = r.Discard(n - max)
+		}
+		return body[:read], err
+	}
+	body = bytepool.Get(n)
+	read, err = io.ReadFull(r, body)
+	return body[:read], err
+}
+
+// readChunkedBody decodes a chunked body and consumes the trailer section behind the last chunk
+func readChunkedBody(tp *textproto.Reader, max int) (body []byte, size int, trailer http.Header, err error) {
+	var (
+		mimeHeader textproto.MIMEHeader
+	)
+	if body, size, err = readAll(httputil.NewChunkedReader(tp.R), max); err != nil {
+		return
+	}
+	if mimeHeader, err = tp.ReadMIMEHeader(); err != nil {
+		return
+	}
+	if len(mimeHeader) > 0 {
+		trailer = http.Header(mimeHeader)
+	}
+	return
+}
+
 func copyHeader(dst, src http.Header) {
 	for k, vv := range src {
 		for _, v := range vv {
@@ -41,3 +104,22 @@ func copyHeader(dst, src http.Header) {
 		}
 	}
 }
+
+func isBinary(b []byte) bool {
+	var (
+		numOfText int
+	)
+	length := len(b)
+	if length > 100 {
+		length = 100
+	}
+	for i := 0; i < length; i++ {
+		if b[i] <= 6 || (b[i] >= 14 && b[i] <= 31) {
+			return true
+		}
+		if b[i] >= 0x20 || b[i] == 9 || b[i] == 10 || b[i] == 13 {
+			numOfText++
+		}
+	}
+	return numOfText <= length/2
+}
@@ -0,0 +1,229 @@
+package decoder
+
+import (
+	"errors"
+	"fmt"
+	iopkg "github.com/uole/httpcap/internal/io"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+type (
+	// Exchange is a record emitted by a decoder, e.g. a request and its response.
+	Exchange interface {
+		Protocol() string
+	}
+
+	EmitFunc func(Exchange)
+
+	// Decoder parses one protocol over the two directions of a tcp connection.
+	Decoder interface {
+		Name() string
+		// Sniff reports whether the first payload of a connection belongs to the protocol,
+		// it is also used to find the start of the next message after a parse error.
+		Sniff(b []byte, fromClient bool) bool
+		// Decode reads the exchanges of the connection until both directions are closed.
+		Decode(conn *Conn, emit EmitFunc)
+	}
+
+	// Pooled is implemented by decoders which read a connection with a single goroutine, they run on
+	// the bounded workers of the factory and may park an idle connection, see Conn.Park.
+	Pooled interface {
+		Pooled() bool
+	}
+
+	// Scheduler hands out the slots of the workers, a decoder holds a slot while it parses.
+	Scheduler interface {
+		Acquire()
+		Release()
+	}
+
+	// Counters are the outcomes reported by the decoders, they are shared by the connections of a factory.
+	Counters struct {
+		ParseErrors int64
+		//responses which did not arrive in time
+		Timeouts int64
+	}
+
+	// Conn is a tcp connection handed to a decoder, the client writes into Up and the server into Down.
+	Conn struct {
+		ID     int64
+		Client string
+		Server string
+		Up     *iopkg.Buffer
+		Down   *iopkg.Buffer
+		Writer io.Writer
+		//counters of the parse errors and timeouts, nil when they are not counted
+		Counters *Counters
+		//bytes of a body which are kept, the rest is read and dropped, 0 keeps every byte
+		MaxBodySize int
+		//state of the decoder which is kept while the connection is parked
+		State     interface{}
+		resync    int32
+		ignored   int32
+		scheduler Scheduler
+		parked    bool
+		detached  bool
+	}
+
+	Registry struct {
+		mutex    sync.RWMutex
+		decoders []Decoder
+	}
+)
+
+// Logf writes a parse error of the connection into the log.
+func (conn *Conn) Logf(format string, args ...interface{}) {
+	if conn.Writer != nil {
+		fmt.Fprintf(conn.Writer, "stream %d "+format+"\n", append([]interface{}{conn.ID}, args...)...)
+	}
+}
+
+// ParseError counts a message the decoder could not parse, the reason is logged with Logf.
+func (conn *Conn) ParseError() {
+	if conn.Counters != nil {
+		atomic.AddInt64(&conn.Counters.ParseErrors, 1)
+	}
+}
+
+// Timeout counts a response which did not arrive in time.
+func (conn *Conn) Timeout() {
+	if conn.Counters != nil {
+		atomic.AddInt64(&conn.Counters.Timeouts, 1)
+	}
+}
+
+// Report counts the error a read of the decoder failed with, a connection which ends in the middle
+// of a message is neither a parse error nor a timeout.
+func (conn *Conn) Report(err error) {
+	switch {
+	case errors.Is(err, iopkg.ErrDeadline):
+		conn.Timeout()
+	case errors.Is(err, io.ErrClosedPipe), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF):
+	default:
+		conn.ParseError()
+	}
+}
+
+func (conn *Conn) Discard() {
+	conn.Up.Discard()
+	conn.Down.Discard()
+}
+
+// Resync drops the buffered data after a parse error, data is buffered again once
+// the client sends what the decoder sniffs as the start of a message.
+func (conn *Conn) Resync() {
+	atomic.StoreInt32(&conn.resync, 1)
+	conn.Discard()
+}
+
+// Overflow drops the buffered data of a connection whose decoder does not keep up, it is called
+// by the writer, data is buffered again once the client sends the start of a message.
+func (conn *Conn) Overflow() {
+	atomic.StoreInt32(&conn.resync, 1)
+	conn.Up.Clear()
+	conn.Down.Clear()
+}
+
+func (conn *Conn) Resyncing() bool {
+	return atomic.LoadInt32(&conn.resync) == 1
+}
+
+func (conn *Conn) Synced() {
+	atomic.StoreInt32(&conn.resync, 0)
+}
+
+// Ignore stops buffering the connection, e.g. once it carries a protocol the decoder does not know.
+func (conn *Conn) Ignore() {
+	atomic.StoreInt32(&conn.ignored, 1)
+}
+
+func (conn *Conn) Ignored() bool {
+	return atomic.LoadInt32(&conn.ignored) == 1
+}
+
+// Schedule runs the decoder on a slot of s, the slot is given up while the decoder waits for data.
+func (conn *Conn) Schedule(s Scheduler) {
+	wait := func(waiting bool) {
+		if waiting {
+			s.Release()
+		} else {
+			s.Acquire()
+		}
+	}
+	conn.scheduler, conn.parked = s, false
+	conn.Up.SetWaitFunc(wait)
+	conn.Down.SetWaitFunc(wait)
+}
+
+// Detach gives up the slot for good, it is called before the decoder reads the connection
+// with goroutines of its own, e.g. after an upgrade to websocket.
+func (conn *Conn) Detach() {
+	if conn.scheduler == nil || conn.detached {
+		return
+	}
+	conn.Up.SetWaitFunc(nil)
+	conn.Down.SetWaitFunc(nil)
+	conn.detached = true
+	conn.scheduler.Release()
+}
+
+func (conn *Conn) Detached() bool {
+	return conn.detached
+}
+
+// Park reports whether the decoder may return from Decode between two messages, the connection is
+// scheduled and Decode is called again once data arrives. Only a scheduled connection without
+// unread data is parked.
+func (conn *Conn) Park() bool {
+	if conn.scheduler == nil || conn.detached || conn.Up.Unread() > 0 || conn.Down.Unread() > 0 {
+		return false
+	}
+	conn.parked = true
+	return true
+}
+
+func (conn *Conn) Parked() bool {
+	return conn.parked
+}
+
+func (conn *Conn) Close() {
+	_ = conn.Up.Close()
+	_ = conn.Down.Close()
+}
+
+// Register adds a decoder, decoders are sniffed in the order of registration.
+func (registry *Registry) Register(d Decoder) *Registry {
+	registry.mutex.Lock()
+	registry.decoders = append(registry.decoders, d)
+	registry.mutex.Unlock()
+	return registry
+}
+
+// Sniff returns the first decoder which accepts the payload.
+func (registry *Registry) Sniff(b []byte, fromClient bool) Decoder {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	for _, d := range registry.decoders {
+		if d.Sniff(b, fromClient) {
+			return d
+		}
+	}
+	return nil
+}
+
+func NewConn(id int64, client, server string, w io.Writer) *Conn {
+	return &Conn{
+		ID:     id,
+		Client: client,
+		Server: server,
+		Up:     iopkg.NewBuffer(),
+		Down:   iopkg.NewBuffer(),
+		Writer: w,
+	}
+}
+
+func NewRegistry(decoders ...Decoder) *Registry {
+	return &Registry{decoders: decoders}
+}
@@ -0,0 +1,287 @@
+package http
+
+import (
+	"bytes"
+	"errors"
+	httpkg "github.com/uole/httpcap/http"
+	iopkg "github.com/uole/httpcap/internal/io"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	h2Preface = []byte(http2.ClientPreface)
+)
+
+type (
+	h2Stream struct {
+		id       uint32
+		req      *httpkg.Request
+		res      *httpkg.Response
+		reqBody  bytes.Buffer
+		resBody  bytes.Buffer
+		reqSize  int
+		resSize  int
+		reqEnded bool
+		resEnded bool
+	}
+
+	h2Conn struct {
+		stream     *stream
+		mutex      sync.Mutex
+		streams    map[uint32]*h2Stream
+		handleFunc func(req *httpkg.Request, res *httpkg.Response)
+	}
+)
+
+func newFramer(r io.Reader) *http2.Framer {
+	framer := http2.NewFramer(io.Discard, r)
+	framer.SetMaxReadFrameSize(1<<24 - 1)
+	decoder := hpack.NewDecoder(4096, nil)
+	//the table size is negotiated by SETTINGS which may have been sent before the capture started
+	decoder.SetAllowedMaxDynamicTableSize(1 << 24)
+	framer.ReadMetaHeaders = decoder
+	framer.MaxHeaderListSize = 1 << 24
+	return framer
+}
+
+func (conn *h2Conn) get(id uint32) *h2Stream {
+	s, ok := conn.streams[id]
+	if !ok {
+		s = &h2Stream{id: id}
+		conn.streams[id] = s
+	}
+	return s
+}
+
+func (conn *h2Conn) onRequestHeaders(f *http2.MetaHeadersFrame, at time.Time) {
+	s := conn.get(f.StreamID)
+	if s.req != nil {
+		//headers after the request headers carry the trailer
+		s.req.Trailer = h2Header(f.RegularFields())
+	} else {
+		req := &httpkg.Request{
+			Proto:      "HTTP/2.0",
+			Method:     f.PseudoValue("method"),
+			RequestURI: f.PseudoValue("path"),
+			Host:       f.PseudoValue("authority"),
+			Header:     h2Header(f.RegularFields()),
+			StreamID:   f.StreamID,
+			StartedAt:  at,
+		}
+		if req.Host == "" {
+			req.Host = req.Header.Get("Host")
+		}
+		if req.Method == http.MethodConnect && req.RequestURI == "" {
+			req.RequestURI = req.Host
+		}
+		s.req = req
+	}
+	if f.StreamEnded() {
+		conn.endRequest(s, at)
+	}
+}
+
+// flush hands over the exchange once both sides are complete, the directions are read
+// concurrently, so the response may be complete before the request has been read.
+func (conn *h2Conn) flush(s *h2Stream, force bool) {
+	if s.req == nil || s.res == nil || !s.resEnded || (!s.reqEnded && !force) {
+		return
+	}
+	delete(conn.streams, s.id)
+	//the request which was cut short keeps the part of its body which was sent
+	if !s.reqEnded {
+		conn.keepRequestBody(s)
+	}
+	s.res.Request = s.req
+	if conn.handleFunc != nil {
+		conn.handleFunc(s.req, s.res)
+	}
+}
+
+func (conn *h2Conn) endRequest(s *h2Stream, at time.Time) {
+	if s.req == nil || s.reqEnded {
+		return
+	}
+	s.reqEnded = true
+	s.req.CompletedAt = at
+	conn.keepRequestBody(s)
+	conn.flush(s, false)
+}
+
+func (conn *h2Conn) keepRequestBody(s *h2Stream) {
+	if s.reqSize > 0 {
+		s.req.Body = append([]byte(nil), s.reqBody.Bytes()...)
+		s.req.ContentLength = s.reqSize
+		s.req.Truncated = len(s.req.Body) < s.reqSize
+	}
+}
+
+func (conn *h2Conn) onResponseHeaders(f *http2.MetaHeadersFrame, at time.Time) {
+	s := conn.get(f.StreamID)
+	status, _ := strconv.Atoi(f.PseudoValue("status"))
+	switch {
+	case s.res != nil:
+		s.res.Trailer = h2Header(f.RegularFields())
+	case status >= 100 && status < 200:
+		//interim responses are not exchanges of their own
+	default:
+		s.res = &httpkg.Response{
+			Request:     s.req,
+			Status:      http.StatusText(status),
+			StatusCode:  status,
+			Proto:       "HTTP/2.0",
+			Header:      h2Header(f.RegularFields()),
+			FirstByteAt: at,
+		}
+	}
+	if f.StreamEnded() {
+		conn.endResponse(s, at)
+	}
+}
+
+func (conn *h2Conn) endResponse(s *h2Stream, at time.Time) {
+	if s.res == nil {
+		delete(conn.streams, s.id)
+		return
+	}
+	s.resEnded = true
+	s.res.CompletedAt = at
+	if s.resSize > 0 {
+		s.res.Body = append([]byte(nil), s.resBody.Bytes()...)
+		s.res.ContentLength = s.resSize
+		s.res.Truncated = len(s.res.Body) < s.resSize
+	}
+	conn.flush(s, false)
+}
+
+// keep appends the data of a frame to the body until the max body size, it returns the size of the data.
+func (conn *h2Conn) keep(body *bytes.Buffer, data []byte) int {
+	if max := conn.stream.MaxBodySize; max > 0 && body.Len()+len(data) > max {
+		_, _ = body.Write(data[:max-body.Len()])
+	} else {
+		_, _ = body.Write(data)
+	}
+	return len(data)
+}
+
+func (conn *h2Conn) process(f http2.Frame, client bool, at time.Time) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	switch frame := f.(type) {
+	case *http2.MetaHeadersFrame:
+		if client {
+			conn.onRequestHeaders(frame, at)
+		} else {
+			conn.onResponseHeaders(frame, at)
+		}
+	case *http2.DataFrame:
+		s, ok := conn.streams[frame.StreamID]
+		if !ok {
+			return
+		}
+		if client {
+			s.reqSize += conn.keep(&s.reqBody, frame.Data())
+			if frame.StreamEnded() {
+				conn.endRequest(s, at)
+			}
+		} else {
+			if s.res == nil {
+				return
+			}
+			s.resSize += conn.keep(&s.resBody, frame.Data())
+			if frame.StreamEnded() {
+				conn.endResponse(s, at)
+			}
+		}
+	case *http2.RSTStreamFrame:
+		if s, ok := conn.streams[frame.StreamID]; ok {
+			if s.resEnded {
+				conn.flush(s, true)
+			} else {
+				delete(conn.streams, frame.StreamID)
+			}
+		}
+	case *http2.GoAwayFrame:
+		conn.stream.Logf("http2 goaway: %s", frame.ErrCode.String())
+	}
+}
+
+func (conn *h2Conn) readLoop(buf *iopkg.Buffer, client bool) {
+	var (
+		err   error
+		pos   int64
+		frame http2.Frame
+	)
+	framer := newFramer(buf.Reader())
+	for {
+		pos = buf.Position()
+		if frame, err = framer.ReadFrame(); err != nil {
+			var streamErr http2.StreamError
+			if errors.As(err, &streamErr) {
+				continue
+			}
+			if !errors.Is(err, io.ErrClosedPipe) {
+				conn.stream.Logf("read http2 frame error: %s", err.Error())
+				conn.stream.Report(err)
+			}
+			buf.Discard()
+			return
+		}
+		first := buf.Timestamp(pos)
+		last := buf.Timestamp(buf.Position() - 1)
+		if _, ok := frame.(*http2.MetaHeadersFrame); ok {
+			conn.process(frame, client, first)
+		} else {
+			conn.process(frame, client, last)
+		}
+	}
+}
+
+// serveH2 decodes the http2 connection until both directions are closed, req is the
+// http1 request which was upgraded with h2c, its response is sent on stream 1.
+func (stream *stream) serveH2(req *httpkg.Request, handleFunc func(req *httpkg.Request, res *httpkg.Response)) {
+	var (
+		wg sync.WaitGroup
+	)
+	conn := &h2Conn{
+		stream:     stream,
+		streams:    make(map[uint32]*h2Stream),
+		handleFunc: handleFunc,
+	}
+	if req != nil {
+		req.StreamID = 1
+		conn.streams[1] = &h2Stream{id: 1, req: req, reqEnded: true}
+	}
+	stream.Down.SetReadDeadline(time.Time{})
+	if _, err := io.ReadFull(stream.Up.Reader(), make([]byte, len(h2Preface))); err != nil {
+		return
+	}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		conn.readLoop(stream.Up, true)
+	}()
+	go func() {
+		defer wg.Done()
+		conn.readLoop(stream.Down, false)
+	}()
+	wg.Wait()
+	//responses of requests which were cut short, e.g. the server answered before the upload completed
+	for _, s := range conn.streams {
+		conn.flush(s, true)
+	}
+}
+
+func h2Header(fields []hpack.HeaderField) http.Header {
+	header := make(http.Header, len(fields))
+	for _, field := range fields {
+		header.Add(field.Name, field.Value)
+	}
+	return header
+}
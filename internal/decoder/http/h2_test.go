@@ -0,0 +1,206 @@
+package http
+
+import (
+	"bytes"
+	"github.com/uole/httpcap/grpc"
+	httpkg "github.com/uole/httpcap/http"
+	"github.com/uole/httpcap/internal/decoder"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+	"sync"
+	"testing"
+	"time"
+)
+
+// h2Writer writes the frames of one direction, its header blocks share the dynamic table of hpack.
+type h2Writer struct {
+	buf     bytes.Buffer
+	block   bytes.Buffer
+	framer  *http2.Framer
+	encoder *hpack.Encoder
+}
+
+func newH2Writer(preface string) *h2Writer {
+	w := &h2Writer{}
+	w.buf.WriteString(preface)
+	w.framer = http2.NewFramer(&w.buf, nil)
+	w.encoder = hpack.NewEncoder(&w.block)
+	_ = w.framer.WriteSettings()
+	return w
+}
+
+func (w *h2Writer) headers(id uint32, end bool, fields ...string) *h2Writer {
+	w.block.Reset()
+	for i := 0; i+1 < len(fields); i += 2 {
+		_ = w.encoder.WriteField(hpack.HeaderField{Name: fields[i], Value: fields[i+1]})
+	}
+	_ = w.framer.WriteHeaders(http2.HeadersFrameParam{StreamID: id, BlockFragment: w.block.Bytes(), EndStream: end, EndHeaders: true})
+	return w
+}
+
+func (w *h2Writer) data(id uint32, end bool, s string) *h2Writer {
+	_ = w.framer.WriteData(id, end, []byte(s))
+	return w
+}
+
+func (w *h2Writer) reset(id uint32) *h2Writer {
+	_ = w.framer.WriteRSTStream(id, http2.ErrCodeCancel)
+	return w
+}
+
+// decodeH2 hands both directions to the decoder and returns the exchanges by the uri of their request.
+func decodeH2(up, down []byte) map[string]*Exchange {
+	var (
+		mutex sync.Mutex
+	)
+	exchanges := make(map[string]*Exchange)
+	conn := decoder.NewConn(1, "10.0.0.1:50000", "10.0.0.2:80", nil)
+	at := time.Unix(1700000000, 0)
+	_ = conn.Up.PutBytes(up, at, at)
+	_ = conn.Down.PutBytes(down, at, at)
+	conn.Close()
+	New().Decode(conn, func(e decoder.Exchange) {
+		if e, ok := e.(*Exchange); ok {
+			mutex.Lock()
+			exchanges[e.Request.RequestURI] = e
+			mutex.Unlock()
+		}
+	})
+	return exchanges
+}
+
+func checkExchange(t *testing.T, exchanges map[string]*Exchange, uri string, status int, reqBody, resBody string) *httpkg.Response {
+	e, ok := exchanges[uri]
+	if !ok {
+		t.Errorf("no exchange of %s", uri)
+		return nil
+	}
+	if e.Response.StatusCode != status {
+		t.Errorf("status of %s is %d, want %d", uri, e.Response.StatusCode, status)
+	}
+	if string(e.Request.Body) != reqBody {
+		t.Errorf("request body of %s is %q, want %q", uri, e.Request.Body, reqBody)
+	}
+	if string(e.Response.Body) != resBody {
+		t.Errorf("response body of %s is %q, want %q", uri, e.Response.Body, resBody)
+	}
+	if e.Response.Request != e.Request {
+		t.Errorf("response of %s is not paired with its request", uri)
+	}
+	return e.Response
+}
+
+func TestH2PriorKnowledge(t *testing.T) {
+	up := newH2Writer(http2.ClientPreface).
+		headers(1, true, ":method", "GET", ":scheme", "http", ":authority", "example.com", ":path", "/a", "user-agent", "test").
+		headers(3, false, ":method", "POST", ":scheme", "http", ":authority", "example.com", ":path", "/b", "user-agent", "test").
+		data(3, false, "hello ").
+		data(3, true, "world").
+		headers(5, true, ":method", "GET", ":scheme", "http", ":authority", "example.com", ":path", "/c", "user-agent", "test")
+	//the responses come in another order than the requests, with an interim response and a trailer
+	down := newH2Writer("").
+		headers(3, false, ":status", "201", "content-type", "text/plain").
+		data(3, true, "created").
+		headers(1, false, ":status", "103", "link", "</a.css>; rel=preload").
+		headers(1, false, ":status", "200", "content-type", "text/plain").
+		data(1, false, "o").
+		data(1, false, "k").
+		headers(1, true, "grpc-status", "0").
+		headers(5, true, ":status", "204")
+	exchanges := decodeH2(up.buf.Bytes(), down.buf.Bytes())
+	if len(exchanges) != 3 {
+		t.Fatalf("%d exchanges are decoded, want 3", len(exchanges))
+	}
+	if res := checkExchange(t, exchanges, "/a", 200, "", "ok"); res != nil {
+		if res.Trailer.Get("grpc-status") != "0" {
+			t.Errorf("trailer is %v", res.Trailer)
+		}
+		if res.Header.Get("Link") != "" {
+			t.Error("header of the interim response is kept")
+		}
+	}
+	checkExchange(t, exchanges, "/b", 201, "hello world", "created")
+	checkExchange(t, exchanges, "/c", 204, "", "")
+	for uri, e := range exchanges {
+		//the dynamic table of hpack is shared by the header blocks of a direction
+		if e.Request.Header.Get("User-Agent") != "test" || e.Request.Host != "example.com" {
+			t.Errorf("request headers of %s are %v", uri, e.Request.Header)
+		}
+		if e.Request.Proto != "HTTP/2.0" || e.Request.StreamID == 0 {
+			t.Errorf("request of %s is %s on stream %d", uri, e.Request.Proto, e.Request.StreamID)
+		}
+	}
+}
+
+func TestH2Reset(t *testing.T) {
+	up := newH2Writer(http2.ClientPreface).
+		headers(1, true, ":method", "GET", ":scheme", "http", ":authority", "example.com", ":path", "/cancelled").
+		headers(3, false, ":method", "PUT", ":scheme", "http", ":authority", "example.com", ":path", "/upload").
+		data(3, false, "part")
+	//the server answers the upload before it is complete and resets the stream
+	down := newH2Writer("").
+		headers(1, false, ":status", "200").
+		data(1, false, "partial").
+		reset(1).
+		headers(3, true, ":status", "413").
+		reset(3)
+	exchanges := decodeH2(up.buf.Bytes(), down.buf.Bytes())
+	if _, ok := exchanges["/cancelled"]; ok {
+		t.Error("the response of a reset stream is kept")
+	}
+	checkExchange(t, exchanges, "/upload", 413, "part", "")
+}
+
+func TestH2CleartextUpgrade(t *testing.T) {
+	var up, down bytes.Buffer
+	up.WriteString("GET /upgrade HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: AAMAAABkAARAAAAAAAIAAAAA\r\n\r\n")
+	up.Write(newH2Writer(http2.ClientPreface).
+		headers(3, true, ":method", "GET", ":scheme", "http", ":authority", "example.com", ":path", "/next").buf.Bytes())
+	down.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n")
+	//the response of the upgraded request is sent on stream 1
+	down.Write(newH2Writer("").
+		headers(1, false, ":status", "200").
+		data(1, true, "upgraded").
+		headers(3, false, ":status", "200").
+		data(3, true, "next").buf.Bytes())
+	exchanges := decodeH2(up.Bytes(), down.Bytes())
+	if len(exchanges) != 2 {
+		t.Fatalf("%d exchanges are decoded, want 2", len(exchanges))
+	}
+	if res := checkExchange(t, exchanges, "/upgrade", 200, "", "upgraded"); res != nil && res.Proto != "HTTP/2.0" {
+		t.Errorf("response of the upgrade is %s", res.Proto)
+	}
+	checkExchange(t, exchanges, "/next", 200, "", "next")
+}
+
+func TestH2GRPC(t *testing.T) {
+	//two length prefixed messages, the prefix of the second one is split over the data frames
+	body := "\x00\x00\x00\x00\x02\x08\x01" + "\x00\x00\x00\x00\x03\x08\x96\x01"
+	up := newH2Writer(http2.ClientPreface).
+		headers(1, false, ":method", "POST", ":scheme", "http", ":authority", "example.com", ":path", "/test.Router/Get", "content-type", "application/grpc").
+		data(1, false, body[:3]).
+		data(1, false, body[3:9]).
+		data(1, true, body[9:])
+	down := newH2Writer("").
+		headers(1, false, ":status", "200", "content-type", "application/grpc").
+		data(1, false, body[:10]).
+		data(1, false, body[10:]).
+		headers(1, true, "grpc-status", "0")
+	exchanges := decodeH2(up.buf.Bytes(), down.buf.Bytes())
+	e, ok := exchanges["/test.Router/Get"]
+	if !ok {
+		t.Fatal("no exchange of the call")
+	}
+	call := grpc.NewCall(e.Request, e.Response, nil)
+	if call == nil || call.Error != "" {
+		t.Fatalf("call is %+v", call)
+	}
+	for _, payloads := range [][]*grpc.Payload{call.Requests, call.Responses} {
+		if len(payloads) != 2 || payloads[0].Raw != "1: 1\n" || payloads[1].Raw != "1: 150\n" {
+			t.Errorf("messages are %+v", payloads)
+		}
+	}
+	if call.Status == nil || *call.Status != 0 {
+		t.Errorf("status is %v", call.Status)
+	}
+}
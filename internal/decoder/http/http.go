@@ -0,0 +1,256 @@
+package http
+
+import (
+	"bytes"
+	"errors"
+	httpkg "github.com/uole/httpcap/http"
+	"github.com/uole/httpcap/internal/decoder"
+	"github.com/uole/httpcap/websocket"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	//time the response has to start after its request, on the clock of the packets
+	responseTimeout = 10 * time.Second
+)
+
+const (
+	protocolHTTP1 int32 = iota
+	protocolH2
+	protocolWebSocket
+	protocolTunnel
+)
+
+var (
+	responseBytes = []byte("HTTP/")
+
+	httpMethods = map[string]bool{
+		http.MethodGet:     true,
+		http.MethodPost:    true,
+		http.MethodPut:     true,
+		http.MethodDelete:  true,
+		http.MethodHead:    true,
+		http.MethodTrace:   true,
+		http.MethodOptions: true,
+		http.MethodPatch:   true,
+	}
+)
+
+type (
+	// Exchange is an http request and its response.
+	Exchange struct {
+		Request  *httpkg.Request
+		Response *httpkg.Response
+		//set by the receiver when it keeps the exchange, the bodies may be released afterwards,
+		//so the websocket messages of a handshake go by this flag instead of the handshake itself
+		Accepted bool
+	}
+
+	// Message is a websocket message of the connection upgraded by the exchange.
+	Message struct {
+		Request   *httpkg.Request
+		Response  *httpkg.Response
+		Message   *websocket.Message
+		Handshake *Exchange
+	}
+
+	// Decoder decodes HTTP/1.x, it follows upgrades to h2c and websocket and reads
+	// HTTP/2 connections which start with the preface.
+	Decoder struct {
+	}
+
+	// stream is the state of a connection, the protocol changes after an upgrade.
+	stream struct {
+		*decoder.Conn
+		isWebsocket bool
+		protocol    int32
+	}
+)
+
+func (e *Exchange) Protocol() string {
+	return "http"
+}
+
+func (m *Message) Protocol() string {
+	return "websocket"
+}
+
+func isHttpRequest(b []byte) bool {
+	var (
+		pos int
+	)
+	if pos = bytes.IndexByte(b, ' '); pos > 0 && pos <= 8 {
+		method := string(b[:pos])
+		return httpMethods[method]
+	}
+	return false
+}
+
+func isHttpResponse(b []byte) bool {
+	if len(b) > 5 {
+		return bytes.Equal(b[:5], responseBytes)
+	}
+	return false
+}
+
+// isPreface reports whether the client starts the connection with the http2 preface (prior knowledge).
+func (stream *stream) isPreface() bool {
+	if b, err := stream.Up.Reader().Peek(3); err != nil || !bytes.Equal(b, h2Preface[:3]) {
+		return false
+	}
+	b, err := stream.Up.Reader().Peek(len(h2Preface))
+	return err == nil && bytes.Equal(b, h2Preface)
+}
+
+func (stream *stream) fetchRequest() (req *httpkg.Request, res *httpkg.Response, err error) {
+	var (
+		pos int64
+	)
+__retry:
+	pos = stream.Up.Position()
+	if req, err = httpkg.ReadRequest(stream.Up.Reader(), stream.MaxBodySize); err != nil {
+		stream.Logf("read request error: %s", err.Error())
+		stream.Report(err)
+		if !errors.Is(err, io.ErrClosedPipe) {
+			stream.Resync()
+			goto __retry
+		}
+		return
+	}
+	req.StartedAt = stream.Up.Timestamp(pos)
+	req.CompletedAt = stream.Up.Timestamp(stream.Up.Position() - 1)
+	req.Gap = stream.Up.Gap(pos, stream.Up.Position()-1)
+	if !stream.isWebsocket {
+		if req.Header.Get("Upgrade") == "websocket" {
+			stream.isWebsocket = true
+		}
+	}
+	//a response which does not start in time is given up, once it has started its body may take as long as it needs.
+	//the deadline follows the capture time of the request, the decoder may lag behind the packets
+	deadline := req.CompletedAt
+	if deadline.IsZero() {
+		deadline = stream.Down.Now()
+	}
+	stream.Down.SetReadDeadline(deadline.Add(responseTimeout))
+	pos = stream.Down.Position()
+	_, err = stream.Down.Reader().Peek(1)
+	stream.Down.SetReadDeadline(time.Time{})
+	if err == nil {
+		res, err = httpkg.ReadResponse(stream.Down.Reader(), req, stream.MaxBodySize)
+	}
+	//the rest of the response was lost in the capture, it is kept with the bytes which arrived
+	if err != nil && res != nil && stream.Down.Gap(pos, stream.Down.Position()) {
+		stream.Logf("read response error: %s, bytes are missing", err.Error())
+		res.Gap, err = true, nil
+	}
+	if err != nil {
+		stream.Logf("read response error: %s", err.Error())
+		stream.Report(err)
+		if !errors.Is(err, io.ErrClosedPipe) {
+			stream.Resync()
+			goto __retry
+		}
+		return
+	}
+	res.FirstByteAt = stream.Down.Timestamp(pos)
+	res.CompletedAt = stream.Down.Timestamp(stream.Down.Position() - 1)
+	res.Gap = res.Gap || stream.Down.Gap(pos, stream.Down.Position()-1)
+	if res.IsTunnel() {
+		switch {
+		case res.StatusCode == http.StatusSwitchingProtocols && strings.EqualFold(res.Header.Get("Upgrade"), "h2c"):
+			stream.protocol = protocolH2
+		case stream.isWebsocket && websocket.IsUpgrade(res.Header, res.StatusCode):
+			stream.protocol = protocolWebSocket
+		default:
+			stream.protocol = protocolTunnel
+			stream.Ignore()
+		}
+	}
+	return
+}
+
+func (d *Decoder) Name() string {
+	return "http"
+}
+
+// Pooled reports that HTTP/1.x is read by a single goroutine, the connection is parked between two requests.
+// A decoder which waits for the rest of a message keeps its goroutine, it only gives up its worker.
+func (d *Decoder) Pooled() bool {
+	return true
+}
+
+func (d *Decoder) Sniff(b []byte, fromClient bool) bool {
+	return fromClient && len(b) > 8 && (isHttpRequest(b) || bytes.HasPrefix(b, h2Preface))
+}
+
+func (d *Decoder) Decode(conn *decoder.Conn, emit decoder.EmitFunc) {
+	var (
+		upgraded *httpkg.Request
+	)
+	//a parked connection goes on with the state it had
+	stream, resumed := conn.State.(*stream)
+	if !resumed {
+		stream = newStream(conn)
+		conn.State = stream
+	}
+	handle := func(req *httpkg.Request, res *httpkg.Response) *Exchange {
+		req.Address = conn.Client
+		res.Address = conn.Server
+		e := &Exchange{Request: req, Response: res}
+		emit(e)
+		return e
+	}
+	if !resumed && stream.isPreface() {
+		stream.protocol = protocolH2
+	}
+	for {
+		if stream.protocol == protocolH2 {
+			//http2 and websocket read both directions at once, they do not share the workers
+			conn.Detach()
+			stream.serveH2(upgraded, func(req *httpkg.Request, res *httpkg.Response) {
+				handle(req, res)
+			})
+			break
+		}
+		req, res, err := stream.fetchRequest()
+		if err != nil {
+			conn.Logf("fetch request error: %s", err.Error())
+			break
+		}
+		//the response of an h2c upgrade request is sent on http2 stream 1
+		if stream.protocol == protocolH2 {
+			res.Release()
+			upgraded = req
+			continue
+		}
+		handshake := handle(req, res)
+		if stream.protocol == protocolWebSocket {
+			conn.Detach()
+			stream.serveWebSocket(res, func(msg *websocket.Message) {
+				emit(&Message{Request: req, Response: res, Message: msg, Handshake: handshake})
+			})
+			break
+		}
+		//the connection no longer carries http messages, e.g. after an upgrade
+		if stream.protocol == protocolTunnel {
+			conn.Logf("switched protocol")
+			conn.Discard()
+			break
+		}
+		//an idle keep-alive connection holds no goroutine until its next request
+		if conn.Park() {
+			break
+		}
+	}
+}
+
+func newStream(conn *decoder.Conn) *stream {
+	return &stream{Conn: conn}
+}
+
+func New() *Decoder {
+	return &Decoder{}
+}
@@ -0,0 +1,55 @@
+package http
+
+import (
+	"errors"
+	httpkg "github.com/uole/httpcap/http"
+	iopkg "github.com/uole/httpcap/internal/io"
+	"github.com/uole/httpcap/websocket"
+	"io"
+	"sync"
+	"time"
+)
+
+func (stream *stream) readWebSocket(buf *iopkg.Buffer, r *websocket.Reader, handleFunc func(msg *websocket.Message)) {
+	var (
+		err error
+		msg *websocket.Message
+	)
+	for {
+		if msg, err = r.ReadMessage(); err != nil {
+			if !errors.Is(err, io.ErrClosedPipe) {
+				stream.Logf("read websocket frame error: %s", err.Error())
+				stream.Report(err)
+			}
+			buf.Discard()
+			return
+		}
+		msg.Time = buf.Timestamp(buf.Position() - 1)
+		handleFunc(msg)
+	}
+}
+
+// serveWebSocket reads the messages of both directions after the handshake until the connection is closed.
+func (stream *stream) serveWebSocket(res *httpkg.Response, handleFunc func(msg *websocket.Message)) {
+	var (
+		wg    sync.WaitGroup
+		mutex sync.Mutex
+	)
+	//messages are handed over one at a time to keep the order of each direction
+	handle := func(msg *websocket.Message) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		handleFunc(msg)
+	}
+	stream.Down.SetReadDeadline(time.Time{})
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		stream.readWebSocket(stream.Up, websocket.NewReader(stream.Up.Reader(), true, res.Header), handle)
+	}()
+	go func() {
+		defer wg.Done()
+		stream.readWebSocket(stream.Down, websocket.NewReader(stream.Down.Reader(), false, res.Header), handle)
+	}()
+	wg.Wait()
+}
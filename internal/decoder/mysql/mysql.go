@@ -0,0 +1,697 @@
+package mysql
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/uole/httpcap/internal/decoder"
+	"github.com/uole/httpcap/sql"
+	"io"
+	"math"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	capabilityConnectWithDB    = 0x00000008
+	capabilityProtocol41       = 0x00000200
+	capabilitySSL              = 0x00000800
+	capabilitySecureConnection = 0x00008000
+	capabilityPluginAuthLenenc = 0x00200000
+	capabilityDeprecateEOF     = 0x01000000
+	capabilityQueryAttributes  = 0x08000000
+
+	statusMoreResults = 0x0008
+
+	//the attributes of an execute start with their count
+	executeParameterCount = 0x08
+
+	maxPacketSize = 0xffffff
+	//statements larger than this are not buffered
+	maxStatementSize = 64 * 1024 * 1024
+	maxPending       = 4096
+)
+
+const (
+	comQuit             = 0x01
+	comInitDB           = 0x02
+	comQuery            = 0x03
+	comStatistics       = 0x09
+	comBinlogDump       = 0x12
+	comStmtPrepare      = 0x16
+	comStmtExecute      = 0x17
+	comStmtSendLongData = 0x18
+	comStmtClose        = 0x19
+	comBinlogDumpGTID   = 0x1e
+)
+
+const (
+	typeTiny      = 0x01
+	typeShort     = 0x02
+	typeLong      = 0x03
+	typeFloat     = 0x04
+	typeDouble    = 0x05
+	typeNull      = 0x06
+	typeTimestamp = 0x07
+	typeLongLong  = 0x08
+	typeInt24     = 0x09
+	typeDate      = 0x0a
+	typeTime      = 0x0b
+	typeDateTime  = 0x0c
+	typeYear      = 0x0d
+)
+
+var (
+	errMalformedPacket = errors.New("malformed mysql packet")
+)
+
+type (
+	// Decoder reads the text protocol and the prepared statements of the MySQL client/server protocol,
+	// a query is emitted with the rows or the error reported by the server.
+	Decoder struct {
+	}
+
+	// request is a command of the client, the server reads the statement of an execute
+	// because the number of its parameters is known from the answer to the prepare.
+	request struct {
+		command      byte
+		capabilities uint32
+		payload      []byte
+		query        *sql.Query
+	}
+
+	statement struct {
+		text   string
+		params int
+		types  []uint16
+	}
+
+	// reader reads the fields of a packet.
+	reader struct {
+		b   []byte
+		err error
+	}
+)
+
+func (r *reader) next(n int) []byte {
+	if r.err != nil || n < 0 || len(r.b) < n {
+		r.err = errMalformedPacket
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *reader) uint(n int) uint64 {
+	var v uint64
+	for i, c := range r.next(n) {
+		v |= uint64(c) << (8 * i)
+	}
+	return v
+}
+
+// lenenc reads a length encoded integer.
+func (r *reader) lenenc() uint64 {
+	b := r.next(1)
+	if b == nil {
+		return 0
+	}
+	switch b[0] {
+	case 0xfc:
+		return r.uint(2)
+	case 0xfd:
+		return r.uint(3)
+	case 0xfe:
+		return r.uint(8)
+	}
+	return uint64(b[0])
+}
+
+func (r *reader) lenencString() []byte {
+	n := r.lenenc()
+	if n > maxStatementSize {
+		r.err = errMalformedPacket
+		return nil
+	}
+	return r.next(int(n))
+}
+
+func (r *reader) nulString() string {
+	pos := bytes.IndexByte(r.b, 0)
+	if r.err != nil || pos < 0 {
+		r.err = errMalformedPacket
+		return ""
+	}
+	s := string(r.b[:pos])
+	r.b = r.b[pos+1:]
+	return s
+}
+
+// readPacket reads a packet, payloads of 16MB and more are split into several packets.
+func readPacket(br *bufio.Reader) (seq byte, payload []byte, err error) {
+	var header [4]byte
+	for {
+		if _, err = io.ReadFull(br, header[:]); err != nil {
+			return
+		}
+		size := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+		if len(payload)+size > maxStatementSize {
+			return 0, nil, fmt.Errorf("%w: packet too large", errMalformedPacket)
+		}
+		if payload == nil {
+			seq = header[3]
+		}
+		n := len(payload)
+		payload = append(payload, make([]byte, size)...)
+		if _, err = io.ReadFull(br, payload[n:]); err != nil {
+			return
+		}
+		if size < maxPacketSize {
+			return
+		}
+	}
+}
+
+func isEOF(payload []byte) bool {
+	return len(payload) > 0 && payload[0] == 0xfe && len(payload) < maxPacketSize
+}
+
+// readError reads the code, the sql state and the message of an ERR packet.
+func readError(payload []byte) (code, message string) {
+	r := &reader{b: payload[1:]}
+	n := r.uint(2)
+	if len(r.b) >= 6 && r.b[0] == '#' {
+		code = string(r.next(6)[1:])
+	} else {
+		code = fmt.Sprint(n)
+	}
+	return code, string(r.b)
+}
+
+// readValue reads a value of the binary protocol.
+func readValue(r *reader, typ uint16) interface{} {
+	unsigned := typ&0x8000 != 0
+	switch typ & 0xff {
+	case typeNull:
+		return nil
+	case typeTiny:
+		if unsigned {
+			return r.uint(1)
+		}
+		return int64(int8(r.uint(1)))
+	case typeShort, typeYear:
+		if unsigned {
+			return r.uint(2)
+		}
+		return int64(int16(r.uint(2)))
+	case typeLong, typeInt24:
+		if unsigned {
+			return r.uint(4)
+		}
+		return int64(int32(r.uint(4)))
+	case typeLongLong:
+		if unsigned {
+			return r.uint(8)
+		}
+		return int64(r.uint(8))
+	case typeFloat:
+		return float64(math.Float32frombits(uint32(r.uint(4))))
+	case typeDouble:
+		return math.Float64frombits(r.uint(8))
+	case typeDate, typeTimestamp, typeDateTime:
+		b := &reader{b: r.next(int(r.uint(1)))}
+		var year, month, day, hour, minute, second, micro uint64
+		if len(b.b) >= 4 {
+			year, month, day = b.uint(2), b.uint(1), b.uint(1)
+		}
+		if len(b.b) >= 3 {
+			hour, minute, second = b.uint(1), b.uint(1), b.uint(1)
+		}
+		if len(b.b) >= 4 {
+			micro = b.uint(4)
+		}
+		if typ&0xff == typeDate {
+			return fmt.Sprintf("%04d-%02d-%02d", year, month, day)
+		}
+		return fmt.Sprintf("%04d-%02d-%02d %02d:%02d:%02d.%06d", year, month, day, hour, minute, second, micro)
+	case typeTime:
+		b := &reader{b: r.next(int(r.uint(1)))}
+		if len(b.b) < 8 {
+			return "00:00:00"
+		}
+		sign := ""
+		if b.uint(1) == 1 {
+			sign = "-"
+		}
+		days, hour, minute, second := b.uint(4), b.uint(1), b.uint(1), b.uint(1)
+		return fmt.Sprintf("%s%02d:%02d:%02d", sign, days*24+hour, minute, second)
+	}
+	//strings, decimals, blobs and json are length encoded
+	b := r.lenencString()
+	if !utf8.Valid(b) {
+		return append([]byte{}, b...)
+	}
+	return string(b)
+}
+
+// readParams reads the null bitmap, the types and the values of n parameters,
+// the types are only sent when they are bound for the first time.
+func readParams(r *reader, n int, types []uint16, withNames bool) (params []interface{}, bound []uint16) {
+	nulls := r.next((n + 7) / 8)
+	bound = types
+	if r.uint(1) == 1 {
+		bound = make([]uint16, n)
+		for i := range bound {
+			bound[i] = uint16(r.uint(2))
+			if withNames {
+				r.lenencString()
+			}
+		}
+	}
+	if r.err != nil || len(bound) < n {
+		return nil, types
+	}
+	params = make([]interface{}, 0, n)
+	for i := 0; i < n; i++ {
+		if nulls[i/8]&(1<<(i%8)) != 0 {
+			params = append(params, nil)
+			continue
+		}
+		params = append(params, readValue(r, bound[i]))
+	}
+	if r.err != nil {
+		return nil, types
+	}
+	return
+}
+
+// readStatement reads the query of a COM_QUERY, the query attributes of newer clients come first.
+func readStatement(payload []byte, capabilities uint32) (text string, err error) {
+	r := &reader{b: payload[1:]}
+	if capabilities&capabilityQueryAttributes != 0 {
+		n := int(r.lenenc())
+		r.lenenc()
+		if n > 0 {
+			readParams(r, n, nil, true)
+		}
+		if r.err != nil {
+			return "", r.err
+		}
+	}
+	return string(r.b), nil
+}
+
+func (d *Decoder) newQuery(conn *decoder.Conn, user, database, text string, startedAt time.Time) *sql.Query {
+	return &sql.Query{
+		Dialect:   sql.DialectMySQL,
+		Client:    conn.Client,
+		Server:    conn.Server,
+		User:      user,
+		Database:  database,
+		Text:      text,
+		StartedAt: startedAt,
+	}
+}
+
+// readHandshake reads the handshake response of the client, false is returned
+// when the connection switches to tls.
+func (d *Decoder) readHandshake(conn *decoder.Conn) (capabilities uint32, user, database string, ok bool) {
+	_, payload, err := readPacket(conn.Up.Reader())
+	if err != nil {
+		if !errors.Is(err, io.ErrClosedPipe) {
+			conn.Logf("read mysql handshake error: %s", err.Error())
+			conn.Report(err)
+		}
+		return
+	}
+	r := &reader{b: payload}
+	capabilities = uint32(r.uint(4))
+	if capabilities&capabilityProtocol41 == 0 {
+		conn.Logf("read mysql handshake error: protocol older than 4.1")
+		conn.ParseError()
+		return
+	}
+	r.next(4 + 1 + 23)
+	//the ssl request is cut after the filler
+	if capabilities&capabilitySSL != 0 && len(r.b) == 0 {
+		return
+	}
+	user = r.nulString()
+	switch {
+	case capabilities&capabilityPluginAuthLenenc != 0:
+		r.lenencString()
+	case capabilities&capabilitySecureConnection != 0:
+		r.next(int(r.uint(1)))
+	default:
+		r.nulString()
+	}
+	if capabilities&capabilityConnectWithDB != 0 {
+		database = r.nulString()
+	}
+	return capabilities, user, database, r.err == nil
+}
+
+func (d *Decoder) readCommands(conn *decoder.Conn, q *decoder.Queue, emit decoder.EmitFunc) {
+	var (
+		err     error
+		pos     int64
+		seq     byte
+		payload []byte
+	)
+	defer q.Close()
+	capabilities, user, database, ok := d.readHandshake(conn)
+	if !ok {
+		conn.Ignore()
+		conn.Discard()
+		return
+	}
+	for {
+		pos = conn.Up.Position()
+		if seq, payload, err = readPacket(conn.Up.Reader()); err != nil {
+			if !errors.Is(err, io.ErrClosedPipe) {
+				conn.Logf("read mysql command error: %s", err.Error())
+				conn.Report(err)
+			}
+			conn.Up.Discard()
+			return
+		}
+		//a command starts a new sequence, the others answer the authentication or a local infile request
+		if seq != 0 || len(payload) == 0 {
+			continue
+		}
+		req := &request{command: payload[0], capabilities: capabilities}
+		startedAt := conn.Up.Timestamp(pos)
+		switch payload[0] {
+		case comQuit:
+			return
+		case comBinlogDump, comBinlogDumpGTID:
+			//a replica streams the binlog from here on
+			conn.Ignore()
+			conn.Discard()
+			return
+		case comInitDB:
+			database = string(payload[1:])
+		case comQuery:
+			var text string
+			if text, err = readStatement(payload, capabilities); err != nil {
+				conn.Logf("read mysql query error: %s", err.Error())
+				conn.Report(err)
+				continue
+			}
+			req.query = d.newQuery(conn, user, database, text, startedAt)
+		case comStmtPrepare:
+			req.query = d.newQuery(conn, user, database, string(payload[1:]), startedAt)
+		case comStmtClose:
+			req.payload = payload
+		case comStmtExecute:
+			req.payload = payload
+			req.query = d.newQuery(conn, user, database, "", startedAt)
+			req.query.Prepared = true
+		}
+		if req.query != nil {
+			req.query.Size = len(payload) + 4
+			req.query.Gap = conn.Up.Gap(pos, conn.Up.Position()-1)
+		}
+		if dropped := q.Push(req); dropped != nil {
+			if req := dropped.(*request); req.query != nil && req.command != comStmtPrepare {
+				emit(req.query)
+			}
+		}
+	}
+}
+
+// readResult reads the answer to a query or an execute, which is an OK, an ERR or one or more result sets.
+func (d *Decoder) readResult(br *bufio.Reader, payload []byte, deprecateEOF bool, query *sql.Query) (err error) {
+	for {
+		var status uint16
+		switch payload[0] {
+		case 0x00:
+			r := &reader{b: payload[1:]}
+			query.Rows += int64(r.lenenc())
+			r.lenenc()
+			status = uint16(r.uint(2))
+		case 0xff:
+			query.ErrorCode, query.Error = readError(payload)
+			return
+		case 0xfb:
+			//the client sends the file of a load data local infile, the server answers with OK or ERR
+		default:
+			r := &reader{b: payload}
+			columns := int(r.lenenc())
+			if !deprecateEOF {
+				columns++
+			}
+			for i := 0; i < columns; i++ {
+				if _, _, err = readPacket(br); err != nil {
+					return
+				}
+			}
+			for {
+				if _, payload, err = readPacket(br); err != nil {
+					return
+				}
+				if len(payload) > 0 && payload[0] == 0xff {
+					query.ErrorCode, query.Error = readError(payload)
+					return
+				}
+				if isEOF(payload) {
+					break
+				}
+				query.Rows++
+			}
+			r = &reader{b: payload[1:]}
+			if deprecateEOF {
+				r.lenenc()
+				r.lenenc()
+			} else {
+				r.uint(2)
+			}
+			status = uint16(r.uint(2))
+		}
+		if payload[0] != 0xfb && status&statusMoreResults == 0 {
+			return
+		}
+		if _, payload, err = readPacket(br); err != nil {
+			return
+		}
+		if len(payload) == 0 {
+			return errMalformedPacket
+		}
+	}
+}
+
+// readPrepare reads the answer to a prepare, which is followed by the definitions of the parameters and columns.
+func (d *Decoder) readPrepare(br *bufio.Reader, payload []byte, deprecateEOF bool, query *sql.Query, statements map[uint32]*statement) (err error) {
+	if payload[0] == 0xff {
+		query.ErrorCode, query.Error = readError(payload)
+		return
+	}
+	r := &reader{b: payload[1:]}
+	id := uint32(r.uint(4))
+	columns, params := int(r.uint(2)), int(r.uint(2))
+	if r.err != nil {
+		return r.err
+	}
+	statements[id] = &statement{text: query.Text, params: params}
+	for _, n := range []int{params, columns} {
+		if n > 0 && !deprecateEOF {
+			n++
+		}
+		for i := 0; i < n; i++ {
+			if _, _, err = readPacket(br); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// readExecute reads the statement and the parameters of an execute.
+func (d *Decoder) readExecute(req *request, statements map[uint32]*statement) {
+	r := &reader{b: req.payload[1:]}
+	stmt := statements[uint32(r.uint(4))]
+	flags := r.uint(1)
+	r.uint(4)
+	if stmt == nil || r.err != nil {
+		return
+	}
+	req.query.Text = stmt.text
+	n := stmt.params
+	withNames := req.capabilities&capabilityQueryAttributes != 0
+	if withNames && flags&executeParameterCount != 0 {
+		n = int(r.lenenc())
+	}
+	if n > 0 {
+		req.query.Params, stmt.types = readParams(r, n, stmt.types, withNames)
+	}
+}
+
+// readResponses pairs the responses with the commands, gap reports whether bytes were missing
+// in the response which could not be read.
+func (d *Decoder) readResponses(conn *decoder.Conn, q *decoder.Queue, statements map[uint32]*statement, emit decoder.EmitFunc) (gap bool) {
+	var (
+		err     error
+		pos     int64
+		payload []byte
+	)
+	br := conn.Down.Reader()
+	//the greeting of the server and the capabilities it offers
+	if _, payload, err = readPacket(br); err != nil || len(payload) == 0 || payload[0] != 10 {
+		return
+	}
+	r := &reader{b: payload[1:]}
+	r.nulString()
+	r.next(4 + 8 + 1)
+	capabilities := uint32(r.uint(2))
+	r.next(1 + 2)
+	capabilities |= uint32(r.uint(2)) << 16
+	//the authentication ends with an OK or an ERR
+	for {
+		if _, payload, err = readPacket(br); err != nil {
+			return
+		}
+		if len(payload) > 0 && (payload[0] == 0x00 || payload[0] == 0xff) {
+			break
+		}
+	}
+	if payload[0] == 0xff {
+		code, message := readError(payload)
+		conn.Logf("mysql authentication error: %s %s", code, message)
+	}
+	for {
+		pos = conn.Down.Position()
+		if _, payload, err = readPacket(br); err != nil {
+			if !errors.Is(err, io.ErrClosedPipe) {
+				conn.Logf("read mysql response error: %s", err.Error())
+				conn.Report(err)
+			}
+			gap = conn.Down.Gap(pos, conn.Down.Position())
+			conn.Down.Discard()
+			return
+		}
+		if len(payload) == 0 {
+			continue
+		}
+		first := conn.Down.Timestamp(pos)
+		var req *request
+		for req == nil {
+			item, ok := q.Pop()
+			if !ok {
+				return
+			}
+			req = item.(*request)
+			//these commands have no answer
+			switch req.command {
+			case comStmtClose:
+				r := &reader{b: req.payload[1:]}
+				delete(statements, uint32(r.uint(4)))
+				req = nil
+			case comStmtSendLongData:
+				req = nil
+			}
+		}
+		deprecateEOF := req.capabilities&capabilities&capabilityDeprecateEOF != 0
+		switch req.command {
+		case comQuery:
+			err = d.readResult(br, payload, deprecateEOF, req.query)
+		case comStmtExecute:
+			d.readExecute(req, statements)
+			err = d.readResult(br, payload, deprecateEOF, req.query)
+		case comStmtPrepare:
+			err = d.readPrepare(br, payload, deprecateEOF, req.query, statements)
+		case comStatistics:
+		default:
+			//field lists end with an EOF, the other commands answer with OK or ERR
+			for payload[0] != 0x00 && payload[0] != 0xff && !isEOF(payload) {
+				if _, payload, err = readPacket(br); err != nil || len(payload) == 0 {
+					break
+				}
+			}
+		}
+		if err != nil {
+			if !errors.Is(err, io.ErrClosedPipe) {
+				conn.Logf("read mysql response error: %s", err.Error())
+				conn.Report(err)
+			}
+			//the result of the query is incomplete, it is kept when bytes of it were missing
+			if req.query != nil && conn.Down.Gap(pos, conn.Down.Position()) {
+				req.query.FirstByteAt, req.query.Gap = first, true
+				emit(req.query)
+			}
+			conn.Down.Discard()
+			return
+		}
+		if req.query == nil {
+			continue
+		}
+		req.query.FirstByteAt = first
+		req.query.Gap = req.query.Gap || conn.Down.Gap(pos, conn.Down.Position()-1)
+		req.query.Complete(conn.Down.Timestamp(conn.Down.Position() - 1))
+		//the query of a prepare is only emitted when the statement can not be prepared
+		if req.command != comStmtPrepare || req.query.Error != "" {
+			emit(req.query)
+		}
+	}
+}
+
+func (d *Decoder) Name() string {
+	return "mysql"
+}
+
+// Sniff accepts the greeting of a server, the protocol version 10 is followed by the server version.
+func (d *Decoder) Sniff(b []byte, fromClient bool) bool {
+	if fromClient || len(b) < 6 || b[3] != 0 || b[4] != 10 {
+		return false
+	}
+	size := int(b[0]) | int(b[1])<<8 | int(b[2])<<16
+	if size < 32 || size > 1024 {
+		return false
+	}
+	pos := bytes.IndexByte(b[5:], 0)
+	if pos < 1 {
+		return false
+	}
+	for _, c := range b[5 : 5+pos] {
+		if c < ' ' || c >= 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *Decoder) Decode(conn *decoder.Conn, emit decoder.EmitFunc) {
+	var (
+		wg sync.WaitGroup
+	)
+	q := decoder.NewQueue(maxPending)
+	statements := make(map[uint32]*statement)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		d.readCommands(conn, q, emit)
+	}()
+	gap := d.readResponses(conn, q, statements, emit)
+	wg.Wait()
+	//queries which have not been answered before the connection was closed
+	for {
+		item, ok := q.Pop()
+		if !ok {
+			break
+		}
+		req := item.(*request)
+		if req.command == comStmtExecute {
+			d.readExecute(req, statements)
+		}
+		if req.query != nil && req.command != comStmtPrepare {
+			req.query.Gap = req.query.Gap || gap
+			emit(req.query)
+		}
+	}
+}
+
+func New() *Decoder {
+	return &Decoder{}
+}
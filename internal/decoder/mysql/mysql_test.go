@@ -0,0 +1,267 @@
+package mysql
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/uole/httpcap/internal/decoder"
+	"github.com/uole/httpcap/sql"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	capabilities = capabilityProtocol41 | capabilitySecureConnection | capabilityPluginAuthLenenc | capabilityConnectWithDB
+)
+
+func packet(seq byte, payload ...[]byte) []byte {
+	b := bytes.Join(payload, nil)
+	return append([]byte{byte(len(b)), byte(len(b) >> 8), byte(len(b) >> 16), seq}, b...)
+}
+
+func uint16le(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.LittleEndian.PutUint16(b, v)
+	return b
+}
+
+func uint32le(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return b
+}
+
+func lenencString(s string) []byte {
+	return append([]byte{byte(len(s))}, s...)
+}
+
+func greeting(caps uint32) []byte {
+	return packet(0,
+		[]byte{10}, []byte("8.0.36\x00"), uint32le(7), []byte("abcdefgh\x00"),
+		uint16le(uint16(caps)), []byte{0xff}, uint16le(2), uint16le(uint16(caps>>16)),
+		[]byte{21}, make([]byte, 10), []byte("ijklmnopqrst\x00"), []byte("mysql_native_password\x00"),
+	)
+}
+
+func handshakeResponse(caps uint32) []byte {
+	return packet(1, uint32le(caps), uint32le(1<<24), []byte{0xff}, make([]byte, 23),
+		[]byte("alice\x00"), lenencString("01234567890123456789"), []byte("shop\x00"))
+}
+
+func ok(seq byte, affected byte) []byte {
+	return packet(seq, []byte{0x00, affected, 0x00}, uint16le(2), uint16le(0))
+}
+
+func eof(seq byte, deprecateEOF bool) []byte {
+	if deprecateEOF {
+		return packet(seq, []byte{0xfe, 0x00, 0x00}, uint16le(2), uint16le(0))
+	}
+	return packet(seq, []byte{0xfe}, uint16le(0), uint16le(2))
+}
+
+// resultSet is a result of one column with a row for each value.
+func resultSet(deprecateEOF bool, values ...string) []byte {
+	var b bytes.Buffer
+	seq := byte(1)
+	next := func() byte {
+		seq++
+		return seq - 1
+	}
+	b.Write(packet(next(), []byte{1}))
+	b.Write(packet(next(), lenencString("def"), lenencString("shop"), lenencString("t"), lenencString("t"), lenencString("id"), lenencString("id"),
+		[]byte{0x0c}, uint16le(63), uint32le(11), []byte{typeLongLong}, uint16le(0), []byte{0}, uint16le(0)))
+	if !deprecateEOF {
+		b.Write(eof(next(), false))
+	}
+	for _, v := range values {
+		b.Write(packet(next(), lenencString(v)))
+	}
+	b.Write(eof(next(), deprecateEOF))
+	return b.Bytes()
+}
+
+func errorPacket(seq byte, code uint16, state, message string) []byte {
+	return packet(seq, []byte{0xff}, uint16le(code), []byte("#"+state+message))
+}
+
+// decode hands both directions to the decoder and returns the queries it emits.
+func decode(up, down []byte) (queries []*sql.Query) {
+	var (
+		mutex sync.Mutex
+	)
+	conn := decoder.NewConn(1, "10.0.0.1:50000", "10.0.0.2:3306", nil)
+	at := time.Unix(1700000000, 0)
+	_ = conn.Up.PutBytes(up, at, at)
+	_ = conn.Down.PutBytes(down, at, at)
+	conn.Close()
+	New().Decode(conn, func(e decoder.Exchange) {
+		mutex.Lock()
+		queries = append(queries, e.(*sql.Query))
+		mutex.Unlock()
+	})
+	return
+}
+
+func TestDecode(t *testing.T) {
+	type result struct {
+		text      string
+		params    []interface{}
+		prepared  bool
+		rows      int64
+		errorCode string
+		completed bool
+	}
+	join := func(b ...[]byte) []byte {
+		return bytes.Join(b, nil)
+	}
+	tests := []struct {
+		name string
+		caps uint32
+		up   []byte
+		down []byte
+		want []result
+	}{
+		{
+			name: "queries",
+			caps: capabilities,
+			up: join(
+				packet(0, []byte{comQuery}, []byte("SELECT id FROM t")),
+				packet(0, []byte{comQuery}, []byte("UPDATE t SET x = 1")),
+				packet(0, []byte{comInitDB}, []byte("other")),
+				packet(0, []byte{comQuery}, []byte("SELEC 1")),
+			),
+			down: join(resultSet(false, "1", "2", "3"), ok(1, 4), ok(1, 0), errorPacket(1, 1064, "42000", "You have an error in your SQL syntax")),
+			want: []result{
+				{text: "SELECT id FROM t", rows: 3, completed: true},
+				{text: "UPDATE t SET x = 1", rows: 4, completed: true},
+				{text: "SELEC 1", errorCode: "42000", completed: true},
+			},
+		},
+		{
+			name: "deprecated eof",
+			caps: capabilities | capabilityDeprecateEOF,
+			up:   packet(0, []byte{comQuery}, []byte("SELECT id FROM t")),
+			down: resultSet(true, "1", "2"),
+			want: []result{{text: "SELECT id FROM t", rows: 2, completed: true}},
+		},
+		{
+			name: "prepared statement",
+			caps: capabilities,
+			up: join(
+				packet(0, []byte{comStmtPrepare}, []byte("SELECT id FROM t WHERE id = ? AND name = ?")),
+				packet(0, []byte{comStmtExecute}, uint32le(1), []byte{0}, uint32le(1), []byte{0}, []byte{1},
+					[]byte{typeLongLong, 0}, []byte{0xfd, 0}, []byte{42, 0, 0, 0, 0, 0, 0, 0}, lenencString("bob")),
+				//the types are only sent with the first execute
+				packet(0, []byte{comStmtExecute}, uint32le(1), []byte{0}, uint32le(1), []byte{0x02}, []byte{0},
+					[]byte{7, 0, 0, 0, 0, 0, 0, 0}),
+				packet(0, []byte{comStmtClose}, uint32le(1)),
+				packet(0, []byte{comQuery}, []byte("SELECT 1")),
+			),
+			down: join(
+				packet(1, []byte{0x00}, uint32le(1), uint16le(1), uint16le(2), []byte{0}, uint16le(0)),
+				packet(2, []byte("param")), packet(3, []byte("param")), eof(4, false),
+				packet(5, []byte("column")), eof(6, false),
+				resultSet(false, "42"),
+				resultSet(false),
+				resultSet(false, "1"),
+			),
+			want: []result{
+				{text: "SELECT id FROM t WHERE id = ? AND name = ?", params: []interface{}{int64(42), "bob"}, prepared: true, rows: 1, completed: true},
+				{text: "SELECT id FROM t WHERE id = ? AND name = ?", params: []interface{}{int64(7), nil}, prepared: true, completed: true},
+				{text: "SELECT 1", rows: 1, completed: true},
+			},
+		},
+		{
+			name: "statement which can not be prepared",
+			caps: capabilities,
+			up:   packet(0, []byte{comStmtPrepare}, []byte("SELEC ?")),
+			down: errorPacket(1, 1064, "42000", "syntax error"),
+			want: []result{{text: "SELEC ?", prepared: false, errorCode: "42000", completed: true}},
+		},
+		{
+			name: "unanswered",
+			caps: capabilities,
+			up:   packet(0, []byte{comQuery}, []byte("SELECT SLEEP(60)")),
+			want: []result{{text: "SELECT SLEEP(60)"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			up := join(handshakeResponse(tt.caps), tt.up)
+			down := join(greeting(tt.caps), ok(2, 0), tt.down)
+			queries := decode(up, down)
+			if len(queries) != len(tt.want) {
+				t.Fatalf("%d queries are emitted, want %d", len(queries), len(tt.want))
+			}
+			for i, q := range queries {
+				got := result{
+					text:      q.Text,
+					params:    q.Params,
+					prepared:  q.Prepared,
+					rows:      q.Rows,
+					errorCode: q.ErrorCode,
+					completed: q.Completed(),
+				}
+				if !reflect.DeepEqual(got, tt.want[i]) {
+					t.Errorf("query %d is %+v, want %+v", i, got, tt.want[i])
+				}
+				if q.User != "alice" {
+					t.Errorf("query %d is of %s", i, q.User)
+				}
+			}
+			if len(queries) > 0 && queries[0].Database != "shop" {
+				t.Errorf("database is %s", queries[0].Database)
+			}
+		})
+	}
+}
+
+func TestReadValue(t *testing.T) {
+	tests := []struct {
+		name string
+		typ  uint16
+		b    []byte
+		want interface{}
+	}{
+		{name: "tiny", typ: typeTiny, b: []byte{0xff}, want: int64(-1)},
+		{name: "unsigned tiny", typ: typeTiny | 0x8000, b: []byte{0xff}, want: uint64(255)},
+		{name: "long", typ: typeLong, b: []byte{0xfe, 0xff, 0xff, 0xff}, want: int64(-2)},
+		{name: "double", typ: typeDouble, b: []byte{0, 0, 0, 0, 0, 0, 0xf8, 0x3f}, want: 1.5},
+		{name: "date", typ: typeDate, b: []byte{4, 0xe8, 0x07, 2, 29}, want: "2024-02-29"},
+		{name: "datetime", typ: typeDateTime, b: []byte{7, 0xe8, 0x07, 2, 29, 13, 14, 15}, want: "2024-02-29 13:14:15.000000"},
+		{name: "time", typ: typeTime, b: []byte{8, 1, 1, 0, 0, 0, 2, 3, 4}, want: "-26:03:04"},
+		{name: "string", typ: 0xfd, b: lenencString("bob"), want: "bob"},
+		{name: "blob", typ: 0xfc, b: []byte{2, 0xff, 0xfe}, want: []byte{0xff, 0xfe}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &reader{b: tt.b}
+			if got := readValue(r, tt.typ); !reflect.DeepEqual(got, tt.want) || r.err != nil {
+				t.Errorf("value is %#v (%v), want %#v", got, r.err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSniff(t *testing.T) {
+	d := New()
+	tests := []struct {
+		name       string
+		b          []byte
+		fromClient bool
+		want       bool
+	}{
+		{name: "greeting", b: greeting(capabilities), want: true},
+		{name: "from the client", b: greeting(capabilities), fromClient: true},
+		{name: "error packet", b: errorPacket(0, 1130, "HY000", "Host is not allowed to connect")},
+		{name: "http", b: []byte("HTTP/1.1 200 OK\r\n")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := d.Sniff(tt.b, tt.fromClient); got != tt.want {
+				t.Errorf("sniff is %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
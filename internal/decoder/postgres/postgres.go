@@ -0,0 +1,623 @@
+package postgres
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/uole/httpcap/internal/decoder"
+	"github.com/uole/httpcap/sql"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	protocolVersion3  = 196608
+	sslRequestCode    = 80877103
+	gssencRequestCode = 80877104
+
+	//messages larger than this are not buffered, e.g. a huge copy
+	maxMessageSize = 64 * 1024 * 1024
+	maxPending     = 4096
+)
+
+const (
+	kindStartup byte = iota
+	kindEncrypt
+	kindQuery
+	kindParse
+	kindBind
+	kindDescribe
+	kindExecute
+	kindClose
+	kindSync
+	kindFunction
+)
+
+var (
+	errMalformedMessage = errors.New("malformed postgres message")
+)
+
+type (
+	// Decoder reads the simple and the extended query protocol of PostgreSQL 3.0,
+	// a query is emitted with the rows or the error reported by the server.
+	Decoder struct {
+	}
+
+	// request is a message of the client which is answered by the server, e.g. a Parse.
+	request struct {
+		kind  byte
+		query *sql.Query
+		rows  int64
+		//encryption requests wait for the single byte answer of the server
+		accepted chan bool
+	}
+
+	statement struct {
+		text  string
+		types []uint32
+	}
+
+	portal struct {
+		statement *statement
+		params    []interface{}
+		size      int
+		gap       bool
+	}
+)
+
+func readMessage(br *bufio.Reader) (typ byte, body []byte, err error) {
+	var header [5]byte
+	if _, err = io.ReadFull(br, header[:]); err != nil {
+		return
+	}
+	size := int(binary.BigEndian.Uint32(header[1:]))
+	if size < 4 || size > maxMessageSize {
+		return 0, nil, fmt.Errorf("%w: invalid length %d", errMalformedMessage, size)
+	}
+	body = make([]byte, size-4)
+	if _, err = io.ReadFull(br, body); err != nil {
+		return
+	}
+	return header[0], body, nil
+}
+
+func readStartup(br *bufio.Reader) (code uint32, body []byte, err error) {
+	var header [8]byte
+	if _, err = io.ReadFull(br, header[:]); err != nil {
+		return
+	}
+	size := int(binary.BigEndian.Uint32(header[:4]))
+	if size < 8 || size > 10240 {
+		return 0, nil, fmt.Errorf("%w: invalid startup length %d", errMalformedMessage, size)
+	}
+	body = make([]byte, size-8)
+	if _, err = io.ReadFull(br, body); err != nil {
+		return
+	}
+	return binary.BigEndian.Uint32(header[4:]), body, nil
+}
+
+func readString(b []byte) (s string, rest []byte, err error) {
+	pos := bytes.IndexByte(b, 0)
+	if pos < 0 {
+		return "", nil, errMalformedMessage
+	}
+	return string(b[:pos]), b[pos+1:], nil
+}
+
+func readInt16(b []byte) (n int, rest []byte, err error) {
+	if len(b) < 2 {
+		return 0, nil, errMalformedMessage
+	}
+	return int(int16(binary.BigEndian.Uint16(b))), b[2:], nil
+}
+
+// decodeParam converts a parameter, binary values are only decoded for the common types.
+func decodeParam(b []byte, binaryFormat bool, oid uint32) interface{} {
+	if !binaryFormat {
+		return string(b)
+	}
+	switch {
+	case oid == 16 && len(b) == 1:
+		return b[0] == 1
+	case oid == 21 && len(b) == 2:
+		return int64(int16(binary.BigEndian.Uint16(b)))
+	case oid == 23 && len(b) == 4:
+		return int64(int32(binary.BigEndian.Uint32(b)))
+	case oid == 20 && len(b) == 8:
+		return int64(binary.BigEndian.Uint64(b))
+	case oid == 700 && len(b) == 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b)))
+	case oid == 701 && len(b) == 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(b))
+	case oid == 25 || oid == 1043 || oid == 114:
+		//text, varchar and json are sent as is
+		return string(b)
+	case oid == 3802 && len(b) > 0 && b[0] == 1:
+		//jsonb starts with its version
+		return string(b[1:])
+	case oid == 2950 && len(b) == 16:
+		return fmt.Sprintf("%x-%x-%x-%x-%x", b[:4], b[4:6], b[6:8], b[8:10], b[10:])
+	}
+	return append([]byte{}, b...)
+}
+
+// readBind reads the portal, the statement and the parameters of a Bind message.
+func readBind(b []byte, statements map[string]*statement) (name string, p *portal, err error) {
+	var (
+		stmtName string
+		n        int
+	)
+	if name, b, err = readString(b); err != nil {
+		return
+	}
+	if stmtName, b, err = readString(b); err != nil {
+		return
+	}
+	p = &portal{statement: statements[stmtName]}
+	if p.statement == nil {
+		p.statement = &statement{}
+	}
+	if n, b, err = readInt16(b); err != nil || n < 0 || len(b) < n*2 {
+		return "", nil, errMalformedMessage
+	}
+	formats := make([]bool, n)
+	for i := range formats {
+		formats[i] = binary.BigEndian.Uint16(b[i*2:]) == 1
+	}
+	b = b[n*2:]
+	if n, b, err = readInt16(b); err != nil || n < 0 {
+		return "", nil, errMalformedMessage
+	}
+	p.params = make([]interface{}, 0, n)
+	for i := 0; i < n; i++ {
+		if len(b) < 4 {
+			return "", nil, errMalformedMessage
+		}
+		size := int(int32(binary.BigEndian.Uint32(b)))
+		b = b[4:]
+		if size < 0 {
+			p.params = append(p.params, nil)
+			continue
+		}
+		if len(b) < size {
+			return "", nil, errMalformedMessage
+		}
+		//no format code means text, a single one applies to every parameter
+		binaryFormat := false
+		if len(formats) == 1 {
+			binaryFormat = formats[0]
+		} else if i < len(formats) {
+			binaryFormat = formats[i]
+		}
+		var oid uint32
+		if i < len(p.statement.types) {
+			oid = p.statement.types[i]
+		}
+		p.params = append(p.params, decodeParam(b[:size], binaryFormat, oid))
+		b = b[size:]
+	}
+	return
+}
+
+// readError reads the code and the message of an ErrorResponse.
+func readError(b []byte) (code, message string) {
+	for len(b) > 1 && b[0] != 0 {
+		field := b[0]
+		value, rest, err := readString(b[1:])
+		if err != nil {
+			break
+		}
+		switch field {
+		case 'C':
+			code = value
+		case 'M':
+			message = value
+		}
+		b = rest
+	}
+	return
+}
+
+// tagRows returns the rows of a command tag, e.g. 1 of INSERT 0 1.
+func tagRows(tag string) int64 {
+	if pos := strings.LastIndexByte(tag, ' '); pos > -1 {
+		if n, err := strconv.ParseInt(tag[pos+1:], 10, 64); err == nil {
+			return n
+		}
+	}
+	return 0
+}
+
+func (d *Decoder) newQuery(conn *decoder.Conn, params map[string]string, text string, startedAt time.Time) *sql.Query {
+	return &sql.Query{
+		Dialect:   sql.DialectPostgres,
+		Client:    conn.Client,
+		Server:    conn.Server,
+		User:      params["user"],
+		Database:  params["database"],
+		Text:      text,
+		StartedAt: startedAt,
+	}
+}
+
+// readStartup reads the messages which come before the startup message, false is returned
+// when the connection is encrypted or is not a regular connection.
+func (d *Decoder) readStartup(conn *decoder.Conn, q *decoder.Queue) (params map[string]string, ok bool) {
+	for {
+		code, body, err := readStartup(conn.Up.Reader())
+		if err != nil {
+			if !errors.Is(err, io.ErrClosedPipe) {
+				conn.Logf("read postgres startup error: %s", err.Error())
+				conn.Report(err)
+			}
+			return nil, false
+		}
+		switch code {
+		case sslRequestCode, gssencRequestCode:
+			req := &request{kind: kindEncrypt, accepted: make(chan bool, 1)}
+			q.Push(req)
+			if accepted := <-req.accepted; accepted {
+				return nil, false
+			}
+		case protocolVersion3:
+			params = make(map[string]string)
+			for len(body) > 1 {
+				var key, value string
+				if key, body, err = readString(body); err != nil {
+					break
+				}
+				if value, body, err = readString(body); err != nil {
+					break
+				}
+				params[key] = value
+			}
+			//the database defaults to the name of the user
+			if params["database"] == "" {
+				params["database"] = params["user"]
+			}
+			q.Push(&request{kind: kindStartup})
+			return params, true
+		default:
+			//a cancel request is the only message of its connection
+			return nil, false
+		}
+	}
+}
+
+func (d *Decoder) readFrontend(conn *decoder.Conn, q *decoder.Queue, emit decoder.EmitFunc) {
+	var (
+		err        error
+		pos        int64
+		typ        byte
+		body       []byte
+		name, text string
+		p          *portal
+	)
+	defer q.Close()
+	params, ok := d.readStartup(conn, q)
+	if !ok {
+		conn.Ignore()
+		conn.Discard()
+		return
+	}
+	statements := make(map[string]*statement)
+	portals := make(map[string]*portal)
+	push := func(req *request) {
+		if dropped := q.Push(req); dropped != nil {
+			if req := dropped.(*request); req.kind == kindQuery || req.kind == kindExecute {
+				emit(req.query)
+			}
+		}
+	}
+	for {
+		pos = conn.Up.Position()
+		if typ, body, err = readMessage(conn.Up.Reader()); err != nil {
+			if !errors.Is(err, io.ErrClosedPipe) {
+				conn.Logf("read postgres message error: %s", err.Error())
+				conn.Report(err)
+			}
+			conn.Up.Discard()
+			return
+		}
+		startedAt := conn.Up.Timestamp(pos)
+		gap := conn.Up.Gap(pos, conn.Up.Position()-1)
+		switch typ {
+		case 'Q':
+			if text, _, err = readString(body); err != nil {
+				conn.Logf("read postgres query error: %s", err.Error())
+				conn.Report(err)
+				continue
+			}
+			query := d.newQuery(conn, params, text, startedAt)
+			query.Size, query.Gap = len(body)+5, gap
+			push(&request{kind: kindQuery, query: query})
+		case 'P':
+			if name, body, err = readString(body); err == nil {
+				text, body, err = readString(body)
+			}
+			if err != nil {
+				conn.Logf("read postgres parse error: %s", err.Error())
+				conn.Report(err)
+				continue
+			}
+			stmt := &statement{text: text}
+			if n, rest, err := readInt16(body); err == nil && n > 0 && len(rest) >= n*4 {
+				for i := 0; i < n; i++ {
+					stmt.types = append(stmt.types, binary.BigEndian.Uint32(rest[i*4:]))
+				}
+			}
+			statements[name] = stmt
+			//the query is only emitted when the statement can not be prepared
+			query := d.newQuery(conn, params, text, startedAt)
+			query.Size, query.Gap = len(body)+5, gap
+			push(&request{kind: kindParse, query: query})
+		case 'B':
+			if name, p, err = readBind(body, statements); err != nil {
+				conn.Logf("read postgres bind error: %s", err.Error())
+				conn.Report(err)
+				continue
+			}
+			p.size, p.gap = len(body)+5, gap
+			portals[name] = p
+			push(&request{kind: kindBind})
+		case 'E':
+			if name, _, err = readString(body); err != nil {
+				conn.Logf("read postgres execute error: %s", err.Error())
+				conn.Report(err)
+				continue
+			}
+			if p = portals[name]; p == nil {
+				p = &portal{statement: &statement{}}
+			}
+			query := d.newQuery(conn, params, p.statement.text, startedAt)
+			query.Params, query.Prepared, query.Size = p.params, true, p.size+len(body)+5
+			query.Gap = p.gap || gap
+			push(&request{kind: kindExecute, query: query})
+		case 'D':
+			push(&request{kind: kindDescribe})
+		case 'C':
+			if len(body) > 1 {
+				if name, _, err = readString(body[1:]); err == nil {
+					if body[0] == 'S' {
+						delete(statements, name)
+					} else {
+						delete(portals, name)
+					}
+				}
+			}
+			push(&request{kind: kindClose})
+		case 'S':
+			push(&request{kind: kindSync})
+		case 'F':
+			push(&request{kind: kindFunction})
+		case 'X':
+			return
+		}
+	}
+}
+
+// readBackend pairs the messages of the server with the requests, gap reports whether bytes were missing
+// in messages which were not given to a query, e.g. the one which could not be read.
+func (d *Decoder) readBackend(conn *decoder.Conn, q *decoder.Queue, emit decoder.EmitFunc) (gap bool) {
+	var (
+		err  error
+		pos  int64
+		typ  byte
+		body []byte
+	)
+	br := conn.Down.Reader()
+	//the answer of an encryption request is a single byte
+	for {
+		item, ok := q.Peek()
+		if !ok {
+			return
+		}
+		req := item.(*request)
+		if req.kind != kindEncrypt {
+			break
+		}
+		c, err := br.ReadByte()
+		if err != nil {
+			req.accepted <- false
+			return
+		}
+		q.Pop()
+		req.accepted <- c == 'S' || c == 'G'
+		if c == 'S' || c == 'G' {
+			return
+		}
+	}
+	for {
+		pos = conn.Down.Position()
+		if typ, body, err = readMessage(br); err != nil {
+			if !errors.Is(err, io.ErrClosedPipe) {
+				conn.Logf("read postgres message error: %s", err.Error())
+				conn.Report(err)
+			}
+			gap = gap || conn.Down.Gap(pos, conn.Down.Position())
+			conn.Down.Discard()
+			return
+		}
+		first := conn.Down.Timestamp(pos)
+		last := conn.Down.Timestamp(conn.Down.Position() - 1)
+		gap = gap || conn.Down.Gap(pos, conn.Down.Position()-1)
+		switch typ {
+		case 'S', 'K', 'N', 'A', 'R', 'v', 'V', 'd', 'c':
+			//parameter status, notices, notifications, authentication and copy data are not answers
+			continue
+		}
+		item, ok := q.Peek()
+		if !ok {
+			return
+		}
+		req := item.(*request)
+		if req.query != nil {
+			if req.query.FirstByteAt.IsZero() {
+				req.query.FirstByteAt = first
+			}
+			req.query.Gap, gap = req.query.Gap || gap, false
+		}
+		switch typ {
+		case 'Z':
+			//ready for query ends a simple query, a sync or the startup
+			for {
+				if item, ok = q.Pop(); !ok {
+					return
+				}
+				req = item.(*request)
+				if req.kind == kindQuery || req.kind == kindExecute {
+					if !req.query.Completed() {
+						req.query.Complete(last)
+					}
+					emit(req.query)
+				}
+				if req.kind == kindQuery || req.kind == kindSync || req.kind == kindStartup || req.kind == kindFunction {
+					break
+				}
+			}
+		case '1', '2', '3':
+			q.Pop()
+		case 'n':
+			if req.kind == kindDescribe {
+				q.Pop()
+			}
+		case 'T':
+			//the row description of a describe, a query or an execute sends its own
+			if req.kind == kindDescribe {
+				q.Pop()
+			}
+		case 'D':
+			req.rows++
+		case 'C', 'I', 's':
+			tag := ""
+			if typ == 'C' {
+				tag, _, _ = readString(body)
+			}
+			switch req.kind {
+			case kindQuery:
+				//a simple query may hold several statements
+				req.query.Tag = tag
+				req.query.Rows += tagRows(tag)
+				req.query.Complete(last)
+			case kindExecute:
+				q.Pop()
+				req.query.Tag = tag
+				//a suspended portal has no tag, its rows are counted
+				if typ == 'C' {
+					req.query.Rows = tagRows(tag)
+				} else {
+					req.query.Rows = req.rows
+				}
+				req.query.Complete(last)
+				emit(req.query)
+			}
+			req.rows = 0
+		case 'E':
+			code, message := readError(body)
+			switch req.kind {
+			case kindStartup:
+				conn.Logf("postgres startup error: %s %s", code, message)
+			case kindQuery:
+				req.query.Error, req.query.ErrorCode = message, code
+				req.query.Complete(last)
+			default:
+				//the server skips the messages until the next sync
+				d.skip(q, code, message, last, emit)
+			}
+		}
+	}
+}
+
+func (d *Decoder) fail(query *sql.Query, code, message string, at time.Time) {
+	query.Error, query.ErrorCode = message, code
+	if query.FirstByteAt.IsZero() {
+		query.FirstByteAt = at
+	}
+	query.Complete(at)
+}
+
+// skip drops the requests up to the next sync after an error of the extended query protocol,
+// the queries of the skipped executes fail with the error.
+func (d *Decoder) skip(q *decoder.Queue, code, message string, at time.Time, emit decoder.EmitFunc) {
+	var (
+		failed *sql.Query
+		found  bool
+	)
+	for i := 0; ; i++ {
+		item, ok := q.Peek()
+		if !ok || item.(*request).kind == kindSync {
+			break
+		}
+		q.Pop()
+		req := item.(*request)
+		switch {
+		case i == 0 && req.kind == kindParse:
+			failed = req.query
+		case req.kind == kindExecute:
+			found = true
+			d.fail(req.query, code, message, at)
+			emit(req.query)
+		}
+	}
+	//a statement which can not be prepared and is not executed
+	if failed != nil && !found {
+		d.fail(failed, code, message, at)
+		emit(failed)
+	}
+}
+
+func (d *Decoder) Name() string {
+	return "postgres"
+}
+
+// Sniff accepts the first message of a client, either the startup message of protocol 3.0
+// or the request to encrypt the connection.
+func (d *Decoder) Sniff(b []byte, fromClient bool) bool {
+	if !fromClient || len(b) < 8 {
+		return false
+	}
+	size := binary.BigEndian.Uint32(b[:4])
+	switch binary.BigEndian.Uint32(b[4:8]) {
+	case sslRequestCode, gssencRequestCode:
+		return size == 8
+	case protocolVersion3:
+		return size > 8 && size <= 10240 && b[len(b)-1] == 0
+	}
+	return false
+}
+
+func (d *Decoder) Decode(conn *decoder.Conn, emit decoder.EmitFunc) {
+	var (
+		wg sync.WaitGroup
+	)
+	q := decoder.NewQueue(maxPending)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		d.readFrontend(conn, q, emit)
+	}()
+	gap := d.readBackend(conn, q, emit)
+	wg.Wait()
+	//queries which have not been answered before the connection was closed
+	for {
+		item, ok := q.Pop()
+		if !ok {
+			break
+		}
+		if req := item.(*request); req.kind == kindQuery || req.kind == kindExecute {
+			req.query.Gap = req.query.Gap || gap
+			emit(req.query)
+		}
+	}
+}
+
+func New() *Decoder {
+	return &Decoder{}
+}
@@ -0,0 +1,231 @@
+package postgres
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/uole/httpcap/internal/decoder"
+	"github.com/uole/httpcap/sql"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// message builds a message of the protocol, a zero type is left out like for the startup message.
+func message(typ byte, fields ...interface{}) []byte {
+	var body bytes.Buffer
+	for _, field := range fields {
+		switch v := field.(type) {
+		case string:
+			body.WriteString(v)
+			body.WriteByte(0)
+		case int16:
+			_ = binary.Write(&body, binary.BigEndian, v)
+		case int32:
+			_ = binary.Write(&body, binary.BigEndian, v)
+		case []byte:
+			body.Write(v)
+		}
+	}
+	var b bytes.Buffer
+	if typ != 0 {
+		b.WriteByte(typ)
+	}
+	_ = binary.Write(&b, binary.BigEndian, int32(body.Len()+4))
+	b.Write(body.Bytes())
+	return b.Bytes()
+}
+
+func join(messages ...[]byte) []byte {
+	return bytes.Join(messages, nil)
+}
+
+var (
+	startup = message(0, int32(protocolVersion3), "user", "alice", "database", "shop", []byte{0})
+	ready   = message('Z', []byte{'I'})
+	//the answer to the startup, the parameters and the key are no answers to a request
+	authenticated = join(message('R', int32(0)), message('S', "server_version", "16.2"), message('K', int32(1), int32(2)), ready)
+)
+
+// decode hands both directions to the decoder and returns the queries it emits.
+func decode(up, down []byte) (queries []*sql.Query) {
+	var (
+		mutex sync.Mutex
+	)
+	conn := decoder.NewConn(1, "10.0.0.1:50000", "10.0.0.2:5432", nil)
+	at := time.Unix(1700000000, 0)
+	_ = conn.Up.PutBytes(up, at, at)
+	_ = conn.Down.PutBytes(down, at, at)
+	conn.Close()
+	New().Decode(conn, func(e decoder.Exchange) {
+		mutex.Lock()
+		queries = append(queries, e.(*sql.Query))
+		mutex.Unlock()
+	})
+	return
+}
+
+func TestDecode(t *testing.T) {
+	type result struct {
+		text      string
+		params    []interface{}
+		prepared  bool
+		rows      int64
+		tag       string
+		errorCode string
+		completed bool
+	}
+	rowDescription := message('T', int16(1), "id", int32(0), int16(0), int32(23), int16(4), int32(-1), int16(0))
+	row := func(v string) []byte {
+		return message('D', int16(1), int32(len(v)), []byte(v))
+	}
+	tests := []struct {
+		name string
+		up   []byte
+		down []byte
+		want []result
+	}{
+		{
+			name: "simple query",
+			up:   join(startup, message('Q', "SELECT id FROM orders")),
+			down: join(authenticated, rowDescription, row("1"), row("2"), message('C', "SELECT 2"), ready),
+			want: []result{{text: "SELECT id FROM orders", rows: 2, tag: "SELECT 2", completed: true}},
+		},
+		{
+			name: "several statements in a simple query",
+			up:   join(startup, message('Q', "UPDATE a SET x = 1; DELETE FROM b")),
+			down: join(authenticated, message('C', "UPDATE 3"), message('C', "DELETE 2"), ready),
+			want: []result{{text: "UPDATE a SET x = 1; DELETE FROM b", rows: 5, tag: "DELETE 2", completed: true}},
+		},
+		{
+			name: "error",
+			up:   join(startup, message('Q', "SELEC 1")),
+			down: join(authenticated, message('E', []byte{'S'}, "ERROR", []byte{'C'}, "42601", []byte{'M'}, "syntax error at or near \"SELEC\"", []byte{0}), ready),
+			want: []result{{text: "SELEC 1", errorCode: "42601", completed: true}},
+		},
+		{
+			name: "extended query",
+			up: join(startup,
+				message('P', "s1", "SELECT id FROM orders WHERE id = $1 AND note = $2", int16(2), int32(23), int32(25)),
+				message('B', "", "s1", int16(2), int16(1), int16(0), int16(2), int32(4), int32(42), int32(3), []byte("new"), int16(0)),
+				message('D', []byte{'P'}, ""),
+				message('E', "", int32(0)),
+				message('S'),
+				message('B', "", "s1", int16(0), int16(2), int32(1), []byte("7"), int32(-1), int16(0)),
+				message('E', "", int32(0)),
+				message('S'),
+			),
+			down: join(authenticated,
+				message('1'), message('2'), rowDescription, row("42"), message('C', "SELECT 1"), ready,
+				message('2'), message('C', "SELECT 0"), ready,
+			),
+			want: []result{
+				{text: "SELECT id FROM orders WHERE id = $1 AND note = $2", params: []interface{}{int64(42), "new"}, prepared: true, rows: 1, tag: "SELECT 1", completed: true},
+				{text: "SELECT id FROM orders WHERE id = $1 AND note = $2", params: []interface{}{"7", nil}, prepared: true, tag: "SELECT 0", completed: true},
+			},
+		},
+		{
+			name: "statement which can not be prepared",
+			up: join(startup,
+				message('P', "", "SELEC $1", int16(0)),
+				message('B', "", "", int16(0), int16(1), int32(1), []byte("1"), int16(0)),
+				message('E', "", int32(0)),
+				message('S'),
+			),
+			down: join(authenticated, message('E', []byte{'C'}, "42601", []byte{'M'}, "syntax error", []byte{0}), ready),
+			want: []result{{text: "SELEC $1", params: []interface{}{"1"}, prepared: true, errorCode: "42601", completed: true}},
+		},
+		{
+			name: "unanswered",
+			up:   join(startup, message('Q', "SELECT pg_sleep(60)")),
+			down: authenticated,
+			want: []result{{text: "SELECT pg_sleep(60)"}},
+		},
+		{
+			name: "ssl request which is refused",
+			up:   join(message(0, int32(sslRequestCode)), startup, message('Q', "SELECT 1")),
+			down: join([]byte{'N'}, authenticated, message('C', "SELECT 1"), ready),
+			want: []result{{text: "SELECT 1", rows: 1, tag: "SELECT 1", completed: true}},
+		},
+		{
+			name: "ssl request which is accepted",
+			up:   join(message(0, int32(sslRequestCode)), []byte{0x16, 0x03, 0x01, 0x00, 0x05}),
+			down: []byte{'S'},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queries := decode(tt.up, tt.down)
+			if len(queries) != len(tt.want) {
+				t.Fatalf("%d queries are emitted, want %d", len(queries), len(tt.want))
+			}
+			for i, q := range queries {
+				got := result{
+					text:      q.Text,
+					params:    q.Params,
+					prepared:  q.Prepared,
+					rows:      q.Rows,
+					tag:       q.Tag,
+					errorCode: q.ErrorCode,
+					completed: q.Completed(),
+				}
+				if !reflect.DeepEqual(got, tt.want[i]) {
+					t.Errorf("query %d is %+v, want %+v", i, got, tt.want[i])
+				}
+				if q.User != "alice" || q.Database != "shop" {
+					t.Errorf("query %d is of %s on %s", i, q.User, q.Database)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeParam(t *testing.T) {
+	tests := []struct {
+		name   string
+		b      []byte
+		binary bool
+		oid    uint32
+		want   interface{}
+	}{
+		{name: "text", b: []byte("42"), oid: 23, want: "42"},
+		{name: "bool", b: []byte{1}, binary: true, oid: 16, want: true},
+		{name: "int2", b: []byte{0xff, 0xfe}, binary: true, oid: 21, want: int64(-2)},
+		{name: "int8", b: []byte{0, 0, 0, 0, 0, 0, 1, 0}, binary: true, oid: 20, want: int64(256)},
+		{name: "float8", b: []byte{0x3f, 0xf8, 0, 0, 0, 0, 0, 0}, binary: true, oid: 701, want: 1.5},
+		{name: "jsonb", b: []byte("\x01{}"), binary: true, oid: 3802, want: "{}"},
+		{name: "uuid", b: bytes.Repeat([]byte{0xab}, 16), binary: true, oid: 2950, want: "abababab-abab-abab-abab-abababababab"},
+		{name: "unknown", b: []byte{1, 2}, binary: true, oid: 17, want: []byte{1, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := decodeParam(tt.b, tt.binary, tt.oid); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("param is %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSniff(t *testing.T) {
+	d := New()
+	tests := []struct {
+		name       string
+		b          []byte
+		fromClient bool
+		want       bool
+	}{
+		{name: "startup", b: startup, fromClient: true, want: true},
+		{name: "ssl request", b: message(0, int32(sslRequestCode)), fromClient: true, want: true},
+		{name: "gssenc request", b: message(0, int32(gssencRequestCode)), fromClient: true, want: true},
+		{name: "from the server", b: startup},
+		{name: "query", b: message('Q', "SELECT 1"), fromClient: true},
+		{name: "http", b: []byte("GET / HTTP/1.1\r\n"), fromClient: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := d.Sniff(tt.b, tt.fromClient); got != tt.want {
+				t.Errorf("sniff is %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
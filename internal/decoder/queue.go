@@ -0,0 +1,71 @@
+package decoder
+
+import (
+	"sync"
+)
+
+// Queue hands the requests read from the client to the reader of the server,
+// a request waits in the queue until its response has been read.
+type Queue struct {
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	items  []interface{}
+	size   int
+	closed bool
+}
+
+// Push adds a request, the oldest one is returned when the queue is full.
+func (q *Queue) Push(v interface{}) (dropped interface{}) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.items) >= q.size {
+		dropped = q.items[0]
+		q.items[0] = nil
+		q.items = q.items[1:]
+	}
+	q.items = append(q.items, v)
+	q.cond.Signal()
+	return
+}
+
+// Peek waits for the oldest request, false is returned once the client side is closed.
+func (q *Queue) Peek() (interface{}, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for len(q.items) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if len(q.items) == 0 {
+		return nil, false
+	}
+	return q.items[0], true
+}
+
+// Pop waits for the oldest request and removes it.
+func (q *Queue) Pop() (interface{}, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for len(q.items) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if len(q.items) == 0 {
+		return nil, false
+	}
+	v := q.items[0]
+	q.items[0] = nil
+	q.items = q.items[1:]
+	return v, true
+}
+
+func (q *Queue) Close() {
+	q.mutex.Lock()
+	q.closed = true
+	q.cond.Broadcast()
+	q.mutex.Unlock()
+}
+
+func NewQueue(size int) *Queue {
+	q := &Queue{size: size}
+	q.cond = sync.NewCond(&q.mutex)
+	return q
+}
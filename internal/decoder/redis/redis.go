@@ -0,0 +1,181 @@
+package redis
+
+import (
+	"bytes"
+	"errors"
+	"github.com/uole/httpcap/internal/decoder"
+	"github.com/uole/httpcap/redis"
+	"io"
+	"strings"
+	"sync"
+)
+
+const (
+	//commands which wait for their reply, older ones are given up once the server falls behind
+	maxPending = 4096
+)
+
+type (
+	// Decoder pairs the commands of a RESP2 or RESP3 connection with their replies,
+	// replies of pipelined commands come in the order of the commands.
+	Decoder struct {
+	}
+)
+
+// pubsubKind returns the kind of a pubsub message or confirmation, e.g. message or subscribe.
+func pubsubKind(v *redis.Value) string {
+	if (v.Type != redis.TypeArray && v.Type != redis.TypePush) || len(v.Elems) < 3 {
+		return ""
+	}
+	if t := v.Elems[0].Type; t != redis.TypeBulkString && t != redis.TypeSimpleString {
+		return ""
+	}
+	return strings.ToLower(v.Elems[0].Text())
+}
+
+func isMessage(kind string) bool {
+	return kind == "message" || kind == "pmessage" || kind == "smessage"
+}
+
+func isConfirmation(kind string) bool {
+	switch kind {
+	case "subscribe", "unsubscribe", "psubscribe", "punsubscribe", "ssubscribe", "sunsubscribe":
+		return true
+	}
+	return false
+}
+
+func (d *Decoder) readCommands(conn *decoder.Conn, q *decoder.Queue, emit decoder.EmitFunc) {
+	var (
+		err error
+		pos int64
+		v   *redis.Value
+		cmd *redis.Command
+	)
+	defer q.Close()
+	for {
+		pos = conn.Up.Position()
+		if v, err = redis.ReadValue(conn.Up.Reader()); err != nil {
+			if !errors.Is(err, io.ErrClosedPipe) {
+				conn.Logf("read redis command error: %s", err.Error())
+				conn.Report(err)
+			}
+			conn.Up.Discard()
+			return
+		}
+		if cmd, err = redis.ReadCommand(v); err != nil {
+			conn.Logf("read redis command error: %s", err.Error())
+			conn.Report(err)
+			continue
+		}
+		cmd.Client, cmd.Server = conn.Client, conn.Server
+		cmd.StartedAt = conn.Up.Timestamp(pos)
+		cmd.Gap = conn.Up.Gap(pos, conn.Up.Position()-1)
+		if dropped := q.Push(cmd); dropped != nil {
+			emit(dropped.(*redis.Command))
+		}
+	}
+}
+
+// readReplies pairs the replies with the commands, gap reports whether bytes were missing
+// in the reply which could not be read.
+func (d *Decoder) readReplies(conn *decoder.Conn, q *decoder.Queue, emit decoder.EmitFunc) (gap bool) {
+	var (
+		err        error
+		pos        int64
+		v          *redis.Value
+		subscribed bool
+		//confirmations of a command which (un)subscribes several channels
+		skip int64
+	)
+	for {
+		pos = conn.Down.Position()
+		if v, err = redis.ReadValue(conn.Down.Reader()); err != nil {
+			if !errors.Is(err, io.ErrClosedPipe) {
+				conn.Logf("read redis reply error: %s", err.Error())
+				conn.Report(err)
+			}
+			gap = conn.Down.Gap(pos, conn.Down.Position())
+			conn.Down.Discard()
+			return
+		}
+		first := conn.Down.Timestamp(pos)
+		last := conn.Down.Timestamp(conn.Down.Position() - 1)
+		gap = conn.Down.Gap(pos, conn.Down.Position()-1)
+		kind := pubsubKind(v)
+		switch {
+		case isMessage(kind) && (subscribed || v.Type == redis.TypePush),
+			v.Type == redis.TypePush && !isConfirmation(kind):
+			emit(&redis.Command{Client: conn.Client, Server: conn.Server, Reply: v, FirstByteAt: first, CompletedAt: last, Push: true, Gap: gap})
+			continue
+		case isConfirmation(kind) && skip > 0:
+			skip--
+			subscribed = v.Elems[2].Int > 0
+			continue
+		}
+		item, ok := q.Pop()
+		if !ok {
+			return false
+		}
+		cmd := item.(*redis.Command)
+		cmd.Reply, cmd.FirstByteAt, cmd.CompletedAt = v, first, last
+		cmd.Gap = cmd.Gap || gap
+		if isConfirmation(kind) && isConfirmation(strings.ToLower(cmd.Name())) {
+			subscribed = v.Elems[2].Int > 0
+			if skip = int64(len(cmd.Args) - 2); skip < 0 {
+				//unsubscribe from every channel, the count of the confirmation is what is left
+				skip = v.Elems[2].Int
+			}
+		}
+		emit(cmd)
+	}
+}
+
+func (d *Decoder) Name() string {
+	return "redis"
+}
+
+// Sniff accepts a command of the client, which is an array of bulk strings, e.g. *2\r\n$3\r\nGET.
+func (d *Decoder) Sniff(b []byte, fromClient bool) bool {
+	if !fromClient || len(b) < 5 || b[0] != '*' {
+		return false
+	}
+	pos := bytes.Index(b, []byte("\r\n"))
+	if pos < 2 || pos > 8 || len(b) < pos+3 || b[pos+2] != '$' {
+		return false
+	}
+	for _, c := range b[1:pos] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *Decoder) Decode(conn *decoder.Conn, emit decoder.EmitFunc) {
+	var (
+		wg sync.WaitGroup
+	)
+	q := decoder.NewQueue(maxPending)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		d.readCommands(conn, q, emit)
+	}()
+	gap := d.readReplies(conn, q, emit)
+	wg.Wait()
+	//commands which have not been answered before the connection was closed
+	for {
+		item, ok := q.Pop()
+		if !ok {
+			break
+		}
+		cmd := item.(*redis.Command)
+		cmd.Gap = cmd.Gap || gap
+		emit(cmd)
+	}
+}
+
+func New() *Decoder {
+	return &Decoder{}
+}
@@ -0,0 +1,159 @@
+package redis
+
+import (
+	"github.com/uole/httpcap/internal/decoder"
+	"github.com/uole/httpcap/redis"
+	"sync"
+	"testing"
+	"time"
+)
+
+type segment struct {
+	fromClient bool
+	data       string
+	//bytes in front of the segment were lost
+	gap bool
+}
+
+// decode hands the segments to the decoder and returns the commands it emits.
+func decode(segments []segment) (cmds []*redis.Command) {
+	var (
+		mutex sync.Mutex
+	)
+	conn := decoder.NewConn(1, "10.0.0.1:50000", "10.0.0.2:6379", nil)
+	at := time.Unix(1700000000, 0)
+	for i, s := range segments {
+		buf := conn.Down
+		if s.fromClient {
+			buf = conn.Up
+		}
+		if s.gap {
+			buf.MarkGap()
+		}
+		t := at.Add(time.Duration(i) * time.Millisecond)
+		_ = buf.PutBytes([]byte(s.data), t, t)
+	}
+	conn.Close()
+	New().Decode(conn, func(e decoder.Exchange) {
+		mutex.Lock()
+		cmds = append(cmds, e.(*redis.Command))
+		mutex.Unlock()
+	})
+	return
+}
+
+func TestDecode(t *testing.T) {
+	type result struct {
+		line  string
+		reply string
+		gap   bool
+	}
+	tests := []struct {
+		name     string
+		segments []segment
+		want     []result
+	}{
+		{
+			name: "pipelined",
+			segments: []segment{
+				{fromClient: true, data: "*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n*2\r\n$3\r\nGET\r\n$1\r\na\r\n*2\r\n$4\r\nINCR\r\n$1\r\nn\r\n"},
+				{data: "+OK\r\n$1\r\n1\r\n"},
+				{data: ":5\r\n"},
+			},
+			want: []result{{line: "SET a 1", reply: "OK"}, {line: "GET a", reply: "bulk(1B)"}, {line: "INCR n", reply: "int(5)"}},
+		},
+		{
+			name: "resp3 push between replies",
+			segments: []segment{
+				{fromClient: true, data: "*3\r\n$6\r\nCLIENT\r\n$8\r\nTRACKING\r\n$2\r\non\r\n*2\r\n$3\r\nGET\r\n$1\r\nk\r\n"},
+				{data: "+OK\r\n>2\r\n$10\r\ninvalidate\r\n*1\r\n$1\r\nk\r\n$1\r\nv\r\n"},
+			},
+			want: []result{{line: "CLIENT TRACKING on", reply: "OK"}, {line: "PUSH invalidate", reply: "push(2)"}, {line: "GET k", reply: "bulk(1B)"}},
+		},
+		{
+			name: "resp2 pubsub",
+			segments: []segment{
+				{fromClient: true, data: "*3\r\n$9\r\nSUBSCRIBE\r\n$1\r\na\r\n$1\r\nb\r\n"},
+				{data: "*3\r\n$9\r\nsubscribe\r\n$1\r\na\r\n:1\r\n*3\r\n$9\r\nsubscribe\r\n$1\r\nb\r\n:2\r\n"},
+				{data: "*3\r\n$7\r\nmessage\r\n$1\r\na\r\n$2\r\nhi\r\n"},
+				{fromClient: true, data: "*1\r\n$11\r\nUNSUBSCRIBE\r\n"},
+				{data: "*3\r\n$11\r\nunsubscribe\r\n$1\r\na\r\n:1\r\n*3\r\n$11\r\nunsubscribe\r\n$1\r\nb\r\n:0\r\n"},
+				{fromClient: true, data: "*1\r\n$4\r\nPING\r\n"},
+				{data: "+PONG\r\n"},
+			},
+			want: []result{
+				{line: "SUBSCRIBE a b", reply: "array(3)"},
+				{line: "PUSH message a", reply: "array(3)"},
+				{line: "UNSUBSCRIBE", reply: "array(3)"},
+				{line: "PING", reply: "PONG"},
+			},
+		},
+		{
+			name: "unanswered",
+			segments: []segment{
+				{fromClient: true, data: "*1\r\n$4\r\nPING\r\n*2\r\n$3\r\nGET\r\n$1\r\nk\r\n"},
+				{data: "+PONG\r\n"},
+			},
+			want: []result{{line: "PING", reply: "PONG"}, {line: "GET k", reply: "no reply"}},
+		},
+		{
+			name: "gap in a reply",
+			segments: []segment{
+				{fromClient: true, data: "*2\r\n$3\r\nGET\r\n$1\r\na\r\n*2\r\n$3\r\nGET\r\n$1\r\nb\r\n"},
+				{data: "$6\r\nab"},
+				{data: "cdef\r\n$1\r\nb\r\n", gap: true},
+			},
+			want: []result{{line: "GET a", reply: "bulk(6B)", gap: true}, {line: "GET b", reply: "bulk(1B)"}},
+		},
+		{
+			name: "reply cut by a gap",
+			segments: []segment{
+				{fromClient: true, data: "*2\r\n$3\r\nGET\r\n$1\r\na\r\n*2\r\n$3\r\nGET\r\n$1\r\nb\r\n"},
+				{data: "$6\r\nab"},
+				{data: "", gap: true},
+			},
+			want: []result{{line: "GET a", reply: "no reply", gap: true}, {line: "GET b", reply: "no reply", gap: true}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmds := decode(tt.segments)
+			if len(cmds) != len(tt.want) {
+				t.Fatalf("%d commands are emitted, want %d", len(cmds), len(tt.want))
+			}
+			for i, cmd := range cmds {
+				reply := "no reply"
+				if cmd.Reply != nil {
+					reply = cmd.Reply.Summary()
+				}
+				got := result{line: cmd.Line(100), reply: reply, gap: cmd.Gap}
+				if got != tt.want[i] {
+					t.Errorf("command %d is %+v, want %+v", i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSniff(t *testing.T) {
+	d := New()
+	tests := []struct {
+		name       string
+		b          string
+		fromClient bool
+		want       bool
+	}{
+		{name: "command", b: "*2\r\n$3\r\nGET\r\n$1\r\na\r\n", fromClient: true, want: true},
+		{name: "reply", b: "*2\r\n$3\r\nGET\r\n$1\r\na\r\n"},
+		{name: "inline command", b: "PING\r\n", fromClient: true},
+		{name: "http", b: "GET / HTTP/1.1\r\n", fromClient: true},
+		{name: "array of integers", b: "*2\r\n:1\r\n:2\r\n", fromClient: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := d.Sniff([]byte(tt.b), tt.fromClient); got != tt.want {
+				t.Errorf("sniff is %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
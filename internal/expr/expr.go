@@ -0,0 +1,386 @@
+package expr
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	KindString Kind = iota + 1
+	KindNumber
+	KindDuration
+)
+
+type (
+	Kind int
+
+	Field struct {
+		Kind    Kind
+		Indexed bool
+	}
+
+	// Resolver returns the value of a field for the record being matched, the
+	// value is one of string, int, int64, float64 or time.Duration.
+	Resolver interface {
+		Resolve(name, key string) interface{}
+	}
+
+	SyntaxError struct {
+		Pos int
+		Msg string
+	}
+
+	Expression struct {
+		src  string
+		root node
+	}
+
+	node interface {
+		eval(r Resolver) bool
+	}
+
+	andNode struct {
+		left, right node
+	}
+
+	orNode struct {
+		left, right node
+	}
+
+	notNode struct {
+		node node
+	}
+
+	fieldRef struct {
+		name  string
+		key   string
+		field Field
+	}
+
+	truthNode struct {
+		ref fieldRef
+	}
+
+	compareNode struct {
+		ref   fieldRef
+		op    string
+		str   string
+		num   float64
+		regex *regexp.Regexp
+	}
+
+	parser struct {
+		fields map[string]Field
+		tokens []token
+		pos    int
+	}
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindString:
+		return "string"
+	case KindNumber:
+		return "number"
+	case KindDuration:
+		return "duration"
+	default:
+		return "unknown"
+	}
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("column %d: %s", e.Pos+1, e.Msg)
+}
+
+func (n *andNode) eval(r Resolver) bool {
+	return n.left.eval(r) && n.right.eval(r)
+}
+
+func (n *orNode) eval(r Resolver) bool {
+	return n.left.eval(r) || n.right.eval(r)
+}
+
+func (n *notNode) eval(r Resolver) bool {
+	return !n.node.eval(r)
+}
+
+func (ref *fieldRef) String() string {
+	if ref.key != "" {
+		return ref.name + "[" + fmt.Sprintf("%q", ref.key) + "]"
+	}
+	return ref.name
+}
+
+func (ref *fieldRef) stringValue(r Resolver) string {
+	switch v := r.Resolve(ref.name, ref.key).(type) {
+	case string:
+		return v
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func (ref *fieldRef) numberValue(r Resolver) float64 {
+	switch v := r.Resolve(ref.name, ref.key).(type) {
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case float64:
+		return v
+	case time.Duration:
+		return float64(v)
+	default:
+		return 0
+	}
+}
+
+func (n *truthNode) eval(r Resolver) bool {
+	if n.ref.field.Kind == KindString {
+		return n.ref.stringValue(r) != ""
+	}
+	return n.ref.numberValue(r) != 0
+}
+
+func (n *compareNode) eval(r Resolver) bool {
+	if n.ref.field.Kind == KindString {
+		s := n.ref.stringValue(r)
+		switch n.op {
+		case "~":
+			return n.regex.MatchString(s)
+		case "!~":
+			return !n.regex.MatchString(s)
+		case "==":
+			return s == n.str
+		case "!=":
+			return s != n.str
+		case "<":
+			return s < n.str
+		case "<=":
+			return s <= n.str
+		case ">":
+			return s > n.str
+		case ">=":
+			return s >= n.str
+		}
+		return false
+	}
+	v := n.ref.numberValue(r)
+	switch n.op {
+	case "==":
+		return v == n.num
+	case "!=":
+		return v != n.num
+	case "<":
+		return v < n.num
+	case "<=":
+		return v <= n.num
+	case ">":
+		return v > n.num
+	case ">=":
+		return v >= n.num
+	}
+	return false
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) errorf(t token, format string, args ...interface{}) error {
+	return &SyntaxError{Pos: t.pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) parseOr() (n node, err error) {
+	var (
+		right node
+	)
+	if n, err = p.parseAnd(); err != nil {
+		return
+	}
+	for p.peek().kind == tokenOr {
+		p.next()
+		if right, err = p.parseAnd(); err != nil {
+			return
+		}
+		n = &orNode{left: n, right: right}
+	}
+	return
+}
+
+func (p *parser) parseAnd() (n node, err error) {
+	var (
+		right node
+	)
+	if n, err = p.parseUnary(); err != nil {
+		return
+	}
+	for p.peek().kind == tokenAnd {
+		p.next()
+		if right, err = p.parseUnary(); err != nil {
+			return
+		}
+		n = &andNode{left: n, right: right}
+	}
+	return
+}
+
+func (p *parser) parseUnary() (n node, err error) {
+	if p.peek().kind == tokenNot {
+		p.next()
+		if n, err = p.parseUnary(); err != nil {
+			return
+		}
+		return &notNode{node: n}, nil
+	}
+	if p.peek().kind == tokenLParen {
+		open := p.next()
+		if n, err = p.parseOr(); err != nil {
+			return
+		}
+		if t := p.next(); t.kind != tokenRParen {
+			return nil, p.errorf(t, "expected \")\" to close \"(\" at column %d, got %s", open.pos+1, t)
+		}
+		return
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseField() (ref fieldRef, err error) {
+	t := p.next()
+	if t.kind != tokenIdent {
+		return ref, p.errorf(t, "expected field name, got %s", t)
+	}
+	field, ok := p.fields[strings.ToLower(t.text)]
+	if !ok {
+		return ref, p.errorf(t, "unknown field %s, available fields are %s", t, strings.Join(p.fieldNames(), ", "))
+	}
+	ref = fieldRef{name: strings.ToLower(t.text), field: field}
+	if p.peek().kind == tokenLBracket {
+		open := p.next()
+		if !field.Indexed {
+			return ref, p.errorf(open, "field %s can not be indexed", t)
+		}
+		key := p.next()
+		if key.kind != tokenString && key.kind != tokenIdent {
+			return ref, p.errorf(key, "expected key of %s, got %s", t, key)
+		}
+		ref.key = key.str
+		if key.kind == tokenIdent {
+			ref.key = key.text
+		}
+		if closing := p.next(); closing.kind != tokenRBracket {
+			return ref, p.errorf(closing, "expected \"]\", got %s", closing)
+		}
+	} else if field.Indexed {
+		return ref, p.errorf(t, "field %s requires a key, e.g. %s[\"name\"]", t, t.text)
+	}
+	return
+}
+
+func (p *parser) parseComparison() (n node, err error) {
+	var (
+		ref fieldRef
+	)
+	if t := p.peek(); t.kind != tokenIdent {
+		return nil, p.errorf(t, "expected field name, got %s", t)
+	}
+	if ref, err = p.parseField(); err != nil {
+		return
+	}
+	if p.peek().kind != tokenOperator {
+		return &truthNode{ref: ref}, nil
+	}
+	op := p.next()
+	value := p.next()
+	cmp := &compareNode{ref: ref, op: op.text}
+	switch ref.field.Kind {
+	case KindString:
+		if value.kind != tokenString {
+			return nil, p.errorf(value, "%s is a string, expected a quoted string, got %s", ref.String(), value)
+		}
+		cmp.str = value.str
+		if op.text == "~" || op.text == "!~" {
+			if cmp.regex, err = regexp.Compile(value.str); err != nil {
+				return nil, p.errorf(value, "invalid regular expression: %s", err.Error())
+			}
+		}
+	case KindNumber:
+		if op.text == "~" || op.text == "!~" {
+			return nil, p.errorf(op, "operator %s only applies to string fields", op)
+		}
+		if value.kind != tokenNumber {
+			return nil, p.errorf(value, "%s is a number, got %s", ref.String(), value)
+		}
+		cmp.num = value.num
+	case KindDuration:
+		if op.text == "~" || op.text == "!~" {
+			return nil, p.errorf(op, "operator %s only applies to string fields", op)
+		}
+		switch value.kind {
+		case tokenDuration:
+			cmp.num = float64(value.dur)
+		case tokenNumber:
+			//plain numbers are milliseconds
+			cmp.num = value.num * float64(time.Millisecond)
+		default:
+			return nil, p.errorf(value, "%s is a duration, expected a value like 200ms, got %s", ref.String(), value)
+		}
+	}
+	return cmp, nil
+}
+
+func (p *parser) fieldNames() []string {
+	names := make([]string, 0, len(p.fields))
+	for name := range p.fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (e *Expression) Match(r Resolver) bool {
+	if e == nil || e.root == nil {
+		return true
+	}
+	return e.root.eval(r)
+}
+
+func (e *Expression) String() string {
+	return e.src
+}
+
+func Compile(src string, fields map[string]Field) (e *Expression, err error) {
+	var (
+		tokens []token
+	)
+	e = &Expression{src: src}
+	if strings.TrimSpace(src) == "" {
+		return
+	}
+	if tokens, err = lex(src); err != nil {
+		return nil, err
+	}
+	p := &parser{fields: fields, tokens: tokens}
+	if e.root, err = p.parseOr(); err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, p.errorf(t, "unexpected %s, expected \"&&\" or \"||\"", t)
+	}
+	return
+}
@@ -0,0 +1,210 @@
+package expr
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// record resolves the fields of a test, indexed fields are looked up as name[key].
+type record map[string]interface{}
+
+func (r record) Resolve(name, key string) interface{} {
+	if key != "" {
+		return r[name+"["+key+"]"]
+	}
+	return r[name]
+}
+
+var (
+	testFields = map[string]Field{
+		"method":   {Kind: KindString},
+		"host":     {Kind: KindString},
+		"path":     {Kind: KindString},
+		"header":   {Kind: KindString, Indexed: true},
+		"status":   {Kind: KindNumber},
+		"size":     {Kind: KindNumber},
+		"duration": {Kind: KindDuration},
+	}
+
+	testRecord = record{
+		"method":               "POST",
+		"host":                 "api.example.com",
+		"path":                 `/v1/users/42`,
+		"header[content-type]": "application/json",
+		"header[x-quote]":      `say "hi" \o/`,
+		"status":               404,
+		"size":                 int64(1536),
+		"duration":             250 * time.Millisecond,
+	}
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		src  string
+		want bool
+	}{
+		{src: "", want: true},
+		{src: `method == "POST"`, want: true},
+		{src: `METHOD == "POST"`, want: true},
+		{src: `method != "POST"`, want: false},
+		{src: `status >= 400 && status < 500`, want: true},
+		{src: `status == 200`, want: false},
+		//and binds tighter than or, not tighter than and
+		{src: `status == 200 and method == "GET" or host == "api.example.com"`, want: true},
+		{src: `host == "api.example.com" or status == 200 and method == "GET"`, want: true},
+		{src: `(host == "api.example.com" or status == 200) and method == "GET"`, want: false},
+		{src: `not status == 200 and method == "POST"`, want: true},
+		{src: `not (status == 404 and method == "POST")`, want: false},
+		{src: `!method == "GET" || status == 200`, want: true},
+		{src: `!(method == "POST" || status == 200)`, want: false},
+		{src: `not not status == 404`, want: true},
+		//durations are nanoseconds, plain numbers are milliseconds
+		{src: `duration > 200ms`, want: true},
+		{src: `duration > 1s`, want: false},
+		{src: `duration >= 250`, want: true},
+		{src: `duration < 1m30s`, want: true},
+		//sizes are bytes
+		{src: `size == 1.5KB`, want: true},
+		{src: `size < 1MB`, want: true},
+		{src: `size > 1kb`, want: true},
+		{src: `size >= 2KB`, want: false},
+		{src: `path ~ "^/v1/users/[0-9]+$"`, want: true},
+		{src: `path ~ "^/v2/"`, want: false},
+		{src: `host !~ "\\.internal$"`, want: true},
+		{src: `header["content-type"] ~ "json"`, want: true},
+		{src: `header[accept] == ""`, want: true},
+		{src: `header["accept"]`, want: false},
+		{src: `header["content-type"]`, want: true},
+		{src: `status`, want: true},
+		//only quotes and backslashes are escaped in strings
+		{src: `header["x-quote"] == "say \"hi\" \\o/"`, want: true},
+		{src: `header["x-quote"] == 'say "hi" \\o/'`, want: true},
+		{src: `path ~ '^/v1/users/\d+$'`, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			e, err := Compile(tt.src, testFields)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := e.Match(testRecord); got != tt.want {
+				t.Errorf("match is %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLexUnits(t *testing.T) {
+	tests := []struct {
+		src  string
+		kind int
+		num  float64
+		dur  time.Duration
+	}{
+		{src: "200", kind: tokenNumber, num: 200},
+		{src: "1.5", kind: tokenNumber, num: 1.5},
+		{src: "10B", kind: tokenNumber, num: 10},
+		{src: "2KB", kind: tokenNumber, num: 2048},
+		{src: "1MB", kind: tokenNumber, num: 1024 * 1024},
+		{src: "1gb", kind: tokenNumber, num: 1024 * 1024 * 1024},
+		{src: "200ms", kind: tokenDuration, num: 200, dur: 200 * time.Millisecond},
+		{src: "1.5s", kind: tokenDuration, num: 1.5, dur: 1500 * time.Millisecond},
+		{src: "1h30m", kind: tokenDuration, num: 1, dur: 90 * time.Minute},
+		{src: "50us", kind: tokenDuration, num: 50, dur: 50 * time.Microsecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			tokens, err := lex(tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tokens) != 2 || tokens[1].kind != tokenEOF {
+				t.Fatalf("%d tokens are read", len(tokens))
+			}
+			if tok := tokens[0]; tok.kind != tt.kind || tok.num != tt.num || tok.dur != tt.dur {
+				t.Errorf("token is kind %d, %v, %v", tok.kind, tok.num, tok.dur)
+			}
+		})
+	}
+}
+
+func TestLexString(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{src: `"abc"`, want: "abc"},
+		{src: `'abc'`, want: "abc"},
+		{src: `"a\"b"`, want: `a"b`},
+		{src: `'a\'b'`, want: `a'b`},
+		{src: `"a'b"`, want: `a'b`},
+		{src: `"a\\b"`, want: `a\b`},
+		{src: `"a\\"`, want: `a\`},
+		{src: `"\d+\.json"`, want: `\d+\.json`},
+		{src: `"日本"`, want: "日本"},
+		{src: `""`, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			tokens, err := lex(tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tokens[0].kind != tokenString || tokens[0].str != tt.want {
+				t.Errorf("string is %q, want %q", tokens[0].str, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileError(t *testing.T) {
+	tests := []struct {
+		src    string
+		column int
+		msg    string
+	}{
+		{src: `method = "GET"`, column: 8, msg: `did you mean "=="`},
+		{src: `method == "GET" & status == 200`, column: 17, msg: `did you mean "&&"`},
+		{src: `status == 200 | status == 404`, column: 15, msg: `did you mean "||"`},
+		{src: `method == "GET`, column: 11, msg: "unterminated string"},
+		{src: `status == 200 #`, column: 15, msg: "unexpected character"},
+		{src: `verb == "GET"`, column: 1, msg: "unknown field \"verb\""},
+		{src: `status == "200"`, column: 11, msg: "is a number"},
+		{src: `method == GET`, column: 11, msg: "expected a quoted string"},
+		{src: `status ~ "2.."`, column: 8, msg: "only applies to string fields"},
+		{src: `duration > 5 parsecs`, column: 14, msg: `unexpected "parsecs"`},
+		{src: `duration > 5xs`, column: 12, msg: "invalid number"},
+		{src: `duration > "fast"`, column: 12, msg: "is a duration"},
+		{src: `path ~ "("`, column: 8, msg: "invalid regular expression"},
+		{src: `(status == 200`, column: 15, msg: `to close "(" at column 1`},
+		{src: `status == 200)`, column: 14, msg: `unexpected ")"`},
+		{src: `header == "x"`, column: 1, msg: "requires a key"},
+		{src: `method["x"] == "GET"`, column: 7, msg: "can not be indexed"},
+		{src: `header["x" == "y"`, column: 12, msg: `expected "]"`},
+		{src: `status == 200 and`, column: 18, msg: "expected field name, got end of expression"},
+		{src: `and status == 200`, column: 1, msg: "expected field name"},
+		{src: `日本 == "x"`, column: 1, msg: "unknown field"},
+		{src: `"日本" == 1`, column: 1, msg: "expected field name"},
+		{src: `path == "日本" &`, column: 14, msg: `did you mean "&&"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			var (
+				syntaxErr *SyntaxError
+			)
+			_, err := Compile(tt.src, testFields)
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("error is %v, want a syntax error", err)
+			}
+			//columns count runes from 1
+			if syntaxErr.Pos+1 != tt.column {
+				t.Errorf("error %q is at column %d, want %d", err, syntaxErr.Pos+1, tt.column)
+			}
+			if !strings.Contains(err.Error(), tt.msg) {
+				t.Errorf("error %q does not contain %q", err, tt.msg)
+			}
+		})
+	}
+}
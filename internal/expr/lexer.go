@@ -0,0 +1,178 @@
+package expr
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	tokenEOF = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenDuration
+	tokenOperator
+	tokenAnd
+	tokenOr
+	tokenNot
+	tokenLParen
+	tokenRParen
+	tokenLBracket
+	tokenRBracket
+)
+
+var (
+	sizeUnits = map[string]float64{
+		"b":  1,
+		"kb": 1024,
+		"mb": 1024 * 1024,
+		"gb": 1024 * 1024 * 1024,
+	}
+
+	operators = []string{"==", "!=", "<=", ">=", "!~", "<", ">", "~"}
+)
+
+type token struct {
+	kind int
+	pos  int
+	text string
+	str  string
+	num  float64
+	dur  time.Duration
+}
+
+func (t token) String() string {
+	if t.kind == tokenEOF {
+		return "end of expression"
+	}
+	return strconv.Quote(t.text)
+}
+
+func isIdentRune(r rune, first bool) bool {
+	if r == '_' || unicode.IsLetter(r) {
+		return true
+	}
+	return !first && unicode.IsDigit(r)
+}
+
+func lex(src string) (tokens []token, err error) {
+	runes := []rune(src)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		if unicode.IsSpace(r) {
+			i++
+			continue
+		}
+		start := i
+		switch {
+		case r == '(':
+			tokens = append(tokens, token{kind: tokenLParen, pos: start, text: "("})
+			i++
+		case r == ')':
+			tokens = append(tokens, token{kind: tokenRParen, pos: start, text: ")"})
+			i++
+		case r == '[':
+			tokens = append(tokens, token{kind: tokenLBracket, pos: start, text: "["})
+			i++
+		case r == ']':
+			tokens = append(tokens, token{kind: tokenRBracket, pos: start, text: "]"})
+			i++
+		case r == '&' || r == '|':
+			if i+1 >= len(runes) || runes[i+1] != r {
+				return nil, &SyntaxError{Pos: start, Msg: fmt.Sprintf("unexpected %q, did you mean %q", string(r), string([]rune{r, r}))}
+			}
+			if r == '&' {
+				tokens = append(tokens, token{kind: tokenAnd, pos: start, text: "&&"})
+			} else {
+				tokens = append(tokens, token{kind: tokenOr, pos: start, text: "||"})
+			}
+			i += 2
+		case r == '"' || r == '\'':
+			var (
+				sb     strings.Builder
+				closed bool
+			)
+			for i++; i < len(runes); i++ {
+				//only quotes and backslashes are escaped, anything else is kept for regular expressions
+				if runes[i] == '\\' && i+1 < len(runes) && (runes[i+1] == r || runes[i+1] == '\\') {
+					i++
+					sb.WriteRune(runes[i])
+					continue
+				}
+				if runes[i] == r {
+					closed = true
+					i++
+					break
+				}
+				sb.WriteRune(runes[i])
+			}
+			if !closed {
+				return nil, &SyntaxError{Pos: start, Msg: "unterminated string"}
+			}
+			tokens = append(tokens, token{kind: tokenString, pos: start, text: string(runes[start:i]), str: sb.String()})
+		case unicode.IsDigit(r):
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			number := string(runes[start:i])
+			//units may be compound, e.g. 1h30m
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			t := token{kind: tokenNumber, pos: start, text: string(runes[start:i])}
+			if t.num, err = strconv.ParseFloat(number, 64); err != nil {
+				return nil, &SyntaxError{Pos: start, Msg: fmt.Sprintf("invalid number %q", t.text)}
+			}
+			if unit := string(runes[start+len([]rune(number)) : i]); unit != "" {
+				if n, ok := sizeUnits[strings.ToLower(unit)]; ok {
+					t.num *= n
+				} else if t.dur, err = time.ParseDuration(t.text); err == nil {
+					t.kind = tokenDuration
+				} else {
+					return nil, &SyntaxError{Pos: start, Msg: fmt.Sprintf("invalid number %q, supported units are ns, us, ms, s, m, h, B, KB, MB and GB", t.text)}
+				}
+			}
+			tokens = append(tokens, t)
+		case isIdentRune(r, true):
+			for i < len(runes) && isIdentRune(runes[i], false) {
+				i++
+			}
+			text := string(runes[start:i])
+			switch strings.ToLower(text) {
+			case "and":
+				tokens = append(tokens, token{kind: tokenAnd, pos: start, text: text})
+			case "or":
+				tokens = append(tokens, token{kind: tokenOr, pos: start, text: text})
+			case "not":
+				tokens = append(tokens, token{kind: tokenNot, pos: start, text: text})
+			default:
+				tokens = append(tokens, token{kind: tokenIdent, pos: start, text: text})
+			}
+		default:
+			matched := false
+			for _, op := range operators {
+				if strings.HasPrefix(string(runes[i:]), op) {
+					tokens = append(tokens, token{kind: tokenOperator, pos: start, text: op})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				if r == '!' {
+					tokens = append(tokens, token{kind: tokenNot, pos: start, text: "!"})
+					i++
+				} else if r == '=' {
+					return nil, &SyntaxError{Pos: start, Msg: `unexpected "=", did you mean "=="`}
+				} else {
+					return nil, &SyntaxError{Pos: start, Msg: fmt.Sprintf("unexpected character %q", string(r))}
+				}
+			}
+		}
+	}
+	tokens = append(tokens, token{kind: tokenEOF, pos: len(runes)})
+	return
+}
@@ -1,7 +1,29 @@
 package factory
 
-import httpkg "github.com/uole/httpcap/http"
+import (
+	httpkg "github.com/uole/httpcap/http"
+	"github.com/uole/httpcap/internal/decoder"
+	"github.com/uole/httpcap/tls"
+	"github.com/uole/httpcap/websocket"
+)
 
 type (
 	HandleFunc func(*httpkg.Request, *httpkg.Response)
+
+	MessageFunc func(*httpkg.Request, *httpkg.Response, *websocket.Message)
+
+	HandshakeFunc func(*tls.Handshake)
+
+	// ExchangeFunc receives the exchanges of protocols other than http, e.g. redis commands.
+	ExchangeFunc func(decoder.Exchange)
+
+	// Limits bounds the memory of a capture, a limit of 0 is disabled.
+	Limits struct {
+		//bytes of a request or response body which are kept, larger bodies are truncated
+		MaxBodySize int
+		//bytes of a direction of a connection which are buffered until its decoder reads them
+		MaxStreamBuffer int
+		//bytes buffered by all connections together
+		MaxMemory int64
+	}
 )
@@ -66,7 +66,7 @@ func (stream *Stream) Reassembled(reassemblies []tcpassembly.Reassembly) {
 			}
 			if stream.isHttp() {
 				fmt.Printf("stream %d put data\n", stream.idx)
-				stream.buf.PutBytes(reassembly.Bytes)
+				stream.buf.PutBytes(reassembly.Bytes, reassembly.Seen, reassembly.Seen)
 			}
 		}
 	}
@@ -2,73 +2,197 @@ package tcp
 
 import (
 	"context"
-	"fmt"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/reassembly"
+	"github.com/uole/httpcap/internal/decoder"
 	"github.com/uole/httpcap/internal/factory"
-	iopkg "github.com/uole/httpcap/internal/io"
+	"github.com/uole/httpcap/tls"
 	"net"
 	"os"
 	"path"
+	"runtime"
+	"strconv"
 	"sync"
 	"sync/atomic"
+	"time"
+)
+
+type (
+	// errorLog is the log file of the decoders, it is dropped when the file can not be created.
+	errorLog struct {
+		file *os.File
+	}
+
+	// Stats describes the connections of the factory.
+	Stats struct {
+		ActiveStreams int64
+		ParseErrors   int64
+		DroppedBytes  int64
+		//responses which did not arrive in time, their requests are dropped
+		Timeouts int64
+		//holes in the connections which the assembler skipped and their bytes
+		Gaps         int64
+		SkippedBytes int64
+	}
 )
 
 type Factory struct {
-	ctx         context.Context
-	idx         int64
-	handleFunc  factory.HandleFunc
-	writeCloser *os.File
-	mutex       sync.RWMutex
-	streams     map[int64]*Stream
+	ctx           context.Context
+	idx           int64
+	active        int64
+	dropped       int64
+	gaps          int64
+	skipped       int64
+	limits        factory.Limits
+	registry      *decoder.Registry
+	emitFunc      decoder.EmitFunc
+	handshakeFunc factory.HandshakeFunc
+	keylog        *tls.KeyLog
+	clock         func() time.Time
+	counters      decoder.Counters
+	writeCloser   *errorLog
+	pool          *pool
+	mutex         sync.RWMutex
+	wg            sync.WaitGroup
+	streams       map[int64]*Stream
 }
 
-func (factory *Factory) process(stream *Stream) {
-	for {
-		if req, res, err := stream.FetchRequest(); err != nil {
-			_, _ = factory.writeCloser.WriteString(fmt.Sprintf("stream %d fetch request error: %s\n", stream.id, err.Error()))
-			break
-		} else {
-			req.Address = stream.srcAddr
-			res.Address = stream.dstAddr
-			if factory.handleFunc != nil {
-				factory.handleFunc(req, res)
-			}
-		}
+func (log *errorLog) Write(p []byte) (n int, err error) {
+	if log.file == nil {
+		return len(p), nil
 	}
+	return log.file.Write(p)
+}
+
+func (factory *Factory) emit(e decoder.Exchange) {
+	if factory.emitFunc != nil {
+		factory.emitFunc(e)
+	}
+}
+
+// start decodes the connection once a decoder has accepted it, connections of
+// unknown protocols are never read. A pooled decoder runs on the workers once data
+// arrives, the others, e.g. redis and sql, read the connection with a goroutine of
+// their own until it is closed, also while it is idle.
+func (factory *Factory) start(stream *Stream) {
+	if p, ok := stream.decoder.(decoder.Pooled); ok && p.Pooled() {
+		atomic.StoreInt32(&stream.state, stateIdle)
+		return
+	}
+	atomic.StoreInt32(&stream.state, stateRunning)
+	factory.wg.Add(1)
+	go func() {
+		defer factory.wg.Done()
+		stream.decoder.Decode(stream.conn, factory.emit)
+		//nothing reads the rest of the connection
+		stream.conn.Ignore()
+		stream.conn.Discard()
+		atomic.StoreInt32(&stream.state, stateDone)
+	}()
+}
+
+// decode runs a pooled decoder on a worker until it returns, a parked connection
+// is scheduled again once data arrives.
+func (factory *Factory) decode(stream *Stream) (detached bool) {
+	defer factory.wg.Done()
+	atomic.StoreInt32(&stream.state, stateRunning)
+	stream.conn.Schedule(factory.pool)
+	stream.decoder.Decode(stream.conn, factory.emit)
+	if detached = stream.conn.Detached(); detached || !stream.conn.Parked() {
+		stream.conn.Ignore()
+		stream.conn.Discard()
+		atomic.StoreInt32(&stream.state, stateDone)
+		return
+	}
+	atomic.StoreInt32(&stream.state, stateIdle)
+	//data which arrived while the decoder was parking
+	if stream.conn.Up.Len() > 0 || stream.conn.Down.Len() > 0 {
+		stream.wake()
+	}
+	return
 }
 
 func (factory *Factory) New(netFlow, tcpFlow gopacket.Flow, tcp *layers.TCP, ac reassembly.AssemblerContext) reassembly.Stream {
 	stream := &Stream{
 		id:        atomic.AddInt64(&factory.idx, 1),
+		factory:   factory,
 		tcp:       tcp,
-		writer:    factory.writeCloser,
 		net:       netFlow,
 		transport: tcpFlow,
-		up:        iopkg.NewBuffer(),
-		down:      iopkg.NewBuffer(),
 	}
-	stream.srcAddr = net.JoinHostPort(netFlow.Src().String(), tcp.SrcPort.String())
-	stream.dstAddr = net.JoinHostPort(netFlow.Dst().String(), tcp.DstPort.String())
+	atomic.AddInt64(&factory.active, 1)
+	stream.srcAddr = net.JoinHostPort(netFlow.Src().String(), strconv.Itoa(int(tcp.SrcPort)))
+	stream.dstAddr = net.JoinHostPort(netFlow.Dst().String(), strconv.Itoa(int(tcp.DstPort)))
 	//factory.mutex.Lock()
 	//factory.streams[stream.id] = stream
 	//factory.mutex.Unlock()
-	go factory.process(stream)
 	return stream
 }
 
+func (factory *Factory) WithHandshakeHandle(f factory.HandshakeFunc) *Factory {
+	factory.handshakeFunc = f
+	return factory
+}
+
+// WithLimits bounds the data buffered for the decoders and the bodies they keep.
+func (factory *Factory) WithLimits(limits factory.Limits) *Factory {
+	factory.limits = limits
+	return factory
+}
+
+// WithWorkers bounds the decoders which parse at the same time, it is 4 per cpu by default.
+func (factory *Factory) WithWorkers(n int) *Factory {
+	if n > 0 {
+		factory.pool.size = n
+	}
+	return factory
+}
+
+// WithClock sets the clock the read deadlines of the decoders run on, e.g. the time of the packets
+// of a capture file, the wall clock is used without.
+func (factory *Factory) WithClock(f func() time.Time) *Factory {
+	factory.clock = f
+	return factory
+}
+
+func (factory *Factory) WithKeyLog(keylog *tls.KeyLog) *Factory {
+	factory.keylog = keylog
+	return factory
+}
+
+func (factory *Factory) Stats() Stats {
+	return Stats{
+		ActiveStreams: atomic.LoadInt64(&factory.active),
+		ParseErrors:   atomic.LoadInt64(&factory.counters.ParseErrors),
+		DroppedBytes:  atomic.LoadInt64(&factory.dropped),
+		Timeouts:      atomic.LoadInt64(&factory.counters.Timeouts),
+		Gaps:          atomic.LoadInt64(&factory.gaps),
+		SkippedBytes:  atomic.LoadInt64(&factory.skipped),
+	}
+}
+
+func (factory *Factory) Wait() {
+	factory.wg.Wait()
+}
+
 func (factory *Factory) Close() (err error) {
-	err = factory.writeCloser.Close()
+	if factory.writeCloser.file != nil {
+		err = factory.writeCloser.file.Close()
+	}
 	return
 }
 
-func New(ctx context.Context, cb factory.HandleFunc) *Factory {
+// New returns a factory which decodes every connection with the first decoder of the registry which accepts it.
+func New(ctx context.Context, registry *decoder.Registry, cb decoder.EmitFunc) *Factory {
 	f := &Factory{
-		ctx:        ctx,
-		handleFunc: cb,
-		streams:    make(map[int64]*Stream),
+		ctx:      ctx,
+		registry: registry,
+		emitFunc: cb,
+		streams:  make(map[int64]*Stream),
 	}
-	f.writeCloser, _ = os.OpenFile(path.Join(os.TempDir(), "httpcap"), os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0644)
+	f.pool = newPool(4*runtime.NumCPU(), f.decode)
+	f.writeCloser = &errorLog{}
+	f.writeCloser.file, _ = os.OpenFile(path.Join(os.TempDir(), "httpcap"), os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0644)
 	return f
 }
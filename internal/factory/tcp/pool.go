@@ -0,0 +1,93 @@
+package tcp
+
+import (
+	"sync"
+)
+
+type (
+	// pool runs the decoders of the streams on a bounded number of workers. A decoder gives up its
+	// slot while it waits for data and waits for a free slot once the data has arrived, so the
+	// streams which are waiting neither hold a worker nor block the others.
+	pool struct {
+		mutex   sync.Mutex
+		cond    *sync.Cond
+		size    int
+		running int
+		waiting int
+		queue   []*Stream
+		run     func(stream *Stream) (detached bool)
+	}
+)
+
+func (p *pool) pop() *Stream {
+	stream := p.queue[0]
+	p.queue[0] = nil
+	p.queue = p.queue[1:]
+	return stream
+}
+
+// spawn starts workers for the queued streams while slots are free, the decoders which wait
+// for a slot to go on come first.
+func (p *pool) spawn() {
+	for p.waiting == 0 && p.running < p.size && len(p.queue) > 0 {
+		p.running++
+		go p.work(p.pop())
+	}
+}
+
+// work runs the queued streams until the queue is empty, the worker ends when its slot
+// has been given up by a detached decoder.
+func (p *pool) work(stream *Stream) {
+	for stream != nil {
+		detached := p.run(stream)
+		stream = nil
+		if detached {
+			return
+		}
+		p.mutex.Lock()
+		if p.waiting == 0 && len(p.queue) > 0 {
+			stream = p.pop()
+		} else {
+			p.running--
+			p.cond.Signal()
+		}
+		p.mutex.Unlock()
+	}
+}
+
+// schedule queues a stream whose decoder has data to read.
+func (p *pool) schedule(stream *Stream) {
+	p.mutex.Lock()
+	p.queue = append(p.queue, stream)
+	p.spawn()
+	p.mutex.Unlock()
+}
+
+func (p *pool) Acquire() {
+	p.mutex.Lock()
+	p.waiting++
+	for p.running >= p.size {
+		p.cond.Wait()
+	}
+	p.waiting--
+	p.running++
+	p.spawn()
+	p.mutex.Unlock()
+}
+
+func (p *pool) Release() {
+	p.mutex.Lock()
+	p.running--
+	if p.waiting > 0 {
+		p.cond.Signal()
+	} else {
+		p.spawn()
+	}
+	p.mutex.Unlock()
+}
+
+func newPool(size int, run func(stream *Stream) bool) *pool {
+	p := &pool{size: size, run: run}
+	p.cond = sync.NewCond(&p.mutex)
+	return p
+}
@@ -0,0 +1,174 @@
+package tcp
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// eventually waits until f reports true, the workers of the pool run on goroutines of their own.
+func eventually(t *testing.T, what string, f func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !f(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s did not happen", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// slots returns the running and waiting decoders and the queued streams.
+func (p *pool) slots() (running, waiting, queued int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.running, p.waiting, len(p.queue)
+}
+
+func TestPoolSize(t *testing.T) {
+	var (
+		active, peak, done int64
+		wg                 sync.WaitGroup
+	)
+	release := make(chan struct{})
+	p := newPool(3, func(stream *Stream) bool {
+		defer wg.Done()
+		n := atomic.AddInt64(&active, 1)
+		for {
+			if m := atomic.LoadInt64(&peak); n <= m || atomic.CompareAndSwapInt64(&peak, m, n) {
+				break
+			}
+		}
+		<-release
+		atomic.AddInt64(&active, -1)
+		atomic.AddInt64(&done, 1)
+		return false
+	})
+	wg.Add(10)
+	for i := 0; i < 10; i++ {
+		p.schedule(&Stream{id: int64(i)})
+	}
+	eventually(t, "3 streams running", func() bool {
+		return atomic.LoadInt64(&active) == 3
+	})
+	if running, waiting, queued := p.slots(); running != 3 || waiting != 0 || queued != 7 {
+		t.Errorf("%d running, %d waiting, %d queued", running, waiting, queued)
+	}
+	close(release)
+	wg.Wait()
+	if peak != 3 || done != 10 {
+		t.Errorf("%d streams ran at the same time, %d are done", peak, done)
+	}
+	//the workers end once the queue is drained
+	eventually(t, "workers ended", func() bool {
+		running, _, _ := p.slots()
+		return running == 0
+	})
+}
+
+func TestPoolAcquire(t *testing.T) {
+	var (
+		mutex  sync.Mutex
+		events []string
+		wg     sync.WaitGroup
+	)
+	record := func(event string) {
+		mutex.Lock()
+		events = append(events, event)
+		mutex.Unlock()
+	}
+	gates := map[int64]chan struct{}{1: make(chan struct{}), 2: make(chan struct{})}
+	var p *pool
+	p = newPool(1, func(stream *Stream) bool {
+		defer wg.Done()
+		switch stream.id {
+		case 1:
+			//the decoder waits for data and gives up its slot meanwhile
+			p.Release()
+			record("1 released")
+			<-gates[1]
+			p.Acquire()
+			record("1 acquired")
+		case 2:
+			record("2 started")
+			<-gates[2]
+		case 3:
+			record("3 started")
+		}
+		return false
+	})
+	wg.Add(3)
+	p.schedule(&Stream{id: 1})
+	eventually(t, "the slot of stream 1 released", func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(events) == 1
+	})
+	if running, _, _ := p.slots(); running != 0 {
+		t.Errorf("%d running after the slot is released", running)
+	}
+	//the free slot runs the next stream while the first one waits for data
+	p.schedule(&Stream{id: 2})
+	if running, _, _ := p.slots(); running != 1 {
+		t.Errorf("%d running after stream 2 is scheduled", running)
+	}
+	close(gates[1])
+	eventually(t, "stream 1 waiting for a slot", func() bool {
+		_, waiting, _ := p.slots()
+		return waiting == 1
+	})
+	//a decoder which waits to go on comes before the queued streams
+	p.schedule(&Stream{id: 3})
+	if running, waiting, queued := p.slots(); running != 1 || waiting != 1 || queued != 1 {
+		t.Errorf("%d running, %d waiting, %d queued", running, waiting, queued)
+	}
+	close(gates[2])
+	wg.Wait()
+	want := []string{"1 released", "2 started", "1 acquired", "3 started"}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(events) != len(want) {
+		t.Fatalf("events are %v, want %v", events, want)
+	}
+	for i := range want {
+		if events[i] != want[i] {
+			t.Fatalf("events are %v, want %v", events, want)
+		}
+	}
+	eventually(t, "workers ended", func() bool {
+		running, waiting, queued := p.slots()
+		return running == 0 && waiting == 0 && queued == 0
+	})
+}
+
+func TestPoolDetach(t *testing.T) {
+	var (
+		wg sync.WaitGroup
+	)
+	detached := make(chan struct{})
+	var p *pool
+	p = newPool(1, func(stream *Stream) bool {
+		defer wg.Done()
+		if stream.id == 1 {
+			//the decoder reads the connection with goroutines of its own from now on
+			p.Release()
+			<-detached
+			return true
+		}
+		return false
+	})
+	wg.Add(3)
+	p.schedule(&Stream{id: 1})
+	//the slot of the detached decoder runs the other streams
+	p.schedule(&Stream{id: 2})
+	p.schedule(&Stream{id: 3})
+	eventually(t, "streams 2 and 3 done", func() bool {
+		running, _, queued := p.slots()
+		return running == 0 && queued == 0
+	})
+	close(detached)
+	wg.Wait()
+	if running, waiting, queued := p.slots(); running != 0 || waiting != 0 || queued != 0 {
+		t.Errorf("%d running, %d waiting, %d queued", running, waiting, queued)
+	}
+}
@@ -1,76 +1,125 @@
 package tcp
 
 import (
-	"bytes"
-	"errors"
 	"fmt"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/reassembly"
-	httpkg "github.com/uole/httpcap/http"
+	"github.com/uole/httpcap/internal/decoder"
 	iopkg "github.com/uole/httpcap/internal/io"
-	"io"
-	"net/http"
+	"github.com/uole/httpcap/tls"
 	"sync/atomic"
 	"time"
 )
 
-var (
-	responseBytes = []byte("HTTP/")
-
-	httpMethods = map[string]bool{
-		http.MethodGet:     true,
-		http.MethodPost:    true,
-		http.MethodPut:     true,
-		http.MethodDelete:  true,
-		http.MethodHead:    true,
-		http.MethodTrace:   true,
-		http.MethodOptions: true,
-		http.MethodPatch:   true,
-	}
+const (
+	//the decoder is parked or has not read anything yet, it is scheduled once data arrives
+	stateIdle int32 = iota
+	stateQueued
+	stateRunning
+	stateDone
 )
 
 type (
 	Stream struct {
 		id          int64
-		up          *iopkg.Buffer
-		down        *iopkg.Buffer
+		factory     *Factory
 		tcp         *layers.TCP
 		net         gopacket.Flow
 		transport   gopacket.Flow
 		srcAddr     string
 		dstAddr     string
-		isHttp      bool
-		isWebsocket bool
-		abnormal    int32
-		writer      io.Writer
+		decoder     decoder.Decoder
+		conn        *decoder.Conn
+		session     *tls.Session
+		ignored     bool
+		state       int32
+		first, last time.Time
 	}
 )
 
-func isHttpRequest(b []byte) bool {
-	var (
-		pos int
-	)
-	if pos = bytes.IndexByte(b, ' '); pos > 0 && pos <= 8 {
-		method := string(b[:pos])
-		return httpMethods[method]
+// sniff looks for a decoder of the payload and starts to decode the connection.
+func (stream *Stream) sniff(fromClient bool, b []byte) {
+	if stream.decoder = stream.factory.registry.Sniff(b, fromClient); stream.decoder != nil {
+		stream.conn = decoder.NewConn(stream.id, stream.srcAddr, stream.dstAddr, stream.factory.writeCloser)
+		stream.conn.MaxBodySize = stream.factory.limits.MaxBodySize
+		stream.conn.Counters = &stream.factory.counters
+		if clock := stream.factory.clock; clock != nil {
+			stream.conn.Up.SetClock(clock)
+			stream.conn.Down.SetClock(clock)
+		}
+		stream.factory.start(stream)
+	}
+}
+
+// write hands data to the decoder, after a parse error the data is dropped until the decoder finds the start of a message.
+func (stream *Stream) write(fromClient bool, b []byte, first, last time.Time) {
+	if stream.conn.Resyncing() {
+		if !stream.decoder.Sniff(b, fromClient) {
+			atomic.AddInt64(&stream.factory.dropped, int64(len(b)))
+			return
+		}
+		stream.conn.Discard()
+		stream.conn.Synced()
+		//a message which is still read misses the dropped data
+		stream.conn.Up.MarkGap()
+		stream.conn.Down.MarkGap()
 	}
-	return false
+	buf := stream.buffer(fromClient)
+	//the decoder does not keep up, its data is dropped instead of growing the buffer without limit
+	limits := stream.factory.limits
+	if (limits.MaxStreamBuffer > 0 && buf.Len()+len(b) > limits.MaxStreamBuffer) ||
+		(limits.MaxMemory > 0 && iopkg.Buffered()+int64(len(b)) > limits.MaxMemory) {
+		atomic.AddInt64(&stream.factory.dropped, int64(stream.conn.Up.Len()+stream.conn.Down.Len()+len(b)))
+		stream.conn.Overflow()
+		return
+	}
+	_ = buf.PutBytes(b, first, last)
+	stream.wake()
 }
 
-func isHttpResponse(b []byte) bool {
-	if len(b) > 5 {
-		return bytes.Equal(b[:5], responseBytes)
+func (stream *Stream) buffer(fromClient bool) *iopkg.Buffer {
+	if fromClient {
+		return stream.conn.Up
 	}
-	return false
+	return stream.conn.Down
 }
 
-func (stream *Stream) Accept(tcp *layers.TCP, ci gopacket.CaptureInfo, dir reassembly.TCPFlowDirection, nextSeq reassembly.Sequence, start *bool, ac reassembly.AssemblerContext) bool {
-	if !stream.isHttp && tcp.PSH {
-		if len(tcp.Payload) > 8 {
-			stream.isHttp = isHttpRequest(tcp.Payload)
+// wake schedules a parked decoder, decoders which are queued or running read the data themselves.
+func (stream *Stream) wake() {
+	if atomic.CompareAndSwapInt32(&stream.state, stateIdle, stateQueued) {
+		stream.factory.wg.Add(1)
+		stream.factory.pool.schedule(stream)
+	}
+}
+
+// put writes the plaintext of a tls connection, the decoder is chosen by the first plaintext.
+func (stream *Stream) put(fromClient bool, b []byte) {
+	if stream.decoder == nil {
+		if stream.sniff(fromClient, b); stream.decoder == nil {
+			return
 		}
 	}
+	//the records are decrypted in place, the buffer keeps a copy
+	stream.write(fromClient, b, stream.first, stream.last)
+}
+
+func (stream *Stream) Accept(tcp *layers.TCP, ci gopacket.CaptureInfo, dir reassembly.TCPFlowDirection, nextSeq reassembly.Sequence, start *bool, ac reassembly.AssemblerContext) bool {
+	if stream.decoder != nil || stream.session != nil || len(tcp.Payload) == 0 {
+		return true
+	}
+	//https connections are decrypted when the key log is given, the others are listed with their handshake
+	if dir == reassembly.TCPDirClientToServer && tls.IsClientHello(tcp.Payload) {
+		startedAt := ci.Timestamp
+		stream.session = tls.NewSession(stream.factory.keylog, stream.put).WithHandshake(func(hs *tls.Handshake) {
+			hs.Time, hs.Client, hs.Server = startedAt, stream.srcAddr, stream.dstAddr
+			if stream.factory.handshakeFunc != nil {
+				stream.factory.handshakeFunc(hs)
+			}
+		})
+		return true
+	}
+	stream.sniff(dir == reassembly.TCPDirClientToServer, tcp.Payload)
 	return true
 }
 
@@ -78,70 +127,75 @@ func (stream *Stream) ReassembledSG(sg reassembly.ScatterGather, ac reassembly.A
 	var (
 		buf    []byte
 		length int
+		skip   int
 		dir    reassembly.TCPFlowDirection
 	)
-	dir, _, _, _ = sg.Info()
+	dir, _, _, skip = sg.Info()
 	length, _ = sg.Lengths()
-	if stream.isHttp && length > 0 {
-		buf = sg.Fetch(length)
-		if atomic.LoadInt32(&stream.abnormal) == 1 {
-			if isHttpRequest(buf) {
-				stream.Discard()
-				atomic.StoreInt32(&stream.abnormal, 0)
-			}
+	//the assembler gave up waiting for the missing bytes of the connection
+	if skip > 0 {
+		atomic.AddInt64(&stream.factory.gaps, 1)
+		atomic.AddInt64(&stream.factory.skipped, int64(skip))
+		switch {
+		case stream.session != nil && !stream.ignored:
+			stream.stop()
+		case stream.conn != nil && !stream.isIgnored():
+			stream.buffer(dir == reassembly.TCPDirClientToServer).MarkGap()
 		}
-		if dir == reassembly.TCPDirClientToServer {
-			_ = stream.up.PutBytes(buf)
-		} else {
-			_ = stream.down.PutBytes(buf)
+	}
+	if length == 0 || (stream.decoder == nil && stream.session == nil) || stream.isIgnored() {
+		return
+	}
+	buf = sg.Fetch(length)
+	first := sg.CaptureInfo(0).Timestamp
+	last := sg.CaptureInfo(length - 1).Timestamp
+	if stream.session != nil {
+		stream.first, stream.last = first, last
+		if err := stream.session.Write(dir == reassembly.TCPDirClientToServer, buf); err != nil {
+			fmt.Fprintf(stream.factory.writeCloser, "stream %d decrypt tls error: %s\n", stream.id, err.Error())
+			atomic.AddInt64(&stream.factory.counters.ParseErrors, 1)
+			stream.ignored = true
+		}
+		//nothing but the handshake can be read from the connection
+		if stream.session.Passive() {
+			stream.ignored = true
 		}
+		return
 	}
+	stream.write(dir == reassembly.TCPDirClientToServer, buf, first, last)
 }
 
-func (stream *Stream) ReassemblyComplete(ac reassembly.AssemblerContext) bool {
-	_ = stream.up.Close()
-	_ = stream.down.Close()
-	return true
-}
-
-func (stream *Stream) Discard() {
-	stream.up.Discard()
-	stream.down.Discard()
-}
-
-func (stream *Stream) Close() {
-	_ = stream.up.Close()
-	_ = stream.down.Close()
+// stop ends the decryption of a tls connection whose records are cut by a gap, the plaintext
+// ends with the gap so that the messages which are read are kept as incomplete.
+func (stream *Stream) stop() {
+	if err := stream.session.Stop(); err != nil {
+		fmt.Fprintf(stream.factory.writeCloser, "stream %d decrypt tls error: %s\n", stream.id, err.Error())
+		atomic.AddInt64(&stream.factory.counters.ParseErrors, 1)
+	}
+	stream.ignored = true
+	if stream.conn != nil {
+		stream.conn.Up.MarkGap()
+		stream.conn.Down.MarkGap()
+		stream.conn.Close()
+	}
 }
 
-func (stream *Stream) FetchRequest() (req *httpkg.Request, res *httpkg.Response, err error) {
-__retry:
-	if req, err = httpkg.ReadRequest(stream.up.Reader()); err != nil {
-		if stream.writer != nil {
-			fmt.Fprintf(stream.writer, "stream %d read request error: %s\n", stream.id, err.Error())
-		}
-		if !errors.Is(err, io.ErrClosedPipe) {
-			atomic.StoreInt32(&stream.abnormal, 1)
-			stream.Discard()
-			goto __retry
+func (stream *Stream) ReassemblyComplete(ac reassembly.AssemblerContext) bool {
+	atomic.AddInt64(&stream.factory.active, -1)
+	if stream.session != nil && !stream.ignored {
+		if err := stream.session.Close(); err != nil {
+			fmt.Fprintf(stream.factory.writeCloser, "stream %d decrypt tls error: %s\n", stream.id, err.Error())
+			atomic.AddInt64(&stream.factory.counters.ParseErrors, 1)
 		}
-		return
 	}
-	if !stream.isWebsocket {
-		if req.Header.Get("Upgrade") == "websocket" {
-			stream.isWebsocket = true
-		}
+	if stream.conn != nil {
+		stream.conn.Close()
 	}
-	stream.down.SetReadDeadline(time.Now().Add(time.Second * 10))
-	if res, err = httpkg.ReadResponse(stream.down.Reader(), req); err != nil {
-		if stream.writer != nil {
-			fmt.Fprintf(stream.writer, "stream %d read response error: %s\n", stream.id, err.Error())
-		}
-		if !errors.Is(err, io.ErrClosedPipe) {
-			atomic.StoreInt32(&stream.abnormal, 1)
-			stream.Discard()
-			goto __retry
-		}
-	}
-	return
+	return true
+}
+
+// isIgnored reports whether the rest of the connection is dropped, either the tls records
+// can not be decrypted or the decoder does not understand the connection any longer.
+func (stream *Stream) isIgnored() bool {
+	return stream.ignored || (stream.conn != nil && stream.conn.Ignored())
 }
@@ -6,53 +6,174 @@ import (
 	"errors"
 	"github.com/uole/httpcap/internal/bufferpool"
 	"io"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
+const (
+	//how often a reader which waits for data looks at the clock of its deadline
+	clockInterval = time.Second
+)
+
 var (
 	ErrDeadline = errors.New("deadline")
+
+	//bytes written into the buffers which have not been read yet
+	buffered int64
 )
 
-type Buffer struct {
-	br           *bufio.Reader
-	closeFlag    int32
-	closeChan    chan struct{}
-	notifyChan   chan struct{}
-	readDeadline time.Time
-	buf          *bytes.Buffer
-	lastOp       time.Time
-}
+type (
+	mark struct {
+		offset int64
+		size   int64
+		first  time.Time
+		last   time.Time
+	}
+
+	Buffer struct {
+		readOffset   int64
+		br           *bufio.Reader
+		closeFlag    int32
+		closeChan    chan struct{}
+		notifyChan   chan struct{}
+		readDeadline time.Time
+		mutex        sync.Mutex
+		buf          *bytes.Buffer
+		lastOp       time.Time
+		writeOffset  int64
+		marks        []mark
+		//offsets where data follows bytes which are missing in the capture
+		gaps     []int64
+		waitFunc func(waiting bool)
+		clock    func() time.Time
+	}
+)
 
 func (r *Buffer) Reader() *bufio.Reader {
 	return r.br
 }
 
+// Clear drops the data which has not been read yet, unlike Discard it may be called by the writer.
+func (r *Buffer) Clear() {
+	r.mutex.Lock()
+	if r.buf != nil {
+		atomic.AddInt64(&r.readOffset, int64(r.buf.Len()))
+		atomic.AddInt64(&buffered, -int64(r.buf.Len()))
+		r.buf.Reset()
+	}
+	//the dropped data is never queried, only a gap in front of the next data is kept
+	for len(r.gaps) > 0 && r.gaps[0] < r.writeOffset {
+		r.gaps = r.gaps[1:]
+	}
+	r.mutex.Unlock()
+}
+
+// Len returns the bytes which have been written but not read yet.
+func (r *Buffer) Len() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.buf == nil {
+		return 0
+	}
+	return r.buf.Len()
+}
+
+// Unread returns the bytes which have not been consumed by the reader yet, including the bytes of its bufio.Reader.
+// It must be called by the reader.
+func (r *Buffer) Unread() int {
+	return r.Len() + r.br.Buffered()
+}
+
 func (r *Buffer) Discard() {
-	r.buf.Reset()
+	r.Clear()
 	if s := r.br.Buffered(); s > 0 {
 		r.br.Discard(s)
 	}
 }
 
-func (r *Buffer) PutBytes(b []byte) (err error) {
+// Position returns the offset of the next byte the reader is going to consume.
+func (r *Buffer) Position() int64 {
+	return atomic.LoadInt64(&r.readOffset) - int64(r.br.Buffered())
+}
+
+// Timestamp returns the capture time of the data at pos, positions are expected
+// to be queried in ascending order so that older marks can be dropped.
+func (r *Buffer) Timestamp(pos int64) (t time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for i, m := range r.marks {
+		if pos >= m.offset+m.size {
+			continue
+		}
+		if pos >= m.offset {
+			if pos == m.offset {
+				t = m.first
+			} else {
+				t = m.last
+			}
+		}
+		r.marks = r.marks[i:]
+		return
+	}
+	r.marks = r.marks[:0]
+	return
+}
+
+// MarkGap records that the next data written does not follow the data before it, bytes are missing in between.
+func (r *Buffer) MarkGap() {
+	r.mutex.Lock()
+	if n := len(r.gaps); n == 0 || r.gaps[n-1] != r.writeOffset {
+		r.gaps = append(r.gaps, r.writeOffset)
+	}
+	r.mutex.Unlock()
+}
+
+// Gap reports whether bytes are missing within the data from offset from to offset to, both included.
+// Like Timestamp it is expected to be queried in ascending order, older gaps are dropped.
+func (r *Buffer) Gap(from, to int64) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for len(r.gaps) > 0 && r.gaps[0] <= from {
+		r.gaps = r.gaps[1:]
+	}
+	return len(r.gaps) > 0 && r.gaps[0] <= to
+}
+
+func (r *Buffer) PutBytes(b []byte, first, last time.Time) (err error) {
 	if atomic.LoadInt32(&r.closeFlag) == 1 {
 		err = io.ErrClosedPipe
 		return
 	}
+	r.mutex.Lock()
 	r.buf.Write(b)
+	atomic.AddInt64(&buffered, int64(len(b)))
+	r.marks = append(r.marks, mark{offset: r.writeOffset, size: int64(len(b)), first: first, last: last})
+	r.writeOffset += int64(len(b))
+	r.mutex.Unlock()
 	r.lastOp = time.Now()
 	select {
 	case r.notifyChan <- struct{}{}:
 	case <-r.closeChan:
 		err = io.ErrClosedPipe
-	case <-time.After(time.Millisecond * 100):
+	default:
+		//the reader has not consumed the previous notification yet
 	}
 	return
 }
 
 func (r *Buffer) Reset() {
+	r.mutex.Lock()
+	if r.buf == nil {
+		r.buf = bufferpool.Get()
+	}
+	atomic.AddInt64(&buffered, -int64(r.buf.Len()))
 	r.buf.Reset()
+	r.marks = r.marks[:0]
+	r.gaps = nil
+	r.writeOffset = 0
+	r.mutex.Unlock()
+	atomic.StoreInt64(&r.readOffset, 0)
 	r.closeFlag = 0
 	r.closeChan = make(chan struct{})
 	r.notifyChan = make(chan struct{}, 1)
@@ -62,57 +183,116 @@ func (r *Buffer) SetReadDeadline(t time.Time) {
 	r.readDeadline = t
 }
 
+// SetWaitFunc is called with true before Read waits for data and with false once it goes on.
+func (r *Buffer) SetWaitFunc(f func(waiting bool)) {
+	r.waitFunc = f
+}
+
+// SetClock sets the clock of the read deadline, e.g. the time of the packets of a capture file
+// which is read faster or slower than it was recorded, the wall clock is used without.
+func (r *Buffer) SetClock(f func() time.Time) {
+	r.clock = f
+}
+
+// Now returns the time of the clock of the read deadline.
+func (r *Buffer) Now() time.Time {
+	if r.clock != nil {
+		return r.clock()
+	}
+	return time.Now()
+}
+
+func (r *Buffer) expired() bool {
+	return !r.readDeadline.IsZero() && !r.Now().Before(r.readDeadline)
+}
+
+// wait blocks until data is written, the buffer is closed or the clock has to be looked at again.
+func (r *Buffer) wait(tick <-chan time.Time) {
+	if r.waitFunc != nil {
+		r.waitFunc(true)
+		defer r.waitFunc(false)
+	}
+	select {
+	case <-tick:
+	case <-r.closeChan:
+	case <-r.notifyChan:
+	}
+}
+
 func (r *Buffer) Read(p []byte) (n int, err error) {
 	var (
-		tires    int
-		deadline <-chan time.Time
+		tick <-chan time.Time
 	)
-	tires = -1
+	//a nil channel never fires, the ticker is only created for a deadline
 	if !r.readDeadline.IsZero() {
-		timer := time.NewTimer(r.readDeadline.Sub(time.Now()))
-		defer timer.Stop()
-		deadline = timer.C
-	} else {
-		deadline = make(chan time.Time)
+		ticker := time.NewTicker(clockInterval)
+		defer ticker.Stop()
+		tick = ticker.C
 	}
 __retry:
 	if atomic.LoadInt32(&r.closeFlag) == 1 {
-		if r.buf.Len() > 0 {
-			return r.buf.Read(p)
+		//drain whatever was written before the stream has been closed
+		if n, err = r.read(p); err == nil {
+			return
 		}
+		r.release()
 		err = io.ErrClosedPipe
+		//the connection was closed after the deadline has passed, e.g. at the end of a capture file
+		if r.expired() {
+			err = ErrDeadline
+		}
 		return
 	}
-	if n, err = r.buf.Read(p); err == nil {
+	if n, err = r.read(p); err == nil {
 		return
 	}
 	if errors.Is(err, io.EOF) {
-		select {
-		case <-deadline:
-			tires++
-			if tires < 1 {
-				goto __retry
-			} else {
-				err = ErrDeadline
-			}
-		case <-r.closeChan:
-			err = io.ErrClosedPipe
-		case <-r.notifyChan:
-			goto __retry
+		//the clock of a capture file only moves with its packets, so it is looked at instead of a timer
+		if r.expired() {
+			err = ErrDeadline
+			return
 		}
+		r.wait(tick)
+		goto __retry
+	}
+	return
+}
+
+func (r *Buffer) read(p []byte) (n int, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.buf == nil {
+		return 0, io.EOF
 	}
+	n, err = r.buf.Read(p)
+	atomic.AddInt64(&r.readOffset, int64(n))
+	atomic.AddInt64(&buffered, -int64(n))
 	return
 }
 
+func (r *Buffer) release() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.buf != nil {
+		atomic.AddInt64(&buffered, -int64(r.buf.Len()))
+		bufferpool.Put(r.buf)
+		r.buf = nil
+	}
+}
+
 func (r *Buffer) Close() (err error) {
 	if atomic.CompareAndSwapInt32(&r.closeFlag, 0, 1) {
 		close(r.closeChan)
 		close(r.notifyChan)
-		bufferpool.Put(r.buf)
 	}
 	return
 }
 
+// Buffered returns the bytes of every buffer which are waiting for their decoder.
+func Buffered() int64 {
+	return atomic.LoadInt64(&buffered)
+}
+
 func NewBuffer() *Buffer {
 	b := &Buffer{
 		closeChan:  make(chan struct{}),
@@ -0,0 +1,214 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	//series of a metric, further label values are counted in a single series
+	maxSeries  = 10000
+	otherValue = "other"
+)
+
+var (
+	labelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+type (
+	// Collector writes its series in the Prometheus text format.
+	Collector interface {
+		Collect(w *bufio.Writer)
+	}
+
+	series struct {
+		values  []string
+		value   float64
+		buckets []uint64
+		sum     float64
+		count   uint64
+	}
+
+	// Vec is a counter or a histogram with labels.
+	Vec struct {
+		name    string
+		help    string
+		typ     string
+		labels  []string
+		buckets []float64
+		mutex   sync.Mutex
+		series  map[string]*series
+	}
+
+	// Func is a counter or a gauge which is read when the metrics are collected.
+	Func struct {
+		name string
+		help string
+		typ  string
+		f    func() float64
+	}
+
+	Registry struct {
+		mutex      sync.Mutex
+		collectors []Collector
+	}
+)
+
+func writeHeader(w *bufio.Writer, name, help, typ string) {
+	_, _ = w.WriteString("# HELP " + name + " " + help + "\n")
+	_, _ = w.WriteString("# TYPE " + name + " " + typ + "\n")
+}
+
+func writeSample(w *bufio.Writer, name string, labels, values []string, value float64) {
+	_, _ = w.WriteString(name)
+	if len(labels) > 0 {
+		_ = w.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				_ = w.WriteByte(',')
+			}
+			_, _ = w.WriteString(label + `="` + labelReplacer.Replace(values[i]) + `"`)
+		}
+		_ = w.WriteByte('}')
+	}
+	_ = w.WriteByte(' ')
+	_, _ = w.WriteString(formatValue(value))
+	_ = w.WriteByte('\n')
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// get returns the series of the label values, it is created on first use.
+func (vec *Vec) get(values []string) *series {
+	key := strings.Join(values, "\xff")
+	s, ok := vec.series[key]
+	if ok {
+		return s
+	}
+	if len(vec.series) >= maxSeries {
+		values = make([]string, len(vec.labels))
+		for i := range values {
+			values[i] = otherValue
+		}
+		key = strings.Join(values, "\xff")
+		if s, ok = vec.series[key]; ok {
+			return s
+		}
+	}
+	s = &series{values: append([]string{}, values...), buckets: make([]uint64, len(vec.buckets))}
+	vec.series[key] = s
+	return s
+}
+
+// Add adds v to the counter of the label values.
+func (vec *Vec) Add(v float64, values ...string) {
+	vec.mutex.Lock()
+	vec.get(values).value += v
+	vec.mutex.Unlock()
+}
+
+func (vec *Vec) Inc(values ...string) {
+	vec.Add(1, values...)
+}
+
+// Observe counts v in the buckets of the histogram of the label values.
+func (vec *Vec) Observe(v float64, values ...string) {
+	vec.mutex.Lock()
+	defer vec.mutex.Unlock()
+	s := vec.get(values)
+	if i := sort.SearchFloat64s(vec.buckets, v); i < len(vec.buckets) {
+		s.buckets[i]++
+	}
+	s.sum += v
+	s.count++
+}
+
+func (vec *Vec) Collect(w *bufio.Writer) {
+	vec.mutex.Lock()
+	defer vec.mutex.Unlock()
+	writeHeader(w, vec.name, vec.help, vec.typ)
+	keys := make([]string, 0, len(vec.series))
+	for key := range vec.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	labels := append(append([]string{}, vec.labels...), "le")
+	for _, key := range keys {
+		s := vec.series[key]
+		if vec.typ != "histogram" {
+			writeSample(w, vec.name, vec.labels, s.values, s.value)
+			continue
+		}
+		//buckets are cumulative
+		var count uint64
+		values := append(append([]string{}, s.values...), "")
+		for i, bound := range vec.buckets {
+			count += s.buckets[i]
+			values[len(values)-1] = formatValue(bound)
+			writeSample(w, vec.name+"_bucket", labels, values, float64(count))
+		}
+		values[len(values)-1] = "+Inf"
+		writeSample(w, vec.name+"_bucket", labels, values, float64(s.count))
+		writeSample(w, vec.name+"_sum", vec.labels, s.values, s.sum)
+		writeSample(w, vec.name+"_count", vec.labels, s.values, float64(s.count))
+	}
+}
+
+func (f *Func) Collect(w *bufio.Writer) {
+	writeHeader(w, f.name, f.help, f.typ)
+	writeSample(w, f.name, nil, nil, f.f())
+}
+
+func (registry *Registry) Register(collectors ...Collector) *Registry {
+	registry.mutex.Lock()
+	registry.collectors = append(registry.collectors, collectors...)
+	registry.mutex.Unlock()
+	return registry
+}
+
+// Write writes every metric in the Prometheus text format.
+func (registry *Registry) Write(w io.Writer) (err error) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	bw := bufio.NewWriter(w)
+	for _, c := range registry.collectors {
+		c.Collect(bw)
+	}
+	return bw.Flush()
+}
+
+func NewCounterVec(name, help string, labels ...string) *Vec {
+	return &Vec{name: name, help: help, typ: "counter", labels: labels, series: make(map[string]*series)}
+}
+
+// NewHistogramVec returns a histogram with the upper bounds of its buckets in ascending order.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *Vec {
+	return &Vec{name: name, help: help, typ: "histogram", labels: labels, buckets: buckets, series: make(map[string]*series)}
+}
+
+func NewCounterFunc(name, help string, f func() float64) *Func {
+	return &Func{name: name, help: help, typ: "counter", f: f}
+}
+
+func NewGaugeFunc(name, help string, f func() float64) *Func {
+	return &Func{name: name, help: help, typ: "gauge", f: f}
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
@@ -0,0 +1,109 @@
+package httpcap
+
+import (
+	"github.com/uole/httpcap/http"
+	"github.com/uole/httpcap/internal/decoder"
+	"github.com/uole/httpcap/internal/metrics"
+	"github.com/uole/httpcap/tls"
+	nethttp "net/http"
+	"strconv"
+)
+
+var (
+	durationBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	sizeBuckets     = []float64{100, 1000, 10000, 100000, 1000000, 10000000}
+)
+
+type (
+	// Metrics serves the captured requests and the health of the capture in the Prometheus text format.
+	Metrics struct {
+		registry  *metrics.Registry
+		requests  *metrics.Vec
+		durations *metrics.Vec
+		sizes     *metrics.Vec
+		exchanges *metrics.Vec
+	}
+)
+
+// statusClass returns the class of a status code, e.g. 2xx.
+func statusClass(code int) string {
+	if code < 100 || code > 599 {
+		return "unknown"
+	}
+	return strconv.Itoa(code/100) + "xx"
+}
+
+func (m *Metrics) observe(req *http.Request, res *http.Response) {
+	labels := []string{hostname(req.Host), req.Method, pathTemplate(req.RequestURI), statusClass(res.StatusCode)}
+	m.requests.Inc(labels...)
+	m.durations.Observe(res.Latency().Seconds(), labels...)
+	//the body may be cut at the max body size, its size on the wire is observed
+	m.sizes.Observe(float64(res.ContentLength), labels...)
+}
+
+func (m *Metrics) observeExchange(e decoder.Exchange) {
+	m.exchanges.Inc(e.Protocol())
+}
+
+func (m *Metrics) observeHandshake(hs *tls.Handshake) {
+	m.exchanges.Inc("tls")
+}
+
+func (m *Metrics) ServeHTTP(w nethttp.ResponseWriter, r *nethttp.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = m.registry.Write(w)
+}
+
+func NewMetrics(capture *Capture) *Metrics {
+	labels := []string{"host", "method", "path", "status_class"}
+	m := &Metrics{
+		registry:  metrics.NewRegistry(),
+		requests:  metrics.NewCounterVec("httpcap_requests_total", "Captured http requests.", labels...),
+		durations: metrics.NewHistogramVec("httpcap_request_duration_seconds", "Time from the first byte of the request to the last byte of the response.", durationBuckets, labels...),
+		sizes:     metrics.NewHistogramVec("httpcap_response_size_bytes", "Size of the response bodies as sent on the wire.", sizeBuckets, labels...),
+		exchanges: metrics.NewCounterVec("httpcap_exchanges_total", "Captured exchanges of other protocols than http, e.g. redis commands or tls handshakes.", "protocol"),
+	}
+	m.registry.Register(m.requests, m.durations, m.sizes, m.exchanges)
+	m.registry.Register(
+		metrics.NewCounterFunc("httpcap_packets_total", "Packets read by the capture.", func() float64 {
+			return float64(capture.Stats().Packets)
+		}),
+		metrics.NewCounterFunc("httpcap_pcap_packets_received_total", "Packets received by libpcap, only known for live captures.", func() float64 {
+			return float64(capture.Stats().PacketsReceived)
+		}),
+		metrics.NewCounterFunc("httpcap_pcap_packets_dropped_total", "Packets dropped by libpcap because the buffer was full.", func() float64 {
+			return float64(capture.Stats().PacketsDropped)
+		}),
+		metrics.NewCounterFunc("httpcap_pcap_packets_if_dropped_total", "Packets dropped by the network interface.", func() float64 {
+			return float64(capture.Stats().PacketsIfDropped)
+		}),
+		metrics.NewGaugeFunc("httpcap_active_streams", "Tcp streams which are being reassembled.", func() float64 {
+			return float64(capture.Stats().ActiveStreams)
+		}),
+		metrics.NewCounterFunc("httpcap_parse_errors_total", "Errors of the decoders, they are written into the log file.", func() float64 {
+			return float64(capture.Stats().ParseErrors)
+		}),
+		metrics.NewCounterFunc("httpcap_truncated_bodies_total", "Bodies which were cut at the max body size.", func() float64 {
+			return float64(capture.Stats().TruncatedBodies)
+		}),
+		metrics.NewCounterFunc("httpcap_dropped_bytes_total", "Bytes of the connections which were dropped after a parse error or once a buffer limit was hit.", func() float64 {
+			return float64(capture.Stats().DroppedBytes)
+		}),
+		metrics.NewCounterFunc("httpcap_response_timeouts_total", "Requests whose response did not arrive in time.", func() float64 {
+			return float64(capture.Stats().Timeouts)
+		}),
+		metrics.NewCounterFunc("httpcap_reassembly_gaps_total", "Holes in the tcp streams which were skipped because the missing packets never arrived.", func() float64 {
+			return float64(capture.Stats().Gaps)
+		}),
+		metrics.NewCounterFunc("httpcap_skipped_bytes_total", "Bytes of the tcp streams which were missing in the capture.", func() float64 {
+			return float64(capture.Stats().SkippedBytes)
+		}),
+		metrics.NewCounterFunc("httpcap_gap_exchanges_total", "Exchanges whose data had gaps, e.g. http requests or redis commands.", func() float64 {
+			return float64(capture.Stats().GapExchanges)
+		}),
+		metrics.NewGaugeFunc("httpcap_buffered_bytes", "Bytes of the connections which are waiting for their decoder.", func() float64 {
+			return float64(capture.Stats().BufferedBytes)
+		}),
+	)
+	return m
+}
@@ -0,0 +1,308 @@
+package httpcap
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/uole/httpcap/grpc"
+	"github.com/uole/httpcap/http"
+	"github.com/uole/httpcap/redis"
+	"github.com/uole/httpcap/sql"
+	"github.com/uole/httpcap/tls"
+	"github.com/uole/httpcap/websocket"
+	nethttp "net/http"
+	"time"
+)
+
+type (
+	message interface {
+		DecodedBody() []byte
+		ContentEncoding() string
+		DecodeError() error
+		IsBinary() bool
+	}
+
+	Body struct {
+		Size            int    `json:"size"`
+		ContentEncoding string `json:"content_encoding,omitempty"`
+		WireSize        int    `json:"wire_size,omitempty"`
+		DecodeError     string `json:"decode_error,omitempty"`
+		Encoding        string `json:"encoding,omitempty"`
+		Content         string `json:"content,omitempty"`
+		Sha256          string `json:"sha256,omitempty"`
+		//the body was cut at the max body size, the size on the wire is in TotalSize
+		Truncated bool `json:"truncated,omitempty"`
+		TotalSize int  `json:"total_size,omitempty"`
+	}
+
+	Record struct {
+		Type            string         `json:"type"`
+		StartedAt       time.Time      `json:"started_at"`
+		FirstByteAt     time.Time      `json:"first_byte_at"`
+		CompletedAt     time.Time      `json:"completed_at"`
+		TimeToFirstByte float64        `json:"ttfb_ms"`
+		Duration        float64        `json:"duration_ms"`
+		Client          string         `json:"client"`
+		Server          string         `json:"server"`
+		Method          string         `json:"method"`
+		URI             string         `json:"uri"`
+		Proto           string         `json:"proto"`
+		StreamID        uint32         `json:"stream_id,omitempty"`
+		Host            string         `json:"host"`
+		RequestHeader   nethttp.Header `json:"request_header"`
+		RequestBody     *Body          `json:"request_body,omitempty"`
+		RequestTrailer  nethttp.Header `json:"request_trailer,omitempty"`
+		Status          int            `json:"status"`
+		StatusText      string         `json:"status_text"`
+		ResponseHeader  nethttp.Header `json:"response_header"`
+		ResponseBody    *Body          `json:"response_body,omitempty"`
+		ResponseTrailer nethttp.Header `json:"response_trailer,omitempty"`
+		GRPC            *grpc.Call     `json:"grpc,omitempty"`
+		//bytes of the exchange were missing in the capture, the bodies can not be trusted
+		Gap bool `json:"gap,omitempty"`
+	}
+
+	// MessageRecord is a websocket message, it follows the record of its handshake.
+	MessageRecord struct {
+		Type      string    `json:"type"`
+		Time      time.Time `json:"time"`
+		Client    string    `json:"client"`
+		Server    string    `json:"server"`
+		Host      string    `json:"host"`
+		URI       string    `json:"uri"`
+		Direction string    `json:"direction"`
+		Opcode    string    `json:"opcode"`
+		Body      *Body     `json:"body,omitempty"`
+		CloseCode int       `json:"close_code,omitempty"`
+		CloseText string    `json:"close_reason,omitempty"`
+	}
+
+	// CommandRecord is a redis command and its reply, a push of the server has no command.
+	CommandRecord struct {
+		Type            string      `json:"type"`
+		StartedAt       time.Time   `json:"started_at"`
+		FirstByteAt     time.Time   `json:"first_byte_at"`
+		CompletedAt     time.Time   `json:"completed_at"`
+		TimeToFirstByte float64     `json:"ttfb_ms"`
+		Duration        float64     `json:"duration_ms"`
+		Client          string      `json:"client"`
+		Server          string      `json:"server"`
+		Command         string      `json:"command"`
+		Args            []string    `json:"args,omitempty"`
+		Reply           interface{} `json:"reply"`
+		ReplyType       string      `json:"reply_type,omitempty"`
+		ReplySize       int         `json:"reply_size,omitempty"`
+		Gap             bool        `json:"gap,omitempty"`
+	}
+
+	// QueryRecord is a sql query of postgres or mysql with its result.
+	QueryRecord struct {
+		Type            string        `json:"type"`
+		StartedAt       time.Time     `json:"started_at"`
+		FirstByteAt     time.Time     `json:"first_byte_at"`
+		CompletedAt     time.Time     `json:"completed_at"`
+		TimeToFirstByte float64       `json:"ttfb_ms"`
+		Duration        float64       `json:"duration_ms"`
+		Client          string        `json:"client"`
+		Server          string        `json:"server"`
+		User            string        `json:"user,omitempty"`
+		Database        string        `json:"database,omitempty"`
+		Query           string        `json:"query"`
+		Params          []interface{} `json:"params,omitempty"`
+		Prepared        bool          `json:"prepared,omitempty"`
+		Rows            int64         `json:"rows"`
+		Tag             string        `json:"tag,omitempty"`
+		Error           string        `json:"error,omitempty"`
+		ErrorCode       string        `json:"error_code,omitempty"`
+		Gap             bool          `json:"gap,omitempty"`
+	}
+
+	// HandshakeRecord is a tls connection which is not decrypted.
+	HandshakeRecord struct {
+		Type        string    `json:"type"`
+		Time        time.Time `json:"time"`
+		Client      string    `json:"client"`
+		Server      string    `json:"server"`
+		ServerName  string    `json:"sni,omitempty"`
+		ALPN        []string  `json:"alpn,omitempty"`
+		Protocol    string    `json:"protocol,omitempty"`
+		Version     string    `json:"version,omitempty"`
+		CipherSuite string    `json:"cipher_suite,omitempty"`
+		Subject     string    `json:"subject,omitempty"`
+		Issuer      string    `json:"issuer,omitempty"`
+		JA3         string    `json:"ja3"`
+		JA4         string    `json:"ja4"`
+	}
+)
+
+func newBody(raw []byte, m message, maxBodySize int) *Body {
+	if len(raw) == 0 {
+		return nil
+	}
+	b := m.DecodedBody()
+	body := &Body{Size: len(b)}
+	if body.ContentEncoding = m.ContentEncoding(); body.ContentEncoding != "" {
+		body.WireSize = len(raw)
+		if err := m.DecodeError(); err != nil {
+			body.DecodeError = err.Error()
+		}
+	}
+	if len(b) > maxBodySize {
+		sum := sha256.Sum256(b)
+		body.Sha256 = hex.EncodeToString(sum[:])
+		return body
+	}
+	if m.IsBinary() {
+		body.Encoding = "base64"
+		body.Content = base64.StdEncoding.EncodeToString(b)
+	} else {
+		body.Content = string(b)
+	}
+	return body
+}
+
+// truncatedBody marks a body which was cut at the max body size of the capture.
+func truncatedBody(body *Body, truncated bool, size int) *Body {
+	if body != nil && truncated {
+		body.Truncated, body.TotalSize = true, size
+	}
+	return body
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func NewRecord(req *http.Request, res *http.Response, maxBodySize int) *Record {
+	return &Record{
+		Type:            "http",
+		StartedAt:       req.StartedAt,
+		FirstByteAt:     res.FirstByteAt,
+		CompletedAt:     res.CompletedAt,
+		TimeToFirstByte: milliseconds(res.TimeToFirstByte()),
+		Duration:        milliseconds(res.Latency()),
+		Client:          req.Address,
+		Server:          res.Address,
+		Method:          req.Method,
+		URI:             req.RequestURI,
+		Proto:           req.Proto,
+		StreamID:        req.StreamID,
+		Host:            req.Host,
+		RequestHeader:   req.Header,
+		RequestBody:     truncatedBody(newBody(req.Body, req, maxBodySize), req.Truncated, req.ContentLength),
+		RequestTrailer:  req.Trailer,
+		Status:          res.StatusCode,
+		StatusText:      res.Status,
+		ResponseHeader:  res.Header,
+		ResponseBody:    truncatedBody(newBody(res.Body, res, maxBodySize), res.Truncated, res.ContentLength),
+		ResponseTrailer: res.Trailer,
+		Gap:             req.Gap || res.Gap,
+	}
+}
+
+func NewMessageRecord(req *http.Request, res *http.Response, msg *websocket.Message, maxBodySize int) *MessageRecord {
+	record := &MessageRecord{
+		Type:      "websocket",
+		Time:      msg.Time,
+		Client:    req.Address,
+		Server:    res.Address,
+		Host:      req.Host,
+		URI:       req.RequestURI,
+		Direction: "receive",
+		Opcode:    msg.Type(),
+		Body:      newBody(msg.Raw, msg, maxBodySize),
+	}
+	if msg.FromClient {
+		record.Direction = "send"
+	}
+	record.CloseCode, record.CloseText = msg.CloseCode()
+	return record
+}
+
+func NewHandshakeRecord(hs *tls.Handshake) *HandshakeRecord {
+	return &HandshakeRecord{
+		Type:        "tls",
+		Time:        hs.Time,
+		Client:      hs.Client,
+		Server:      hs.Server,
+		ServerName:  hs.ServerName,
+		ALPN:        hs.ALPN,
+		Protocol:    hs.Protocol,
+		Version:     hs.VersionName(),
+		CipherSuite: hs.CipherSuiteName(),
+		Subject:     hs.Subject,
+		Issuer:      hs.Issuer,
+		JA3:         hs.JA3,
+		JA4:         hs.JA4,
+	}
+}
+
+func NewCommandRecord(cmd *redis.Command, maxBodySize int) *CommandRecord {
+	record := &CommandRecord{
+		Type:            "redis",
+		StartedAt:       cmd.StartedAt,
+		FirstByteAt:     cmd.FirstByteAt,
+		CompletedAt:     cmd.CompletedAt,
+		TimeToFirstByte: milliseconds(cmd.TimeToFirstByte()),
+		Duration:        milliseconds(cmd.Latency()),
+		Client:          cmd.Client,
+		Server:          cmd.Server,
+		Command:         cmd.Name(),
+		Gap:             cmd.Gap,
+	}
+	//a push has no command, it starts when it arrives
+	if cmd.Push {
+		record.StartedAt = cmd.FirstByteAt
+	} else {
+		for _, arg := range cmd.Args[1:] {
+			if len(arg) > maxBodySize {
+				arg = append(arg[:maxBodySize:maxBodySize], "..."...)
+			}
+			record.Args = append(record.Args, string(arg))
+		}
+	}
+	if cmd.Reply != nil {
+		record.Reply = cmd.Reply.Interface(maxBodySize)
+		record.ReplyType = cmd.Reply.TypeName()
+		record.ReplySize = cmd.Reply.Size()
+	}
+	return record
+}
+
+func NewQueryRecord(q *sql.Query, maxBodySize int) *QueryRecord {
+	record := &QueryRecord{
+		Type:            q.Dialect,
+		StartedAt:       q.StartedAt,
+		FirstByteAt:     q.FirstByteAt,
+		CompletedAt:     q.CompletedAt,
+		TimeToFirstByte: milliseconds(q.TimeToFirstByte()),
+		Duration:        milliseconds(q.Latency()),
+		Client:          q.Client,
+		Server:          q.Server,
+		User:            q.User,
+		Database:        q.Database,
+		Query:           q.Text,
+		Prepared:        q.Prepared,
+		Rows:            q.Rows,
+		Tag:             q.Tag,
+		Error:           q.Error,
+		ErrorCode:       q.ErrorCode,
+		Gap:             q.Gap,
+	}
+	for _, param := range q.Params {
+		switch v := param.(type) {
+		case string:
+			if len(v) > maxBodySize {
+				v = v[:maxBodySize] + "..."
+			}
+			param = v
+		case []byte:
+			if len(v) > maxBodySize {
+				v = v[:maxBodySize]
+			}
+			param = map[string]string{"base64": base64.StdEncoding.EncodeToString(v)}
+		}
+		record.Params = append(record.Params, param)
+	}
+	return record
+}
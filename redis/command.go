@@ -0,0 +1,146 @@
+package redis
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type (
+	// Command is a command of a client paired with the reply of the server.
+	Command struct {
+		Client      string
+		Server      string
+		Args        [][]byte
+		Reply       *Value
+		StartedAt   time.Time
+		FirstByteAt time.Time
+		CompletedAt time.Time
+		//a push of the server, e.g. a pubsub message, has no command
+		Push bool
+		//bytes of the command or its reply were missing in the capture
+		Gap  bool
+		size int
+	}
+)
+
+// ReadCommand reads a command, which is an array of bulk strings.
+func ReadCommand(v *Value) (cmd *Command, err error) {
+	if v.Type != TypeArray || v.Null || len(v.Elems) == 0 {
+		return nil, fmt.Errorf("%w: command is not an array", ErrProtocol)
+	}
+	cmd = &Command{Args: make([][]byte, 0, len(v.Elems)), size: v.Size()}
+	for _, elem := range v.Elems {
+		if elem.Type != TypeBulkString || elem.Null {
+			return nil, fmt.Errorf("%w: argument is not a bulk string", ErrProtocol)
+		}
+		cmd.Args = append(cmd.Args, elem.Str)
+	}
+	return
+}
+
+func (cmd *Command) Protocol() string {
+	return "redis"
+}
+
+func isPlain(arg []byte) bool {
+	if len(arg) == 0 {
+		return false
+	}
+	for _, c := range arg {
+		if c <= ' ' || c >= 0x7f || c == '"' || c == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+// Name returns the upper case name of the command, CLIENT SETNAME and other commands
+// with a subcommand are not split.
+func (cmd *Command) Name() string {
+	if cmd.Push {
+		return "PUSH"
+	}
+	return strings.ToUpper(string(cmd.Args[0]))
+}
+
+// Line returns the command with its arguments, arguments which are not plain words are quoted.
+// Arguments are left out once the line is longer than width.
+func (cmd *Command) Line(width int) string {
+	var (
+		b    strings.Builder
+		args [][]byte
+	)
+	b.WriteString(cmd.Name())
+	if cmd.Push {
+		//the kind and channel of a pubsub message
+		for i := 0; i < len(cmd.Reply.Elems) && i < 2 && cmd.Reply.Elems[i].Elems == nil; i++ {
+			args = append(args, []byte(cmd.Reply.Elems[i].Text()))
+		}
+	} else {
+		args = cmd.Args[1:]
+	}
+	for _, arg := range args {
+		if b.Len() >= width {
+			b.WriteString(" …")
+			break
+		}
+		b.WriteByte(' ')
+		if isPlain(arg) {
+			b.Write(arg)
+		} else {
+			b.WriteString(Quote(string(arg)))
+		}
+	}
+	return b.String()
+}
+
+// Summary describes the command and its reply, e.g. GET user:42 -> bulk(312B).
+func (cmd *Command) Summary(width int) string {
+	reply := "no reply"
+	if cmd.Reply != nil {
+		reply = cmd.Reply.Summary()
+	}
+	return cmd.Line(width) + " -> " + reply
+}
+
+// Size returns the number of bytes of the command on the wire.
+func (cmd *Command) Size() int {
+	return cmd.size
+}
+
+// MarshalJSON keeps the size of the command on the wire, e.g. when it is stored.
+func (cmd *Command) MarshalJSON() ([]byte, error) {
+	type plain Command
+	return json.Marshal(struct {
+		*plain
+		Size int
+	}{(*plain)(cmd), cmd.size})
+}
+
+func (cmd *Command) UnmarshalJSON(b []byte) (err error) {
+	type plain Command
+	s := struct {
+		*plain
+		Size int
+	}{plain: (*plain)(cmd)}
+	if err = json.Unmarshal(b, &s); err == nil {
+		cmd.size = s.Size
+	}
+	return
+}
+
+func (cmd *Command) Latency() time.Duration {
+	if cmd.Reply == nil || cmd.StartedAt.IsZero() {
+		return 0
+	}
+	return cmd.CompletedAt.Sub(cmd.StartedAt)
+}
+
+func (cmd *Command) TimeToFirstByte() time.Duration {
+	if cmd.Reply == nil || cmd.StartedAt.IsZero() {
+		return 0
+	}
+	return cmd.FirstByteAt.Sub(cmd.StartedAt)
+}
@@ -0,0 +1,387 @@
+package redis
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	TypeSimpleString = '+'
+	TypeError        = '-'
+	TypeInteger      = ':'
+	TypeBulkString   = '$'
+	TypeArray        = '*'
+	TypeNull         = '_'
+	TypeBoolean      = '#'
+	TypeDouble       = ','
+	TypeBigNumber    = '('
+	TypeBulkError    = '!'
+	TypeVerbatim     = '='
+	TypeMap          = '%'
+	TypeAttribute    = '|'
+	TypeSet          = '~'
+	TypePush         = '>'
+)
+
+const (
+	maxBulkSize = 512 * 1024 * 1024
+	maxElements = 1024 * 1024
+	maxDepth    = 64
+)
+
+var (
+	ErrProtocol = errors.New("redis protocol error")
+)
+
+// Value is a RESP2 or RESP3 value, the elements of a map or attribute are keys and values in turn.
+type Value struct {
+	Type     byte
+	Str      []byte
+	Int      int64
+	Elems    []*Value
+	Null     bool
+	Attrs    *Value
+	wireSize int
+}
+
+func readLine(br *bufio.Reader) (line []byte, err error) {
+	if line, err = br.ReadSlice('\n'); err != nil {
+		if errors.Is(err, bufio.ErrBufferFull) {
+			return nil, fmt.Errorf("%w: line too long", ErrProtocol)
+		}
+		return
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("%w: line does not end with CRLF", ErrProtocol)
+	}
+	return line[:len(line)-2], nil
+}
+
+func parseLength(b []byte, max int) (n int, err error) {
+	if n, err = strconv.Atoi(string(b)); err != nil || n < -1 || n > max {
+		return 0, fmt.Errorf("%w: invalid length %q", ErrProtocol, b)
+	}
+	return
+}
+
+func readValue(br *bufio.Reader, depth int) (v *Value, err error) {
+	var (
+		line []byte
+		n    int
+	)
+	if depth > maxDepth {
+		return nil, fmt.Errorf("%w: nested too deep", ErrProtocol)
+	}
+	if line, err = readLine(br); err != nil {
+		return
+	}
+	if len(line) == 0 {
+		return nil, fmt.Errorf("%w: empty line", ErrProtocol)
+	}
+	v = &Value{Type: line[0], wireSize: len(line) + 2}
+	body := line[1:]
+	switch v.Type {
+	case TypeSimpleString, TypeError, TypeDouble, TypeBigNumber:
+		v.Str = append([]byte{}, body...)
+	case TypeInteger:
+		if v.Int, err = strconv.ParseInt(string(body), 10, 64); err != nil {
+			return nil, fmt.Errorf("%w: invalid integer %q", ErrProtocol, body)
+		}
+	case TypeNull:
+		v.Null = true
+	case TypeBoolean:
+		if len(body) != 1 || (body[0] != 't' && body[0] != 'f') {
+			return nil, fmt.Errorf("%w: invalid boolean %q", ErrProtocol, body)
+		}
+		if body[0] == 't' {
+			v.Int = 1
+		}
+	case TypeBulkString, TypeBulkError, TypeVerbatim:
+		if n, err = parseLength(body, maxBulkSize); err != nil {
+			return
+		}
+		if n < 0 {
+			v.Null = true
+			return
+		}
+		v.Str = make([]byte, n+2)
+		if _, err = io.ReadFull(br, v.Str); err != nil {
+			return
+		}
+		if !bytes.HasSuffix(v.Str, []byte("\r\n")) {
+			return nil, fmt.Errorf("%w: bulk string does not end with CRLF", ErrProtocol)
+		}
+		v.Str = v.Str[:n]
+		v.wireSize += n + 2
+	case TypeArray, TypeSet, TypePush, TypeMap, TypeAttribute:
+		if n, err = parseLength(body, maxElements); err != nil {
+			return
+		}
+		if n < 0 {
+			v.Null = true
+			return
+		}
+		if v.Type == TypeMap || v.Type == TypeAttribute {
+			n *= 2
+		}
+		v.Elems = make([]*Value, 0, n)
+		for i := 0; i < n; i++ {
+			var elem *Value
+			if elem, err = readValue(br, depth+1); err != nil {
+				return
+			}
+			v.Elems = append(v.Elems, elem)
+			v.wireSize += elem.wireSize
+		}
+		//an attribute describes the value which follows it
+		if v.Type == TypeAttribute {
+			var next *Value
+			if next, err = readValue(br, depth+1); err != nil {
+				return
+			}
+			next.Attrs, next.wireSize = v, next.wireSize+v.wireSize
+			return next, nil
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown type %q", ErrProtocol, v.Type)
+	}
+	return
+}
+
+// ReadValue reads the next value of a connection.
+func ReadValue(br *bufio.Reader) (*Value, error) {
+	return readValue(br, 0)
+}
+
+// MarshalJSON keeps the size of the value on the wire, e.g. when it is stored.
+func (v *Value) MarshalJSON() ([]byte, error) {
+	type plain Value
+	return json.Marshal(struct {
+		*plain
+		WireSize int
+	}{(*plain)(v), v.wireSize})
+}
+
+func (v *Value) UnmarshalJSON(b []byte) (err error) {
+	type plain Value
+	s := struct {
+		*plain
+		WireSize int
+	}{plain: (*plain)(v)}
+	if err = json.Unmarshal(b, &s); err == nil {
+		v.wireSize = s.WireSize
+	}
+	return
+}
+
+func (v *Value) IsError() bool {
+	return v.Type == TypeError || v.Type == TypeBulkError
+}
+
+// Size returns the number of bytes of the value on the wire.
+func (v *Value) Size() int {
+	return v.wireSize
+}
+
+// Text returns the string of a scalar value, the format of a verbatim string is left out.
+func (v *Value) Text() string {
+	switch v.Type {
+	case TypeInteger:
+		return strconv.FormatInt(v.Int, 10)
+	case TypeBoolean:
+		return strconv.FormatBool(v.Int == 1)
+	case TypeVerbatim:
+		if len(v.Str) >= 4 && v.Str[3] == ':' {
+			return string(v.Str[4:])
+		}
+	}
+	return string(v.Str)
+}
+
+// TypeName returns the name of the type, e.g. bulk or array.
+func (v *Value) TypeName() string {
+	switch v.Type {
+	case TypeSimpleString:
+		return "string"
+	case TypeError, TypeBulkError:
+		return "error"
+	case TypeInteger:
+		return "int"
+	case TypeBoolean:
+		return "bool"
+	case TypeDouble:
+		return "double"
+	case TypeBigNumber:
+		return "bignum"
+	case TypeBulkString, TypeVerbatim:
+		return "bulk"
+	case TypeArray:
+		return "array"
+	case TypeSet:
+		return "set"
+	case TypePush:
+		return "push"
+	case TypeMap:
+		return "map"
+	}
+	return "nil"
+}
+
+// Summary describes the value in a few words, e.g. bulk(312B), array(3) or OK.
+func (v *Value) Summary() string {
+	switch {
+	case v.Null:
+		return "nil"
+	case v.Type == TypeSimpleString:
+		return v.Text()
+	case v.Type == TypeBulkString || v.Type == TypeVerbatim:
+		return "bulk(" + formatSize(len(v.Str)) + ")"
+	case v.Type == TypeMap:
+		return "map(" + strconv.Itoa(len(v.Elems)/2) + ")"
+	case v.Elems != nil:
+		return v.TypeName() + "(" + strconv.Itoa(len(v.Elems)) + ")"
+	}
+	return v.TypeName() + "(" + v.Text() + ")"
+}
+
+// Interface converts the value for json, strings longer than limit are cut.
+func (v *Value) Interface(limit int) interface{} {
+	if v.Null {
+		return nil
+	}
+	switch v.Type {
+	case TypeInteger:
+		return v.Int
+	case TypeBoolean:
+		return v.Int == 1
+	case TypeError, TypeBulkError:
+		return map[string]string{"error": v.Text()}
+	case TypeArray, TypeSet, TypePush:
+		values := make([]interface{}, 0, len(v.Elems))
+		for _, elem := range v.Elems {
+			values = append(values, elem.Interface(limit))
+		}
+		return values
+	case TypeMap:
+		values := make(map[string]interface{}, len(v.Elems)/2)
+		for i := 0; i+1 < len(v.Elems); i += 2 {
+			values[v.Elems[i].Text()] = v.Elems[i+1].Interface(limit)
+		}
+		return values
+	case TypeDouble:
+		if f, err := strconv.ParseFloat(v.Text(), 64); err == nil && !math.IsInf(f, 0) && !math.IsNaN(f) {
+			return f
+		}
+	}
+	s := v.Text()
+	//binary strings are kept as base64, like the bodies of http messages
+	if !utf8.ValidString(s) {
+		if len(s) > limit {
+			s = s[:limit]
+		}
+		return map[string]string{"base64": base64.StdEncoding.EncodeToString([]byte(s))}
+	}
+	if len(s) > limit {
+		s = s[:limit] + "..."
+	}
+	return s
+}
+
+// WriteTo writes the value the way redis-cli prints it.
+func (v *Value) WriteTo(w io.Writer) (n int64, err error) {
+	var buf bytes.Buffer
+	v.format(&buf, "")
+	return buf.WriteTo(w)
+}
+
+func (v *Value) format(buf *bytes.Buffer, indent string) {
+	if v.Null {
+		buf.WriteString("(nil)\n")
+		return
+	}
+	switch v.Type {
+	case TypeSimpleString:
+		buf.WriteString(v.Text() + "\n")
+	case TypeError, TypeBulkError:
+		buf.WriteString("(error) " + v.Text() + "\n")
+	case TypeInteger:
+		buf.WriteString("(integer) " + v.Text() + "\n")
+	case TypeBoolean, TypeDouble, TypeBigNumber:
+		buf.WriteString("(" + v.TypeName() + ") " + v.Text() + "\n")
+	case TypeBulkString, TypeVerbatim:
+		buf.WriteString(Quote(v.Text()) + "\n")
+	case TypeArray, TypeSet, TypePush, TypeMap:
+		if len(v.Elems) == 0 {
+			buf.WriteString("(empty " + v.TypeName() + ")\n")
+			return
+		}
+		step := 1
+		if v.Type == TypeMap {
+			step = 2
+		}
+		width := len(strconv.Itoa(len(v.Elems) / step))
+		for i := 0; i < len(v.Elems); i += step {
+			prefix := fmt.Sprintf("%*d) ", width, i/step+1)
+			if i > 0 {
+				buf.WriteString(indent)
+			}
+			buf.WriteString(prefix)
+			inner := indent + strings.Repeat(" ", len(prefix))
+			if v.Type == TypeMap {
+				buf.WriteString(Quote(v.Elems[i].Text()) + " => ")
+				inner += strings.Repeat(" ", utf8.RuneCountInString(Quote(v.Elems[i].Text()))+4)
+				v.Elems[i+1].format(buf, inner)
+			} else {
+				v.Elems[i].format(buf, inner)
+			}
+		}
+	default:
+		buf.WriteString(v.Text() + "\n")
+	}
+}
+
+// Quote quotes s like redis-cli, printable strings stay readable and other bytes are escaped.
+func Quote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == '\n':
+			b.WriteString(`\n`)
+		case c == '\r':
+			b.WriteString(`\r`)
+		case c == '\t':
+			b.WriteString(`\t`)
+		case c < 0x20 || c >= 0x7f:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func formatSize(n int) string {
+	switch {
+	case n < 1024:
+		return strconv.Itoa(n) + "B"
+	case n < 1024*1024:
+		return strconv.FormatFloat(float64(n)/1024, 'f', 1, 64) + "KB"
+	default:
+		return strconv.FormatFloat(float64(n)/1024/1024, 'f', 1, 64) + "MB"
+	}
+}
@@ -0,0 +1,144 @@
+package redis
+
+import (
+	"bufio"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadValue(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		typ   byte
+		text  string
+		null  bool
+		value interface{}
+	}{
+		{name: "simple string", input: "+OK\r\n", typ: TypeSimpleString, text: "OK", value: "OK"},
+		{name: "error", input: "-ERR unknown command\r\n", typ: TypeError, text: "ERR unknown command", value: map[string]string{"error": "ERR unknown command"}},
+		{name: "integer", input: ":-42\r\n", typ: TypeInteger, text: "-42", value: int64(-42)},
+		{name: "bulk string", input: "$5\r\nhello\r\n", typ: TypeBulkString, text: "hello", value: "hello"},
+		{name: "bulk string with crlf", input: "$4\r\na\r\nb\r\n", typ: TypeBulkString, text: "a\r\nb", value: "a\r\nb"},
+		{name: "empty bulk string", input: "$0\r\n\r\n", typ: TypeBulkString, text: "", value: ""},
+		{name: "null bulk string", input: "$-1\r\n", typ: TypeBulkString, null: true},
+		{name: "null array", input: "*-1\r\n", typ: TypeArray, null: true},
+		{name: "array", input: "*3\r\n:1\r\n$1\r\na\r\n*1\r\n+b\r\n", typ: TypeArray, value: []interface{}{int64(1), "a", []interface{}{"b"}}},
+		{name: "null", input: "_\r\n", typ: TypeNull, null: true},
+		{name: "boolean", input: "#t\r\n", typ: TypeBoolean, text: "true", value: true},
+		{name: "double", input: ",3.25\r\n", typ: TypeDouble, text: "3.25", value: 3.25},
+		{name: "infinite double", input: ",inf\r\n", typ: TypeDouble, text: "inf", value: "inf"},
+		{name: "big number", input: "(3492890328409238509324850943850943825024385\r\n", typ: TypeBigNumber, text: "3492890328409238509324850943850943825024385", value: "3492890328409238509324850943850943825024385"},
+		{name: "bulk error", input: "!21\r\nSYNTAX invalid syntax\r\n", typ: TypeBulkError, text: "SYNTAX invalid syntax", value: map[string]string{"error": "SYNTAX invalid syntax"}},
+		{name: "verbatim string", input: "=15\r\ntxt:Some string\r\n", typ: TypeVerbatim, text: "Some string", value: "Some string"},
+		{name: "map", input: "%2\r\n+first\r\n:1\r\n+second\r\n:2\r\n", typ: TypeMap, value: map[string]interface{}{"first": int64(1), "second": int64(2)}},
+		{name: "set", input: "~2\r\n+a\r\n+b\r\n", typ: TypeSet, value: []interface{}{"a", "b"}},
+		{name: "push", input: ">3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$2\r\nhi\r\n", typ: TypePush, value: []interface{}{"message", "news", "hi"}},
+		{name: "attribute", input: "|1\r\n+ttl\r\n:3600\r\n:7\r\n", typ: TypeInteger, text: "7", value: int64(7)},
+		{name: "binary", input: "$2\r\n\xff\xfe\r\n", typ: TypeBulkString, text: "\xff\xfe", value: map[string]string{"base64": "//4="}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := ReadValue(bufio.NewReader(strings.NewReader(tt.input)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v.Type != tt.typ {
+				t.Errorf("type is %q, want %q", v.Type, tt.typ)
+			}
+			if v.Null != tt.null {
+				t.Errorf("null is %v, want %v", v.Null, tt.null)
+			}
+			if v.Size() != len(tt.input) {
+				t.Errorf("size is %d, want %d", v.Size(), len(tt.input))
+			}
+			if tt.null {
+				return
+			}
+			if tt.text != "" && v.Text() != tt.text {
+				t.Errorf("text is %q, want %q", v.Text(), tt.text)
+			}
+			if value := v.Interface(1024); !reflect.DeepEqual(value, tt.value) {
+				t.Errorf("value is %#v, want %#v", value, tt.value)
+			}
+		})
+	}
+}
+
+func TestReadValueAttribute(t *testing.T) {
+	v, err := ReadValue(bufio.NewReader(strings.NewReader("|1\r\n+ttl\r\n:3600\r\n:7\r\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Attrs == nil || v.Attrs.Type != TypeAttribute || len(v.Attrs.Elems) != 2 || v.Attrs.Elems[1].Int != 3600 {
+		t.Errorf("attributes are %+v", v.Attrs)
+	}
+}
+
+func TestReadValueError(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{name: "no crlf", input: "+OK\n"},
+		{name: "empty line", input: "\r\n"},
+		{name: "unknown type", input: "@x\r\n"},
+		{name: "invalid integer", input: ":abc\r\n"},
+		{name: "invalid boolean", input: "#x\r\n"},
+		{name: "invalid length", input: "$-2\r\n"},
+		{name: "bulk string without crlf", input: "$2\r\nabcd"},
+		{name: "nested too deep", input: strings.Repeat("*1\r\n", maxDepth+2) + ":1\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ReadValue(bufio.NewReader(strings.NewReader(tt.input))); !errors.Is(err, ErrProtocol) {
+				t.Errorf("error is %v, want %v", err, ErrProtocol)
+			}
+		})
+	}
+}
+
+func TestReadCommand(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		cmd   string
+		line  string
+		err   bool
+	}{
+		{name: "get", input: "*2\r\n$3\r\nget\r\n$3\r\nkey\r\n", cmd: "GET", line: "GET key"},
+		{name: "quoted argument", input: "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$3\r\na b\r\n", cmd: "SET", line: `SET k "a b"`},
+		{name: "not an array", input: "+PING\r\n", err: true},
+		{name: "empty array", input: "*0\r\n", err: true},
+		{name: "integer argument", input: "*2\r\n$3\r\nGET\r\n:1\r\n", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := ReadValue(bufio.NewReader(strings.NewReader(tt.input)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			cmd, err := ReadCommand(v)
+			if tt.err {
+				if !errors.Is(err, ErrProtocol) {
+					t.Errorf("error is %v, want %v", err, ErrProtocol)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cmd.Name() != tt.cmd {
+				t.Errorf("name is %q, want %q", cmd.Name(), tt.cmd)
+			}
+			if line := cmd.Line(100); line != tt.line {
+				t.Errorf("line is %q, want %q", line, tt.line)
+			}
+			if cmd.Size() != len(tt.input) {
+				t.Errorf("size is %d, want %d", cmd.Size(), len(tt.input))
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package httpcap
+
+import (
+	"github.com/uole/httpcap/redis"
+	"github.com/uole/httpcap/sql"
+	"github.com/uole/httpcap/tls"
+	"time"
+)
+
+type (
+	// Retention bounds the exchanges kept by the terminal ui, the oldest ones are evicted first.
+	// A limit of 0 is disabled.
+	Retention struct {
+		MaxEntries int
+		//bytes of the request, response and websocket message bodies
+		MaxBodySize int64
+		MaxAge      time.Duration
+	}
+
+	// retained is the size of the exchanges in the list.
+	retained struct {
+		bodySize int64
+		evicted  int
+		newest   time.Time
+	}
+)
+
+// exchangeTime returns the time an exchange of the list started.
+func exchangeTime(v interface{}) time.Time {
+	switch p := v.(type) {
+	case *packet:
+		return p.request.StartedAt
+	case *tls.Handshake:
+		return p.Time
+	case *redis.Command:
+		//pushes of the server have no command
+		if p.StartedAt.IsZero() {
+			return p.FirstByteAt
+		}
+		return p.StartedAt
+	case *sql.Query:
+		return p.StartedAt
+	}
+	return time.Time{}
+}
+
+// bodySize returns the bytes of the bodies of an exchange, including its websocket messages.
+func bodySize(v interface{}) int64 {
+	p, ok := v.(*packet)
+	if !ok {
+		return 0
+	}
+	size := int64(len(p.request.Body) + len(p.response.Body))
+	p.mutex.Lock()
+	for _, m := range p.messages {
+		size += int64(len(m.Raw))
+	}
+	p.mutex.Unlock()
+	return size
+}
+
+// expired reports whether the oldest exchange has to be evicted.
+func (r Retention) expired(v interface{}, entries int, size int64, now time.Time) bool {
+	if r.MaxEntries > 0 && entries > r.MaxEntries {
+		return true
+	}
+	if r.MaxBodySize > 0 && size > r.MaxBodySize {
+		return true
+	}
+	if at := exchangeTime(v); r.MaxAge > 0 && !at.IsZero() && now.Sub(at) > r.MaxAge {
+		return true
+	}
+	return false
+}
+
+// retain counts an exchange which has been added to the list. A websocket message is added to its
+// handshake here, under the lock of the eviction, it is dropped when the handshake has been evicted
+// since the message was received, otherwise its size would never be subtracted again.
+func (app *App) retain(v interface{}, size int64) bool {
+	app.mutex.Lock()
+	defer app.mutex.Unlock()
+	if m, ok := v.(*socketMessage); ok {
+		if app.sockets[m.packet.response] != m.packet {
+			return false
+		}
+		m.packet.appendMessage(m)
+	}
+	app.retained.bodySize += size
+	if at := exchangeTime(v); at.After(app.retained.newest) {
+		app.retained.newest = at
+	}
+	return true
+}
+
+// evict removes the oldest exchanges until the retention is met, their bodies are released.
+// The age of the exchanges of a capture file or a store is relative to the newest one.
+func (app *App) evict() {
+	app.mutex.Lock()
+	now := time.Now()
+	if app.offline() {
+		now = app.retained.newest
+	}
+	_, entries := app.sideWidget.Count()
+	size := app.retained.bodySize
+	evicted, reselected := app.sideWidget.Evict(func(v interface{}) bool {
+		if !app.retention.expired(v, entries, size, now) {
+			return false
+		}
+		entries--
+		size -= bodySize(v)
+		return true
+	})
+	for _, v := range evicted {
+		if p, ok := v.(*packet); ok {
+			delete(app.sockets, p.response)
+			p.request.Release()
+			p.response.Release()
+		}
+	}
+	app.retained.bodySize = size
+	app.retained.evicted += len(evicted)
+	app.mutex.Unlock()
+	//the selected exchange is drawn again, which can load it from the store
+	if reselected {
+		app.sideWidget.Notify()
+	}
+}
@@ -0,0 +1,124 @@
+package httpcap
+
+import (
+	"fmt"
+	"github.com/uole/httpcap/internal/decoder"
+	"github.com/uole/httpcap/store"
+	"github.com/uole/httpcap/tls"
+	"github.com/uole/httpcap/websocket"
+)
+
+const (
+	//bytes of a stored websocket message kept for the preview of the list
+	previewSize = 256
+)
+
+// persist appends an exchange to the store and returns its offset, 0 when there is no store or it failed.
+func (app *App) persist(v interface{}) int64 {
+	if app.store == nil {
+		return 0
+	}
+	offset, err := app.store.Append(v)
+	if err != nil {
+		app.setMessage("store failed: " + err.Error())
+		return 0
+	}
+	return offset
+}
+
+// persistPacket stores a http exchange, only its headers are kept in memory then.
+func (app *App) persistPacket(p *packet) {
+	if p.offset = app.persist(&store.Exchange{Request: p.request, Response: p.response}); p.offset > 0 {
+		p.request.DropBody()
+		p.response.DropBody()
+	}
+}
+
+// persistMessage stores a websocket message of a stored handshake, the head of its payload is kept for the preview.
+func (app *App) persistMessage(m *socketMessage) {
+	if m.packet.offset == 0 {
+		return
+	}
+	if m.offset = app.persist(&store.Message{Handshake: m.packet.offset, Message: m.Message}); m.offset > 0 {
+		m.Message = summarizeMessage(m.Message)
+	}
+}
+
+func summarizeMessage(msg *websocket.Message) *websocket.Message {
+	summary := *msg
+	summary.Raw = nil
+	if len(summary.Data) > previewSize {
+		summary.Data = append([]byte(nil), summary.Data[:previewSize]...)
+	}
+	return &summary
+}
+
+// loadPacket returns the exchange with its bodies, they are read from the store when they are not kept in memory.
+func (app *App) loadPacket(p *packet) *packet {
+	if p.offset == 0 {
+		return p
+	}
+	v, err := app.store.Load(p.offset)
+	if e, ok := v.(*store.Exchange); ok && err == nil {
+		return &packet{request: e.Request, response: e.Response, size: p.size, offset: p.offset}
+	}
+	if err == nil {
+		err = fmt.Errorf("record at %d is not a http exchange", p.offset)
+	}
+	//it also runs while the list is ranged for the HAR export, the footer shows the message with its next refresh
+	app.setMessage("load failed: " + err.Error())
+	return p
+}
+
+// loadMessage returns the websocket message with its payload.
+func (app *App) loadMessage(m *socketMessage) *socketMessage {
+	if m.offset == 0 {
+		return m
+	}
+	v, err := app.store.Load(m.offset)
+	if e, ok := v.(*store.Message); ok && err == nil {
+		return &socketMessage{Message: e.Message, packet: m.packet, size: m.size, offset: m.offset}
+	}
+	if err == nil {
+		err = fmt.Errorf("record at %d is not a websocket message", m.offset)
+	}
+	app.setMessage("load failed: " + err.Error())
+	return m
+}
+
+// replay lists the exchanges of a store which is reopened, done is closed once it has been read.
+func (app *App) replay(done chan struct{}) {
+	defer close(done)
+	handshakes := make(map[int64]*packet)
+	err := app.store.Scan(func(offset int64, v interface{}) bool {
+		switch e := v.(type) {
+		case *store.Exchange:
+			p := &packet{request: e.Request, response: e.Response, size: e.Response.ContentLength, offset: offset}
+			p.request.DropBody()
+			p.response.DropBody()
+			if websocket.IsUpgrade(p.response.Header, p.response.StatusCode) {
+				handshakes[offset] = p
+			}
+			app.addPacket(p)
+		case *store.Message:
+			if p, ok := handshakes[e.Handshake]; ok {
+				app.addMessage(&socketMessage{Message: summarizeMessage(e.Message), packet: p, size: len(e.Message.Data), offset: offset})
+			}
+		case *tls.Handshake:
+			app.push(e)
+		case decoder.Exchange:
+			app.push(e)
+		}
+		return app.ctx.Err() == nil
+	})
+	if err != nil {
+		app.setMessage("read " + app.store.Name() + ": " + err.Error())
+	}
+}
+
+// WithStore persists every exchange into the store as it arrives and keeps only their summaries in memory,
+// the bodies are loaded when a request is selected. Without a capture the exchanges of the store are listed.
+func (app *App) WithStore(s *store.Store) *App {
+	app.store = s
+	return app
+}
@@ -0,0 +1,166 @@
+package sql
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DialectPostgres = "postgres"
+	DialectMySQL    = "mysql"
+)
+
+type (
+	// Query is a statement sent by a client with the outcome reported by the database server.
+	Query struct {
+		Dialect  string
+		Client   string
+		Server   string
+		User     string
+		Database string
+		Text     string
+		//values of the placeholders, either nil, bool, int64, uint64, float64, string or []byte
+		Params []interface{}
+		//the statement was prepared before, e.g. the extended query protocol of postgres
+		Prepared bool
+		//rows returned by a select or changed by an insert, update or delete
+		Rows        int64
+		Tag         string
+		Error       string
+		ErrorCode   string
+		StartedAt   time.Time
+		FirstByteAt time.Time
+		CompletedAt time.Time
+		Size        int
+		//bytes of the query or its result were missing in the capture
+		Gap       bool
+		completed bool
+	}
+)
+
+func (q *Query) Protocol() string {
+	return q.Dialect
+}
+
+// DialectName returns the name of the database, e.g. PostgreSQL.
+func (q *Query) DialectName() string {
+	switch q.Dialect {
+	case DialectPostgres:
+		return "PostgreSQL"
+	case DialectMySQL:
+		return "MySQL"
+	}
+	return q.Dialect
+}
+
+// Verb returns the upper case keyword the query starts with, e.g. SELECT.
+func (q *Query) Verb() string {
+	text := strings.TrimLeft(q.Text, " \t\r\n(")
+	pos := strings.IndexFunc(text, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z')
+	})
+	if pos > -1 {
+		text = text[:pos]
+	}
+	return strings.ToUpper(text)
+}
+
+// Complete marks the response of the server as read, at is the time of its last byte.
+func (q *Query) Complete(at time.Time) {
+	q.CompletedAt, q.completed = at, true
+}
+
+func (q *Query) Completed() bool {
+	return q.completed
+}
+
+// MarshalJSON keeps whether the response was read, e.g. when the query is stored.
+func (q *Query) MarshalJSON() ([]byte, error) {
+	type plain Query
+	return json.Marshal(struct {
+		*plain
+		Completed bool
+	}{(*plain)(q), q.completed})
+}
+
+func (q *Query) UnmarshalJSON(b []byte) (err error) {
+	type plain Query
+	s := struct {
+		*plain
+		Completed bool
+	}{plain: (*plain)(q)}
+	if err = json.Unmarshal(b, &s); err == nil {
+		q.completed = s.Completed
+	}
+	return
+}
+
+// Line returns the query on a single line, it is cut once it is longer than width.
+func (q *Query) Line(width int) string {
+	var b strings.Builder
+	for _, field := range strings.Fields(q.Text) {
+		if b.Len() >= width {
+			b.WriteString(" …")
+			break
+		}
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(field)
+	}
+	return b.String()
+}
+
+// Result describes the outcome of the query, e.g. 3 rows or the error message.
+func (q *Query) Result() string {
+	switch {
+	case q.Error != "":
+		return "error: " + q.Error
+	case !q.completed:
+		return "no reply"
+	case q.Rows == 1:
+		return "1 row"
+	}
+	return strconv.FormatInt(q.Rows, 10) + " rows"
+}
+
+// Summary describes the query and its result, e.g. SELECT * FROM users -> 3 rows.
+func (q *Query) Summary(width int) string {
+	return q.Line(width) + " -> " + q.Result()
+}
+
+func (q *Query) Latency() time.Duration {
+	if !q.completed || q.StartedAt.IsZero() {
+		return 0
+	}
+	return q.CompletedAt.Sub(q.StartedAt)
+}
+
+func (q *Query) TimeToFirstByte() time.Duration {
+	if !q.completed || q.StartedAt.IsZero() || q.FirstByteAt.IsZero() {
+		return 0
+	}
+	return q.FirstByteAt.Sub(q.StartedAt)
+}
+
+// FormatParam formats the value of a placeholder as a sql literal.
+func FormatParam(v interface{}) string {
+	switch p := v.(type) {
+	case nil:
+		return "NULL"
+	case string:
+		return "'" + strings.ReplaceAll(p, "'", "''") + "'"
+	case []byte:
+		return "x'" + hex.EncodeToString(p) + "'"
+	case bool:
+		if p {
+			return "TRUE"
+		}
+		return "FALSE"
+	}
+	return fmt.Sprint(v)
+}
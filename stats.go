@@ -0,0 +1,241 @@
+package httpcap
+
+import (
+	"github.com/uole/httpcap/http"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//seconds of the current request rate
+	statsWindow = 10
+	//distinct hosts, paths or clients which are counted, the others are counted as one
+	maxStatsKeys = 10000
+	//buckets of the latency histogram, each one is 10% wider than the previous one
+	latencyBuckets = 200
+	latencyGrowth  = 1.1
+)
+
+var (
+	uuidReg   = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	hexReg    = regexp.MustCompile(`^[0-9a-fA-F]{16,}$`)
+	numberReg = regexp.MustCompile(`^[0-9]+$`)
+)
+
+type (
+	// histogram counts latencies in exponential buckets, percentiles are read from the buckets
+	// so the memory does not grow with the number of requests.
+	histogram struct {
+		counts [latencyBuckets]int64
+		total  int64
+		max    time.Duration
+	}
+
+	rank struct {
+		Key   string
+		Count int64
+	}
+
+	counter struct {
+		counts map[string]int64
+	}
+
+	statusCount struct {
+		Code  int
+		Count int64
+	}
+
+	statsSummary struct {
+		Total       int64
+		Rate        float64
+		AverageRate float64
+		P50         time.Duration
+		P90         time.Duration
+		P99         time.Duration
+		Statuses    []statusCount
+		Hosts       []rank
+		Paths       []rank
+		Clients     []rank
+	}
+
+	// stats is computed incrementally from the captured requests.
+	stats struct {
+		mutex       sync.Mutex
+		total       int64
+		first, last time.Time
+		seconds     [statsWindow]int64
+		secondAt    [statsWindow]int64
+		statuses    map[int]int64
+		latency     histogram
+		hosts       counter
+		paths       counter
+		clients     counter
+	}
+)
+
+func (h *histogram) add(d time.Duration) {
+	idx := 0
+	if us := float64(d) / float64(time.Microsecond); us > 1 {
+		idx = int(math.Ceil(math.Log(us) / math.Log(latencyGrowth)))
+	}
+	if idx >= latencyBuckets {
+		idx = latencyBuckets - 1
+	}
+	h.counts[idx]++
+	h.total++
+	if d > h.max {
+		h.max = d
+	}
+}
+
+// percentile returns the upper bound of the bucket which holds the p-th latency, it is never above the slowest one.
+func (h *histogram) percentile(p float64) time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	var sum int64
+	target := int64(math.Ceil(p * float64(h.total)))
+	for i, n := range h.counts {
+		if sum += n; sum < target {
+			continue
+		}
+		if d := time.Duration(math.Pow(latencyGrowth, float64(i)) * float64(time.Microsecond)); d < h.max {
+			return d
+		}
+		break
+	}
+	return h.max
+}
+
+func (c *counter) add(key string) {
+	if c.counts == nil {
+		c.counts = make(map[string]int64)
+	}
+	if _, ok := c.counts[key]; !ok && len(c.counts) >= maxStatsKeys {
+		key = "(other)"
+	}
+	c.counts[key]++
+}
+
+func (c *counter) top(n int) []rank {
+	values := make([]rank, 0, len(c.counts))
+	for k, v := range c.counts {
+		values = append(values, rank{Key: k, Count: v})
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if values[i].Count == values[j].Count {
+			return values[i].Key < values[j].Key
+		}
+		return values[i].Count > values[j].Count
+	})
+	if len(values) > n {
+		values = values[:n]
+	}
+	return values
+}
+
+// pathTemplate collapses the ids of a path, e.g. /users/42/orders becomes /users/{id}/orders.
+func pathTemplate(uri string) string {
+	path, _ := requestPath(uri)
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		switch {
+		case s == "":
+		case numberReg.MatchString(s):
+			segments[i] = "{id}"
+		case uuidReg.MatchString(s):
+			segments[i] = "{uuid}"
+		case hexReg.MatchString(s):
+			segments[i] = "{hex}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func (s *stats) add(req *http.Request, res *http.Response) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.total++
+	at := req.StartedAt
+	if s.first.IsZero() || at.Before(s.first) {
+		s.first = at
+	}
+	if at.After(s.last) {
+		s.last = at
+	}
+	sec := at.Unix()
+	idx := sec % statsWindow
+	if s.secondAt[idx] != sec {
+		s.secondAt[idx], s.seconds[idx] = sec, 0
+	}
+	s.seconds[idx]++
+	if s.statuses == nil {
+		s.statuses = make(map[int]int64)
+	}
+	s.statuses[res.StatusCode]++
+	//the latency is unknown without timestamps, it would pull the percentiles down
+	if d := res.Latency(); d > 0 {
+		s.latency.add(d)
+	}
+	s.hosts.add(hostname(req.Host))
+	s.paths.add(pathTemplate(req.RequestURI))
+	s.clients.add(hostname(req.Address))
+}
+
+// summary returns the stats, the current rate counts the requests of the last seconds before now.
+func (s *stats) summary(now time.Time, top int) (summary statsSummary) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	summary.Total = s.total
+	var count int64
+	for i, sec := range s.secondAt {
+		if sec > now.Unix()-statsWindow && sec <= now.Unix() {
+			count += s.seconds[i]
+		}
+	}
+	//the rate of a capture which has just started is not spread over the whole window
+	window := float64(statsWindow)
+	if elapsed := now.Sub(s.first).Seconds() + 1; !s.first.IsZero() && elapsed < window {
+		window = elapsed
+	}
+	summary.Rate = float64(count) / window
+	if elapsed := s.last.Sub(s.first).Seconds(); elapsed >= 1 {
+		summary.AverageRate = float64(s.total) / elapsed
+	} else {
+		summary.AverageRate = float64(s.total)
+	}
+	summary.P50 = s.latency.percentile(0.5)
+	summary.P90 = s.latency.percentile(0.9)
+	summary.P99 = s.latency.percentile(0.99)
+	for code, n := range s.statuses {
+		summary.Statuses = append(summary.Statuses, statusCount{Code: code, Count: n})
+	}
+	sort.Slice(summary.Statuses, func(i, j int) bool {
+		return summary.Statuses[i].Code < summary.Statuses[j].Code
+	})
+	summary.Hosts = s.hosts.top(top)
+	summary.Paths = s.paths.top(top)
+	summary.Clients = s.clients.top(top)
+	return
+}
+
+// lastAt returns the time of the latest request, a capture file is summarized at its end.
+func (s *stats) lastAt() time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.last
+}
+
+func (s *stats) reset() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.total, s.first, s.last = 0, time.Time{}, time.Time{}
+	s.seconds, s.secondAt = [statsWindow]int64{}, [statsWindow]int64{}
+	s.statuses = nil
+	s.latency = histogram{}
+	s.hosts, s.paths, s.clients = counter{}, counter{}, counter{}
+}
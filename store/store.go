@@ -0,0 +1,241 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/uole/httpcap/http"
+	"github.com/uole/httpcap/redis"
+	"github.com/uole/httpcap/sql"
+	"github.com/uole/httpcap/tls"
+	"github.com/uole/httpcap/websocket"
+	"io"
+	"os"
+	"sync"
+)
+
+const (
+	KindExchange byte = iota + 1
+	KindMessage
+	KindHandshake
+	KindCommand
+	KindQuery
+)
+
+const (
+	//length of the payload and the kind of a record
+	headerSize = 5
+	maxRecord  = 1 << 30
+)
+
+var (
+	magic = []byte("HTTPCAP1")
+)
+
+var (
+	ErrFormat   = errors.New("not a httpcap store")
+	ErrReadOnly = errors.New("store is opened read only")
+)
+
+type (
+	// Exchange is a http request with its response.
+	Exchange struct {
+		Request  *http.Request
+		Response *http.Response
+	}
+
+	// Message is a websocket message, Handshake is the offset of the exchange which upgraded the connection.
+	Message struct {
+		Handshake int64
+		Message   *websocket.Message
+	}
+
+	// Store is an append-only file of the captured exchanges, each record is the length of its payload,
+	// its kind and the payload as json. A record is addressed by its offset, which is never 0.
+	Store struct {
+		name     string
+		fp       *os.File
+		mutex    sync.Mutex
+		size     int64
+		readOnly bool
+	}
+)
+
+func kindOf(v interface{}) (kind byte, err error) {
+	switch v.(type) {
+	case *Exchange:
+		kind = KindExchange
+	case *Message:
+		kind = KindMessage
+	case *tls.Handshake:
+		kind = KindHandshake
+	case *redis.Command:
+		kind = KindCommand
+	case *sql.Query:
+		kind = KindQuery
+	default:
+		err = fmt.Errorf("unsupported record %T", v)
+	}
+	return
+}
+
+func decode(kind byte, b []byte) (v interface{}, err error) {
+	switch kind {
+	case KindExchange:
+		e := &Exchange{}
+		if err = json.Unmarshal(b, e); err == nil && e.Request != nil && e.Response != nil {
+			e.Response.Request = e.Request
+		}
+		v = e
+	case KindMessage:
+		m := &Message{}
+		err = json.Unmarshal(b, m)
+		v = m
+	case KindHandshake:
+		hs := &tls.Handshake{}
+		err = json.Unmarshal(b, hs)
+		v = hs
+	case KindCommand:
+		cmd := &redis.Command{}
+		err = json.Unmarshal(b, cmd)
+		v = cmd
+	case KindQuery:
+		q := &sql.Query{}
+		err = json.Unmarshal(b, q)
+		v = q
+	default:
+		err = fmt.Errorf("%w: unknown record kind %d", ErrFormat, kind)
+	}
+	return
+}
+
+func (s *Store) Name() string {
+	return s.name
+}
+
+// Append writes a record and returns its offset, v is an *Exchange, *Message, *tls.Handshake,
+// *redis.Command or *sql.Query.
+func (s *Store) Append(v interface{}) (offset int64, err error) {
+	var (
+		kind    byte
+		payload []byte
+	)
+	if s.readOnly {
+		return 0, ErrReadOnly
+	}
+	if kind, err = kindOf(v); err != nil {
+		return
+	}
+	if payload, err = json.Marshal(v); err != nil {
+		return
+	}
+	b := make([]byte, headerSize+len(payload))
+	binary.BigEndian.PutUint32(b, uint32(len(payload)))
+	b[4] = kind
+	copy(b[headerSize:], payload)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	offset = s.size
+	if _, err = s.fp.WriteAt(b, offset); err != nil {
+		return 0, err
+	}
+	s.size += int64(len(b))
+	return
+}
+
+// Load reads the record at offset.
+func (s *Store) Load(offset int64) (v interface{}, err error) {
+	header := make([]byte, headerSize)
+	if _, err = s.fp.ReadAt(header, offset); err != nil {
+		return
+	}
+	n := binary.BigEndian.Uint32(header)
+	if n > maxRecord {
+		return nil, fmt.Errorf("%w: record at %d is too large", ErrFormat, offset)
+	}
+	payload := make([]byte, n)
+	if _, err = s.fp.ReadAt(payload, offset+headerSize); err != nil {
+		return
+	}
+	return decode(header[4], payload)
+}
+
+// Scan reads the records in the order they were appended until f returns false, a record
+// which was cut off, e.g. when httpcap was killed while writing it, ends the scan.
+func (s *Store) Scan(f func(offset int64, v interface{}) bool) (err error) {
+	var (
+		v interface{}
+	)
+	s.mutex.Lock()
+	size := s.size
+	s.mutex.Unlock()
+	offset := int64(len(magic))
+	br := bufio.NewReaderSize(io.NewSectionReader(s.fp, offset, size-offset), 64*1024)
+	header := make([]byte, headerSize)
+	for {
+		if _, err = io.ReadFull(br, header); err != nil {
+			break
+		}
+		n := binary.BigEndian.Uint32(header)
+		if n > maxRecord {
+			return fmt.Errorf("%w: record at %d is too large", ErrFormat, offset)
+		}
+		payload := make([]byte, n)
+		if _, err = io.ReadFull(br, payload); err != nil {
+			break
+		}
+		if v, err = decode(header[4], payload); err != nil {
+			return
+		}
+		if !f(offset, v) {
+			return nil
+		}
+		offset += headerSize + int64(n)
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return
+}
+
+func (s *Store) Close() error {
+	return s.fp.Close()
+}
+
+// Create creates a store, an existing file is truncated.
+func Create(name string) (s *Store, err error) {
+	s = &Store{name: name}
+	if s.fp, err = os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644); err != nil {
+		return nil, err
+	}
+	if _, err = s.fp.Write(magic); err != nil {
+		_ = s.fp.Close()
+		return nil, err
+	}
+	s.size = int64(len(magic))
+	return
+}
+
+// Open opens a store which was written before, it is read only.
+func Open(name string) (s *Store, err error) {
+	var (
+		info os.FileInfo
+	)
+	s = &Store{name: name, readOnly: true}
+	if s.fp, err = os.Open(name); err != nil {
+		return nil, err
+	}
+	header := make([]byte, len(magic))
+	if _, err = io.ReadFull(s.fp, header); err != nil || string(header) != string(magic) {
+		_ = s.fp.Close()
+		return nil, ErrFormat
+	}
+	if info, err = s.fp.Stat(); err != nil {
+		_ = s.fp.Close()
+		return nil, err
+	}
+	s.size = info.Size()
+	return
+}
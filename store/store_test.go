@@ -0,0 +1,223 @@
+package store
+
+import (
+	"bufio"
+	"errors"
+	"github.com/uole/httpcap/http"
+	"github.com/uole/httpcap/redis"
+	"github.com/uole/httpcap/sql"
+	"github.com/uole/httpcap/tls"
+	"github.com/uole/httpcap/websocket"
+	nethttp "net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readValue(t *testing.T, s string) *redis.Value {
+	v, err := redis.ReadValue(bufio.NewReader(strings.NewReader(s)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// records returns a record of every kind, the times are in UTC as they are read back.
+func records(t *testing.T) []interface{} {
+	at := time.Unix(1700000000, 123456789).UTC()
+	req := &http.Request{
+		Proto:         "HTTP/1.1",
+		RequestURI:    "/chat?room=1",
+		Method:        "GET",
+		Host:          "example.com",
+		Header:        nethttp.Header{"Upgrade": {"websocket"}, "Connection": {"Upgrade"}},
+		ContentLength: 4,
+		Body:          []byte{0, 1, 0xfe, 0xff},
+		Address:       "10.0.0.1:50000",
+		StreamID:      3,
+		StartedAt:     at,
+		CompletedAt:   at.Add(time.Millisecond),
+	}
+	res := &http.Response{
+		Request:       req,
+		Status:        "101 Switching Protocols",
+		StatusCode:    101,
+		Proto:         "HTTP/1.1",
+		Header:        nethttp.Header{"Upgrade": {"websocket"}},
+		Trailer:       nethttp.Header{"X-Checksum": {"abc"}},
+		Body:          []byte("cut"),
+		ContentLength: 1 << 20,
+		Truncated:     true,
+		Gap:           true,
+		Address:       "10.0.0.2:80",
+		FirstByteAt:   at.Add(2 * time.Millisecond),
+		CompletedAt:   at.Add(3 * time.Millisecond),
+	}
+	cmd, err := redis.ReadCommand(readValue(t, "*2\r\n$3\r\nGET\r\n$1\r\nk\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd.Client, cmd.Server, cmd.StartedAt = "10.0.0.1:50001", "10.0.0.2:6379", at
+	cmd.Reply = readValue(t, "*2\r\n$1\r\nv\r\n:42\r\n")
+	query := &sql.Query{
+		Dialect:   "postgres",
+		Client:    "10.0.0.1:50002",
+		Server:    "10.0.0.2:5432",
+		User:      "alice",
+		Database:  "shop",
+		Text:      "SELECT * FROM t WHERE name = $1 AND deleted = $2",
+		Params:    []interface{}{"bob", nil, true},
+		Prepared:  true,
+		Rows:      2,
+		Tag:       "SELECT 2",
+		StartedAt: at,
+	}
+	query.Complete(at.Add(time.Second))
+	return []interface{}{
+		&Exchange{Request: req, Response: res},
+		&Message{Message: &websocket.Message{FromClient: true, Opcode: websocket.OpText, Compressed: true, Raw: []byte{0xf2, 0x00}, Data: []byte("hello"), Time: at}},
+		&tls.Handshake{Time: at, Client: "10.0.0.1:50003", Server: "10.0.0.2:443", ServerName: "example.com", ALPN: []string{"h2", "http/1.1"}, Version: 0x0304, CipherSuite: 0x1301, JA3: "ada70206e40642a3e4461f35503241d5", JA4: "t13d1516h2_8daaf6152771_e5627efa2ab1"},
+		cmd,
+		query,
+	}
+}
+
+// write appends the records to a new store and returns their offsets.
+func write(t *testing.T, name string, values []interface{}) (offsets []int64) {
+	s, err := Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range values {
+		//the message refers to the exchange which upgraded the connection
+		if m, ok := v.(*Message); ok {
+			m.Handshake = offsets[0]
+		}
+		offset, err := s.Append(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, offset)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestRoundTrip(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "capture.httpcap")
+	values := records(t)
+	offsets := write(t, name, values)
+	s, err := Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = s.Close()
+	}()
+	for i := len(offsets) - 1; i >= 0; i-- {
+		v, err := s.Load(offsets[i])
+		if err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(v, values[i]) {
+			t.Errorf("record %d is %+v, want %+v", i, v, values[i])
+		}
+	}
+	var scanned []int64
+	if err = s.Scan(func(offset int64, v interface{}) bool {
+		scanned = append(scanned, offset)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(scanned, offsets) {
+		t.Errorf("offsets are %v, want %v", scanned, offsets)
+	}
+	if e, _ := s.Load(offsets[0]); e.(*Exchange).Response.Request != e.(*Exchange).Request {
+		t.Error("response is not paired with its request")
+	}
+	if _, err = s.Append(values[2]); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("append is %v, want %v", err, ErrReadOnly)
+	}
+}
+
+func TestTornRecord(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "capture.httpcap")
+	values := records(t)
+	offsets := write(t, name, values)
+	info, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := offsets[len(offsets)-1]
+	tests := []struct {
+		name string
+		size int64
+		want int
+	}{
+		{name: "complete", size: info.Size(), want: len(values)},
+		{name: "payload cut", size: info.Size() - 1, want: len(values) - 1},
+		{name: "only the header", size: last + headerSize, want: len(values) - 1},
+		{name: "header cut", size: last + 3, want: len(values) - 1},
+		{name: "empty", size: int64(len(magic)), want: 0},
+	}
+	//the file is cut shorter with every test
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := os.Truncate(name, tt.size); err != nil {
+				t.Fatal(err)
+			}
+			s, err := Open(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				_ = s.Close()
+			}()
+			var n int
+			if err = s.Scan(func(offset int64, v interface{}) bool {
+				if offset != offsets[n] || !reflect.DeepEqual(v, values[n]) {
+					t.Errorf("record %d at %d is %+v", n, offset, v)
+				}
+				n++
+				return true
+			}); err != nil {
+				t.Fatalf("scan: %v", err)
+			}
+			if n != tt.want {
+				t.Errorf("%d records are read, want %d", n, tt.want)
+			}
+			if _, err = s.Load(last); tt.want < len(values) && err == nil {
+				t.Error("torn record is loaded")
+			}
+		})
+	}
+}
+
+func TestOpen(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name string
+		b    string
+	}{
+		{name: "empty"},
+		{name: "short", b: "HTTP"},
+		{name: "other file", b: "GET / HTTP/1.1\r\n\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := filepath.Join(dir, tt.name)
+			if err := os.WriteFile(name, []byte(tt.b), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := Open(name); !errors.Is(err, ErrFormat) {
+				t.Errorf("error is %v, want %v", err, ErrFormat)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package tls
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/binary"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	versionTLS12 = 0x0303
+	versionTLS13 = 0x0304
+)
+
+type (
+	cipherSuite struct {
+		id     uint16
+		keyLen int
+		//length of the implicit part of the nonce in TLS 1.2, TLS 1.3 always uses 12 bytes
+		ivLen int
+		hash  crypto.Hash
+		aead  func(key []byte) (cipher.AEAD, error)
+		//TLS 1.2 AES-GCM records carry the last 8 bytes of the nonce
+		explicitNonce bool
+	}
+)
+
+var (
+	cipherSuites = map[uint16]*cipherSuite{}
+)
+
+func init() {
+	for _, suite := range []*cipherSuite{
+		{0x1301, 16, 12, crypto.SHA256, aesGCM, false},
+		{0x1302, 32, 12, crypto.SHA384, aesGCM, false},
+		{0x1303, 32, 12, crypto.SHA256, chacha20poly1305.New, false},
+		{0x009c, 16, 4, crypto.SHA256, aesGCM, true},
+		{0x009d, 32, 4, crypto.SHA384, aesGCM, true},
+		{0x009e, 16, 4, crypto.SHA256, aesGCM, true},
+		{0x009f, 32, 4, crypto.SHA384, aesGCM, true},
+		{0xc02b, 16, 4, crypto.SHA256, aesGCM, true},
+		{0xc02c, 32, 4, crypto.SHA384, aesGCM, true},
+		{0xc02f, 16, 4, crypto.SHA256, aesGCM, true},
+		{0xc030, 32, 4, crypto.SHA384, aesGCM, true},
+		{0xcca8, 32, 12, crypto.SHA256, chacha20poly1305.New, false},
+		{0xcca9, 32, 12, crypto.SHA256, chacha20poly1305.New, false},
+		{0xccaa, 32, 12, crypto.SHA256, chacha20poly1305.New, false},
+	} {
+		cipherSuites[suite.id] = suite
+	}
+}
+
+func aesGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// prf is the TLS 1.2 pseudo random function of RFC 5246 section 5.
+func prf(hash crypto.Hash, secret []byte, label string, seed []byte, n int) []byte {
+	seed = append([]byte(label), seed...)
+	out := make([]byte, 0, n)
+	mac := hmac.New(hash.New, secret)
+	mac.Write(seed)
+	a := mac.Sum(nil)
+	for len(out) < n {
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(seed)
+		out = mac.Sum(out)
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+	}
+	return out[:n]
+}
+
+// expandLabel is HKDF-Expand-Label of RFC 8446 section 7.1.
+func expandLabel(hash crypto.Hash, secret []byte, label string, n int) []byte {
+	label = "tls13 " + label
+	info := make([]byte, 0, 4+len(label))
+	info = append(info, byte(n>>8), byte(n), byte(len(label)))
+	info = append(info, label...)
+	info = append(info, 0)
+	out := make([]byte, n)
+	_, _ = hkdf.Expand(hash.New, secret, info).Read(out)
+	return out
+}
+
+// keys12 returns the client and server write keys and IVs of a TLS 1.2 connection.
+func (suite *cipherSuite) keys12(masterSecret, clientRandom, serverRandom []byte) (clientKey, serverKey, clientIV, serverIV []byte) {
+	seed := append(append([]byte{}, serverRandom...), clientRandom...)
+	block := prf(suite.hash, masterSecret, "key expansion", seed, 2*suite.keyLen+2*suite.ivLen)
+	clientKey, block = block[:suite.keyLen], block[suite.keyLen:]
+	serverKey, block = block[:suite.keyLen], block[suite.keyLen:]
+	clientIV, block = block[:suite.ivLen], block[suite.ivLen:]
+	serverIV = block[:suite.ivLen]
+	return
+}
+
+// keys13 returns the key and IV of a TLS 1.3 traffic secret.
+func (suite *cipherSuite) keys13(secret []byte) (key, iv []byte) {
+	return expandLabel(suite.hash, secret, "key", suite.keyLen), expandLabel(suite.hash, secret, "iv", 12)
+}
+
+func (suite *cipherSuite) nextSecret(secret []byte) []byte {
+	return expandLabel(suite.hash, secret, "traffic upd", suite.hash.Size())
+}
+
+// xorNonce xors the sequence number into the IV, as done by TLS 1.3 and the ChaCha20-Poly1305 suites of TLS 1.2.
+func xorNonce(iv []byte, seq uint64) []byte {
+	nonce := append([]byte{}, iv...)
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], seq)
+	for i := range b {
+		nonce[len(nonce)-8+i] ^= b[i]
+	}
+	return nonce
+}
@@ -0,0 +1,277 @@
+package tls
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	cryptotls "crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	extensionServerName          = 0
+	extensionSupportedGroups     = 10
+	extensionPointFormats        = 11
+	extensionSignatureAlgorithms = 13
+	extensionALPN                = 16
+)
+
+type (
+	clientHello struct {
+		version             uint16
+		random              []byte
+		ciphers             []uint16
+		extensions          []uint16
+		serverName          string
+		alpn                []string
+		groups              []uint16
+		pointFormats        []uint8
+		signatureAlgorithms []uint16
+		supportedVersions   []uint16
+		ticket              []byte
+	}
+
+	// Handshake is what can be seen of a connection without its secrets.
+	Handshake struct {
+		Time        time.Time
+		Client      string
+		Server      string
+		ServerName  string
+		ALPN        []string
+		Protocol    string
+		Version     uint16
+		CipherSuite uint16
+		Subject     string
+		Issuer      string
+		JA3         string
+		JA4         string
+	}
+)
+
+// isGREASE reports whether v is a reserved value of RFC 8701, they are left out of fingerprints.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func readUint16s(b []byte) (values []uint16) {
+	for ; len(b) >= 2; b = b[2:] {
+		values = append(values, binary.BigEndian.Uint16(b))
+	}
+	return
+}
+
+func parseClientHello(b []byte) (hello *clientHello, err error) {
+	//legacy_version, random, session id, cipher suites and compression methods
+	if len(b) < 35 || len(b) < 35+int(b[34])+2 {
+		return nil, errMalformedHandshake
+	}
+	hello = &clientHello{
+		version: binary.BigEndian.Uint16(b[:2]),
+		random:  append([]byte{}, b[2:34]...),
+	}
+	b = b[35+int(b[34]):]
+	n := 2 + int(binary.BigEndian.Uint16(b[:2]))
+	if len(b) < n+1 || len(b) < n+1+int(b[n]) {
+		return nil, errMalformedHandshake
+	}
+	hello.ciphers = readUint16s(b[2:n])
+	b = b[n+1+int(b[n]):]
+	err = extensions(b, func(typ uint16, data []byte) {
+		hello.extensions = append(hello.extensions, typ)
+		switch typ {
+		case extensionServerName:
+			//server_name_list of a host_name
+			if len(data) > 5 && data[2] == 0 && len(data) >= 5+int(binary.BigEndian.Uint16(data[3:5])) {
+				hello.serverName = string(data[5 : 5+int(binary.BigEndian.Uint16(data[3:5]))])
+			}
+		case extensionSupportedGroups:
+			if len(data) >= 2 {
+				hello.groups = readUint16s(data[2:])
+			}
+		case extensionPointFormats:
+			if len(data) >= 1 {
+				hello.pointFormats = data[1:]
+			}
+		case extensionSignatureAlgorithms:
+			if len(data) >= 2 {
+				hello.signatureAlgorithms = readUint16s(data[2:])
+			}
+		case extensionALPN:
+			if len(data) < 2 {
+				break
+			}
+			for data = data[2:]; len(data) > 0 && len(data) > int(data[0]); data = data[1+int(data[0]):] {
+				hello.alpn = append(hello.alpn, string(data[1:1+int(data[0])]))
+			}
+		case extensionSupportedVersions:
+			if len(data) >= 1 {
+				hello.supportedVersions = readUint16s(data[1:])
+			}
+		case extensionSessionTicket:
+			hello.ticket = append([]byte{}, data...)
+		}
+	})
+	return
+}
+
+func joinValues(values []uint16, format string, sep string) string {
+	items := make([]string, 0, len(values))
+	for _, v := range values {
+		if !isGREASE(v) {
+			items = append(items, fmt.Sprintf(format, v))
+		}
+	}
+	return strings.Join(items, sep)
+}
+
+// ja3 returns the md5 digest of version,ciphers,extensions,groups,point formats.
+func (hello *clientHello) ja3() string {
+	formats := make([]string, 0, len(hello.pointFormats))
+	for _, v := range hello.pointFormats {
+		formats = append(formats, strconv.Itoa(int(v)))
+	}
+	s := strings.Join([]string{
+		strconv.Itoa(int(hello.version)),
+		joinValues(hello.ciphers, "%d", "-"),
+		joinValues(hello.extensions, "%d", "-"),
+		joinValues(hello.groups, "%d", "-"),
+		strings.Join(formats, "-"),
+	}, ",")
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func truncatedHash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func isAlphanumeric(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z'
+}
+
+// ja4 returns the JA4 fingerprint of FoxIO for TCP, e.g. t13d1516h2_8daaf6152771_e5627efa2ab1.
+func (hello *clientHello) ja4() string {
+	var (
+		ciphers    []uint16
+		extensions []uint16
+		count      int
+	)
+	version := hello.version
+	for _, v := range hello.supportedVersions {
+		if !isGREASE(v) && v > version {
+			version = v
+		}
+	}
+	versions := map[uint16]string{0x0304: "13", 0x0303: "12", 0x0302: "11", 0x0301: "10", 0x0300: "s3"}
+	name, ok := versions[version]
+	if !ok {
+		name = "00"
+	}
+	sni := "i"
+	if hello.serverName != "" {
+		sni = "d"
+	}
+	alpn := "00"
+	if len(hello.alpn) > 0 && hello.alpn[0] != "" {
+		v := hello.alpn[0]
+		if isAlphanumeric(v[0]) && isAlphanumeric(v[len(v)-1]) {
+			alpn = v[:1] + v[len(v)-1:]
+		} else {
+			h := hex.EncodeToString([]byte(v))
+			alpn = h[:1] + h[len(h)-1:]
+		}
+	}
+	for _, v := range hello.ciphers {
+		if !isGREASE(v) {
+			ciphers = append(ciphers, v)
+		}
+	}
+	//server name and alpn are counted, but not part of the hash of the extensions
+	for _, v := range hello.extensions {
+		if isGREASE(v) {
+			continue
+		}
+		count++
+		if v != extensionServerName && v != extensionALPN {
+			extensions = append(extensions, v)
+		}
+	}
+	sort.Slice(ciphers, func(i, j int) bool { return ciphers[i] < ciphers[j] })
+	sort.Slice(extensions, func(i, j int) bool { return extensions[i] < extensions[j] })
+	suffix := joinValues(extensions, "%04x", ",")
+	if len(extensions) > 0 && len(hello.signatureAlgorithms) > 0 {
+		suffix += "_" + joinValues(hello.signatureAlgorithms, "%04x", ",")
+	}
+	//both counts are two digits, longer lists show as 99
+	ciphersCount := len(ciphers)
+	if ciphersCount > 99 {
+		ciphersCount = 99
+	}
+	if count > 99 {
+		count = 99
+	}
+	return fmt.Sprintf("t%s%s%02d%02d%s_%s_%s", name, sni, ciphersCount, count, alpn,
+		truncatedHash(joinValues(ciphers, "%04x", ",")), truncatedHash(suffix))
+}
+
+// readCertificate reads the subject and issuer of the first certificate of the chain.
+func (hs *Handshake) readCertificate(b []byte, version uint16) {
+	//TLS 1.3 starts with the certificate request context
+	if version == versionTLS13 {
+		if len(b) < 1 || len(b) < 1+int(b[0]) {
+			return
+		}
+		b = b[1+int(b[0]):]
+	}
+	if len(b) < 6 {
+		return
+	}
+	size := int(b[3])<<16 | int(b[4])<<8 | int(b[5])
+	if len(b) < 6+size {
+		return
+	}
+	if cert, err := x509.ParseCertificate(b[6 : 6+size]); err == nil {
+		hs.Subject = cert.Subject.String()
+		hs.Issuer = cert.Issuer.String()
+	}
+}
+
+func VersionName(version uint16) string {
+	switch version {
+	case 0x0300:
+		return "SSL 3.0"
+	case 0x0301:
+		return "TLS 1.0"
+	case 0x0302:
+		return "TLS 1.1"
+	case versionTLS12:
+		return "TLS 1.2"
+	case versionTLS13:
+		return "TLS 1.3"
+	case 0:
+		return ""
+	default:
+		return fmt.Sprintf("0x%04x", version)
+	}
+}
+
+func (hs *Handshake) VersionName() string {
+	return VersionName(hs.Version)
+}
+
+func (hs *Handshake) CipherSuiteName() string {
+	if hs.CipherSuite == 0 {
+		return ""
+	}
+	return cryptotls.CipherSuiteName(hs.CipherSuite)
+}
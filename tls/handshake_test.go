@@ -0,0 +1,137 @@
+package tls
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func uint16s(values ...uint16) []byte {
+	b := make([]byte, 2*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint16(b[2*i:], v)
+	}
+	return b
+}
+
+// vector prefixes b with its length of two bytes.
+func vector(b ...[]byte) []byte {
+	v := bytes.Join(b, nil)
+	return append(uint16s(uint16(len(v))), v...)
+}
+
+func extension(typ uint16, data ...[]byte) []byte {
+	return append(uint16s(typ), vector(data...)...)
+}
+
+// hello returns the body of a ClientHello, from legacy_version to the extensions.
+func hello(version uint16, ciphers []uint16, extensions ...[]byte) []byte {
+	return bytes.Join([][]byte{
+		uint16s(version), make([]byte, 32), {32}, make([]byte, 32),
+		vector(uint16s(ciphers...)), {1, 0},
+		vector(extensions...),
+	}, nil)
+}
+
+// chromeHello is a ClientHello as Chrome sends it, with GREASE values among the ciphers, extensions, groups and versions.
+func chromeHello() []byte {
+	return hello(0x0303,
+		[]uint16{0x0a0a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035},
+		extension(0x1a1a),
+		extension(extensionServerName, vector([]byte{0}, vector([]byte("example.com")))),
+		extension(23),
+		extension(0xff01, []byte{0}),
+		extension(extensionSupportedGroups, vector(uint16s(0x2a2a, 0x001d, 0x0017, 0x0018))),
+		extension(extensionPointFormats, []byte{1, 0}),
+		extension(extensionSessionTicket),
+		extension(extensionALPN, vector([]byte{2}, []byte("h2"), []byte{8}, []byte("http/1.1"))),
+		extension(5, []byte{1, 0, 0, 0, 0}),
+		extension(extensionSignatureAlgorithms, vector(uint16s(0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601))),
+		extension(18),
+		extension(51, vector(uint16s(0x2a2a, 1), []byte{0})),
+		extension(45, []byte{1, 1}),
+		extension(extensionSupportedVersions, []byte{6}, uint16s(0x3a3a, 0x0304, 0x0303)),
+		extension(27, []byte{2, 0, 2}),
+		extension(0x4469, vector([]byte{2}, []byte("h2"))),
+		extension(21, make([]byte, 16)),
+		extension(0x4a4a, []byte{0}),
+	)
+}
+
+func TestParseClientHello(t *testing.T) {
+	h, err := parseClientHello(chromeHello())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.serverName != "example.com" {
+		t.Errorf("server name is %q, want %q", h.serverName, "example.com")
+	}
+	if strings.Join(h.alpn, ",") != "h2,http/1.1" {
+		t.Errorf("alpn is %v, want [h2 http/1.1]", h.alpn)
+	}
+	if len(h.ciphers) != 16 || len(h.extensions) != 18 {
+		t.Errorf("%d ciphers and %d extensions are read, want 16 and 18", len(h.ciphers), len(h.extensions))
+	}
+	if _, err = parseClientHello(chromeHello()[:40]); err == nil {
+		t.Errorf("truncated hello is read")
+	}
+}
+
+func TestFingerprints(t *testing.T) {
+	many := make([]uint16, 120)
+	for i := range many {
+		many[i] = uint16(0x1000 + i)
+	}
+	tests := []struct {
+		name string
+		b    []byte
+		ja3  string
+		ja4  string
+	}{
+		{
+			//GREASE values are left out of both fingerprints, server name and alpn are counted but not hashed by JA4
+			name: "chrome",
+			b:    chromeHello(),
+			ja3:  "cd08e31494f9531f560d64c695473da9",
+			ja4:  "t13d1516h2_8daaf6152771_e5627efa2ab1",
+		},
+		{
+			//the example of the JA3 README, 769,47-53-5-10-49161-49162-49171-49172-50-56-19-4,0-10-11,23-24-25,0
+			name: "tls 1.0",
+			b: hello(0x0301,
+				[]uint16{47, 53, 5, 10, 49161, 49162, 49171, 49172, 50, 56, 19, 4},
+				extension(extensionServerName, vector([]byte{0}, vector([]byte("example.com")))),
+				extension(extensionSupportedGroups, vector(uint16s(23, 24, 25))),
+				extension(extensionPointFormats, []byte{1, 0}),
+			),
+			ja3: "ada70206e40642a3e4461f35503241d5",
+			ja4: "t10d120300_",
+		},
+		{
+			name: "without extensions",
+			b:    hello(0x0303, []uint16{0x002f}),
+			ja4:  "t12i010000_",
+		},
+		{
+			//counts of more than two digits are capped
+			name: "more than 99 ciphers",
+			b:    hello(0x0303, many),
+			ja4:  "t12i990000_",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := parseClientHello(tt.b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := h.ja3(); tt.ja3 != "" && got != tt.ja3 {
+				t.Errorf("ja3 is %s, want %s", got, tt.ja3)
+			}
+			if got := h.ja4(); !strings.HasPrefix(got, tt.ja4) {
+				t.Errorf("ja4 is %s, want %s", got, tt.ja4)
+			}
+		})
+	}
+}
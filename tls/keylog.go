@@ -0,0 +1,155 @@
+package tls
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxSessions = 4096
+)
+
+type (
+	// Secrets are the secrets of a connection logged by the client or the server.
+	Secrets struct {
+		MasterSecret    []byte
+		ClientHandshake []byte
+		ServerHandshake []byte
+		ClientTraffic   []byte
+		ServerTraffic   []byte
+	}
+
+	// KeyLog is a key log file in the NSS format, as written by SSLKEYLOGFILE of browsers
+	// and curl or tls.Config.KeyLogWriter. The file is read again when it has changed,
+	// so keys of connections started after the capture are found as well.
+	KeyLog struct {
+		path    string
+		mutex   sync.Mutex
+		size    int64
+		modTime time.Time
+		secrets map[string]*Secrets
+		//master secrets of TLS 1.2 sessions by session id and ticket, they are used again on resumption
+		sessions map[string][]byte
+		//keys of the sessions in the order they were remembered, the oldest one is forgotten first
+		order []string
+	}
+)
+
+func (keylog *KeyLog) parse(line string) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 || strings.HasPrefix(fields[0], "#") {
+		return
+	}
+	clientRandom, err := hex.DecodeString(fields[1])
+	if err != nil || len(clientRandom) != 32 {
+		return
+	}
+	secret, err := hex.DecodeString(fields[2])
+	if err != nil {
+		return
+	}
+	s, ok := keylog.secrets[string(clientRandom)]
+	if !ok {
+		s = &Secrets{}
+		keylog.secrets[string(clientRandom)] = s
+	}
+	switch fields[0] {
+	case "CLIENT_RANDOM":
+		s.MasterSecret = secret
+	case "CLIENT_HANDSHAKE_TRAFFIC_SECRET":
+		s.ClientHandshake = secret
+	case "SERVER_HANDSHAKE_TRAFFIC_SECRET":
+		s.ServerHandshake = secret
+	case "CLIENT_TRAFFIC_SECRET_0":
+		s.ClientTraffic = secret
+	case "SERVER_TRAFFIC_SECRET_0":
+		s.ServerTraffic = secret
+	}
+}
+
+// reload reads the file again if its size or modification time has changed.
+func (keylog *KeyLog) reload() (err error) {
+	var (
+		info os.FileInfo
+		buf  []byte
+	)
+	if info, err = os.Stat(keylog.path); err != nil {
+		return
+	}
+	if info.Size() == keylog.size && info.ModTime().Equal(keylog.modTime) {
+		return
+	}
+	if buf, err = os.ReadFile(keylog.path); err != nil {
+		return
+	}
+	keylog.size, keylog.modTime = info.Size(), info.ModTime()
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	scanner.Buffer(make([]byte, 4096), 1024*1024)
+	for scanner.Scan() {
+		keylog.parse(scanner.Text())
+	}
+	return scanner.Err()
+}
+
+// Lookup returns a copy of the secrets of the connection with the client random.
+func (keylog *KeyLog) Lookup(clientRandom []byte) (*Secrets, bool) {
+	keylog.mutex.Lock()
+	defer keylog.mutex.Unlock()
+	s, ok := keylog.secrets[string(clientRandom)]
+	if !ok || !s.complete() {
+		_ = keylog.reload()
+		if s, ok = keylog.secrets[string(clientRandom)]; !ok || !s.complete() {
+			return nil, false
+		}
+	}
+	c := *s
+	return &c, true
+}
+
+func (keylog *KeyLog) remember(key []byte, masterSecret []byte) {
+	if len(key) == 0 {
+		return
+	}
+	keylog.mutex.Lock()
+	defer keylog.mutex.Unlock()
+	if _, ok := keylog.sessions[string(key)]; !ok {
+		if len(keylog.order) >= maxSessions {
+			delete(keylog.sessions, keylog.order[0])
+			keylog.order[0] = ""
+			keylog.order = keylog.order[1:]
+		}
+		keylog.order = append(keylog.order, string(key))
+	}
+	keylog.sessions[string(key)] = masterSecret
+}
+
+func (keylog *KeyLog) resume(key []byte) (masterSecret []byte, ok bool) {
+	if len(key) == 0 {
+		return
+	}
+	keylog.mutex.Lock()
+	defer keylog.mutex.Unlock()
+	masterSecret, ok = keylog.sessions[string(key)]
+	return
+}
+
+func (s *Secrets) complete() bool {
+	return s.MasterSecret != nil || (s.ClientHandshake != nil && s.ServerHandshake != nil && s.ClientTraffic != nil && s.ServerTraffic != nil)
+}
+
+func OpenKeyLog(path string) (keylog *KeyLog, err error) {
+	keylog = &KeyLog{
+		path:     path,
+		secrets:  make(map[string]*Secrets),
+		sessions: make(map[string][]byte),
+	}
+	if err = keylog.reload(); err != nil {
+		return nil, err
+	}
+	return
+}
@@ -0,0 +1,520 @@
+package tls
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	recordChangeCipherSpec = 20
+	recordAlert            = 21
+	recordHandshake        = 22
+	recordApplicationData  = 23
+)
+
+const (
+	handshakeClientHello = 1
+	handshakeServerHello = 2
+	handshakeNewTicket   = 4
+	handshakeCertificate = 11
+	handshakeFinished    = 20
+	handshakeKeyUpdate   = 24
+)
+
+const (
+	extensionSessionTicket     = 35
+	extensionSupportedVersions = 43
+)
+
+const (
+	//the largest ciphertext of a record is 2^14 + 256 bytes in TLS 1.3 and 2^14 + 2048 bytes in TLS 1.2
+	maxRecordSize = 16384 + 2048
+	//encrypted records are kept until their secrets are written to the key log
+	maxPendingSize = 1024 * 1024
+)
+
+var (
+	//the random of a ServerHello which is a HelloRetryRequest, RFC 8446 section 4.1.3
+	helloRetryRandom = []byte{
+		0xCF, 0x21, 0xAD, 0x74, 0xE5, 0x9A, 0x61, 0x11, 0xBE, 0x1D, 0x8C, 0x02, 0x1E, 0x65, 0xB8, 0x91,
+		0xC2, 0xA2, 0x11, 0x16, 0x7A, 0xBB, 0x8C, 0x5E, 0x07, 0x9E, 0x09, 0xE2, 0xC8, 0xA8, 0x33, 0x9C,
+	}
+
+	errMalformedHandshake = errors.New("malformed tls handshake message")
+)
+
+type (
+	WriteFunc func(fromClient bool, b []byte)
+
+	HandshakeFunc func(hs *Handshake)
+
+	// halfConn is the state of one direction of a connection.
+	halfConn struct {
+		name      string
+		buf       []byte
+		encrypted bool
+		aead      cipher.AEAD
+		iv        []byte
+		seq       uint64
+		secret    []byte
+		handshake []byte
+		pending   [][]byte
+	}
+
+	// Session decrypts the records of both directions of a connection with the secrets
+	// of the key log, the application data is handed to the write function. Without a key
+	// log or with an unsupported cipher suite the session is passive, it only reads the
+	// handshake and hands it to the handshake function.
+	Session struct {
+		keylog        *KeyLog
+		writeFunc     WriteFunc
+		handshakeFunc HandshakeFunc
+		handshake     Handshake
+		passive       bool
+		emitted       bool
+		version       uint16
+		suite         *cipherSuite
+		clientRandom  []byte
+		serverRandom  []byte
+		sessionID     []byte
+		ticket        []byte
+		newTicket     []byte
+		secrets       *Secrets
+		pendingSize   int
+		client        halfConn
+		server        halfConn
+	}
+)
+
+// IsClientHello reports whether b starts with the record of a ClientHello.
+func IsClientHello(b []byte) bool {
+	return len(b) > 5 && b[0] == recordHandshake && b[1] == 0x03 && b[2] <= 0x04 && b[5] == handshakeClientHello
+}
+
+func (hc *halfConn) setKey(aead func(key []byte) (cipher.AEAD, error), key, iv []byte) (err error) {
+	if hc.aead, err = aead(key); err != nil {
+		return
+	}
+	hc.iv = iv
+	hc.seq = 0
+	return
+}
+
+func (hc *halfConn) setSecret(suite *cipherSuite, secret []byte) error {
+	hc.secret = secret
+	key, iv := suite.keys13(secret)
+	return hc.setKey(suite.aead, key, iv)
+}
+
+func (session *Session) half(fromClient bool) *halfConn {
+	if fromClient {
+		return &session.client
+	}
+	return &session.server
+}
+
+// extensions calls f with every extension of a hello message.
+func extensions(b []byte, f func(typ uint16, data []byte)) error {
+	if len(b) < 2 {
+		return nil
+	}
+	b = b[2:]
+	for len(b) >= 4 {
+		typ, size := binary.BigEndian.Uint16(b[:2]), int(binary.BigEndian.Uint16(b[2:4]))
+		if len(b) < 4+size {
+			return errMalformedHandshake
+		}
+		f(typ, b[4:4+size])
+		b = b[4+size:]
+	}
+	return nil
+}
+
+func (session *Session) readClientHello(b []byte) (err error) {
+	var (
+		hello *clientHello
+	)
+	if hello, err = parseClientHello(b); err != nil {
+		return
+	}
+	session.clientRandom = hello.random
+	session.ticket = hello.ticket
+	session.handshake.ServerName = hello.serverName
+	session.handshake.ALPN = hello.alpn
+	session.handshake.JA3 = hello.ja3()
+	session.handshake.JA4 = hello.ja4()
+	return
+}
+
+func (session *Session) readServerHello(b []byte) (err error) {
+	//legacy_version, random and the session id
+	if len(b) < 35 || len(b) < 35+int(b[34])+3 {
+		return errMalformedHandshake
+	}
+	random := b[2:34]
+	if bytes.Equal(random, helloRetryRandom) {
+		return
+	}
+	session.version = binary.BigEndian.Uint16(b[:2])
+	session.serverRandom = append([]byte{}, random...)
+	session.sessionID = append([]byte{}, b[35:35+int(b[34])]...)
+	b = b[35+int(b[34]):]
+	id := binary.BigEndian.Uint16(b[:2])
+	if err = extensions(b[3:], func(typ uint16, data []byte) {
+		switch {
+		case typ == extensionSupportedVersions && len(data) == 2:
+			session.version = binary.BigEndian.Uint16(data)
+		case typ == extensionALPN && len(data) > 3 && len(data) >= 3+int(data[2]):
+			session.handshake.Protocol = string(data[3 : 3+int(data[2])])
+		}
+	}); err != nil {
+		return
+	}
+	session.handshake.Version, session.handshake.CipherSuite = session.version, id
+	//the handshake is still read if the connection can not be decrypted
+	session.suite = cipherSuites[id]
+	if (session.version != versionTLS12 && session.version != versionTLS13) || session.suite == nil {
+		session.passive = true
+	}
+	//every record after the ServerHello is encrypted in TLS 1.3
+	if session.version == versionTLS13 {
+		session.client.encrypted = true
+		session.server.encrypted = true
+	}
+	return
+}
+
+// readHandshake reads the handshake messages of a record, a message may span several records.
+func (session *Session) readHandshake(hc *halfConn, fromClient bool, b []byte) (err error) {
+	hc.handshake = append(hc.handshake, b...)
+	for len(hc.handshake) >= 4 {
+		size := int(hc.handshake[1])<<16 | int(hc.handshake[2])<<8 | int(hc.handshake[3])
+		if size > maxRecordSize*4 {
+			return errMalformedHandshake
+		}
+		if len(hc.handshake) < 4+size {
+			break
+		}
+		typ, body := hc.handshake[0], hc.handshake[4:4+size]
+		hc.handshake = hc.handshake[4+size:]
+		switch {
+		case typ == handshakeClientHello && fromClient:
+			if err = session.readClientHello(body); err != nil {
+				return
+			}
+		case typ == handshakeServerHello && !fromClient:
+			if err = session.readServerHello(body); err != nil {
+				return
+			}
+		case typ == handshakeNewTicket && session.version == versionTLS12:
+			//lifetime hint and the length of the ticket
+			if len(body) < 6 {
+				return errMalformedHandshake
+			}
+			session.newTicket = append([]byte{}, body[6:]...)
+			session.remember()
+		case typ == handshakeCertificate && !fromClient && session.handshake.Subject == "":
+			session.handshake.readCertificate(body, session.version)
+		case typ == handshakeFinished && session.version == versionTLS13 && session.secrets != nil:
+			secret := session.secrets.ServerTraffic
+			if fromClient {
+				secret = session.secrets.ClientTraffic
+			}
+			if err = hc.setSecret(session.suite, secret); err != nil {
+				return
+			}
+		case typ == handshakeKeyUpdate && session.version == versionTLS13 && session.secrets != nil:
+			if err = hc.setSecret(session.suite, session.suite.nextSecret(hc.secret)); err != nil {
+				return
+			}
+		}
+	}
+	if len(hc.handshake) == 0 {
+		hc.handshake = nil
+	}
+	return
+}
+
+// establish derives the keys of both directions once the secrets are found in the key log.
+func (session *Session) establish() (ok bool, err error) {
+	var (
+		s *Secrets
+	)
+	if session.secrets != nil {
+		return true, nil
+	}
+	if session.clientRandom == nil || session.suite == nil {
+		return false, errors.New("tls handshake was not captured")
+	}
+	if s, ok = session.lookup(); !ok {
+		return
+	}
+	suite := session.suite
+	if session.version == versionTLS12 {
+		if s.MasterSecret == nil {
+			return false, fmt.Errorf("no master secret of client random %x in the key log", session.clientRandom)
+		}
+		clientKey, serverKey, clientIV, serverIV := suite.keys12(s.MasterSecret, session.clientRandom, session.serverRandom)
+		if err = session.client.setKey(suite.aead, clientKey, clientIV); err == nil {
+			err = session.server.setKey(suite.aead, serverKey, serverIV)
+		}
+	} else {
+		if s.ClientHandshake == nil || s.ServerHandshake == nil {
+			return false, fmt.Errorf("no handshake secrets of client random %x in the key log", session.clientRandom)
+		}
+		if err = session.client.setSecret(suite, s.ClientHandshake); err == nil {
+			err = session.server.setSecret(suite, s.ServerHandshake)
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+	session.secrets = s
+	session.remember()
+	return true, nil
+}
+
+func (session *Session) lookup() (s *Secrets, ok bool) {
+	if s, ok = session.keylog.Lookup(session.clientRandom); ok || session.version != versionTLS12 {
+		return
+	}
+	//key logs only have the full handshakes, a resumed session uses the master secret of the ticket or session id
+	for _, key := range [][]byte{session.ticket, session.sessionID} {
+		if masterSecret, found := session.keylog.resume(key); found {
+			return &Secrets{MasterSecret: masterSecret}, true
+		}
+	}
+	return nil, false
+}
+
+// remember keeps the master secret of a TLS 1.2 session for its resumption.
+func (session *Session) remember() {
+	if session.version != versionTLS12 || session.secrets == nil {
+		return
+	}
+	session.keylog.remember(session.sessionID, session.secrets.MasterSecret)
+	session.keylog.remember(session.newTicket, session.secrets.MasterSecret)
+}
+
+func (session *Session) decrypt(hc *halfConn, fromClient bool, record []byte) (err error) {
+	var (
+		nonce      []byte
+		additional []byte
+		plaintext  []byte
+	)
+	typ, payload := record[0], record[5:]
+	if session.version == versionTLS13 {
+		nonce = xorNonce(hc.iv, hc.seq)
+		additional = record[:5]
+	} else {
+		if session.suite.explicitNonce {
+			if len(payload) < 8 {
+				return fmt.Errorf("record of %d bytes is too short", len(payload))
+			}
+			nonce = append(append([]byte{}, hc.iv...), payload[:8]...)
+			payload = payload[8:]
+		} else {
+			nonce = xorNonce(hc.iv, hc.seq)
+		}
+		n := len(payload) - hc.aead.Overhead()
+		if n < 0 {
+			return fmt.Errorf("record of %d bytes is too short", len(payload))
+		}
+		additional = make([]byte, 13)
+		binary.BigEndian.PutUint64(additional, hc.seq)
+		additional[8], additional[9], additional[10] = typ, record[1], record[2]
+		binary.BigEndian.PutUint16(additional[11:], uint16(n))
+	}
+	if plaintext, err = hc.aead.Open(payload[:0], nonce, payload, additional); err != nil {
+		//0-RTT data is encrypted with the early secret, which is not used
+		if session.version == versionTLS13 && fromClient && bytes.Equal(hc.secret, session.secrets.ClientHandshake) {
+			return nil
+		}
+		return fmt.Errorf("decrypt record %d of the %s: %w", hc.seq, hc.name, err)
+	}
+	hc.seq++
+	if session.version == versionTLS13 {
+		//the content type follows the content, zeros are padding
+		plaintext = bytes.TrimRight(plaintext, "\x00")
+		if len(plaintext) == 0 {
+			return fmt.Errorf("record %d of the %s has no content type", hc.seq-1, hc.name)
+		}
+		typ, plaintext = plaintext[len(plaintext)-1], plaintext[:len(plaintext)-1]
+	}
+	switch typ {
+	case recordApplicationData:
+		if len(plaintext) > 0 {
+			session.writeFunc(fromClient, plaintext)
+		}
+	case recordHandshake:
+		if session.version == versionTLS13 {
+			err = session.readHandshake(hc, fromClient, plaintext)
+		}
+	}
+	return
+}
+
+func (session *Session) readRecord(hc *halfConn, fromClient bool, record []byte) (err error) {
+	var (
+		ok bool
+	)
+	typ := record[0]
+	if !hc.encrypted {
+		switch typ {
+		case recordHandshake:
+			err = session.readHandshake(hc, fromClient, record[5:])
+		case recordChangeCipherSpec:
+			if session.version != 0 && session.version != versionTLS13 {
+				hc.encrypted = true
+			}
+		}
+		//the rest of the handshake of a passive session is encrypted
+		if session.passive && hc.encrypted {
+			session.emit()
+		}
+		return
+	}
+	if session.passive {
+		session.emit()
+		return
+	}
+	//the change cipher spec records of TLS 1.3 are only sent for middlebox compatibility
+	if typ == recordChangeCipherSpec {
+		return
+	}
+	if len(hc.pending) == 0 {
+		if ok, err = session.establish(); err != nil || ok {
+			if ok {
+				err = session.decrypt(hc, fromClient, record)
+			}
+			return
+		}
+	}
+	hc.pending = append(hc.pending, append([]byte{}, record...))
+	if session.pendingSize += len(record); session.pendingSize > maxPendingSize {
+		return fmt.Errorf("no secrets of client random %x in the key log", session.clientRandom)
+	}
+	return
+}
+
+// flush decrypts the records which were waiting for the key log.
+func (session *Session) flush() (err error) {
+	if session.pendingSize == 0 {
+		return
+	}
+	ok, err := session.establish()
+	if !ok {
+		return
+	}
+	for _, fromClient := range []bool{true, false} {
+		hc := session.half(fromClient)
+		for len(hc.pending) > 0 {
+			record := hc.pending[0]
+			hc.pending = hc.pending[1:]
+			if err = session.decrypt(hc, fromClient, record); err != nil {
+				return
+			}
+		}
+		hc.pending = nil
+	}
+	session.pendingSize = 0
+	return
+}
+
+// emit hands the handshake to the handshake function once.
+func (session *Session) emit() {
+	if session.emitted || session.clientRandom == nil {
+		return
+	}
+	session.emitted = true
+	if session.handshakeFunc != nil {
+		hs := session.handshake
+		session.handshakeFunc(&hs)
+	}
+}
+
+// Passive reports whether the session does not decrypt and its handshake is complete.
+func (session *Session) Passive() bool {
+	return session.passive && session.emitted
+}
+
+// Write reads the records of a direction, incomplete records are kept until the rest arrives.
+func (session *Session) Write(fromClient bool, b []byte) (err error) {
+	defer func() {
+		//a connection which can not be decrypted is listed with its handshake
+		if err != nil {
+			session.emit()
+		}
+	}()
+	if err = session.flush(); err != nil {
+		return
+	}
+	hc := session.half(fromClient)
+	hc.buf = append(hc.buf, b...)
+	for len(hc.buf) >= 5 {
+		size := int(binary.BigEndian.Uint16(hc.buf[3:5]))
+		if size > maxRecordSize {
+			return fmt.Errorf("tls record of %d bytes exceeds the limit", size)
+		}
+		if len(hc.buf) < 5+size {
+			break
+		}
+		record := hc.buf[:5+size]
+		hc.buf = hc.buf[5+size:]
+		if err = session.readRecord(hc, fromClient, record); err != nil {
+			return
+		}
+	}
+	//do not keep the consumed records alive
+	hc.buf = append([]byte{}, hc.buf...)
+	return
+}
+
+// Close decrypts the records which are still waiting for the key log, an error is
+// returned if their secrets have never been written.
+func (session *Session) Close() (err error) {
+	if session.passive {
+		session.emit()
+		return
+	}
+	if err = session.flush(); err != nil {
+		session.emit()
+		return
+	}
+	if session.pendingSize > 0 {
+		session.emit()
+		return fmt.Errorf("no secrets of client random %x in the key log, %d bytes are not decrypted", session.clientRandom, session.pendingSize)
+	}
+	return
+}
+
+// Stop ends a session whose records can not be followed any longer, e.g. bytes of the connection were
+// lost. The complete records are decrypted like on Close, a session which has decrypted nothing is listed
+// with its handshake.
+func (session *Session) Stop() (err error) {
+	err = session.Close()
+	if session.secrets == nil {
+		session.emit()
+	}
+	session.passive = true
+	session.client.buf, session.server.buf = nil, nil
+	return
+}
+
+func (session *Session) WithHandshake(f HandshakeFunc) *Session {
+	session.handshakeFunc = f
+	return session
+}
+
+func NewSession(keylog *KeyLog, f WriteFunc) *Session {
+	return &Session{
+		keylog:    keylog,
+		writeFunc: f,
+		passive:   keylog == nil,
+		client:    halfConn{name: "client"},
+		server:    halfConn{name: "server"},
+	}
+}
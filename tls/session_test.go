@@ -0,0 +1,219 @@
+package tls
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	cryptotls "crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type (
+	chunk struct {
+		fromClient bool
+		b          []byte
+	}
+
+	// transcript keeps the bytes of both directions in the order they were written.
+	transcript struct {
+		mutex  sync.Mutex
+		chunks []chunk
+	}
+
+	recorder struct {
+		net.Conn
+		fromClient bool
+		transcript *transcript
+	}
+)
+
+func (r *recorder) Write(b []byte) (int, error) {
+	r.transcript.mutex.Lock()
+	r.transcript.chunks = append(r.transcript.chunks, chunk{fromClient: r.fromClient, b: append([]byte{}, b...)})
+	r.transcript.mutex.Unlock()
+	return r.Conn.Write(b)
+}
+
+func newCertificate(t *testing.T) cryptotls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cryptotls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// exchange sends a request and a response over a tls connection and returns what was on the wire.
+func exchange(t *testing.T, config *cryptotls.Config, keylogPath string, request, response []byte) *transcript {
+	tr := &transcript{}
+	keylogFile, err := os.OpenFile(keylogPath, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keylogFile.Close()
+	clientConn, serverConn := net.Pipe()
+	serverConfig := &cryptotls.Config{Certificates: []cryptotls.Certificate{newCertificate(t)}}
+	clientConfig := config.Clone()
+	clientConfig.InsecureSkipVerify = true
+	clientConfig.ServerName = "example.com"
+	clientConfig.KeyLogWriter = keylogFile
+	server := cryptotls.Server(&recorder{Conn: serverConn, transcript: tr}, serverConfig)
+	client := cryptotls.Client(&recorder{Conn: clientConn, fromClient: true, transcript: tr}, clientConfig)
+	errs := make(chan error, 2)
+	go func() {
+		buf := make([]byte, len(request))
+		_, err := io.ReadFull(server, buf)
+		if err == nil {
+			_, err = server.Write(response)
+		}
+		errs <- err
+	}()
+	//the client reads while it writes, the server may send its session tickets first
+	go func() {
+		_, err := client.Write(request)
+		errs <- err
+	}()
+	buf := make([]byte, len(response))
+	if _, err = io.ReadFull(client, buf); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err = <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	//a close notify would wait for the peer to read it
+	_ = clientConn.Close()
+	_ = serverConn.Close()
+	return tr
+}
+
+func TestSessionDecrypt(t *testing.T) {
+	request := bytes.Repeat([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), 10)
+	//the response spans several records
+	response := bytes.Repeat([]byte("0123456789abcdef"), 3000)
+	tests := []struct {
+		name   string
+		config *cryptotls.Config
+	}{
+		{
+			name: "TLS 1.2 AES-GCM",
+			config: &cryptotls.Config{
+				MaxVersion:   cryptotls.VersionTLS12,
+				CipherSuites: []uint16{cryptotls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+			},
+		},
+		{
+			name: "TLS 1.2 ChaCha20-Poly1305",
+			config: &cryptotls.Config{
+				MaxVersion:   cryptotls.VersionTLS12,
+				CipherSuites: []uint16{cryptotls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256},
+			},
+		},
+		{
+			name:   "TLS 1.3",
+			config: &cryptotls.Config{MinVersion: cryptotls.VersionTLS13},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keylogPath := filepath.Join(t.TempDir(), "keys.log")
+			if err := os.WriteFile(keylogPath, nil, 0600); err != nil {
+				t.Fatal(err)
+			}
+			tr := exchange(t, tt.config, keylogPath, request, response)
+			keylog, err := OpenKeyLog(keylogPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var up, down bytes.Buffer
+			session := NewSession(keylog, func(fromClient bool, b []byte) {
+				if fromClient {
+					up.Write(b)
+				} else {
+					down.Write(b)
+				}
+			})
+			for _, c := range tr.chunks {
+				if err = session.Write(c.fromClient, c.b); err != nil {
+					t.Fatalf("write: %v", err)
+				}
+			}
+			if err = session.Close(); err != nil {
+				t.Fatalf("close: %v", err)
+			}
+			if !bytes.Equal(up.Bytes(), request) {
+				t.Errorf("client plaintext is %d bytes, want %d", up.Len(), len(request))
+			}
+			if !bytes.Equal(down.Bytes(), response) {
+				t.Errorf("server plaintext is %d bytes, want %d", down.Len(), len(response))
+			}
+		})
+	}
+}
+
+// TestSessionPending decrypts the records which arrived before their secrets were written to the key log.
+func TestSessionPending(t *testing.T) {
+	dir := t.TempDir()
+	written := filepath.Join(dir, "written.log")
+	if err := os.WriteFile(written, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	keylogPath := filepath.Join(dir, "keys.log")
+	if err := os.WriteFile(keylogPath, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	tr := exchange(t, &cryptotls.Config{MinVersion: cryptotls.VersionTLS13}, written, []byte("ping"), []byte("pong"))
+	keylog, err := OpenKeyLog(keylogPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var down bytes.Buffer
+	session := NewSession(keylog, func(fromClient bool, b []byte) {
+		if !fromClient {
+			down.Write(b)
+		}
+	})
+	for _, c := range tr.chunks {
+		if err = session.Write(c.fromClient, c.b); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	if down.Len() > 0 {
+		t.Fatal("records are decrypted without secrets")
+	}
+	//the key log is written after the capture
+	keys, err := os.ReadFile(written)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(keylogPath, keys, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = session.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if down.String() != "pong" {
+		t.Errorf("server plaintext is %q, want %q", down.String(), "pong")
+	}
+}
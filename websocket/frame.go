@@ -0,0 +1,92 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	OpContinuation = 0x0
+	OpText         = 0x1
+	OpBinary       = 0x2
+	OpClose        = 0x8
+	OpPing         = 0x9
+	OpPong         = 0xA
+)
+
+const (
+	maxFrameSize   = 32 * 1024 * 1024
+	maxMessageSize = 32 * 1024 * 1024
+)
+
+var (
+	ErrFrameTooLarge = errors.New("websocket frame too large")
+)
+
+type Frame struct {
+	Fin     bool
+	Rsv1    bool
+	Opcode  int
+	Masked  bool
+	Payload []byte
+}
+
+func (f *Frame) IsControl() bool {
+	return f.Opcode&0x8 != 0
+}
+
+// ReadFrame reads a frame and removes the mask of client frames.
+func ReadFrame(r *bufio.Reader) (f *Frame, err error) {
+	var (
+		header [14]byte
+		size   uint64
+		mask   []byte
+	)
+	if _, err = io.ReadFull(r, header[:2]); err != nil {
+		return
+	}
+	f = &Frame{
+		Fin:    header[0]&0x80 != 0,
+		Rsv1:   header[0]&0x40 != 0,
+		Opcode: int(header[0] & 0x0F),
+		Masked: header[1]&0x80 != 0,
+	}
+	size = uint64(header[1] & 0x7F)
+	switch size {
+	case 126:
+		if _, err = io.ReadFull(r, header[2:4]); err != nil {
+			return nil, err
+		}
+		size = uint64(binary.BigEndian.Uint16(header[2:4]))
+	case 127:
+		if _, err = io.ReadFull(r, header[2:10]); err != nil {
+			return nil, err
+		}
+		size = binary.BigEndian.Uint64(header[2:10])
+	}
+	if f.IsControl() && (size > 125 || !f.Fin) {
+		return nil, fmt.Errorf("malformed websocket control frame, opcode %d", f.Opcode)
+	}
+	if size > maxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+	if f.Masked {
+		mask = header[10:14]
+		if _, err = io.ReadFull(r, mask); err != nil {
+			return nil, err
+		}
+	}
+	f.Payload = make([]byte, size)
+	if _, err = io.ReadFull(r, f.Payload); err != nil {
+		return nil, err
+	}
+	if f.Masked {
+		for i := range f.Payload {
+			f.Payload[i] ^= mask[i%4]
+		}
+	}
+	return
+}
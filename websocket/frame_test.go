@@ -0,0 +1,100 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+// frame encodes a frame, the payload is masked when a mask is given.
+func frame(fin, rsv1 bool, opcode int, mask []byte, payload []byte) []byte {
+	var b []byte
+	first := byte(opcode)
+	if fin {
+		first |= 0x80
+	}
+	if rsv1 {
+		first |= 0x40
+	}
+	second := byte(0)
+	if mask != nil {
+		second = 0x80
+	}
+	switch size := len(payload); {
+	case size < 126:
+		b = []byte{first, second | byte(size)}
+	case size <= 0xffff:
+		b = []byte{first, second | 126, 0, 0}
+		binary.BigEndian.PutUint16(b[2:], uint16(size))
+	default:
+		b = []byte{first, second | 127, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint64(b[2:], uint64(size))
+	}
+	if mask == nil {
+		return append(b, payload...)
+	}
+	b = append(b, mask...)
+	for i, c := range payload {
+		b = append(b, c^mask[i%4])
+	}
+	return b
+}
+
+func TestReadFrame(t *testing.T) {
+	mask := []byte{0x37, 0xfa, 0x21, 0x3d}
+	large := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	tests := []struct {
+		name    string
+		b       []byte
+		fin     bool
+		rsv1    bool
+		opcode  int
+		masked  bool
+		payload []byte
+		err     error
+	}{
+		//the examples of RFC 6455 section 5.7
+		{name: "unmasked", b: []byte{0x81, 0x05, 0x48, 0x65, 0x6c, 0x6c, 0x6f}, fin: true, opcode: OpText, payload: []byte("Hello")},
+		{name: "masked", b: []byte{0x81, 0x85, 0x37, 0xfa, 0x21, 0x3d, 0x7f, 0x9f, 0x4d, 0x51, 0x58}, fin: true, opcode: OpText, masked: true, payload: []byte("Hello")},
+		{name: "first fragment", b: []byte{0x01, 0x03, 0x48, 0x65, 0x6c}, opcode: OpText, payload: []byte("Hel")},
+		{name: "last fragment", b: []byte{0x80, 0x02, 0x6c, 0x6f}, fin: true, opcode: OpContinuation, payload: []byte("lo")},
+		{name: "masked ping", b: []byte{0x89, 0x85, 0x37, 0xfa, 0x21, 0x3d, 0x7f, 0x9f, 0x4d, 0x51, 0x58}, fin: true, opcode: OpPing, masked: true, payload: []byte("Hello")},
+		{name: "compressed", b: frame(true, true, OpText, nil, []byte{0xf2, 0x48, 0xcd, 0xc9, 0xc9, 0x07, 0x00}), fin: true, rsv1: true, opcode: OpText, payload: []byte{0xf2, 0x48, 0xcd, 0xc9, 0xc9, 0x07, 0x00}},
+		{name: "empty", b: []byte{0x82, 0x80, 1, 2, 3, 4}, fin: true, opcode: OpBinary, masked: true, payload: []byte{}},
+		//lengths of 126 and more are sent in 16 bits, of more than 65535 in 64 bits
+		{name: "16 bit length", b: frame(true, false, OpBinary, nil, large[:256]), fin: true, opcode: OpBinary, payload: large[:256]},
+		{name: "16 bit length of 126", b: frame(true, false, OpBinary, mask, large[:126]), fin: true, opcode: OpBinary, masked: true, payload: large[:126]},
+		{name: "16 bit length of 65535", b: frame(true, false, OpBinary, mask, large[:65535]), fin: true, opcode: OpBinary, masked: true, payload: large[:65535]},
+		{name: "64 bit length", b: frame(true, false, OpBinary, mask, large), fin: true, opcode: OpBinary, masked: true, payload: large},
+		{name: "control frame of 126 bytes", b: frame(true, false, OpPing, nil, large[:126]), err: errors.New("malformed websocket control frame, opcode 9")},
+		{name: "fragmented control frame", b: frame(false, false, OpClose, nil, []byte{0x03, 0xe8}), err: errors.New("malformed websocket control frame, opcode 8")},
+		{name: "too large", b: []byte{0x82, 0x7f, 0, 0, 0, 0, 0x02, 0, 0, 1}, err: ErrFrameTooLarge},
+		{name: "truncated length", b: []byte{0x82, 0x7e, 0x01}, err: io.ErrUnexpectedEOF},
+		{name: "truncated mask", b: []byte{0x81, 0x85, 0x37, 0xfa}, err: io.ErrUnexpectedEOF},
+		{name: "truncated payload", b: []byte{0x81, 0x05, 0x48, 0x65}, err: io.ErrUnexpectedEOF},
+		{name: "end of stream", err: io.EOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := ReadFrame(bufio.NewReader(bytes.NewReader(tt.b)))
+			if tt.err != nil {
+				if err == nil || !errors.Is(err, tt.err) && err.Error() != tt.err.Error() {
+					t.Errorf("error is %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f.Fin != tt.fin || f.Rsv1 != tt.rsv1 || f.Opcode != tt.opcode || f.Masked != tt.masked {
+				t.Errorf("frame is fin %v, rsv1 %v, opcode %d, masked %v", f.Fin, f.Rsv1, f.Opcode, f.Masked)
+			}
+			if !bytes.Equal(f.Payload, tt.payload) {
+				t.Errorf("payload is %q, want %q", f.Payload, tt.payload)
+			}
+		})
+	}
+}
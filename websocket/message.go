@@ -0,0 +1,235 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	//the largest LZ77 window of permessage-deflate
+	maxWindowSize = 32 * 1024
+)
+
+var (
+	deflateTail = []byte{0x00, 0x00, 0xff, 0xff}
+)
+
+type (
+	Message struct {
+		FromClient bool
+		Opcode     int
+		Compressed bool
+		Raw        []byte
+		Data       []byte
+		Time       time.Time
+		err        error
+	}
+
+	// Reader reads the messages of one direction of a connection.
+	Reader struct {
+		br                *bufio.Reader
+		fromClient        bool
+		deflate           bool
+		noContextTakeover bool
+		window            []byte
+		pending           *Message
+	}
+)
+
+func OpcodeName(opcode int) string {
+	switch opcode {
+	case OpContinuation:
+		return "continuation"
+	case OpText:
+		return "text"
+	case OpBinary:
+		return "binary"
+	case OpClose:
+		return "close"
+	case OpPing:
+		return "ping"
+	case OpPong:
+		return "pong"
+	default:
+		return fmt.Sprintf("opcode(%d)", opcode)
+	}
+}
+
+func (m *Message) Type() string {
+	return OpcodeName(m.Opcode)
+}
+
+func (m *Message) DecodedBody() []byte {
+	return m.Data
+}
+
+func (m *Message) ContentEncoding() string {
+	if m.Compressed {
+		return "permessage-deflate"
+	}
+	return ""
+}
+
+func (m *Message) DecodeError() error {
+	return m.err
+}
+
+// MarshalJSON keeps the error of the payload, e.g. when the message is stored.
+func (m *Message) MarshalJSON() ([]byte, error) {
+	type plain Message
+	s := struct {
+		*plain
+		Error string `json:",omitempty"`
+	}{plain: (*plain)(m)}
+	if m.err != nil {
+		s.Error = m.err.Error()
+	}
+	return json.Marshal(s)
+}
+
+func (m *Message) UnmarshalJSON(b []byte) (err error) {
+	type plain Message
+	s := struct {
+		*plain
+		Error string `json:",omitempty"`
+	}{plain: (*plain)(m)}
+	if err = json.Unmarshal(b, &s); err == nil && s.Error != "" {
+		m.err = errors.New(s.Error)
+	}
+	return
+}
+
+func (m *Message) IsBinary() bool {
+	if m.Opcode == OpText {
+		return false
+	}
+	if m.Opcode == OpBinary {
+		return true
+	}
+	return !utf8.Valid(m.Data)
+}
+
+// CloseCode returns the status code and reason of a close message.
+func (m *Message) CloseCode() (code int, reason string) {
+	if m.Opcode != OpClose || len(m.Data) < 2 {
+		return 0, ""
+	}
+	return int(binary.BigEndian.Uint16(m.Data[:2])), string(m.Data[2:])
+}
+
+// IsUpgrade reports whether the exchange switched the connection to websocket.
+func IsUpgrade(header http.Header, statusCode int) bool {
+	return statusCode == http.StatusSwitchingProtocols && strings.EqualFold(header.Get("Upgrade"), "websocket")
+}
+
+// parseExtensions returns whether permessage-deflate is enabled and the context takeover
+// settings of the client and server, as accepted in the handshake response.
+func parseExtensions(header http.Header) (deflate bool, clientNoTakeover bool, serverNoTakeover bool) {
+	for _, value := range header.Values("Sec-WebSocket-Extensions") {
+		for _, ext := range strings.Split(value, ",") {
+			params := strings.Split(ext, ";")
+			if strings.TrimSpace(params[0]) != "permessage-deflate" {
+				continue
+			}
+			deflate = true
+			for _, param := range params[1:] {
+				switch strings.TrimSpace(param) {
+				case "client_no_context_takeover":
+					clientNoTakeover = true
+				case "server_no_context_takeover":
+					serverNoTakeover = true
+				}
+			}
+		}
+	}
+	return
+}
+
+func (r *Reader) inflate(b []byte) (buf []byte, err error) {
+	var (
+		dict []byte
+	)
+	if !r.noContextTakeover {
+		dict = r.window
+	}
+	src := io.MultiReader(bytes.NewReader(b), bytes.NewReader(deflateTail))
+	fr := flate.NewReaderDict(src, dict)
+	defer func() {
+		_ = fr.Close()
+	}()
+	buf, err = io.ReadAll(io.LimitReader(fr, maxMessageSize))
+	//the message does not end with a final block, the reader stops at the end of the input
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = nil
+	}
+	if err == nil && !r.noContextTakeover {
+		r.window = append(r.window, buf...)
+		if len(r.window) > maxWindowSize {
+			r.window = append(r.window[:0:0], r.window[len(r.window)-maxWindowSize:]...)
+		}
+	}
+	return
+}
+
+// ReadMessage returns the next complete message, control frames which are sent in
+// the middle of a fragmented message are returned before the message.
+func (r *Reader) ReadMessage() (m *Message, err error) {
+	var (
+		f *Frame
+	)
+	for {
+		if f, err = ReadFrame(r.br); err != nil {
+			return
+		}
+		if f.IsControl() {
+			return &Message{FromClient: r.fromClient, Opcode: f.Opcode, Raw: f.Payload, Data: f.Payload}, nil
+		}
+		if f.Opcode != OpContinuation {
+			r.pending = &Message{FromClient: r.fromClient, Opcode: f.Opcode, Compressed: r.deflate && f.Rsv1}
+		} else if r.pending == nil {
+			//the start of the message was sent before the capture started
+			continue
+		}
+		if len(r.pending.Raw)+len(f.Payload) > maxMessageSize {
+			r.pending = nil
+			return nil, fmt.Errorf("websocket message exceeds %d bytes", maxMessageSize)
+		}
+		r.pending.Raw = append(r.pending.Raw, f.Payload...)
+		if !f.Fin {
+			continue
+		}
+		m, r.pending = r.pending, nil
+		m.Data = m.Raw
+		if m.Compressed {
+			if m.Data, m.err = r.inflate(m.Raw); m.err != nil {
+				m.Data = m.Raw
+			}
+		}
+		return
+	}
+}
+
+func NewReader(br *bufio.Reader, fromClient bool, header http.Header) *Reader {
+	deflate, clientNoTakeover, serverNoTakeover := parseExtensions(header)
+	r := &Reader{
+		br:         br,
+		fromClient: fromClient,
+		deflate:    deflate,
+	}
+	if fromClient {
+		r.noContextTakeover = clientNoTakeover
+	} else {
+		r.noContextTakeover = serverNoTakeover
+	}
+	return r
+}
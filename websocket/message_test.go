@@ -0,0 +1,254 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"testing"
+)
+
+// compressor deflates the messages of one direction like permessage-deflate.
+type compressor struct {
+	buf bytes.Buffer
+	w   *flate.Writer
+}
+
+func newCompressor() *compressor {
+	c := &compressor{}
+	c.w, _ = flate.NewWriter(&c.buf, flate.BestCompression)
+	return c
+}
+
+// compress returns the payload of a message, the window of the writer is kept for the next one.
+func (c *compressor) compress(s string) []byte {
+	c.buf.Reset()
+	_, _ = c.w.Write([]byte(s))
+	_ = c.w.Flush()
+	return append([]byte{}, bytes.TrimSuffix(c.buf.Bytes(), deflateTail)...)
+}
+
+func readMessages(t *testing.T, b []byte, fromClient bool, header http.Header) (messages []*Message) {
+	r := NewReader(bufio.NewReader(bytes.NewReader(b)), fromClient, header)
+	for {
+		m, err := r.ReadMessage()
+		if errors.Is(err, io.EOF) {
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, m)
+	}
+}
+
+func checkMessages(t *testing.T, messages []*Message, opcodes []int, data []string) {
+	t.Helper()
+	if len(messages) != len(data) {
+		t.Fatalf("%d messages are read, want %d", len(messages), len(data))
+	}
+	for i, m := range messages {
+		if m.Opcode != opcodes[i] || string(m.Data) != data[i] {
+			t.Errorf("message %d is %s %q, want %s %q", i, m.Type(), m.Data, OpcodeName(opcodes[i]), data[i])
+		}
+		if m.err != nil {
+			t.Errorf("message %d: %v", i, m.err)
+		}
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	mask := []byte{1, 2, 3, 4}
+	join := func(b ...[]byte) []byte {
+		return bytes.Join(b, nil)
+	}
+	tests := []struct {
+		name    string
+		b       []byte
+		opcodes []int
+		data    []string
+	}{
+		{
+			name:    "single frames",
+			b:       join(frame(true, false, OpText, mask, []byte("a")), frame(true, false, OpBinary, mask, []byte{0, 1})),
+			opcodes: []int{OpText, OpBinary},
+			data:    []string{"a", "\x00\x01"},
+		},
+		{
+			name: "fragmented",
+			b: join(
+				frame(false, false, OpText, mask, []byte("Hel")),
+				frame(false, false, OpContinuation, mask, []byte("lo ")),
+				frame(true, false, OpContinuation, mask, []byte("world")),
+			),
+			opcodes: []int{OpText},
+			data:    []string{"Hello world"},
+		},
+		{
+			//control frames may be sent between the fragments of a message
+			name: "control frames mid message",
+			b: join(
+				frame(false, false, OpText, mask, []byte("Hel")),
+				frame(true, false, OpPing, mask, []byte("ping")),
+				frame(false, false, OpContinuation, mask, []byte("lo")),
+				frame(true, false, OpPong, mask, nil),
+				frame(true, false, OpContinuation, mask, nil),
+				frame(true, false, OpClose, mask, []byte{0x03, 0xe8, 'b', 'y', 'e'}),
+			),
+			opcodes: []int{OpPing, OpPong, OpText, OpClose},
+			data:    []string{"ping", "", "Hello", "\x03\xe8bye"},
+		},
+		{
+			//the start of the message was sent before the capture started
+			name:    "continuation without a start",
+			b:       join(frame(false, false, OpContinuation, nil, []byte("x")), frame(true, false, OpContinuation, nil, []byte("y")), frame(true, false, OpText, nil, []byte("z"))),
+			opcodes: []int{OpText},
+			data:    []string{"z"},
+		},
+		{
+			//rsv1 is no compression when permessage-deflate is not negotiated
+			name:    "rsv1 without deflate",
+			b:       frame(true, true, OpText, nil, []byte("plain")),
+			opcodes: []int{OpText},
+			data:    []string{"plain"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messages := readMessages(t, tt.b, true, http.Header{})
+			checkMessages(t, messages, tt.opcodes, tt.data)
+			for _, m := range messages {
+				if !m.FromClient || m.Compressed {
+					t.Errorf("%s message is from the client %v, compressed %v", m.Type(), m.FromClient, m.Compressed)
+				}
+			}
+		})
+	}
+}
+
+func TestCloseCode(t *testing.T) {
+	messages := readMessages(t, frame(true, false, OpClose, nil, []byte{0x03, 0xe9, 'g', 'o', 'n', 'e'}), false, http.Header{})
+	if code, reason := messages[0].CloseCode(); code != 1001 || reason != "gone" {
+		t.Errorf("close is %d %q, want 1001 \"gone\"", code, reason)
+	}
+}
+
+func TestParseExtensions(t *testing.T) {
+	tests := []struct {
+		values                  []string
+		deflate, client, server bool
+	}{
+		{values: nil},
+		{values: []string{"x-webkit-deflate-frame"}},
+		{values: []string{"permessage-deflate"}, deflate: true},
+		{values: []string{"permessage-deflate; client_max_window_bits=15; server_no_context_takeover"}, deflate: true, server: true},
+		{values: []string{"foo, permessage-deflate ;client_no_context_takeover"}, deflate: true, client: true},
+		{values: []string{"permessage-deflate; server_no_context_takeover", "x; client_no_context_takeover"}, deflate: true, server: true},
+	}
+	for _, tt := range tests {
+		header := http.Header{"Sec-Websocket-Extensions": tt.values}
+		if deflate, client, server := parseExtensions(header); deflate != tt.deflate || client != tt.client || server != tt.server {
+			t.Errorf("extensions of %v are %v %v %v, want %v %v %v", tt.values, deflate, client, server, tt.deflate, tt.client, tt.server)
+		}
+	}
+}
+
+func TestPermessageDeflate(t *testing.T) {
+	//the second message repeats the first one, it is sent as a reference into the window of the first
+	first := "the quick brown fox jumps over the lazy dog, again and again"
+	second := first + "!"
+	shared := newCompressor()
+	p1, p2 := shared.compress(first), shared.compress(second)
+	if b, err := io.ReadAll(flate.NewReader(io.MultiReader(bytes.NewReader(p2), bytes.NewReader(deflateTail)))); err == nil && string(b) == second {
+		t.Fatal("second message can be inflated without the window of the first")
+	}
+	fresh := newCompressor()
+	q1 := fresh.compress(first)
+	fresh = newCompressor()
+	q2 := fresh.compress(second)
+	tests := []struct {
+		name       string
+		extensions string
+		fromClient bool
+		b          []byte
+	}{
+		{
+			name:       "context takeover",
+			extensions: "permessage-deflate",
+			b:          bytes.Join([][]byte{frame(true, true, OpText, nil, p1), frame(true, true, OpText, nil, p2)}, nil),
+		},
+		{
+			//a compressed message may be fragmented, only the first frame has rsv1 set
+			name:       "fragmented and interleaved with a ping",
+			extensions: "permessage-deflate",
+			fromClient: true,
+			b: bytes.Join([][]byte{
+				frame(true, true, OpText, []byte{9, 8, 7, 6}, p1),
+				frame(false, true, OpText, []byte{9, 8, 7, 6}, p2[:len(p2)/2]),
+				frame(true, false, OpPing, []byte{9, 8, 7, 6}, nil),
+				frame(true, false, OpContinuation, []byte{9, 8, 7, 6}, p2[len(p2)/2:]),
+			}, nil),
+		},
+		{
+			name:       "no context takeover",
+			extensions: "permessage-deflate; server_no_context_takeover",
+			b:          bytes.Join([][]byte{frame(true, true, OpText, nil, q1), frame(true, true, OpText, nil, q2)}, nil),
+		},
+		{
+			name:       "no context takeover of the client",
+			extensions: "permessage-deflate; client_no_context_takeover",
+			fromClient: true,
+			b:          bytes.Join([][]byte{frame(true, true, OpText, []byte{1, 2, 3, 4}, q1), frame(true, true, OpText, []byte{1, 2, 3, 4}, q2)}, nil),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				messages []*Message
+			)
+			for _, m := range readMessages(t, tt.b, tt.fromClient, http.Header{"Sec-Websocket-Extensions": {tt.extensions}}) {
+				if m.Opcode != OpPing {
+					messages = append(messages, m)
+				}
+			}
+			checkMessages(t, messages, []int{OpText, OpText}, []string{first, second})
+			for _, m := range messages {
+				if !m.Compressed || m.ContentEncoding() != "permessage-deflate" {
+					t.Errorf("message %q is not compressed", m.Data)
+				}
+			}
+		})
+	}
+}
+
+func TestPermessageDeflateWindow(t *testing.T) {
+	//the window keeps the last 32 KB of the messages, the second refers to the oldest bytes of it
+	random := rand.New(rand.NewSource(1))
+	b := make([]byte, 40*1024)
+	for i := range b {
+		b[i] = 'a' + byte(random.Intn(26))
+	}
+	first, second := string(b), string(b[len(b)-maxWindowSize+100:len(b)-maxWindowSize+1100])
+	c := newCompressor()
+	data := bytes.Join([][]byte{frame(true, true, OpBinary, nil, c.compress(first)), frame(true, true, OpBinary, nil, c.compress(second))}, nil)
+	messages := readMessages(t, data, false, http.Header{"Sec-Websocket-Extensions": {"permessage-deflate"}})
+	checkMessages(t, messages, []int{OpBinary, OpBinary}, []string{first, second})
+}
+
+func TestPermessageDeflateError(t *testing.T) {
+	//a message which can not be inflated keeps its payload and the error, the next message is read
+	data := bytes.Join([][]byte{frame(true, true, OpText, nil, []byte{0xff, 0xff, 0xff}), frame(true, false, OpText, nil, []byte("ok"))}, nil)
+	messages := readMessages(t, data, false, http.Header{"Sec-Websocket-Extensions": {"permessage-deflate"}})
+	if len(messages) != 2 {
+		t.Fatalf("%d messages are read, want 2", len(messages))
+	}
+	if messages[0].DecodeError() == nil || !bytes.Equal(messages[0].Data, []byte{0xff, 0xff, 0xff}) {
+		t.Errorf("message is %x (%v)", messages[0].Data, messages[0].DecodeError())
+	}
+	if string(messages[1].Data) != "ok" || messages[1].Compressed {
+		t.Errorf("next message is %q", messages[1].Data)
+	}
+}
@@ -0,0 +1,178 @@
+package widget
+
+import (
+	"errors"
+	"github.com/jroimartin/gocui"
+	"strings"
+	"sync"
+)
+
+type (
+	InputFunc func(s string)
+
+	InputView struct {
+		name         string
+		title        string
+		text         string
+		active       bool
+		created      bool
+		previous     string
+		clientWidth  int
+		clientHeight int
+		offsetX      int
+		offsetY      int
+		contentWidth int
+		once         sync.Once
+		ui           *gocui.Gui
+		view         *gocui.View
+		changeFunc   InputFunc
+		submitFunc   InputFunc
+		cancelFunc   func()
+	}
+)
+
+func (widget *InputView) edit(v *gocui.View, key gocui.Key, ch rune, mod gocui.Modifier) {
+	gocui.DefaultEditor.Edit(v, key, ch, mod)
+	if widget.changeFunc != nil {
+		widget.changeFunc(widget.Text())
+	}
+}
+
+// Write inserts a rune at the cursor, it is used for keys which are bound globally, e.g. space.
+func (widget *InputView) Write(ch rune) {
+	if widget.view != nil {
+		widget.edit(widget.view, 0, ch, gocui.ModNone)
+	}
+}
+
+func (widget *InputView) Title(s string) *InputView {
+	widget.title = s
+	return widget
+}
+
+func (widget *InputView) Offset(x, y int) *InputView {
+	widget.offsetX = x
+	widget.offsetY = y
+	return widget
+}
+
+func (widget *InputView) WithChange(f InputFunc) *InputView {
+	widget.changeFunc = f
+	return widget
+}
+
+func (widget *InputView) WithSubmit(f InputFunc) *InputView {
+	widget.submitFunc = f
+	return widget
+}
+
+func (widget *InputView) WithCancel(f func()) *InputView {
+	widget.cancelFunc = f
+	return widget
+}
+
+func (widget *InputView) Active() bool {
+	return widget.active
+}
+
+func (widget *InputView) Text() string {
+	if widget.view == nil {
+		return widget.text
+	}
+	return strings.TrimRight(widget.view.Buffer(), "\r\n")
+}
+
+// Show opens the input with the given title and text, the view is created at the next layout.
+func (widget *InputView) Show(title string, text string) {
+	widget.title = title
+	widget.text = text
+	widget.active = true
+	widget.created = false
+}
+
+func (widget *InputView) Hide() {
+	widget.active = false
+	if widget.ui == nil {
+		return
+	}
+	_ = widget.ui.DeleteView(widget.name)
+	widget.view = nil
+	if widget.previous != "" {
+		_, _ = widget.ui.SetCurrentView(widget.previous)
+	}
+}
+
+func (widget *InputView) Layout(ui *gocui.Gui) (err error) {
+	var (
+		x, y             int
+		offsetX, offsetY int
+	)
+	widget.ui = ui
+	if !widget.active {
+		return
+	}
+	widget.clientWidth, widget.clientHeight = ui.Size()
+	if widget.offsetX < 0 {
+		offsetX = widget.clientWidth + widget.offsetX
+	} else {
+		offsetX = widget.offsetX
+	}
+	if widget.offsetY < 0 {
+		offsetY = widget.clientHeight + widget.offsetY
+	} else {
+		offsetY = widget.offsetY
+	}
+	if widget.contentWidth <= 0 {
+		x = widget.clientWidth - 1 + widget.contentWidth
+	} else {
+		x = offsetX + widget.contentWidth
+	}
+	y = offsetY + 2
+	if widget.view, err = ui.SetView(widget.name, offsetX, offsetY, x, y); err != nil {
+		if !errors.Is(err, gocui.ErrUnknownView) {
+			return
+		}
+		err = nil
+	}
+	widget.view.Title = widget.title
+	widget.view.Editable = true
+	widget.view.Editor = gocui.EditorFunc(widget.edit)
+	if !widget.created {
+		widget.created = true
+		widget.view.Clear()
+		_ = widget.view.SetOrigin(0, 0)
+		_, _ = widget.view.Write([]byte(widget.text))
+		_ = widget.view.SetCursor(len([]rune(widget.text)), 0)
+		if cur := ui.CurrentView(); cur != nil && cur.Name() != widget.name {
+			widget.previous = cur.Name()
+		}
+		if _, err = ui.SetCurrentView(widget.name); err != nil {
+			return
+		}
+	}
+	widget.once.Do(func() {
+		err = ui.SetKeybinding(widget.name, gocui.KeyEnter, gocui.ModNone, func(gui *gocui.Gui, view *gocui.View) error {
+			text := widget.Text()
+			widget.Hide()
+			if widget.submitFunc != nil {
+				widget.submitFunc(text)
+			}
+			return nil
+		})
+		err = ui.SetKeybinding(widget.name, gocui.KeyEsc, gocui.ModNone, func(gui *gocui.Gui, view *gocui.View) error {
+			widget.Hide()
+			if widget.cancelFunc != nil {
+				widget.cancelFunc()
+			}
+			return nil
+		})
+	})
+	return
+}
+
+func NewInputView(name string, width int) *InputView {
+	return &InputView{
+		name:         name,
+		contentWidth: width,
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"github.com/fatih/color"
 	"github.com/jroimartin/gocui"
+	"sort"
+	"strings"
 	"sync"
 )
 
@@ -13,6 +15,26 @@ type (
 
 	ChangeFunc func(i int, v interface{})
 
+	MatchFunc func(v interface{}) bool
+
+	LessFunc func(a, b interface{}) bool
+
+	ChildrenFunc func(v interface{}) []interface{}
+
+	// row is a line of the list, child rows are displayed below their value when it is expanded.
+	// The index of a value does not change when older values are evicted.
+	row struct {
+		index int
+		child interface{}
+	}
+
+	// selection is the value under the cursor, the change function is called with it once the lock
+	// of the list is released, so that it can use the list.
+	selection struct {
+		index int
+		value interface{}
+	}
+
 	ListView struct {
 		name          string
 		title         string
@@ -21,6 +43,9 @@ type (
 		view          *gocui.View
 		formatFunc    FormatFunc
 		changeFunc    ChangeFunc
+		filterFunc    MatchFunc
+		lessFunc      LessFunc
+		childrenFunc  ChildrenFunc
 		clientWidth   int
 		clientHeight  int
 		offsetX       int
@@ -30,11 +55,16 @@ type (
 		visibleOffset int
 		once          sync.Once
 		mutex         sync.RWMutex
-		values        []interface{}
+		//index of the first value, it grows when the oldest values are evicted
+		base     int
+		values   []interface{}
+		rows     []row
+		expanded map[interface{}]bool
 	}
 )
 
-func (widget *ListView) draw() {
+// scrollToCursor moves the visible rows as little as needed to show the cursor.
+func (widget *ListView) scrollToCursor() {
 	contentVisibleLines := widget.visibleLines() - 2 //2px border
 	if widget.cursor > widget.visibleOffset {
 		if widget.cursor-widget.visibleOffset > contentVisibleLines {
@@ -44,17 +74,34 @@ func (widget *ListView) draw() {
 	if widget.cursor < widget.visibleOffset {
 		widget.visibleOffset = widget.cursor
 	}
+	//fewer rows are left after a filter, the last page is filled
+	if last := len(widget.rows) - 1 - contentVisibleLines; widget.visibleOffset > last {
+		widget.visibleOffset = last
+	}
+	if widget.visibleOffset < 0 {
+		widget.visibleOffset = 0
+	}
+}
+
+func (widget *ListView) draw() {
+	widget.scrollToCursor()
 	widget.ui.Update(func(gui *gocui.Gui) error {
 		if view, err := gui.View(widget.name); err == nil {
+			widget.mutex.RLock()
+			defer widget.mutex.RUnlock()
 			view.Clear()
-			for i := widget.visibleOffset; i < len(widget.values); i++ {
+			for i := widget.visibleOffset; i < len(widget.rows); i++ {
 				var str string
+				idx := widget.rows[i].index
+				v := widget.value(widget.rows[i])
 				if widget.formatFunc == nil {
-					str = fmt.Sprint(widget.values[i])
+					str = fmt.Sprint(v)
 				} else {
-					str = widget.formatFunc(i, widget.values[i])
+					str = widget.formatFunc(idx, v)
 				}
 				if i == widget.cursor {
+					//restore the highlight after colored cells
+					str = strings.ReplaceAll(str, "\x1b[0m", "\x1b[0;32m")
 					_, _ = color.New(color.FgGreen).Fprintln(view, str)
 				} else {
 					_, _ = fmt.Fprintln(view, str)
@@ -76,6 +123,12 @@ func (widget *ListView) Offset(x, y int) *ListView {
 	return widget
 }
 
+func (widget *ListView) Size(width, height int) *ListView {
+	widget.contentWidth = width
+	widget.contentHeight = height
+	return widget
+}
+
 func (widget *ListView) WithFormat(f FormatFunc) *ListView {
 	widget.formatFunc = f
 	return widget
@@ -86,25 +139,318 @@ func (widget *ListView) WithChange(f ChangeFunc) *ListView {
 	return widget
 }
 
+// WithChildren sets the function which returns the child rows of a value, they are displayed when the value is expanded.
+func (widget *ListView) WithChildren(f ChildrenFunc) *ListView {
+	widget.childrenFunc = f
+	return widget
+}
+
+func (widget *ListView) match(v interface{}) bool {
+	return widget.filterFunc == nil || widget.filterFunc(v)
+}
+
+func (widget *ListView) at(idx int) interface{} {
+	return widget.values[idx-widget.base]
+}
+
+func (widget *ListView) value(r row) interface{} {
+	if r.child != nil {
+		return r.child
+	}
+	return widget.at(r.index)
+}
+
+// selected returns the value under the cursor, nil when the list is empty.
+func (widget *ListView) selected() *selection {
+	if widget.cursor >= len(widget.rows) {
+		return nil
+	}
+	r := widget.rows[widget.cursor]
+	return &selection{index: r.index, value: widget.value(r)}
+}
+
+// notify calls the change function, the lock of the list must not be held.
+func (widget *ListView) notify(s *selection) {
+	if s != nil && widget.changeFunc != nil {
+		widget.changeFunc(s.index, s.value)
+	}
+}
+
+// expand returns the rows of the values and the children of the expanded values.
+func (widget *ListView) expand(indexes []int) []row {
+	rows := make([]row, 0, len(indexes))
+	for _, idx := range indexes {
+		rows = append(rows, row{index: idx})
+		if widget.childrenFunc != nil && widget.expanded[widget.at(idx)] {
+			for _, child := range widget.childrenFunc(widget.at(idx)) {
+				rows = append(rows, row{index: idx, child: child})
+			}
+		}
+	}
+	return rows
+}
+
+// parents returns the indexes of the visible values in the displayed order.
+func (widget *ListView) parents() []int {
+	indexes := make([]int, 0, len(widget.rows))
+	for _, r := range widget.rows {
+		if r.child == nil {
+			indexes = append(indexes, r.index)
+		}
+	}
+	return indexes
+}
+
+// setRows replaces the rows and keeps the cursor on the selected row, or on its value if the row is gone.
+func (widget *ListView) setRows(rows []row) {
+	selected := row{index: -1}
+	if widget.cursor < len(widget.rows) {
+		selected = widget.rows[widget.cursor]
+	}
+	widget.rows = rows
+	widget.cursor = 0
+	for i, r := range widget.rows {
+		if r == selected {
+			widget.cursor = i
+			return
+		}
+		if r.index == selected.index && r.child == nil {
+			widget.cursor = i
+		}
+	}
+}
+
+// rebuild computes the visible rows again and keeps the cursor on the selected value, which is returned.
+func (widget *ListView) rebuild() *selection {
+	indexes := make([]int, 0, len(widget.values))
+	for i, v := range widget.values {
+		if widget.match(v) {
+			indexes = append(indexes, widget.base+i)
+		}
+	}
+	if widget.lessFunc != nil {
+		sort.SliceStable(indexes, func(i, j int) bool {
+			return widget.lessFunc(widget.at(indexes[i]), widget.at(indexes[j]))
+		})
+	}
+	widget.setRows(widget.expand(indexes))
+	widget.draw()
+	return widget.selected()
+}
+
+// Toggle expands or collapses the value under the cursor.
+func (widget *ListView) Toggle() {
+	widget.mutex.Lock()
+	if widget.cursor >= len(widget.rows) || widget.childrenFunc == nil {
+		widget.mutex.Unlock()
+		return
+	}
+	v := widget.at(widget.rows[widget.cursor].index)
+	if widget.expanded[v] {
+		delete(widget.expanded, v)
+	} else {
+		widget.expanded[v] = true
+	}
+	widget.setRows(widget.expand(widget.parents()))
+	widget.draw()
+	s := widget.selected()
+	widget.mutex.Unlock()
+	widget.notify(s)
+}
+
+// Refresh redraws the list after v has changed, e.g. when a child is added.
+func (widget *ListView) Refresh(v interface{}) {
+	widget.mutex.Lock()
+	defer widget.mutex.Unlock()
+	if widget.expanded[v] {
+		widget.setRows(widget.expand(widget.parents()))
+	}
+	widget.draw()
+}
+
+// Notify calls the change function with the value under the cursor.
+func (widget *ListView) Notify() {
+	widget.mutex.RLock()
+	s := widget.selected()
+	widget.mutex.RUnlock()
+	widget.notify(s)
+}
+
+// Selected returns the value or the child under the cursor.
+func (widget *ListView) Selected() (v interface{}, ok bool) {
+	widget.mutex.RLock()
+	defer widget.mutex.RUnlock()
+	if widget.cursor >= len(widget.rows) {
+		return nil, false
+	}
+	return widget.value(widget.rows[widget.cursor]), true
+}
+
+// SetFilter hides the values which are not matched, the values are kept and displayed again when the filter is removed.
+func (widget *ListView) SetFilter(f MatchFunc) {
+	widget.mutex.Lock()
+	widget.filterFunc = f
+	s := widget.rebuild()
+	widget.mutex.Unlock()
+	widget.notify(s)
+}
+
+// SetSort orders the visible values, nil keeps the order in which the values are pushed.
+func (widget *ListView) SetSort(f LessFunc) {
+	widget.mutex.Lock()
+	widget.lessFunc = f
+	s := widget.rebuild()
+	widget.mutex.Unlock()
+	widget.notify(s)
+}
+
+// Find moves the cursor to the next matched value, step 0 starts at the cursor, 1 searches forward and -1 backward.
+func (widget *ListView) Find(f MatchFunc, step int) bool {
+	widget.mutex.Lock()
+	n := len(widget.rows)
+	if n == 0 || f == nil {
+		widget.mutex.Unlock()
+		return false
+	}
+	direction := 1
+	if step < 0 {
+		direction = -1
+	}
+	for i := 0; i < n; i++ {
+		pos := ((widget.cursor+step+i*direction)%n + n) % n
+		if r := widget.rows[pos]; r.child == nil && f(widget.at(r.index)) {
+			widget.cursor = pos
+			widget.draw()
+			s := widget.selected()
+			widget.mutex.Unlock()
+			widget.notify(s)
+			return true
+		}
+	}
+	widget.mutex.Unlock()
+	return false
+}
+
+// Count returns the number of visible and stored values.
+func (widget *ListView) Count() (visible int, total int) {
+	widget.mutex.RLock()
+	defer widget.mutex.RUnlock()
+	for _, r := range widget.rows {
+		if r.child == nil {
+			visible++
+		}
+	}
+	return visible, len(widget.values)
+}
+
+func (widget *ListView) Redraw() {
+	widget.mutex.Lock()
+	defer widget.mutex.Unlock()
+	if widget.ui != nil {
+		widget.draw()
+	}
+}
+
 func (widget *ListView) Item(idx int) (v interface{}, ok bool) {
 	widget.mutex.RLock()
 	defer widget.mutex.RUnlock()
-	if idx >= len(widget.values) || idx < 0 {
+	if idx >= widget.base+len(widget.values) || idx < widget.base {
 		return nil, false
 	}
-	return widget.values[idx], true
+	return widget.at(idx), true
+}
+
+func (widget *ListView) Range(f func(i int, v interface{}) bool) {
+	widget.mutex.RLock()
+	defer widget.mutex.RUnlock()
+	for i, v := range widget.values {
+		if !f(widget.base+i, v) {
+			break
+		}
+	}
 }
 
 func (widget *ListView) Push(v interface{}) {
 	widget.mutex.Lock()
 	defer widget.mutex.Unlock()
 	widget.values = append(widget.values, v)
+	if !widget.match(v) {
+		return
+	}
+	if widget.lessFunc != nil {
+		//child rows compare like their value, a new value is never inserted between them
+		pos := sort.Search(len(widget.rows), func(i int) bool {
+			return widget.lessFunc(v, widget.at(widget.rows[i].index))
+		})
+		widget.rows = append(widget.rows, row{})
+		copy(widget.rows[pos+1:], widget.rows[pos:])
+		widget.rows[pos] = row{index: widget.base + len(widget.values) - 1}
+		if pos <= widget.cursor && len(widget.rows) > 1 {
+			widget.cursor++
+		}
+		widget.draw()
+		return
+	}
+	widget.rows = append(widget.rows, row{index: widget.base + len(widget.values) - 1})
 	contentVisibleLines := widget.visibleLines() - 2
-	if len(widget.values) < contentVisibleLines || len(widget.values) <= widget.visibleOffset+contentVisibleLines+1 {
+	if len(widget.rows) < contentVisibleLines || len(widget.rows) <= widget.visibleOffset+contentVisibleLines+1 {
 		widget.draw()
 	}
 }
 
+// Evict removes the oldest values as long as f reports true for them, the indexes and the
+// selection of the other values are kept. It returns the removed values and whether the selected
+// value was removed, the change function is not called then, the caller calls Notify once it
+// does not hold locks which the function may take.
+func (widget *ListView) Evict(f MatchFunc) (evicted []interface{}, reselected bool) {
+	widget.mutex.Lock()
+	defer widget.mutex.Unlock()
+	n := 0
+	for n < len(widget.values) && f(widget.values[n]) {
+		n++
+	}
+	if n == 0 {
+		return
+	}
+	evicted = append(evicted, widget.values[:n]...)
+	//the slots are cleared so that the array does not hold the values until it grows
+	for i := 0; i < n; i++ {
+		delete(widget.expanded, widget.values[i])
+		widget.values[i] = nil
+	}
+	widget.values = widget.values[n:]
+	widget.base += n
+	var (
+		removed  int
+		selected = -1
+	)
+	rows := make([]row, 0, len(widget.rows))
+	for i, r := range widget.rows {
+		if r.index < widget.base {
+			if i < widget.visibleOffset {
+				removed++
+			}
+			continue
+		}
+		if i == widget.cursor {
+			selected = len(rows)
+		}
+		rows = append(rows, r)
+	}
+	widget.rows = rows
+	widget.visibleOffset -= removed
+	if selected >= 0 {
+		widget.cursor = selected
+	} else {
+		//the selected value is gone, the oldest value which is left is selected
+		widget.cursor = 0
+		widget.visibleOffset = 0
+		reselected = true
+	}
+	widget.draw()
+	return
+}
+
 func (widget *ListView) visibleLines() int {
 	var (
 		n int
@@ -122,49 +468,49 @@ func (widget *ListView) visibleLines() int {
 }
 
 func (widget *ListView) MoveNext() (v interface{}) {
-	widget.mutex.RLock()
-	defer widget.mutex.RUnlock()
-	if len(widget.values) == 0 {
-
+	widget.mutex.Lock()
+	if len(widget.rows) == 0 {
+		widget.mutex.Unlock()
 		return nil
 	}
-	if widget.cursor < len(widget.values)-1 {
+	if widget.cursor < len(widget.rows)-1 {
 		widget.cursor++
 	}
-	v = widget.values[widget.cursor]
-	if widget.changeFunc != nil {
-		widget.changeFunc(widget.cursor, v)
-	}
 	widget.draw()
-	return v
+	s := widget.selected()
+	widget.mutex.Unlock()
+	widget.notify(s)
+	return s.value
 }
 
 func (widget *ListView) MovePrev() (v interface{}) {
-	widget.mutex.RLock()
-	defer widget.mutex.RUnlock()
-	if len(widget.values) == 0 {
+	widget.mutex.Lock()
+	if len(widget.rows) == 0 {
+		widget.mutex.Unlock()
 		return nil
 	}
 	if widget.cursor > 0 {
 		widget.cursor--
 	}
-	v = widget.values[widget.cursor]
-	if widget.changeFunc != nil {
-		widget.changeFunc(widget.cursor, v)
-	}
 	widget.draw()
-	return v
+	s := widget.selected()
+	widget.mutex.Unlock()
+	widget.notify(s)
+	return s.value
 }
 
 func (widget *ListView) Reset(f func(v interface{})) {
 	widget.mutex.Lock()
 	defer widget.mutex.Unlock()
-	if f == nil {
+	if f != nil {
 		for _, v := range widget.values {
 			f(v)
 		}
 	}
+	widget.base = 0
 	widget.values = make([]interface{}, 0)
+	widget.rows = make([]row, 0)
+	widget.expanded = make(map[interface{}]bool)
 	widget.visibleOffset = 0
 	widget.cursor = 0
 	widget.ui.Update(func(gui *gocui.Gui) error {
@@ -247,5 +593,7 @@ func NewListView(name string, width int, height int) *ListView {
 		contentWidth:  width,
 		contentHeight: height,
 		values:        make([]interface{}, 0),
+		rows:          make([]row, 0),
+		expanded:      make(map[interface{}]bool),
 	}
 }